@@ -37,6 +37,8 @@ func (s *session) unauthedState(cmd *proto.Packet) *response {
 	switch msg := payload.(type) {
 	case *proto.AuthCommand:
 		return s.handleAuthCommand(msg)
+	case *proto.RequestAccessCommand:
+		return s.handleRequestAccessCommand(msg)
 	case *proto.StaffInvadeCommand:
 		return s.handleStaffInvadeCommand(msg)
 	default:
@@ -75,7 +77,8 @@ func (s *session) joinedState(cmd *proto.Packet) *response {
 			return &response{err: err}
 		}
 		packet, err := proto.DecryptPayload(
-			proto.LogReply{Log: msgs, Before: msg.Before}, &s.client.Authorization, s.privilegeLevel())
+			proto.LogReply{Log: s.withoutBlockedMessages(msgs), Before: msg.Before},
+			&s.client.Authorization, s.privilegeLevel())
 		return &response{
 			packet: packet,
 			err:    err,
@@ -86,8 +89,13 @@ func (s *session) joinedState(cmd *proto.Packet) *response {
 		if err != nil {
 			return &response{err: err}
 		}
+		verified, err := s.checkNick(nick)
+		if err != nil {
+			return &response{err: err}
+		}
 		formerName := s.identity.Name()
 		s.identity.name = nick
+		s.identity.verified = verified
 		event, err := s.room.RenameUser(s.ctx, s, formerName)
 		if err != nil {
 			return &response{err: err}
@@ -125,38 +133,100 @@ func (s *session) handleCoreCommands(payload interface{}) *response {
 		return &response{}
 
 	// account management commands
+	case *proto.AddIdentityCommand:
+		return s.handleAddIdentityCommand(msg)
+	case *proto.BlockUserCommand:
+		return s.handleBlockUserCommand(msg)
 	case *proto.ChangeEmailCommand:
 		return s.handleChangeEmailCommand(msg)
+	case *proto.ChangeLocaleCommand:
+		return s.handleChangeLocaleCommand(msg)
 	case *proto.ChangeNameCommand:
 		return s.handleChangeNameCommand(msg)
 	case *proto.ChangePasswordCommand:
 		return s.handleChangePasswordCommand(msg)
+	case *proto.DeleteAccountCommand:
+		return s.handleDeleteAccountCommand(msg)
+	case *proto.DisableOTPCommand:
+		return s.handleDisableOTPCommand(msg)
+	case *proto.EnrollOTPCommand:
+		return s.handleEnrollOTPCommand(msg)
+	case *proto.GetEmailPreferencesCommand:
+		return s.handleGetEmailPreferencesCommand()
+	case *proto.ListBlockedUsersCommand:
+		return s.handleListBlockedUsersCommand()
+	case *proto.ListIdentitiesCommand:
+		return s.handleListIdentitiesCommand()
+	case *proto.ListLoginsCommand:
+		return s.handleListLoginsCommand()
+	case *proto.ListPMsCommand:
+		return s.handleListPMsCommand()
+	case *proto.ListReservedNicksCommand:
+		return s.handleListReservedNicksCommand()
 	case *proto.LoginCommand:
 		return s.handleLoginCommand(msg)
 	case *proto.LogoutCommand:
 		return s.handleLogoutCommand()
 	case *proto.RegisterAccountCommand:
 		return s.handleRegisterAccountCommand(msg)
+	case *proto.ReleaseNickCommand:
+		return s.handleReleaseNickCommand(msg)
+	case *proto.RemoveIdentityCommand:
+		return s.handleRemoveIdentityCommand(msg)
+	case *proto.RequestDataExportCommand:
+		return s.handleRequestDataExportCommand()
 	case *proto.ResendVerificationEmailCommand:
 		return s.handleResendVerificationEmail(msg)
+	case *proto.ReserveNickCommand:
+		return s.handleReserveNickCommand(msg)
 	case *proto.ResetPasswordCommand:
 		return s.handleResetPasswordCommand(msg)
+	case *proto.RevokeLoginCommand:
+		return s.handleRevokeLoginCommand(msg)
+	case *proto.SetEmailPreferencesCommand:
+		return s.handleSetEmailPreferencesCommand(msg)
+	case *proto.SetPrimaryIdentityCommand:
+		return s.handleSetPrimaryIdentityCommand(msg)
+	case *proto.UnblockUserCommand:
+		return s.handleUnblockUserCommand(msg)
+	case *proto.ValidateOTPCommand:
+		return s.handleValidateOTPCommand(msg)
 
 	// room manager commands
 	case *proto.BanCommand:
 		return s.handleBanCommand(msg)
 	case *proto.UnbanCommand:
 		return s.handleUnbanCommand(msg)
+	case *proto.CreateInviteCommand:
+		return s.handleCreateInviteCommand(msg)
 	case *proto.EditMessageCommand:
 		return s.handleEditMessageCommand(msg)
 	case *proto.GrantAccessCommand:
 		return s.handleGrantAccessCommand(msg)
 	case *proto.GrantManagerCommand:
 		return s.handleGrantManagerCommand(msg)
+	case *proto.InviteByEmailCommand:
+		return s.handleInviteByEmailCommand(msg)
+	case *proto.ListAccessCommand:
+		return s.handleListAccessCommand()
+	case *proto.ListAccessRequestsCommand:
+		return s.handleListAccessRequestsCommand()
+	case *proto.ListEmailInvitesCommand:
+		return s.handleListEmailInvitesCommand()
+	case *proto.ListInvitesCommand:
+		return s.handleListInvitesCommand()
+	case *proto.ListManagersCommand:
+		return s.handleListManagersCommand()
+	case *proto.ResolveAccessRequestCommand:
+		return s.handleResolveAccessRequestCommand(msg)
 	case *proto.RevokeManagerCommand:
 		return s.handleRevokeManagerCommand(msg)
 	case *proto.RevokeAccessCommand:
 		return s.handleRevokeAccessCommand(msg)
+	case *proto.RevokeEmailInviteCommand:
+		return s.handleRevokeEmailInviteCommand(msg)
+	case *proto.RevokeInviteCommand:
+		return s.handleRevokeInviteCommand(msg)
 
 	// staff commands
 	case *proto.StaffCreateRoomCommand:
@@ -239,6 +309,8 @@ func (s *session) handleSendCommand(cmd *proto.SendCommand) *response {
 		sent.Sender.ClientAddress = ""
 	}
 
+	s.heim.NotifyOffline(s.ctx, s.room, s.roomName, s.Identity().View(), sent.ID, cmd.Content, s.keyID == "")
+
 	packet, err := proto.DecryptPayload(proto.SendReply(sent), &s.client.Authorization, s.privilegeLevel())
 	return &response{
 		packet: packet,
@@ -265,6 +337,11 @@ func (s *session) handleGrantAccessCommand(cmd *proto.GrantAccessCommand) *respo
 		return &response{err: fmt.Errorf("not holding message key")}
 	}
 
+	expires, err := grantExpiry(cmd.Seconds)
+	if err != nil {
+		return &response{err: err}
+	}
+
 	switch {
 	case cmd.AccountID != 0:
 		account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
@@ -273,12 +350,13 @@ func (s *session) handleGrantAccessCommand(cmd *proto.GrantAccessCommand) *respo
 		}
 
 		err = rmk.GrantToAccount(
-			s.ctx, s.kms, s.client.Account, s.client.Authorization.ClientKey, account)
+			s.ctx, s.kms, s.client.Account, s.client.Authorization.ClientKey, account, expires)
 		if err != nil {
 			return &response{err: err}
 		}
 	case cmd.Passcode != "":
-		err = rmk.GrantToPasscode(s.ctx, s.client.Account, s.client.Authorization.ClientKey, cmd.Passcode)
+		err = rmk.GrantToPasscode(
+			s.ctx, s.client.Account, s.client.Authorization.ClientKey, cmd.Passcode, expires)
 		if err != nil {
 			return &response{err: err}
 		}
@@ -316,18 +394,432 @@ func (s *session) handleRevokeAccessCommand(cmd *proto.RevokeAccessCommand) *res
 	return &response{packet: &proto.RevokeAccessReply{}}
 }
 
+// grantExpiry returns the time a grant lasting the given number of seconds
+// expires. A zero value for seconds indicates the grant never expires.
+func grantExpiry(seconds int) (time.Time, error) {
+	switch {
+	case seconds < 0:
+		return time.Time{}, fmt.Errorf("seconds must not be negative")
+	case seconds == 0:
+		return time.Time{}, nil
+	default:
+		return time.Now().Add(time.Duration(seconds) * time.Second), nil
+	}
+}
+
+func (s *session) managerMessageKey() (proto.RoomMessageKey, error) {
+	if s.managedRoom == nil || s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
+		return nil, proto.ErrAccessDenied
+	}
+
+	rmk, err := s.managedRoom.MessageKey(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rmk == nil {
+		return nil, fmt.Errorf("room is public")
+	}
+	return rmk, nil
+}
+
+func (s *session) handleCreateInviteCommand(cmd *proto.CreateInviteCommand) *response {
+	rmk, err := s.managerMessageKey()
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if cmd.Seconds < 0 || cmd.MaxUses < 0 {
+		return &response{err: fmt.Errorf("seconds and max_uses must not be negative")}
+	}
+
+	code, err := proto.GenerateInviteCode(s.kms)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	expires, err := grantExpiry(cmd.Seconds)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	invite, err := rmk.GrantToInvite(
+		s.ctx, s.client.Account, s.client.Authorization.ClientKey, code, expires, cmd.MaxUses)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.CreateInviteReply{Invite: *invite, Code: code}}
+}
+
+func (s *session) handleInviteByEmailCommand(cmd *proto.InviteByEmailCommand) *response {
+	rmk, err := s.managerMessageKey()
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if cmd.Email == "" {
+		return &response{err: fmt.Errorf("email required")}
+	}
+	if cmd.Seconds < 0 {
+		return &response{err: fmt.Errorf("seconds must not be negative")}
+	}
+
+	senderName := s.identity.Name()
+	if senderName == "" {
+		senderName = s.client.Account.Name()
+	}
+
+	// Only an account that has verified the address is granted access right
+	// away. Otherwise the invite waits for whoever verifies it.
+	account, err := s.backend.AccountManager().Resolve(s.ctx, "email", cmd.Email)
+	if err == nil && !proto.HasVerifiedPersonalIdentity(account, "email", cmd.Email) {
+		account, err = nil, proto.ErrAccountNotFound
+	}
+	switch err {
+	case nil:
+		err = rmk.GrantToAccount(
+			s.ctx, s.kms, s.client.Account, s.client.Authorization.ClientKey, account, time.Time{})
+		if err != nil {
+			return &response{err: err}
+		}
+
+		params := &proto.RoomInvitationEmailParams{
+			CommonEmailParams: proto.DefaultCommonEmailParams,
+			AccountName:       account.Name(),
+			RoomName:          s.roomName,
+			SenderName:        senderName,
+			SenderMessage:     cmd.Message,
+		}
+		_, err := s.heim.SendEmail(s.ctx, s.backend, account, cmd.Email, proto.RoomInvitationEmail, params)
+		if err != nil && !proto.IsEmailSuppressed(err) {
+			return &response{err: err}
+		}
+	case proto.ErrAccountNotFound:
+		lifetime := proto.DefaultPendingInviteLifetime
+		if cmd.Seconds > 0 {
+			lifetime = time.Duration(cmd.Seconds) * time.Second
+		}
+		now := time.Now()
+		invite := &proto.PendingInvite{
+			Room:      s.roomName,
+			Email:     cmd.Email,
+			CreatorID: s.client.Account.ID(),
+			Created:   proto.Time(now),
+			Expires:   proto.Time(now.Add(lifetime)),
+		}
+		if err := s.backend.PendingInvites().Add(s.ctx, invite); err != nil {
+			return &response{err: err}
+		}
+
+		// No account has verified the address yet, so the email is tracked
+		// against the sender's.
+		params := &proto.RoomInvitationWelcomeEmailParams{
+			CommonEmailParams: proto.DefaultCommonEmailParams,
+			RoomName:          s.roomName,
+			RoomPrivacy:       "private",
+			SenderName:        senderName,
+			SenderMessage:     cmd.Message,
+		}
+		_, err := s.heim.SendEmail(
+			s.ctx, s.backend, s.client.Account, cmd.Email, proto.RoomInvitationWelcomeEmail, params)
+		if err != nil {
+			return &response{err: err}
+		}
+	default:
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.InviteByEmailReply{}}
+}
+
+func (s *session) handleListAccessCommand() *response {
+	if _, err := s.managerMessageKey(); err != nil {
+		return &response{err: err}
+	}
+
+	reply, err := proto.ListRoomAccess(s.ctx, s.backend, s.managedRoom)
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleListManagersCommand() *response {
+	if s.managedRoom == nil || s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	managers, err := s.managedRoom.Managers(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	reply := &proto.ListManagersReply{Managers: make([]proto.AccountView, len(managers))}
+	for i, manager := range managers {
+		reply.Managers[i] = *manager.View(s.roomName)
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleListInvitesCommand() *response {
+	rmk, err := s.managerMessageKey()
+	if err != nil {
+		return &response{err: err}
+	}
+
+	invites, err := rmk.ListInvites(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	if invites == nil {
+		invites = []proto.Invite{}
+	}
+
+	return &response{packet: &proto.ListInvitesReply{Invites: invites}}
+}
+
+func (s *session) handleListEmailInvitesCommand() *response {
+	if _, err := s.managerMessageKey(); err != nil {
+		return &response{err: err}
+	}
+
+	pending, err := s.backend.PendingInvites().List(s.ctx, s.roomName)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	invites := make([]proto.PendingInvite, len(pending))
+	for i, invite := range pending {
+		invites[i] = *invite
+	}
+	return &response{packet: &proto.ListEmailInvitesReply{Invites: invites}}
+}
+
+func (s *session) handleRevokeEmailInviteCommand(cmd *proto.RevokeEmailInviteCommand) *response {
+	if _, err := s.managerMessageKey(); err != nil {
+		return &response{err: err}
+	}
+
+	if err := s.backend.PendingInvites().Remove(s.ctx, s.roomName, cmd.Email); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RevokeEmailInviteReply{}}
+}
+
+func (s *session) handleRevokeInviteCommand(cmd *proto.RevokeInviteCommand) *response {
+	rmk, err := s.managerMessageKey()
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if err := rmk.RevokeInvite(s.ctx, cmd.ID); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RevokeInviteReply{}}
+}
+
+func (s *session) handleRequestAccessCommand(cmd *proto.RequestAccessCommand) *response {
+	if s.managedRoom == nil {
+		return &response{err: fmt.Errorf("room is public")}
+	}
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	if len(cmd.Note) > proto.MaxAccessRequestNoteLength {
+		return &response{err: fmt.Errorf("note too long")}
+	}
+
+	rmk, err := s.managedRoom.MessageKey(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+	if rmk == nil {
+		return &response{err: fmt.Errorf("room is public")}
+	}
+
+	id, err := snowflake.New()
+	if err != nil {
+		return &response{err: err}
+	}
+	req := &proto.AccessRequest{
+		ID:        id,
+		Room:      s.roomName,
+		Account:   *s.client.Account.View(s.roomName),
+		Note:      cmd.Note,
+		Requested: proto.Now(),
+	}
+	if err := s.backend.AccessRequests().Add(s.ctx, req); err != nil {
+		return &response{err: err}
+	}
+
+	// Stay reachable by the room so the outcome can be delivered.
+	if s.onClose == nil {
+		if err := s.managedRoom.Knock(s.ctx, s); err != nil {
+			return &response{err: err}
+		}
+		s.onClose = func() {
+			ctx := s.server.rootCtx.Fork()
+			if err := s.managedRoom.CancelKnock(ctx, s); err != nil {
+				logging.Logger(ctx).Printf("cancel knock failed: %s", err)
+			}
+		}
+	}
+
+	if err := s.notifyManagersOfAccessRequest(req); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RequestAccessReply{ID: id}, cost: 1}
+}
+
+// notifyManagersOfAccessRequest sends an access-request-event to each manager
+// present in the room, and emails the rest.
+func (s *session) notifyManagersOfAccessRequest(req *proto.AccessRequest) error {
+	managers, err := s.managedRoom.Managers(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	listing, err := s.room.Listing(s.ctx, proto.Staff)
+	if err != nil {
+		return err
+	}
+	present := make(map[proto.UserID]struct{}, len(listing))
+	for _, view := range listing {
+		present[view.ID] = struct{}{}
+	}
+
+	requesterName := s.identity.Name()
+	if requesterName == "" {
+		requesterName = req.Account.Name
+	}
+
+	// Absent managers are emailed about requests from the same account at
+	// most once per interval, however often the account asks.
+	emailing, emailChecked := false, false
+
+	for _, manager := range managers {
+		userID := proto.UserID(fmt.Sprintf("account:%s", manager.ID()))
+		if _, ok := present[userID]; ok {
+			event := (*proto.AccessRequestEvent)(req)
+			err := s.backend.NotifyUserInRoom(s.ctx, s.roomName, userID, proto.AccessRequestEventType, event)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !emailChecked {
+			emailChecked = true
+			since := time.Now().Add(-proto.AccessRequestEmailInterval)
+			emailing, err = s.backend.AccessRequests().MarkEmailed(s.ctx, s.roomName, req.Account.ID, since)
+			if err != nil {
+				return err
+			}
+		}
+		if !emailing {
+			continue
+		}
+
+		params := &proto.AccessRequestEmailParams{
+			CommonEmailParams: proto.DefaultCommonEmailParams,
+			AccountName:       manager.Name(),
+			RoomName:          s.roomName,
+			RequesterName:     requesterName,
+			RequesterNote:     req.Note,
+		}
+		_, err := s.heim.SendEmail(s.ctx, s.backend, manager, "", proto.AccessRequestEmail, params)
+		if err != nil && !proto.IsEmailSuppressed(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *session) handleListAccessRequestsCommand() *response {
+	if _, err := s.managerMessageKey(); err != nil {
+		return &response{err: err}
+	}
+
+	reqs, err := s.backend.AccessRequests().List(s.ctx, s.roomName)
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.ListAccessRequestsReply{Requests: reqs}}
+}
+
+func (s *session) handleResolveAccessRequestCommand(cmd *proto.ResolveAccessRequestCommand) *response {
+	rmk, err := s.managerMessageKey()
+	if err != nil {
+		return &response{err: err}
+	}
+
+	req, err := s.backend.AccessRequests().Get(s.ctx, s.roomName, cmd.ID)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if cmd.Approve {
+		if _, ok := s.client.Authorization.MessageKeys[rmk.KeyID()]; !ok {
+			return &response{err: fmt.Errorf("not holding message key")}
+		}
+
+		expires, err := grantExpiry(cmd.Seconds)
+		if err != nil {
+			return &response{err: err}
+		}
+
+		account, err := s.backend.AccountManager().Get(s.ctx, req.Account.ID)
+		if err != nil {
+			return &response{err: err}
+		}
+
+		err = rmk.GrantToAccount(
+			s.ctx, s.kms, s.client.Account, s.client.Authorization.ClientKey, account, expires)
+		if err != nil {
+			return &response{err: err}
+		}
+	}
+
+	if err := s.backend.AccessRequests().Remove(s.ctx, s.roomName, req.ID); err != nil {
+		return &response{err: err}
+	}
+
+	event := &proto.AccessRequestResolvedEvent{
+		ID:       req.ID,
+		Room:     s.roomName,
+		Approved: cmd.Approve,
+	}
+	requester := proto.UserID(fmt.Sprintf("account:%s", req.Account.ID))
+	err = s.backend.NotifyUserInRoom(s.ctx, s.roomName, requester, proto.AccessRequestResolvedEventType, event)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.ResolveAccessRequestReply{}}
+}
+
 func (s *session) handleGrantManagerCommand(cmd *proto.GrantManagerCommand) *response {
 	mkp := s.client.Authorization.ManagerKeyPair
 	if s.managedRoom == nil || s.client.Account == nil || mkp == nil {
 		return &response{err: proto.ErrAccessDenied}
 	}
 
+	expires, err := grantExpiry(cmd.Seconds)
+	if err != nil {
+		return &response{err: err}
+	}
+
 	account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
 	if err != nil {
 		return &response{err: err}
 	}
 
-	err = s.managedRoom.AddManager(s.ctx, s.kms, s.client.Account, s.client.Authorization.ClientKey, account)
+	err = s.managedRoom.AddManager(
+		s.ctx, s.kms, s.client.Account, s.client.Authorization.ClientKey, account, expires)
 	if err != nil {
 		return &response{err: err}
 	}
@@ -335,288 +827,955 @@ func (s *session) handleGrantManagerCommand(cmd *proto.GrantManagerCommand) *res
 	return &response{packet: &proto.GrantAccessReply{}}
 }
 
-func (s *session) handleRevokeManagerCommand(cmd *proto.RevokeManagerCommand) *response {
-	if s.managedRoom == nil || s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
-		return &response{err: proto.ErrAccessDenied}
+func (s *session) handleRevokeManagerCommand(cmd *proto.RevokeManagerCommand) *response {
+	if s.managedRoom == nil || s.client.Account == nil || s.client.Authorization.ManagerKeyPair == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	err = s.managedRoom.RemoveManager(s.ctx, s.client.Account, s.client.Authorization.ClientKey, account)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RevokeManagerReply{}}
+}
+
+func (s *session) handleStaffGrantManagerCommand(cmd *proto.StaffGrantManagerCommand) *response {
+	if s.staffKMS == nil {
+		return &response{err: fmt.Errorf("must unlock staff capability first")}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	expires, err := grantExpiry(cmd.Seconds)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	mkey, err := s.managedRoom.ManagerKey(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	msgkey, err := s.managedRoom.MessageKey(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if err := mkey.StaffGrantToAccount(s.ctx, s.staffKMS, account, expires); err != nil {
+		return &response{err: err}
+	}
+
+	if msgkey != nil {
+		if err := msgkey.StaffGrantToAccount(s.ctx, s.staffKMS, account, expires); err != nil {
+			return &response{err: err}
+		}
+	}
+
+	return &response{packet: &proto.StaffGrantManagerReply{}}
+}
+
+func (s *session) handleStaffRevokeManagerCommand(cmd *proto.StaffRevokeManagerCommand) *response {
+	if s.staffKMS == nil {
+		return &response{err: fmt.Errorf("must unlock staff capability first")}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	mkey, err := s.managedRoom.ManagerKey(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if err := mkey.RevokeFromAccount(s.ctx, account); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.StaffRevokeManagerReply{}}
+}
+
+func (s *session) handleStaffRevokeAccessCommand(cmd *proto.StaffRevokeAccessCommand) *response {
+	if s.staffKMS == nil {
+		return &response{err: fmt.Errorf("must unlock staff capability first")}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	mkey, err := s.managedRoom.MessageKey(s.ctx)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	switch {
+	case cmd.AccountID != 0:
+		account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
+		if err != nil {
+			return &response{err: err}
+		}
+		if err := mkey.RevokeFromAccount(s.ctx, account); err != nil {
+			return &response{err: err}
+		}
+	case cmd.Passcode != "":
+		if err := mkey.RevokeFromPasscode(s.ctx, cmd.Passcode); err != nil {
+			return &response{err: err}
+		}
+	}
+
+	return &response{packet: &proto.RevokeAccessReply{}}
+}
+
+func (s *session) handleStaffLockRoomCommand() *response {
+	if s.staffKMS == nil {
+		return &response{err: fmt.Errorf("must unlock staff capability first")}
+	}
+
+	if s.managedRoom == nil {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
+	if _, err := s.managedRoom.GenerateMessageKey(s.ctx, s.staffKMS); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.StaffLockRoomReply{}}
+}
+
+// admitLogin counts a login or registration attempt against the given key,
+// before its outcome is known, and returns the failures recorded before it.
+// It also returns the number of seconds to wait before another attempt is
+// accepted, or 0 if this one may proceed. Refused attempts should be forgiven.
+func (s *session) admitLogin(throttle proto.LoginThrottle, key string) (*proto.LoginFailures, int, error) {
+	failures, err := s.backend.LoginAttempts().Attempt(s.ctx, key, throttle.Window)
+	if err != nil {
+		return nil, 0, err
+	}
+	wait := throttle.RetryAfter(failures).Sub(time.Now())
+	if wait <= 0 {
+		return failures, 0, nil
+	}
+	return failures, int((wait + time.Second - 1) / time.Second), nil
+}
+
+// forgiveLogin takes back an attempt that turned out not to be a failure,
+// from the session's client address and, if given, the account.
+func (s *session) forgiveLogin(account proto.Account) error {
+	if err := s.backend.LoginAttempts().Forgive(s.ctx, proto.ClientLoginKey(s.client.IP)); err != nil {
+		return err
+	}
+	if account != nil {
+		return s.backend.LoginAttempts().Forgive(s.ctx, proto.AccountLoginKey(account))
+	}
+	return nil
+}
+
+// failLogin notifies the owner of an account if the failed attempt, counted
+// on top of the given failures, has just locked the account out.
+func (s *session) failLogin(account proto.Account, failures *proto.LoginFailures) {
+	throttle := s.server.accountLoginThrottle
+	if throttle.LockedOut(&proto.LoginFailures{Count: failures.Count + 1}) {
+		err := s.heim.OnAccountLockout(s.ctx, s.backend, account, s.client.IP, throttle.LockoutDuration)
+		if err != nil {
+			// Log this error only.
+			logging.Logger(s.ctx).Printf("error on account lockout: %s", err)
+		}
+	}
+}
+
+func (s *session) handleLoginCommand(cmd *proto.LoginCommand) *response {
+	// Accounts registered through an identity provider have no password.
+	if cmd.Namespace == proto.OIDCNamespace {
+		return &response{packet: &proto.LoginReply{Reason: proto.ErrOIDCAccount.Error()}}
+	}
+
+	// Count the attempt up front, and refuse clients that have failed too
+	// often recently.
+	_, wait, err := s.admitLogin(s.server.clientLoginThrottle, proto.ClientLoginKey(s.client.IP))
+	if err != nil {
+		return &response{err: err}
+	}
+	if wait > 0 {
+		if err := s.forgiveLogin(nil); err != nil {
+			return &response{err: err}
+		}
+		return &response{packet: &proto.LoginReply{Reason: "too many attempts", RetryAfter: wait}}
+	}
+
+	// Any of the account's verified identities may be used to log in, as well
+	// as the one it registered with, but unverified backups don't resolve.
+	account, err := s.backend.AccountManager().Resolve(s.ctx, cmd.Namespace, cmd.ID)
+	if err != nil {
+		switch err {
+		case proto.ErrAccountNotFound:
+			return &response{packet: &proto.LoginReply{Reason: err.Error()}}
+		default:
+			return &response{err: err}
+		}
+	}
+
+	// Refuse attempts on accounts that have been targeted too often recently,
+	// before checking the password.
+	failures, wait, err := s.admitLogin(s.server.accountLoginThrottle, proto.AccountLoginKey(account))
+	if err != nil {
+		return &response{err: err}
+	}
+	if wait > 0 {
+		if err := s.forgiveLogin(account); err != nil {
+			return &response{err: err}
+		}
+		return &response{packet: &proto.LoginReply{Reason: "too many attempts", RetryAfter: wait}}
+	}
+
+	clientKey := account.KeyFromPassword(cmd.Password)
+
+	if _, err = account.Unlock(clientKey); err != nil {
+		switch err {
+		case proto.ErrAccessDenied:
+			s.failLogin(account, failures)
+			return &response{packet: &proto.LoginReply{Reason: err.Error()}}
+		default:
+			return &response{err: err}
+		}
+	}
+
+	// If the account is enrolled in two-factor authentication, require a
+	// one-time password too.
+	otp, err := s.backend.AccountManager().OTP(s.ctx, s.kms, account.ID())
+	if err != nil && err != proto.ErrOTPNotEnrolled {
+		return &response{err: err}
+	}
+	if otp != nil && otp.Validated {
+		if cmd.OTP == "" {
+			// The password was right, so this attempt wasn't a failure.
+			if err := s.forgiveLogin(account); err != nil {
+				return &response{err: err}
+			}
+			return &response{packet: &proto.LoginReply{Reason: "otp required", OTPRequired: true}}
+		}
+		if err := proto.CheckOTP(s.ctx, s.backend.AccountManager(), s.kms, account.ID(), cmd.OTP); err != nil {
+			switch err {
+			case proto.ErrAccessDenied:
+				s.failLogin(account, failures)
+				return &response{packet: &proto.LoginReply{Reason: "invalid otp", OTPRequired: true}}
+			default:
+				return &response{err: err}
+			}
+		}
+	}
+
+	if err := s.backend.LoginAttempts().Forgive(s.ctx, proto.ClientLoginKey(s.client.IP)); err != nil {
+		return &response{err: err}
+	}
+	if err := s.backend.LoginAttempts().Reset(s.ctx, proto.AccountLoginKey(account)); err != nil {
+		return &response{err: err}
+	}
+
+	err = s.backend.AgentTracker().SetClientKey(
+		s.ctx, s.client.Agent.IDString(), s.agentKey, account.ID(), clientKey)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	err = s.backend.NotifyUser(s.ctx, s.Identity().ID(), proto.LoginEventType, proto.LoginEvent{AccountID: account.ID()}, s)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	reply := &proto.LoginReply{
+		Success:   true,
+		AccountID: account.ID(),
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleLogoutCommand() *response {
+	if err := s.backend.AgentTracker().ClearClientKey(s.ctx, s.client.Agent.IDString()); err != nil {
+		return &response{err: err}
+	}
+	err := s.backend.NotifyUser(s.ctx, proto.UserID("agent:"+s.AgentID()), proto.LogoutEventType, proto.LogoutEvent{}, s)
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.LogoutReply{}}
+}
+
+func (s *session) handleListLoginsCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	agents, err := s.backend.AgentTracker().ListForAccount(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+
+	reply := &proto.ListLoginsReply{Logins: make([]proto.AgentView, len(agents))}
+	for i, agent := range agents {
+		reply.Logins[i] = agent.View()
+		reply.Logins[i].Current = agent.IDString() == s.AgentID()
+	}
+	return &response{packet: reply}
+}
+
+func (s *session) handleRevokeLoginCommand(msg *proto.RevokeLoginCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if msg.AgentID == s.AgentID() {
+		return &response{err: fmt.Errorf("use logout to revoke the current login")}
+	}
+
+	// Only agents logged into this account may be revoked.
+	agent, err := s.backend.AgentTracker().Get(s.ctx, msg.AgentID)
+	if err != nil {
+		return &response{err: err}
+	}
+	if agent.AccountID != s.client.Account.ID().String() {
+		return &response{err: proto.ErrAgentNotFound}
+	}
+
+	if err := s.backend.AgentTracker().ClearClientKey(s.ctx, msg.AgentID); err != nil {
+		return &response{err: err}
+	}
+
+	// Kick any of the agent's live sessions, so they can't go on acting as the account.
+	err = s.backend.NotifyUser(
+		s.ctx, proto.UserID("agent:"+msg.AgentID), proto.DisconnectEventType,
+		proto.DisconnectEvent{Reason: "authentication changed"})
+	if err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.RevokeLoginReply{}}
+}
+
+func (s *session) handleChangeEmailCommand(msg *proto.ChangeEmailCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	if _, err := s.client.Account.Unlock(s.client.Account.KeyFromPassword(msg.Password)); err != nil {
+		if err == proto.ErrAccessDenied {
+			return &response{packet: &proto.ChangeEmailReply{Reason: err.Error()}}
+		}
+		return &response{err: err}
+	}
+	verified, err := s.backend.AccountManager().ChangeEmail(s.ctx, s.client.Account.ID(), msg.Email)
+	if err != nil {
+		return &response{err: err}
+	}
+	err = s.heim.OnAccountEmailChanged(
+		s.ctx, s.backend, s.client.Account, s.client.Authorization.ClientKey, msg.Email, verified)
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.ChangeEmailReply{Success: true, VerificationNeeded: !verified}}
+}
+
+// checkAccountPassword returns proto.ErrAccessDenied unless the given password
+// unlocks the logged in account. Accounts registered through an identity
+// provider have no password, so instead the session's agent must have logged
+// in through the provider recently.
+func (s *session) checkAccountPassword(password string) error {
+	if proto.IsOIDCAccount(s.client.Account) {
+		if time.Now().Sub(s.client.Agent.LoggedIn) > s.server.oidcRecentLogin {
+			return proto.ErrOIDCLoginRequired
+		}
+		return nil
+	}
+	_, err := s.client.Account.Unlock(s.client.Account.KeyFromPassword(password))
+	return err
+}
+
+// personalIdentityViews describes the logged in account's current personal
+// identities.
+func (s *session) personalIdentityViews() ([]proto.PersonalIdentityView, error) {
+	account, err := s.backend.AccountManager().Get(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return nil, err
+	}
+	return proto.PersonalIdentityViews(account), nil
+}
+
+func (s *session) handleListIdentitiesCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	views, err := s.personalIdentityViews()
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.ListIdentitiesReply{Identities: views}}
+}
+
+func (s *session) handleAddIdentityCommand(msg *proto.AddIdentityCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	// Other namespaces are only added through registration.
+	if msg.Namespace != "email" {
+		return &response{err: fmt.Errorf("invalid namespace: %s", msg.Namespace)}
+	}
+	if ok, reason := proto.ValidatePersonalIdentity(msg.Namespace, msg.ID); !ok {
+		return &response{err: fmt.Errorf("%s", reason)}
+	}
+
+	if err := s.checkAccountPassword(msg.Password); err != nil {
+		return &response{err: err}
+	}
+
+	err := s.backend.AccountManager().AddPersonalIdentity(s.ctx, s.client.Account.ID(), msg.Namespace, msg.ID)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	// Send a verification email unless the address was already verified.
+	account, err := s.backend.AccountManager().Get(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	for _, pid := range account.PersonalIdentities() {
+		if pid.Namespace() == msg.Namespace && pid.ID() == msg.ID && !pid.Verified() {
+			err := s.heim.OnAccountEmailChanged(
+				s.ctx, s.backend, account, s.client.Authorization.ClientKey, msg.ID, false)
+			if err != nil {
+				return &response{err: err}
+			}
+		}
+	}
+
+	return &response{packet: &proto.AddIdentityReply{Identities: proto.PersonalIdentityViews(account)}}
+}
+
+func (s *session) handleRemoveIdentityCommand(msg *proto.RemoveIdentityCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if err := s.checkAccountPassword(msg.Password); err != nil {
+		return &response{err: err}
+	}
+
+	// An account's link to its identity provider can't be removed.
+	if msg.Namespace == proto.OIDCNamespace {
+		return &response{err: proto.ErrOIDCAccount}
+	}
+
+	err := s.backend.AccountManager().RemovePersonalIdentity(s.ctx, s.client.Account.ID(), msg.Namespace, msg.ID)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	views, err := s.personalIdentityViews()
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.RemoveIdentityReply{Identities: views}}
+}
+
+func (s *session) handleSetPrimaryIdentityCommand(msg *proto.SetPrimaryIdentityCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if msg.Namespace != "email" {
+		return &response{err: fmt.Errorf("invalid namespace: %s", msg.Namespace)}
+	}
+
+	if err := s.checkAccountPassword(msg.Password); err != nil {
+		return &response{err: err}
+	}
+
+	// Only verified addresses can be made primary.
+	account, err := s.backend.AccountManager().Get(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	var found proto.PersonalIdentity
+	for _, pid := range account.PersonalIdentities() {
+		if pid.Namespace() == msg.Namespace && pid.ID() == msg.ID {
+			found = pid
+			break
+		}
+	}
+	if found == nil {
+		return &response{err: proto.ErrPersonalIdentityNotFound}
+	}
+	if !found.Verified() {
+		return &response{err: proto.ErrPersonalIdentityNotVerified}
+	}
+
+	if _, err := s.backend.AccountManager().ChangeEmail(s.ctx, account.ID(), msg.ID); err != nil {
+		return &response{err: err}
+	}
+
+	views, err := s.personalIdentityViews()
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.SetPrimaryIdentityReply{Identities: views}}
+}
+
+func (s *session) handleResendVerificationEmail(msg *proto.ResendVerificationEmailCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	// Refresh view of account.
+	account, err := s.backend.AccountManager().Get(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	sent := false
+	for _, pid := range account.PersonalIdentities() {
+		fmt.Printf("considering pid %s/%s/%t\n", pid.Namespace(), pid.ID(), pid.Verified())
+		if pid.Namespace() == "email" && !pid.Verified() {
+			err := s.heim.OnAccountEmailChanged(
+				s.ctx, s.backend, account, s.client.Authorization.ClientKey, pid.ID(), false)
+			if err != nil {
+				return &response{err: err}
+			}
+			sent = true
+		}
+	}
+	if !sent {
+		return &response{err: proto.ErrPersonalIdentityAlreadyVerified}
+	}
+	return &response{packet: &proto.ResendVerificationEmailReply{}}
+}
+
+func (s *session) handleChangeLocaleCommand(msg *proto.ChangeLocaleCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	locale, err := proto.NormalizeLocale(msg.Locale)
+	if err != nil {
+		return &response{err: err}
+	}
+	if err := s.backend.AccountManager().ChangeLocale(s.ctx, s.client.Account.ID(), locale); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.ChangeLocaleReply{Locale: locale}}
+}
+
+func (s *session) handleChangeNameCommand(msg *proto.ChangeNameCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+	if err := s.backend.AccountManager().ChangeName(s.ctx, s.client.Account.ID(), msg.Name); err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.ChangeNameReply{Name: msg.Name}}
+}
+
+func (s *session) handleChangePasswordCommand(msg *proto.ChangePasswordCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if proto.IsOIDCAccount(s.client.Account) {
+		return &response{err: proto.ErrOIDCAccount}
+	}
+
+	oldClientKey := s.client.Account.KeyFromPassword(msg.OldPassword)
+	newClientKey := s.client.Account.KeyFromPassword(msg.NewPassword)
+
+	// Change password, invalidating all agents.
+	err := s.backend.AccountManager().ChangeClientKey(
+		s.ctx, s.client.Account.ID(), oldClientKey, newClientKey)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	// Log in current agent using new password.
+	err = s.backend.AgentTracker().SetClientKey(
+		s.ctx, s.client.Agent.IDString(), s.agentKey, s.client.Account.ID(), newClientKey)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	// Log out all other agents on this account.
+	err = s.backend.NotifyUser(s.ctx, s.Identity().ID(), proto.LogoutEventType, proto.LogoutEvent{}, s)
+	if err != nil {
+		return &response{err: err}
+	}
+
+	if err := s.heim.OnAccountPasswordChanged(s.ctx, s.backend, s.client.Account); err != nil {
+		return &response{err: err}
+	}
+
+	return &response{packet: &proto.ChangePasswordReply{}}
+}
+
+func (s *session) handleEnrollOTPCommand(cmd *proto.EnrollOTPCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	// Identity providers are responsible for their own second factors.
+	if proto.IsOIDCAccount(s.client.Account) {
+		return &response{err: proto.ErrOIDCAccount}
 	}
 
-	account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
+	otp, err := s.backend.AccountManager().GenerateOTP(s.ctx, s.heim, s.kms, s.client.Account)
 	if err != nil {
 		return &response{err: err}
 	}
 
-	err = s.managedRoom.RemoveManager(s.ctx, s.client.Account, s.client.Authorization.ClientKey, account)
+	qrImage, err := otpQRImage(otp)
 	if err != nil {
 		return &response{err: err}
 	}
 
-	return &response{packet: &proto.RevokeManagerReply{}}
+	return &response{packet: &proto.EnrollOTPReply{URI: otp.URI, QRImage: qrImage}}
 }
 
-func (s *session) handleStaffGrantManagerCommand(cmd *proto.StaffGrantManagerCommand) *response {
-	if s.staffKMS == nil {
-		return &response{err: fmt.Errorf("must unlock staff capability first")}
+func (s *session) handleValidateOTPCommand(cmd *proto.ValidateOTPCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	if s.managedRoom == nil {
-		return &response{err: proto.ErrAccessDenied}
-	}
+	am := s.backend.AccountManager()
+	accountID := s.client.Account.ID()
 
-	account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
+	otp, err := am.OTP(s.ctx, s.kms, accountID)
 	if err != nil {
 		return &response{err: err}
 	}
+	if otp == nil {
+		return &response{err: proto.ErrOTPNotEnrolled}
+	}
+	if otp.Validated {
+		return &response{err: proto.ErrOTPAlreadyEnrolled}
+	}
 
-	mkey, err := s.managedRoom.ManagerKey(s.ctx)
-	if err != nil {
+	if err := am.ValidateOTP(s.ctx, s.kms, accountID, cmd.Password); err != nil {
 		return &response{err: err}
 	}
 
-	msgkey, err := s.managedRoom.MessageKey(s.ctx)
+	codes, err := proto.GenerateOTPRecoveryCodes(s.kms)
 	if err != nil {
 		return &response{err: err}
 	}
-
-	if err := mkey.StaffGrantToAccount(s.ctx, s.staffKMS, account); err != nil {
-		return &response{err: err}
+	digests := make([]string, len(codes))
+	for i, code := range codes {
+		digests[i] = proto.OTPRecoveryCodeDigest(accountID, code)
 	}
-
-	if msgkey != nil {
-		if err := msgkey.StaffGrantToAccount(s.ctx, s.staffKMS, account); err != nil {
-			return &response{err: err}
-		}
+	if err := am.SetOTPRecoveryCodes(s.ctx, accountID, digests); err != nil {
+		return &response{err: err}
 	}
 
-	return &response{packet: &proto.StaffGrantManagerReply{}}
+	return &response{packet: &proto.ValidateOTPReply{RecoveryCodes: codes}}
 }
 
-func (s *session) handleStaffRevokeManagerCommand(cmd *proto.StaffRevokeManagerCommand) *response {
-	if s.staffKMS == nil {
-		return &response{err: fmt.Errorf("must unlock staff capability first")}
-	}
-
-	if s.managedRoom == nil {
-		return &response{err: proto.ErrAccessDenied}
+func (s *session) handleDisableOTPCommand(cmd *proto.DisableOTPCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
-	if err != nil {
+	if _, err := s.client.Account.Unlock(s.client.Account.KeyFromPassword(cmd.Password)); err != nil {
 		return &response{err: err}
 	}
 
-	mkey, err := s.managedRoom.ManagerKey(s.ctx)
-	if err != nil {
+	am := s.backend.AccountManager()
+	accountID := s.client.Account.ID()
+	if err := proto.CheckOTP(s.ctx, am, s.kms, accountID, cmd.OTP); err != nil {
 		return &response{err: err}
 	}
 
-	if err := mkey.RevokeFromAccount(s.ctx, account); err != nil {
+	if err := am.DisableOTP(s.ctx, accountID); err != nil {
 		return &response{err: err}
 	}
 
-	return &response{packet: &proto.StaffRevokeManagerReply{}}
+	return &response{packet: &proto.DisableOTPReply{}}
 }
 
-func (s *session) handleStaffRevokeAccessCommand(cmd *proto.StaffRevokeAccessCommand) *response {
-	if s.staffKMS == nil {
-		return &response{err: fmt.Errorf("must unlock staff capability first")}
+func (s *session) handleBlockUserCommand(msg *proto.BlockUserCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	if s.managedRoom == nil {
-		return &response{err: proto.ErrAccessDenied}
+	if err := proto.ValidateBlockedUserID(msg.UserID); err != nil {
+		return &response{err: err}
+	}
+	if msg.UserID == s.Identity().ID() {
+		return &response{err: fmt.Errorf("you can't block yourself")}
 	}
 
-	mkey, err := s.managedRoom.MessageKey(s.ctx)
-	if err != nil {
+	if err := s.backend.Blocks().Block(s.ctx, s.client.Account.ID(), msg.UserID); err != nil {
 		return &response{err: err}
 	}
+	s.setBlocked(msg.UserID, true)
 
-	switch {
-	case cmd.AccountID != 0:
-		account, err := s.backend.AccountManager().Get(s.ctx, cmd.AccountID)
-		if err != nil {
-			return &response{err: err}
-		}
-		if err := mkey.RevokeFromAccount(s.ctx, account); err != nil {
-			return &response{err: err}
-		}
-	case cmd.Passcode != "":
-		if err := mkey.RevokeFromPasscode(s.ctx, cmd.Passcode); err != nil {
-			return &response{err: err}
-		}
+	// Let the account's other sessions start withholding the user too.
+	err := s.backend.NotifyUser(
+		s.ctx, s.Identity().ID(), proto.BlockUserEventType, &proto.BlockUserEvent{UserID: msg.UserID}, s)
+	if err != nil {
+		return &response{err: err}
 	}
 
-	return &response{packet: &proto.RevokeAccessReply{}}
+	return &response{packet: &proto.BlockUserReply{}}
 }
 
-func (s *session) handleStaffLockRoomCommand() *response {
-	if s.staffKMS == nil {
-		return &response{err: fmt.Errorf("must unlock staff capability first")}
+func (s *session) handleUnblockUserCommand(msg *proto.UnblockUserCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	if s.managedRoom == nil {
-		return &response{err: proto.ErrAccessDenied}
+	if err := s.backend.Blocks().Unblock(s.ctx, s.client.Account.ID(), msg.UserID); err != nil {
+		return &response{err: err}
 	}
+	s.setBlocked(msg.UserID, false)
 
-	if _, err := s.managedRoom.GenerateMessageKey(s.ctx, s.staffKMS); err != nil {
+	err := s.backend.NotifyUser(
+		s.ctx, s.Identity().ID(), proto.UnblockUserEventType, &proto.UnblockUserEvent{UserID: msg.UserID}, s)
+	if err != nil {
 		return &response{err: err}
 	}
 
-	return &response{packet: &proto.StaffLockRoomReply{}}
+	return &response{packet: &proto.UnblockUserReply{}}
 }
 
-func (s *session) handleLoginCommand(cmd *proto.LoginCommand) *response {
-	account, err := s.backend.AccountManager().Resolve(s.ctx, cmd.Namespace, cmd.ID)
-	if err != nil {
-		switch err {
-		case proto.ErrAccountNotFound:
-			return &response{packet: &proto.LoginReply{Reason: err.Error()}}
-		default:
-			return &response{err: err}
-		}
+func (s *session) handleListBlockedUsersCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	clientKey := account.KeyFromPassword(cmd.Password)
+	userIDs, err := s.backend.Blocks().List(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
+	}
+	return &response{packet: &proto.ListBlockedUsersReply{UserIDs: userIDs}}
+}
 
-	if _, err = account.Unlock(clientKey); err != nil {
-		switch err {
-		case proto.ErrAccessDenied:
-			return &response{packet: &proto.LoginReply{Reason: err.Error()}}
-		default:
-			return &response{err: err}
-		}
+func (s *session) handleListPMsCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	err = s.backend.AgentTracker().SetClientKey(
-		s.ctx, s.client.Agent.IDString(), s.agentKey, account.ID(), clientKey)
+	pms, err := s.backend.PMTracker().List(s.ctx, s.client.Account.ID())
 	if err != nil {
 		return &response{err: err}
 	}
+	return &response{packet: &proto.ListPMsReply{PMs: pms}}
+}
 
-	err = s.backend.NotifyUser(s.ctx, s.Identity().ID(), proto.LoginEventType, proto.LoginEvent{AccountID: account.ID()}, s)
+func (s *session) handleGetEmailPreferencesCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	prefs, err := s.backend.EmailPreferences().Get(s.ctx, s.client.Account.ID())
 	if err != nil {
 		return &response{err: err}
 	}
+	return &response{packet: &proto.GetEmailPreferencesReply{Preferences: *prefs}}
+}
 
-	reply := &proto.LoginReply{
-		Success:   true,
-		AccountID: account.ID(),
+func (s *session) handleSetEmailPreferencesCommand(msg *proto.SetEmailPreferencesCommand) *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
 	}
-	return &response{packet: reply}
-}
 
-func (s *session) handleLogoutCommand() *response {
-	if err := s.backend.AgentTracker().ClearClientKey(s.ctx, s.client.Agent.IDString()); err != nil {
+	if err := s.backend.EmailPreferences().Set(s.ctx, s.client.Account.ID(), &msg.Preferences); err != nil {
 		return &response{err: err}
 	}
-	err := s.backend.NotifyUser(s.ctx, proto.UserID("agent:"+s.AgentID()), proto.LogoutEventType, proto.LogoutEvent{}, s)
-	if err != nil {
-		return &response{err: err}
+	return &response{packet: &proto.SetEmailPreferencesReply{}}
+}
+
+// isBlockedBy reports whether the account behind the given user has blocked
+// the session's user.
+func (s *session) isBlockedBy(userID proto.UserID) (bool, error) {
+	var accountID snowflake.Snowflake
+	kind, id := userID.Parse()
+	switch kind {
+	case "account":
+		if err := accountID.FromString(id); err != nil {
+			return false, proto.ErrInvalidUserID
+		}
+	case "agent":
+		agent, err := s.backend.AgentTracker().Get(s.ctx, id)
+		if err != nil {
+			if err == proto.ErrAgentNotFound {
+				return false, nil
+			}
+			return false, err
+		}
+		if agent.AccountID == "" {
+			return false, nil
+		}
+		if err := accountID.FromString(agent.AccountID); err != nil {
+			return false, err
+		}
+	default:
+		return false, nil
 	}
-	return &response{packet: &proto.LogoutReply{}}
+	return s.backend.Blocks().IsBlocked(s.ctx, accountID, s.Identity().ID())
 }
 
-func (s *session) handleChangeEmailCommand(msg *proto.ChangeEmailCommand) *response {
+func (s *session) handleReserveNickCommand(msg *proto.ReserveNickCommand) *response {
 	if s.client.Account == nil {
 		return &response{err: proto.ErrNotLoggedIn}
 	}
-	if _, err := s.client.Account.Unlock(s.client.Account.KeyFromPassword(msg.Password)); err != nil {
-		if err == proto.ErrAccessDenied {
-			return &response{packet: &proto.ChangeEmailReply{Reason: err.Error()}}
-		}
+
+	// Reservations are only open to accounts someone has verified they can
+	// reach, so that throwaway accounts can't squat on nicks.
+	account, err := s.backend.AccountManager().Get(s.ctx, s.client.Account.ID())
+	if err != nil {
 		return &response{err: err}
 	}
-	verified, err := s.backend.AccountManager().ChangeEmail(s.ctx, s.client.Account.ID(), msg.Email)
+	verified := false
+	for _, pid := range account.PersonalIdentities() {
+		if pid.Verified() {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return &response{err: proto.ErrPersonalIdentityNotVerified}
+	}
+
+	nick, err := proto.NormalizeNick(msg.Name)
 	if err != nil {
 		return &response{err: err}
 	}
-	err = s.heim.OnAccountEmailChanged(
-		s.ctx, s.backend, s.client.Account, s.client.Authorization.ClientKey, msg.Email, verified)
+
+	nr := s.backend.NickReservations()
+	if err := nr.Reserve(s.ctx, s.client.Account.ID(), nick); err != nil {
+		return &response{err: err}
+	}
+
+	nicks, err := nr.List(s.ctx, s.client.Account.ID())
 	if err != nil {
 		return &response{err: err}
 	}
-	return &response{packet: &proto.ChangeEmailReply{Success: true, VerificationNeeded: !verified}}
+	return &response{packet: &proto.ReserveNickReply{Nicks: nicks}}
 }
 
-func (s *session) handleResendVerificationEmail(msg *proto.ResendVerificationEmailCommand) *response {
+func (s *session) handleReleaseNickCommand(msg *proto.ReleaseNickCommand) *response {
 	if s.client.Account == nil {
 		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	// Refresh view of account.
-	account, err := s.backend.AccountManager().Get(s.ctx, s.client.Account.ID())
+	nick, err := proto.NormalizeNick(msg.Name)
 	if err != nil {
 		return &response{err: err}
 	}
-	sent := false
-	for _, pid := range account.PersonalIdentities() {
-		fmt.Printf("considering pid %s/%s/%t\n", pid.Namespace(), pid.ID(), pid.Verified())
-		if pid.Namespace() == "email" && !pid.Verified() {
-			err := s.heim.OnAccountEmailChanged(
-				s.ctx, s.backend, account, s.client.Authorization.ClientKey, pid.ID(), false)
-			if err != nil {
-				return &response{err: err}
-			}
-			sent = true
-		}
+
+	nr := s.backend.NickReservations()
+	if err := nr.Release(s.ctx, s.client.Account.ID(), nick); err != nil {
+		return &response{err: err}
 	}
-	if !sent {
-		return &response{err: proto.ErrPersonalIdentityAlreadyVerified}
+
+	nicks, err := nr.List(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return &response{err: err}
 	}
-	return &response{packet: &proto.ResendVerificationEmailReply{}}
+	return &response{packet: &proto.ReleaseNickReply{Nicks: nicks}}
 }
 
-func (s *session) handleChangeNameCommand(msg *proto.ChangeNameCommand) *response {
+func (s *session) handleListReservedNicksCommand() *response {
 	if s.client.Account == nil {
 		return &response{err: proto.ErrNotLoggedIn}
 	}
-	if err := s.backend.AccountManager().ChangeName(s.ctx, s.client.Account.ID(), msg.Name); err != nil {
+
+	nicks, err := s.backend.NickReservations().List(s.ctx, s.client.Account.ID())
+	if err != nil {
 		return &response{err: err}
 	}
-	return &response{packet: &proto.ChangeNameReply{Name: msg.Name}}
+	return &response{packet: &proto.ListReservedNicksReply{Nicks: nicks}}
 }
 
-func (s *session) handleChangePasswordCommand(msg *proto.ChangePasswordCommand) *response {
+func (s *session) handleDeleteAccountCommand(cmd *proto.DeleteAccountCommand) *response {
 	if s.client.Account == nil {
 		return &response{err: proto.ErrNotLoggedIn}
 	}
 
-	oldClientKey := s.client.Account.KeyFromPassword(msg.OldPassword)
-	newClientKey := s.client.Account.KeyFromPassword(msg.NewPassword)
-
-	// Change password, invalidating all agents.
-	err := s.backend.AccountManager().ChangeClientKey(
-		s.ctx, s.client.Account.ID(), oldClientKey, newClientKey)
-	if err != nil {
+	if err := s.checkAccountPassword(cmd.Password); err != nil {
 		return &response{err: err}
 	}
 
-	// Log in current agent using new password.
-	err = s.backend.AgentTracker().SetClientKey(
-		s.ctx, s.client.Agent.IDString(), s.agentKey, s.client.Account.ID(), newClientKey)
-	if err != nil {
+	am := s.backend.AccountManager()
+	accountID := s.client.Account.ID()
+	otp, err := am.OTP(s.ctx, s.kms, accountID)
+	if err != nil && err != proto.ErrOTPNotEnrolled {
 		return &response{err: err}
 	}
+	if otp != nil && otp.Validated {
+		if err := proto.CheckOTP(s.ctx, am, s.kms, accountID, cmd.OTP); err != nil {
+			return &response{err: err}
+		}
+	}
 
-	// Log out all other agents on this account.
-	err = s.backend.NotifyUser(s.ctx, s.Identity().ID(), proto.LogoutEventType, proto.LogoutEvent{}, s)
-	if err != nil {
+	if err := proto.QueueAccountDeletion(s.ctx, s.backend, accountID); err != nil {
 		return &response{err: err}
 	}
 
-	if err := s.heim.OnAccountPasswordChanged(s.ctx, s.backend, s.client.Account); err != nil {
+	return &response{packet: &proto.DeleteAccountReply{}}
+}
+
+func (s *session) handleRequestDataExportCommand() *response {
+	if s.client.Account == nil {
+		return &response{err: proto.ErrNotLoggedIn}
+	}
+
+	if err := proto.QueueAccountDataExport(s.ctx, s.backend, s.client.Account.ID()); err != nil {
 		return &response{err: err}
 	}
 
-	return &response{packet: &proto.ChangePasswordReply{}}
+	return &response{packet: &proto.RequestDataExportReply{}}
 }
 
 func (s *session) handleResetPasswordCommand(msg *proto.ResetPasswordCommand) *response {
+	if msg.Namespace == proto.OIDCNamespace {
+		return &response{err: proto.ErrOIDCAccount}
+	}
+
+	// The account may also be found by a backup email address.
+	acc, err := s.backend.AccountManager().Resolve(s.ctx, msg.Namespace, msg.ID)
+	if err != nil {
+		return &response{err: err}
+	}
+	if proto.IsOIDCAccount(acc) {
+		return &response{err: proto.ErrOIDCAccount}
+	}
+
 	acc, req, err := s.backend.AccountManager().RequestPasswordReset(s.ctx, s.kms, msg.Namespace, msg.ID)
 	if err != nil {
 		return &response{err: err}
 	}
 
-	if err := s.heim.OnAccountPasswordResetRequest(s.ctx, s.backend, acc, req); err != nil {
+	// If the reset was requested by a verified email address, such as a backup
+	// address, send the confirmation there.
+	to := ""
+	for _, pid := range acc.PersonalIdentities() {
+		if pid.Namespace() == "email" && pid.ID() == msg.ID && msg.Namespace == "email" && pid.Verified() {
+			to = pid.ID()
+		}
+	}
+
+	if err := s.heim.OnAccountPasswordResetRequest(s.ctx, s.backend, acc, to, req); err != nil {
 		return &response{err: err}
 	}
 
@@ -638,12 +1797,29 @@ func (s *session) handleRegisterAccountCommand(cmd *proto.RegisterAccountCommand
 	if ok, reason := proto.ValidatePersonalIdentity(cmd.Namespace, cmd.ID); !ok {
 		return &response{packet: &proto.RegisterAccountReply{Reason: reason}}
 	}
+	if cmd.Namespace == proto.OIDCNamespace {
+		return &response{packet: &proto.RegisterAccountReply{Reason: "oidc identities must register through their provider"}}
+	}
 
 	if ok, reason := proto.ValidateAccountPassword(cmd.Password); !ok {
 		return &response{packet: &proto.RegisterAccountReply{Reason: reason}}
 	}
 
-	// Register the account.
+	// Count the attempt up front, and refuse clients that have failed too
+	// often recently.
+	_, wait, err := s.admitLogin(s.server.clientLoginThrottle, proto.ClientLoginKey(s.client.IP))
+	if err != nil {
+		return &response{err: err}
+	}
+	if wait > 0 {
+		if err := s.forgiveLogin(nil); err != nil {
+			return &response{err: err}
+		}
+		return &response{packet: &proto.RegisterAccountReply{Reason: "too many attempts", RetryAfter: wait}}
+	}
+
+	// Register the account. Failing because the identity is taken counts as
+	// a failure, to slow down probing for registered identities.
 	account, clientKey, err := s.backend.AccountManager().Register(
 		s.ctx, s.kms, cmd.Namespace, cmd.ID, cmd.Password, s.client.Agent.IDString(), s.agentKey)
 	if err != nil {
@@ -655,6 +1831,10 @@ func (s *session) handleRegisterAccountCommand(cmd *proto.RegisterAccountCommand
 		}
 	}
 
+	if err := s.forgiveLogin(nil); err != nil {
+		return &response{err: err}
+	}
+
 	// Kick off on-registration tasks.
 	if err := s.heim.OnAccountRegistration(s.ctx, s.backend, account, clientKey); err != nil {
 		// Log this error only.
@@ -707,6 +1887,12 @@ func (s *session) handleAuthCommand(msg *proto.AuthCommand) *response {
 		} else {
 			failureReason, err = s.client.AuthenticateWithPasscode(s.ctx, s.managedRoom, msg.Passcode)
 		}
+	case proto.AuthInvite:
+		if s.managedRoom == nil {
+			failureReason = fmt.Sprintf("auth type not supported: %s", msg.Type)
+		} else {
+			failureReason, err = s.client.AuthenticateWithInvite(s.ctx, s.kms, s.managedRoom, msg.Invite)
+		}
 	default:
 		failureReason = fmt.Sprintf("auth type not supported: %s", msg.Type)
 	}
@@ -748,22 +1934,31 @@ func (s *session) handleStaffEnrollOTPCommand(cmd *proto.StaffEnrollOTPCommand)
 		return failure(err)
 	}
 
-	img, err := otp.QRImage(200, 200)
+	qrImage, err := otpQRImage(otp)
 	if err != nil {
 		return failure(err)
 	}
-	encodedImg := &bytes.Buffer{}
-	if err := png.Encode(encodedImg, img); err != nil {
-		return failure(err)
-	}
 
 	reply := &proto.StaffEnrollOTPReply{
 		URI:     otp.URI,
-		QRImage: fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(encodedImg.Bytes())),
+		QRImage: qrImage,
 	}
 	return &response{packet: reply}
 }
 
+// otpQRImage returns a data URI for a QR image encoding the given OTP's URI.
+func otpQRImage(otp *proto.OTP) (string, error) {
+	img, err := otp.QRImage(200, 200)
+	if err != nil {
+		return "", err
+	}
+	encodedImg := &bytes.Buffer{}
+	if err := png.Encode(encodedImg, img); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data:image/png;base64,%s", base64.StdEncoding.EncodeToString(encodedImg.Bytes())), nil
+}
+
 func (s *session) handleStaffValidateOTPCommand(cmd *proto.StaffValidateOTPCommand) *response {
 	failure := func(err error) *response { return &response{err: err} }
 
@@ -1012,6 +2207,14 @@ func (s *session) handlePMInitiateCommand(msg *proto.PMInitiateCommand) *respons
 		return &response{err: proto.ErrAccessDenied}
 	}
 
+	blocked, err := s.isBlockedBy(msg.UserID)
+	if err != nil {
+		return &response{err: err}
+	}
+	if blocked {
+		return &response{err: proto.ErrAccessDenied}
+	}
+
 	toNick, ok, err := s.room.ResolveNick(s.ctx, msg.UserID)
 	if err != nil {
 		return &response{err: err}
@@ -72,7 +72,8 @@ func init() {
 	flag.BoolVar(&Config.AllowRoomCreation, "allow-room-creation", true, "allow rooms to be created")
 	flag.BoolVar(&Config.SetInsecureCookies, "set-insecure-cookies", false, "allow non-https cookies")
 
-	flag.StringVar(&Config.Email.Server, "smtp-server", "", "address of SMTP server to send mail through")
+	flag.StringVar(&Config.Email.Server, "smtp-server", "",
+		`address of SMTP server to send mail through (or "maildir:DIR", "mbox:FILE", "sendmail[:PATH]", "$stdout")`)
 	flag.StringVar(&Config.Email.AuthMethod, "smtp-auth-method", "",
 		`authenticate when using the SMTP server (must be either "CRAM-MD5" or "PLAIN")`)
 	flag.StringVar(&Config.Email.Username, "smtp-username", "",
@@ -83,6 +84,19 @@ func init() {
 		"authenticate with SMTP server using this identity (PLAIN auth only)")
 	flag.BoolVar(&Config.Email.UseTLS, "smtp-use-tls", true, "require TLS with SMTP server")
 	flag.StringVar(&Config.Email.Templates, "email-templates", "", "path to email templates")
+	flag.IntVar(&Config.Email.PoolSize, "smtp-pool-size", emails.DefaultSMTPPoolSize,
+		"maximum number of concurrent connections to the SMTP server (0 to connect per email)")
+	flag.DurationVar(&Config.Email.PoolMaxIdle, "smtp-pool-max-idle", emails.DefaultSMTPPoolMaxIdle,
+		"close pooled SMTP connections after they've been idle this long")
+	flag.StringVar(&Config.Email.DKIMDomain, "dkim-domain", "", "sign outgoing email with DKIM for this domain")
+	flag.StringVar(&Config.Email.DKIMSelector, "dkim-selector", "", "DKIM selector of the signing key")
+	flag.StringVar(&Config.Email.DKIMKeyFile, "dkim-key-file", "", "path to PEM-encoded RSA key for DKIM signing")
+	flag.DurationVar(&Config.Email.DigestWindow, "email-digest-window", proto.DefaultNotificationDigestWindow,
+		"how long to collect offline notifications before emailing them")
+	flag.StringVar(&Config.Email.ReplyDomain, "email-reply-domain", "",
+		"domain to accept replies to notification emails at (disabled if empty)")
+	flag.StringVar(&Config.Email.ReplyAuthServID, "email-reply-authserv-id", "",
+		"authserv-id of the Authentication-Results header the MTA adds to email replies")
 }
 
 func RegisterBackend(name string, factory proto.BackendFactory) { backendFactories[name] = factory }
@@ -112,6 +126,10 @@ type ServerConfig struct {
 	KMS     KMSConfig      `yaml:"kms"`
 	Email   EmailConfig    `yaml:"email"`
 	GeoIP   GeoIPConfig    `yaml:"geoip"`
+
+	// OIDC maps names to OpenID Connect providers that accounts may log in
+	// through, at /login/oidc/{name}.
+	OIDC map[string]OIDCProviderConfig `yaml:"oidc,omitempty"`
 }
 
 func (cfg *ServerConfig) String() string {
@@ -188,6 +206,10 @@ func (cfg *ServerConfig) Heim(ctx scope.Context) (*proto.Heim, error) {
 		PageTemplater:  pageTemplater,
 		SiteName:       cfg.SiteName,
 		StaticPath:     cfg.StaticPath,
+
+		NotificationDigestWindow: cfg.Email.DigestWindow,
+		EmailReplyDomain:         cfg.Email.ReplyDomain,
+		EmailReplyAuthServID:     cfg.Email.ReplyAuthServID,
 	}
 
 	backend, err := cfg.GetBackend(heim)
@@ -328,6 +350,9 @@ func (kc *KMSConfig) amazon() (security.KMS, error) {
 }
 
 type EmailConfig struct {
+	// Server is the address of an SMTP server, or one of the following to
+	// deliver locally instead: "maildir:DIR", "mbox:FILE", "sendmail" or
+	// "sendmail:PATH", or "$stdout".
 	Server     string `yaml:"server"`
 	AuthMethod string `yaml:"auth_method"` // must be "", "CRAM-MD5", or "PLAIN"
 	Username   string `yaml:"username"`
@@ -335,6 +360,28 @@ type EmailConfig struct {
 	Identity   string `yaml:"identity"`
 	UseTLS     bool   `yaml:"use_tls"`
 	Templates  string `yaml:"templates"`
+
+	// PoolSize bounds the number of connections to the SMTP server, which
+	// are reused between emails. Zero connects anew for each email.
+	PoolSize    int           `yaml:"pool_size"`
+	PoolMaxIdle time.Duration `yaml:"pool_max_idle"`
+
+	// DKIM signing is enabled when all of these are given.
+	DKIMDomain   string `yaml:"dkim_domain"`
+	DKIMSelector string `yaml:"dkim_selector"`
+	DKIMKeyFile  string `yaml:"dkim_key_file"`
+
+	// DigestWindow is how long to collect an offline account's mentions and
+	// private messages before emailing them.
+	DigestWindow time.Duration `yaml:"digest_window"`
+
+	// ReplyDomain is the domain of the addresses notification emails can be
+	// replied to at. Mail to it must be routed to heimctl email-replies.
+	ReplyDomain string `yaml:"reply_domain"`
+
+	// ReplyAuthServID identifies the MTA that receives replies in the
+	// Authentication-Results headers it adds. Only its results are trusted.
+	ReplyAuthServID string `yaml:"reply_authserv_id"`
 }
 
 func (ec *EmailConfig) Get(cfg *ServerConfig) (*templates.Templater, emails.Deliverer, error) {
@@ -357,13 +404,47 @@ func (ec *EmailConfig) Get(cfg *ServerConfig) (*templates.Templater, emails.Deli
 		return nil, nil, fmt.Errorf("template validation failed: %s...", errs[0].Error())
 	}
 
+	var signer *emails.DKIMSigner
+	if ec.DKIMDomain != "" || ec.DKIMSelector != "" || ec.DKIMKeyFile != "" {
+		if ec.DKIMDomain == "" || ec.DKIMSelector == "" || ec.DKIMKeyFile == "" {
+			return nil, nil, fmt.Errorf("DKIM signing requires a domain, selector, and key file")
+		}
+		var err error
+		signer, err = emails.LoadDKIMSigner(ec.DKIMDomain, ec.DKIMSelector, ec.DKIMKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dkim key: %s", err)
+		}
+	}
+
 	// Set up deliverer.
 	fmt.Printf("setting up deliverer for %#v\n", ec)
-	switch ec.Server {
-	case "":
+	scheme, path := ec.Server, ""
+	if i := strings.IndexByte(ec.Server, ':'); i >= 0 {
+		scheme, path = ec.Server[:i], ec.Server[i+1:]
+	}
+	switch {
+	case ec.Server == "":
 		return templater, nil, nil
-	case "$stdout":
+	case ec.Server == "$stdout":
 		return templater, &mockDeliverer{Writer: os.Stdout}, nil
+	case scheme == "maildir":
+		if path == "" {
+			return nil, nil, fmt.Errorf("maildir: path must be specified")
+		}
+		deliverer, err := emails.NewMaildirDeliverer(localDomain, path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("maildir: %s", err)
+		}
+		return templater, deliverer, nil
+	case scheme == "mbox":
+		if path == "" {
+			return nil, nil, fmt.Errorf("mbox: path must be specified")
+		}
+		return templater, emails.NewMboxDeliverer(localDomain, path), nil
+	case scheme == "sendmail":
+		deliverer := emails.NewSendmailDeliverer(localDomain, path)
+		deliverer.DKIM = signer
+		return templater, deliverer, nil
 	default:
 		var sslHost string
 		if ec.UseTLS {
@@ -387,6 +468,10 @@ func (ec *EmailConfig) Get(cfg *ServerConfig) (*templates.Templater, emails.Deli
 		}
 
 		deliverer := emails.NewSMTPDeliverer(localDomain, ec.Server, sslHost, auth)
+		deliverer.DKIM = signer
+		if ec.PoolSize > 0 {
+			return templater, emails.NewPooledSMTPDeliverer(deliverer, ec.PoolSize, ec.PoolMaxIdle), nil
+		}
 		return templater, deliverer, nil
 	}
 }
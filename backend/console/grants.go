@@ -0,0 +1,78 @@
+package console
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("list-access", listAccess{})
+	register("list-managers", listManagers{})
+}
+
+func formatExpires(expires proto.Time) string {
+	if time.Time(expires).IsZero() {
+		return "never"
+	}
+	return time.Time(expires).String()
+}
+
+type listAccess struct{}
+
+func (listAccess) usage() string { return "usage: list-access ROOM" }
+
+func (listAccess) run(ctx scope.Context, c *console, args []string) error {
+	if len(args) < 1 {
+		return usageError("room must be given")
+	}
+
+	room, err := c.backend.GetRoom(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	reply, err := proto.ListRoomAccess(ctx, c.backend, room)
+	if err != nil {
+		return err
+	}
+
+	c.Printf("Account grants in &%s:\n", args[0])
+	for _, grant := range reply.AccountGrants {
+		c.Printf("  %s (%s): granted %s, expires %s\n",
+			grant.ID, grant.Name, time.Time(grant.Granted), formatExpires(grant.Expires))
+	}
+	c.Printf("Passcode grants in &%s:\n", args[0])
+	for _, grant := range reply.PasscodeGrants {
+		c.Printf("  %s: granted %s, expires %s\n",
+			grant.CapabilityID, time.Time(grant.Granted), formatExpires(grant.Expires))
+	}
+	return nil
+}
+
+type listManagers struct{}
+
+func (listManagers) usage() string { return "usage: list-managers ROOM" }
+
+func (listManagers) run(ctx scope.Context, c *console, args []string) error {
+	if len(args) < 1 {
+		return usageError("room must be given")
+	}
+
+	room, err := c.backend.GetRoom(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	managers, err := room.Managers(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.Printf("Managers of &%s:\n", args[0])
+	for _, manager := range managers {
+		c.Printf("  %s (%s)\n", manager.ID(), manager.Name())
+	}
+	return nil
+}
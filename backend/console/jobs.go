@@ -0,0 +1,137 @@
+package console
+
+import (
+	"fmt"
+
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("list-dead-jobs", listDeadJobs{})
+	register("inspect-job", inspectJob{})
+	register("requeue-job", requeueJob{})
+	register("purge-job", purgeJob{})
+}
+
+type listDeadJobs struct{}
+
+func (listDeadJobs) usage() string { return "usage: list-dead-jobs [-n <count>] QUEUE" }
+
+func (listDeadJobs) run(ctx scope.Context, c *console, args []string) error {
+	n := c.Int("n", 20, "maximum number of jobs to list")
+
+	if err := c.Parse(args); err != nil {
+		return err
+	}
+
+	if len(c.Args()) < 1 {
+		return usageError("queue must be given")
+	}
+
+	jq, err := c.backend.Jobs().GetQueue(ctx, c.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dead, err := jq.DeadLetters(ctx, *n)
+	if err != nil {
+		return err
+	}
+
+	c.Printf("Dead jobs in %s:\n", jq.Name())
+	for _, job := range dead {
+		c.Printf("  %s (%s): died %s after %d attempts: %s\n",
+			job.ID, job.Type, job.DeadLettered, job.AttemptsMade, job.FailureReason)
+	}
+	return nil
+}
+
+type inspectJob struct{}
+
+func (inspectJob) usage() string { return "usage: inspect-job QUEUE JOB-ID" }
+
+func (inspectJob) run(ctx scope.Context, c *console, args []string) error {
+	if len(args) < 2 {
+		return usageError("queue and job id must be given")
+	}
+
+	jq, err := c.backend.Jobs().GetQueue(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	var jobID snowflake.Snowflake
+	if err := jobID.FromString(args[1]); err != nil {
+		return err
+	}
+
+	return jobs.Inspect(ctx, jq, jobID, c)
+}
+
+type requeueJob struct{}
+
+func (requeueJob) usage() string { return "usage: requeue-job [-attempts <n>] QUEUE JOB-ID..." }
+
+func (requeueJob) run(ctx scope.Context, c *console, args []string) error {
+	attempts := c.Int("attempts", 1, "number of attempts to give each job")
+
+	if err := c.Parse(args); err != nil {
+		return err
+	}
+
+	if len(c.Args()) < 2 {
+		return usageError("queue and one or more job ids must be given")
+	}
+
+	if *attempts < 1 {
+		return usageError("-attempts must be positive")
+	}
+
+	return forEachJob(ctx, c, c.Args(), func(jq jobs.JobQueue, jobID snowflake.Snowflake) error {
+		if err := jq.Requeue(ctx, jobID, int32(*attempts)); err != nil {
+			return err
+		}
+		c.Printf("Requeued job %s with %d attempts\n", jobID, *attempts)
+		return nil
+	})
+}
+
+type purgeJob struct{}
+
+func (purgeJob) usage() string { return "usage: purge-job QUEUE JOB-ID..." }
+
+func (purgeJob) run(ctx scope.Context, c *console, args []string) error {
+	if len(args) < 2 {
+		return usageError("queue and one or more job ids must be given")
+	}
+
+	return forEachJob(ctx, c, args, func(jq jobs.JobQueue, jobID snowflake.Snowflake) error {
+		if err := jq.Purge(ctx, jobID); err != nil {
+			return err
+		}
+		c.Printf("Purged job %s\n", jobID)
+		return nil
+	})
+}
+
+func forEachJob(
+	ctx scope.Context, c *console, args []string, f func(jobs.JobQueue, snowflake.Snowflake) error) error {
+
+	jq, err := c.backend.Jobs().GetQueue(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args[1:] {
+		var jobID snowflake.Snowflake
+		if err := jobID.FromString(arg); err != nil {
+			return fmt.Errorf("%s: %s", arg, err)
+		}
+		if err := f(jq, jobID); err != nil {
+			return fmt.Errorf("%s: %s", arg, err)
+		}
+	}
+	return nil
+}
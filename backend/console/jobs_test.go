@@ -0,0 +1,78 @@
+package console
+
+import (
+	"testing"
+
+	"euphoria.io/heim/backend/mock"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeadJobs(t *testing.T) {
+	ctx := scope.New()
+	kms := security.LocalKMS()
+	kms.SetMasterKey(make([]byte, security.AES256.KeySize()))
+
+	Convey("List, inspect, requeue, and purge dead jobs", t, func() {
+		ctrl := &Controller{
+			backend: &mock.TestBackend{},
+			kms:     kms,
+		}
+
+		jq, err := ctrl.backend.Jobs().GetQueue(ctx, jobs.EmailQueue)
+		So(err, ShouldBeNil)
+
+		fail := func() *jobs.Job {
+			job, err := jq.TryClaim(ctx, "test")
+			So(err, ShouldBeNil)
+			job.Write([]byte("sending email\n"))
+			So(job.Fail(ctx, "smtp unavailable"), ShouldBeNil)
+			return job
+		}
+
+		_, err = jq.Add(ctx, jobs.EmailJobType, &jobs.EmailJob{EmailID: "verification"},
+			jobs.JobOptions.MaxAttempts(1), jobs.JobOptions.Backoff(0))
+		So(err, ShouldBeNil)
+		job := fail()
+		jobID := job.ID.String()
+
+		term := &testTerm{}
+		runCommand(ctx, ctrl, "list-dead-jobs", term, []string{jobs.EmailQueue})
+		So(term.String(), ShouldContainSubstring, jobID+" (email)")
+		So(term.String(), ShouldContainSubstring, "smtp unavailable")
+
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "inspect-job", term, []string{jobs.EmailQueue, jobID})
+		So(term.String(), ShouldContainSubstring, "dead since")
+		So(term.String(), ShouldContainSubstring, `"EmailID":"verification"`)
+		So(term.String(), ShouldContainSubstring, "by test failed: smtp unavailable")
+		So(term.String(), ShouldContainSubstring, "sending email")
+
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "requeue-job", term, []string{"-attempts", "2", jobs.EmailQueue, jobID})
+		So(term.String(), ShouldEqual, "Requeued job "+jobID+" with 2 attempts\r\n")
+
+		requeued, err := jq.Get(ctx, job.ID)
+		So(err, ShouldBeNil)
+		So(requeued.AttemptsMade, ShouldEqual, 0)
+		So(requeued.AttemptsRemaining, ShouldEqual, 2)
+		So(requeued.DeadLettered.IsZero(), ShouldBeTrue)
+
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "purge-job", term, []string{jobs.EmailQueue, jobID})
+		So(term.String(), ShouldEqual, "error: "+jobID+": job not found\r\n")
+
+		fail()
+		fail()
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "purge-job", term, []string{jobs.EmailQueue, jobID})
+		So(term.String(), ShouldEqual, "Purged job "+jobID+"\r\n")
+
+		term = &testTerm{}
+		runCommand(ctx, ctrl, "list-dead-jobs", term, []string{jobs.EmailQueue})
+		So(term.String(), ShouldEqual, "Dead jobs in emails:\r\n")
+	})
+}
@@ -1,11 +1,14 @@
 package backend
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"encoding/hex"
 	"encoding/json"
@@ -41,12 +44,29 @@ func (s *Server) route() {
 	s.r.HandleFunc("/room/{prefix:(pm:)?}{room:[a-z0-9]+}/ws", instrumentSocketHandlerFunc("ws", s.handleRoom))
 	s.r.Handle(
 		"/room/{prefix:(pm:)?}{room:[a-z0-9]+}/", prometheus.InstrumentHandlerFunc("room_static", s.handleRoomStatic))
+	s.r.Handle(
+		"/room/{room:[a-z0-9]+}/invite/{code:[a-f0-9]+}",
+		prometheus.InstrumentHandlerFunc("room_invite", s.handleRoomInvite))
+
+	s.r.Handle(
+		"/login/oidc/{provider:[a-z0-9-]+}", prometheus.InstrumentHandlerFunc("loginOIDC", s.handleOIDCLogin))
+	s.r.Handle(
+		"/login/oidc/{provider:[a-z0-9-]+}/callback",
+		prometheus.InstrumentHandlerFunc("loginOIDCCallback", s.handleOIDCCallback))
 
 	s.r.Handle(
 		"/prefs/reset-password",
 		prometheus.InstrumentHandlerFunc("prefsResetPassword", s.handlePrefsResetPassword))
 	s.r.Handle(
 		"/prefs/verify", prometheus.InstrumentHandlerFunc("prefsVerify", s.handlePrefsVerify))
+	s.r.Handle(
+		"/prefs/data-export/{id:[a-f0-9]+}",
+		prometheus.InstrumentHandlerFunc("prefsDataExport", s.handlePrefsDataExport))
+	s.r.Handle(
+		"/prefs/emails", prometheus.InstrumentHandlerFunc("prefsEmails", s.handlePrefsEmails))
+	s.r.Handle(
+		"/prefs/emails/unsubscribe",
+		prometheus.InstrumentHandlerFunc("prefsEmailsUnsubscribe", s.handlePrefsEmailsUnsubscribe))
 }
 
 func (s *Server) handleProbe(w http.ResponseWriter, r *http.Request) {
@@ -101,6 +121,51 @@ func (s *Server) handleRoomStatic(w http.ResponseWriter, r *http.Request) {
 	s.servePage("room.html", params, w, r)
 }
 
+func (s *Server) handleRoomInvite(w http.ResponseWriter, r *http.Request) {
+	ctx := s.rootCtx.Fork()
+
+	roomName := mux.Vars(r)["room"]
+	code := mux.Vars(r)["code"]
+	room, err := s.b.GetRoom(ctx, roomName)
+	if err != nil {
+		if err == proto.ErrRoomNotFound {
+			s.serveErrorPage("room not found", http.StatusNotFound, w, r)
+		} else {
+			s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		}
+		return
+	}
+
+	mkey, err := room.MessageKey(ctx)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+	if mkey == nil {
+		s.serveErrorPage("invite not found", http.StatusNotFound, w, r)
+		return
+	}
+
+	invite, err := mkey.LookupInvite(ctx, code)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+	if invite == nil {
+		s.serveErrorPage("invite not found", http.StatusNotFound, w, r)
+		return
+	}
+	if err := invite.Check(time.Now()); err != nil {
+		s.serveErrorPage(err.Error(), http.StatusGone, w, r)
+		return
+	}
+
+	// The invite is redeemed by the client with the auth command. Pass the code
+	// along in the fragment so it isn't sent back to the server or leaked via
+	// referrers.
+	http.Redirect(w, r, fmt.Sprintf("/room/%s/#invite=%s", roomName, code), http.StatusFound)
+}
+
 func (s *Server) handleHomeStatic(w http.ResponseWriter, r *http.Request) {
 	s.serveGzippedFile(w, r, "/pages/home.html", false)
 }
@@ -217,6 +282,14 @@ func (s *Server) serveRoomWebsocket(
 		}
 	}
 
+	// Note where logged in agents connect from, so the account owner can review them.
+	if client.Account != nil {
+		err := s.b.AgentTracker().RecordConnection(ctx, client.Agent.IDString(), client.IP, client.UserAgent)
+		if err != nil {
+			logging.Logger(ctx).Printf("error recording agent connection: %s", err)
+		}
+	}
+
 	// Serve the session.
 	session := newSession(ctx, s, conn, clientAddress, room, client, agentKey)
 	if err = session.serve(); err != nil {
@@ -282,7 +355,7 @@ func (s *Server) handlePrefsVerifyPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := s.rootCtx.Fork()
-	account, err := s.b.AccountManager().Resolve(ctx, "email", email)
+	account, err := s.b.AccountManager().ResolveUnverified(ctx, "email", email)
 	if err != nil {
 		status := http.StatusInternalServerError
 		if err == proto.ErrAccountNotFound {
@@ -301,7 +374,7 @@ func (s *Server) handlePrefsVerifyPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.b.AccountManager().VerifyPersonalIdentity(ctx, "email", email); err != nil {
+	if err := s.heim.VerifyEmail(ctx, s.b, account, email); err != nil {
 		reply(err, http.StatusInternalServerError)
 		return
 	}
@@ -381,3 +454,157 @@ func (s *Server) handlePrefsResetPasswordPost(w http.ResponseWriter, r *http.Req
 		reply(nil, http.StatusOK)
 	}
 }
+
+func (s *Server) handlePrefsDataExport(w http.ResponseWriter, r *http.Request) {
+	ctx := s.rootCtx.Fork()
+
+	export, err := s.b.AccountData().GetExport(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == proto.ErrAccountDataExportNotFound {
+			s.serveErrorPage("data export not found", http.StatusNotFound, w, r)
+		} else {
+			s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		}
+		return
+	}
+
+	filename := fmt.Sprintf("euphoria-data-%s.zip", export.Created.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, export.Created, bytes.NewReader(export.Data))
+}
+
+func (s *Server) handlePrefsEmails(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.serveErrorPage(err.Error(), http.StatusBadRequest, w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		token := r.Form.Get("token")
+		ctx := s.rootCtx.Fork()
+		account, err := proto.ResolveEmailPreferencesToken(ctx, s.kms, s.b, token)
+		switch err {
+		case nil:
+		case proto.ErrInvalidEmailPreferencesToken:
+			s.serveErrorPage("invalid email preferences link", http.StatusForbidden, w, r)
+			return
+		default:
+			s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+			return
+		}
+
+		prefs, err := s.b.EmailPreferences().Get(ctx, account.ID())
+		if err != nil {
+			s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+			return
+		}
+		email, _ := account.Email()
+		params := map[string]interface{}{
+			"token":       token,
+			"email":       email,
+			"preferences": prefs,
+		}
+		s.serveJSONPage(EmailPreferencesPage, params, w, r)
+	case "POST":
+		s.handlePrefsEmailsPost(w, r)
+	default:
+		s.serveErrorPage("invalid method", http.StatusMethodNotAllowed, w, r)
+	}
+}
+
+func (s *Server) handlePrefsEmailsPost(w http.ResponseWriter, r *http.Request) {
+	reply := func(err error, status int) {
+		data := struct {
+			Error string `json:"error,omitempty"`
+		}{}
+		if err != nil {
+			data.Error = err.Error()
+		}
+		w.WriteHeader(status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+
+	var req struct {
+		Token       string                 `json:"token"`
+		Preferences proto.EmailPreferences `json:"preferences"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		reply(err, http.StatusBadRequest)
+		return
+	}
+
+	ctx := s.rootCtx.Fork()
+	account, err := proto.ResolveEmailPreferencesToken(ctx, s.kms, s.b, req.Token)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == proto.ErrInvalidEmailPreferencesToken {
+			status = http.StatusForbidden
+		}
+		reply(err, status)
+		return
+	}
+
+	if err := s.b.EmailPreferences().Set(ctx, account.ID(), &req.Preferences); err != nil {
+		reply(err, http.StatusInternalServerError)
+		return
+	}
+
+	reply(nil, http.StatusOK)
+}
+
+// handlePrefsEmailsUnsubscribe implements one-click unsubscription from an
+// optional email, as described in RFC 8058. Only POST unsubscribes; a GET
+// (for example, from a link scanner or a user following the link by hand) is
+// redirected to the preferences page.
+func (s *Server) handlePrefsEmailsUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.serveErrorPage(err.Error(), http.StatusBadRequest, w, r)
+		return
+	}
+
+	token := r.Form.Get("token")
+	switch r.Method {
+	case "GET":
+		u := url.URL{
+			Path:     "/prefs/emails",
+			RawQuery: url.Values{"token": []string{token}}.Encode(),
+		}
+		http.Redirect(w, r, u.String(), http.StatusSeeOther)
+		return
+	case "POST":
+	default:
+		s.serveErrorPage("invalid method", http.StatusMethodNotAllowed, w, r)
+		return
+	}
+
+	ctx := s.rootCtx.Fork()
+	account, err := proto.ResolveEmailPreferencesToken(ctx, s.kms, s.b, token)
+	switch err {
+	case nil:
+	case proto.ErrInvalidEmailPreferencesToken:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	prefs, err := s.b.EmailPreferences().Get(ctx, account.ID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !prefs.Unsubscribe(r.Form.Get("email")) {
+		http.Error(w, "email can't be unsubscribed from", http.StatusBadRequest)
+		return
+	}
+	if err := s.b.EmailPreferences().Set(ctx, account.ID(), prefs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "You have been unsubscribed.")
+}
@@ -7,6 +7,7 @@ type memIdentity struct {
 	name      string
 	serverID  string
 	serverEra string
+	verified  bool
 }
 
 func newMemIdentity(id proto.UserID, serverID, serverEra string) *memIdentity {
@@ -28,6 +29,7 @@ func (s *memIdentity) View() proto.IdentityView {
 		Name:      s.name,
 		ServerID:  s.serverID,
 		ServerEra: s.serverEra,
+		Verified:  s.verified,
 	}
 }
 
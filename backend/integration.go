@@ -1,18 +1,29 @@
 package backend
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"html/template"
 	"io/ioutil"
 	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/smtp"
 	"net/url"
 	"sort"
 	"strings"
@@ -27,6 +38,7 @@ import (
 	"euphoria.io/heim/proto/logging"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/heim/templates"
 	"euphoria.io/scope"
 
 	"github.com/gorilla/websocket"
@@ -563,6 +575,12 @@ func IntegrationTest(t *testing.T, factory proto.BackendFactory) {
 		heim.Backend = backend
 		defer heim.Backend.Close()
 
+		// Every test connects from the loopback address, so start each one
+		// without any failed logins counted against it.
+		if err := backend.LoginAttempts().Reset(scope.New(), proto.ClientLoginKey("127.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+
 		// Set up and start server.
 		app, err := NewServer(heim, "test1", "era1")
 		if err != nil {
@@ -607,6 +625,12 @@ func IntegrationTest(t *testing.T, factory proto.BackendFactory) {
 	runTest("Account change password", testAccountChangePassword)
 	runTest("Account reset password", testAccountResetPassword)
 	runTest("Account change name", testAccountChangeName)
+	runTest("Account change locale", testAccountChangeLocale)
+	runTest("Nick reservations", testNickReservations)
+	runTest("Blocks", testBlocks)
+	runTest("Account logins", testAccountLogins)
+	runTest("Login throttling", testLoginThrottle)
+	runTest("Account OIDC", testAccountOIDC)
 	runTest("Room creation", testRoomCreation)
 	runTest("Room grants", testRoomGrants)
 	runTest("Room not found", testRoomNotFound)
@@ -615,10 +639,18 @@ func IntegrationTest(t *testing.T, factory proto.BackendFactory) {
 	runTest("Message truncation", testMessageTruncation)
 	runTest("Bots and humans", testBotsAndHumans)
 	runTest("Staff OTP", testStaffOTP)
+	runTest("Account OTP", testAccountOTP)
+	runTest("Account data", testAccountData)
 	runTest("Staff invasion", testStaffInvasion)
 	runTest("NotifyUser", testNotifyUser)
 	runTest("Account change email", testAccountChangeEmail)
+	runTest("Account identities", testAccountIdentities)
 	runTest("PMs", testPMs)
+	runTest("PM inbox", testPMInbox)
+	runTest("Notifications", testNotifications)
+	runTest("Email preferences", testEmailPreferences)
+	runTest("Email feedback", testEmailFeedback)
+	runTest("Email replies", testEmailReplies)
 }
 
 func testLurker(s *serverUnderTest) {
@@ -764,7 +796,7 @@ func testThreading(s *serverUnderTest) {
 		room, err := s.Room(ctx, kms, true, "threading", owner)
 		So(err, ShouldBeNil)
 		rkey, err := room.MessageKey(ctx)
-		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2"), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2", time.Time{}), ShouldBeNil)
 
 		conn := s.Connect("threading")
 		defer conn.Close()
@@ -949,7 +981,7 @@ func testAuthentication(s *serverUnderTest) {
 	s.once.Do(func() {
 		rkey, err := room.MessageKey(ctx)
 		So(err, ShouldBeNil)
-		So(rkey.GrantToPasscode(ctx, logan, loganKey, "hunter2"), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, logan, loganKey, "hunter2", time.Time{}), ShouldBeNil)
 	})
 
 	Convey("Access denied", func() {
@@ -1260,20 +1292,20 @@ func testManagersLowLevel(s *serverUnderTest) {
 	})
 
 	Convey("Non-manager should be unable to add or remove manager", func() {
-		So(room.AddManager(ctx, kms, carol, carolKey, carol), ShouldEqual, proto.ErrAccessDenied)
+		So(room.AddManager(ctx, kms, carol, carolKey, carol, time.Time{}), ShouldEqual, proto.ErrAccessDenied)
 		So(room.RemoveManager(ctx, carol, carolKey, carol), ShouldEqual, proto.ErrAccessDenied)
 		So(room.RemoveManager(ctx, carol, carolKey, alice), ShouldEqual, proto.ErrAccessDenied)
 	})
 
 	Convey("Manager should be able to add new manager", func() {
-		So(room.AddManager(ctx, kms, alice, aliceKey, carol), ShouldBeNil)
+		So(room.AddManager(ctx, kms, alice, aliceKey, carol, time.Time{}), ShouldBeNil)
 		managers, err := room.Managers(ctx)
 		So(err, ShouldBeNil)
 		So(managers, shouldComprise, "alice", "bob", "carol")
 	})
 
 	Convey("New manager should be able to remove other manager", func() {
-		So(room.AddManager(ctx, kms, bob, bobKey, carol), ShouldBeNil)
+		So(room.AddManager(ctx, kms, bob, bobKey, carol, time.Time{}), ShouldBeNil)
 		So(room.RemoveManager(ctx, carol, carolKey, bob), ShouldBeNil)
 		managers, err := room.Managers(ctx)
 		So(err, ShouldBeNil)
@@ -1286,16 +1318,26 @@ func testManagersLowLevel(s *serverUnderTest) {
 		So(err, ShouldBeNil)
 		So(managers, shouldComprise, "bob")
 
-		So(room.AddManager(ctx, kms, alice, aliceKey, alice), ShouldEqual, proto.ErrAccessDenied)
+		So(room.AddManager(ctx, kms, alice, aliceKey, alice, time.Time{}), ShouldEqual, proto.ErrAccessDenied)
 		So(room.RemoveManager(ctx, alice, aliceKey, bob), ShouldEqual, proto.ErrAccessDenied)
 	})
 
 	Convey("Redundant manager addition should be a no-op", func() {
-		So(room.AddManager(ctx, kms, alice, aliceKey, bob), ShouldBeNil)
+		So(room.AddManager(ctx, kms, alice, aliceKey, bob, time.Time{}), ShouldBeNil)
+		managers, err := room.Managers(ctx)
+		So(err, ShouldBeNil)
+		So(managers, shouldComprise, "alice", "bob")
+		So(room.AddManager(ctx, kms, carol, carolKey, bob, time.Time{}), ShouldEqual, proto.ErrAccessDenied)
+	})
+
+	Convey("Expired manager grants should not be honored", func() {
+		So(room.AddManager(ctx, kms, alice, aliceKey, carol, time.Now().Add(-time.Second)), ShouldBeNil)
 		managers, err := room.Managers(ctx)
 		So(err, ShouldBeNil)
 		So(managers, shouldComprise, "alice", "bob")
-		So(room.AddManager(ctx, kms, carol, carolKey, bob), ShouldEqual, proto.ErrAccessDenied)
+		_, err = room.ManagerCapability(ctx, carol)
+		So(err, ShouldEqual, proto.ErrManagerNotFound)
+		So(room.RemoveManager(ctx, carol, carolKey, bob), ShouldEqual, proto.ErrAccessDenied)
 	})
 
 	Convey("Redundant manager removal should be an error", func() {
@@ -1438,6 +1480,215 @@ func testAccountResetPassword(s *serverUnderTest) {
 	})
 }
 
+func testAccountLogins(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+	So(err, ShouldBeNil)
+
+	login := func(roomName string) (*testConn, string) {
+		conn := s.Connect(roomName)
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		agentID := strings.TrimPrefix(conn.userID, "bot:")
+		conn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		conn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		conn.Close()
+
+		s.Reconnect(conn)
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		return conn, agentID
+	}
+
+	listLogins := func(conn *testConn, id string) map[string]map[string]interface{} {
+		conn.send(id, "list-logins", "")
+		capture := conn.expect(id, "list-logins-reply", `{"logins":"*"}`)
+		logins := map[string]map[string]interface{}{}
+		for _, login := range capture["logins"].([]interface{}) {
+			login := login.(map[string]interface{})
+			logins[login["id"].(string)] = login
+		}
+		return logins
+	}
+
+	Convey("List and revoke logins", func() {
+		anon := s.Connect("logins1")
+		defer anon.Close()
+		anon.expectPing()
+		anon.expectSnapshot(s.backend.Version(), nil, nil)
+		anon.send("1", "list-logins", "")
+		anon.expectError("1", "list-logins-reply", proto.ErrNotLoggedIn.Error())
+
+		laptop, laptopAgentID := login("logins2")
+		defer laptop.Close()
+		phone, phoneAgentID := login("logins3")
+		defer phone.Close()
+
+		logins := listLogins(phone, "1")
+		So(logins, ShouldContainKey, laptopAgentID)
+		So(logins, ShouldContainKey, phoneAgentID)
+		So(logins[laptopAgentID]["ip"], ShouldNotEqual, "")
+		So(logins[laptopAgentID]["last_seen"], ShouldNotBeNil)
+		So(logins[laptopAgentID]["current"], ShouldBeNil)
+		So(logins[phoneAgentID]["current"], ShouldEqual, true)
+
+		// Logins can't be revoked across accounts, or for the current agent.
+		anon.send("2", "revoke-login", `{"agent_id":"%s"}`, laptopAgentID)
+		anon.expectError("2", "revoke-login-reply", proto.ErrNotLoggedIn.Error())
+		phone.send("2", "revoke-login", `{"agent_id":"%s"}`, strings.TrimPrefix(anon.userID, "bot:"))
+		phone.expectError("2", "revoke-login-reply", proto.ErrAgentNotFound.Error())
+		phone.send("3", "revoke-login", `{"agent_id":"%s"}`, phoneAgentID)
+		phone.expectError("3", "revoke-login-reply", "use logout to revoke the current login")
+
+		// Revoking the laptop disconnects it and logs it out.
+		phone.send("4", "revoke-login", `{"agent_id":"%s"}`, laptopAgentID)
+		phone.expect("4", "revoke-login-reply", `{}`)
+		laptop.expect("", "disconnect-event", `{"reason":"authentication changed"}`)
+		laptop.Close()
+
+		laptop.accountID = ""
+		s.Reconnect(laptop)
+		laptop.expectPing()
+		laptop.expectSnapshot(s.backend.Version(), nil, nil)
+		So(laptop.userID, ShouldEqual, "bot:"+laptopAgentID)
+
+		logins = listLogins(phone, "5")
+		So(logins, ShouldNotContainKey, laptopAgentID)
+		So(logins, ShouldContainKey, phoneAgentID)
+	})
+}
+
+func testLoginThrottle(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+	So(err, ShouldBeNil)
+	max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "hunter2")
+	So(err, ShouldBeNil)
+
+	lenient := proto.LoginThrottle{FreeFailures: 100, LockoutFailures: 100, LockoutDuration: time.Hour, Window: time.Hour}
+	strict := proto.LoginThrottle{FreeFailures: 1, LockoutFailures: 3, LockoutDuration: time.Hour, Window: time.Hour}
+
+	connect := func(roomName string) *testConn {
+		So(s.backend.LoginAttempts().Reset(ctx, proto.ClientLoginKey("127.0.0.1")), ShouldBeNil)
+		conn := s.Connect(roomName)
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		return conn
+	}
+
+	Convey("Failed logins to an account back off", func() {
+		s.app.accountLoginThrottle = strict
+		s.app.clientLoginThrottle = lenient
+		conn := connect("throttle1")
+		defer conn.Close()
+
+		conn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"wrongpass"}`, nonce)
+		conn.expect("1", "login-reply", `{"success":false,"reason":"access denied"}`)
+		conn.send("2", "login", `{"namespace":"email","id":"logan%s","password":"wrongpass"}`, nonce)
+		conn.expect("2", "login-reply", `{"success":false,"reason":"access denied"}`)
+
+		// The next attempt must wait, even with the right password.
+		conn.send("3", "login", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		conn.expect("3", "login-reply", `{"success":false,"reason":"too many attempts","retry_after":2}`)
+
+		// Other accounts aren't affected.
+		conn.send("4", "login", `{"namespace":"email","id":"max%s","password":"hunter2"}`, nonce)
+		conn.expect("4", "login-reply", `{"success":true,"account_id":"%s"}`, max.ID())
+	})
+
+	Convey("Enough failed logins lock the account out", func() {
+		s.app.accountLoginThrottle = proto.LoginThrottle{
+			FreeFailures: 3, LockoutFailures: 3, LockoutDuration: time.Hour, Window: time.Hour}
+		s.app.clientLoginThrottle = lenient
+		So(s.backend.LoginAttempts().Reset(ctx, proto.AccountLoginKey(logan)), ShouldBeNil)
+		inbox := s.app.heim.MockDeliverer().Inbox("logan" + nonce)
+		conn := connect("throttle2")
+		defer conn.Close()
+
+		for i := 0; i < 3; i++ {
+			conn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"wrongpass"}`, nonce)
+			conn.expect("1", "login-reply", `{"success":false,"reason":"access denied"}`)
+		}
+		conn.send("2", "login", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		conn.expect("2", "login-reply", `{"success":false,"reason":"too many attempts","retry_after":3600}`)
+
+		// The owner is notified of the lockout.
+		msg := <-inbox
+		So(msg.EmailType, ShouldEqual, proto.LoginLockoutEmail)
+		params, ok := msg.Data.(*proto.LoginLockoutEmailParams)
+		So(ok, ShouldBeTrue)
+		So(params.ClientAddress, ShouldEqual, "127.0.0.1")
+		So(params.LockoutMinutes(), ShouldEqual, 60)
+	})
+
+	Convey("Failed attempts from a client back off across accounts", func() {
+		s.app.accountLoginThrottle = lenient
+		s.app.clientLoginThrottle = strict
+		conn := connect("throttle3")
+		defer conn.Close()
+
+		conn.send("1", "login", `{"namespace":"email","id":"nobody%s","password":"hunter2"}`, nonce)
+		conn.expect("1", "login-reply", `{"success":false,"reason":"account not found"}`)
+		conn.send("2", "login", `{"namespace":"email","id":"logan%s","password":"wrongpass"}`, nonce)
+		conn.expect("2", "login-reply", `{"success":false,"reason":"access denied"}`)
+		conn.send("3", "login", `{"namespace":"email","id":"max%s","password":"hunter2"}`, nonce)
+		conn.expect("3", "login-reply", `{"success":false,"reason":"too many attempts","retry_after":2}`)
+		conn.send("4", "register-account", `{"namespace":"email","id":"new%s","password":"hunter2"}`, nonce)
+		conn.expect("4", "register-account-reply", `{"success":false,"reason":"too many attempts","retry_after":2}`)
+	})
+
+	Convey("Concurrent attempts are each counted before the next is judged", func() {
+		key := proto.ClientLoginKey("concurrent" + nonce)
+		counts := make(chan int, 10)
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			go func() {
+				failures, err := s.backend.LoginAttempts().Attempt(ctx, key, time.Hour)
+				if err != nil {
+					errs <- err
+					return
+				}
+				counts <- failures.Count
+			}()
+		}
+		seen := map[int]bool{}
+		for i := 0; i < 10; i++ {
+			select {
+			case err := <-errs:
+				So(err, ShouldBeNil)
+			case count := <-counts:
+				seen[count] = true
+			}
+		}
+		So(len(seen), ShouldEqual, 10)
+		So(seen[0], ShouldBeTrue)
+		So(seen[9], ShouldBeTrue)
+
+		So(s.backend.LoginAttempts().Forgive(ctx, key), ShouldBeNil)
+		failures, err := s.backend.LoginAttempts().Attempt(ctx, key, time.Hour)
+		So(err, ShouldBeNil)
+		So(failures.Count, ShouldEqual, 9)
+	})
+
+	Convey("Registering taken identities counts as failure", func() {
+		s.app.accountLoginThrottle = lenient
+		s.app.clientLoginThrottle = strict
+		conn := connect("throttle4")
+		defer conn.Close()
+
+		conn.send("1", "register-account", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		conn.expect("1", "register-account-reply", `{"success":false,"reason":"personal identity already in use"}`)
+		conn.send("2", "register-account", `{"namespace":"email","id":"max%s","password":"hunter2"}`, nonce)
+		conn.expect("2", "register-account-reply", `{"success":false,"reason":"personal identity already in use"}`)
+		conn.send("3", "login", `{"namespace":"email","id":"max%s","password":"hunter2"}`, nonce)
+		conn.expect("3", "login-reply", `{"success":false,"reason":"too many attempts","retry_after":2}`)
+	})
+}
+
 func testAccountChangeName(s *serverUnderTest) {
 	ctx := scope.New()
 	kms := s.app.kms
@@ -1470,6 +1721,425 @@ func testAccountChangeName(s *serverUnderTest) {
 	})
 }
 
+func testAccountChangeLocale(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+	So(err, ShouldBeNil)
+
+	Convey("Change locale", func() {
+		conn := s.Connect("changelocale")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "change-locale", `{"locale":"de"}`)
+		conn.expectError("1", "change-locale-reply", "not logged in")
+		conn.send("2", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		conn.expect("2", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		conn.Close()
+
+		s.Reconnect(conn)
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "change-locale", `{"locale":"pt_BR"}`)
+		conn.expect("1", "change-locale-reply", `{"locale":"pt-br"}`)
+		account, err := s.backend.AccountManager().Get(ctx, logan.ID())
+		So(err, ShouldBeNil)
+		So(account.Locale(), ShouldEqual, "pt-br")
+
+		conn.send("2", "change-locale", `{"locale":"not a locale"}`)
+		conn.expectError("2", "change-locale-reply", proto.ErrInvalidLocale.Error())
+
+		conn.send("3", "change-locale", `{"locale":""}`)
+		conn.expect("3", "change-locale-reply", `{"locale":""}`)
+		account, err = s.backend.AccountManager().Get(ctx, logan.ID())
+		So(err, ShouldBeNil)
+		So(account.Locale(), ShouldEqual, "")
+	})
+}
+
+func testNickReservations(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+	So(err, ShouldBeNil)
+
+	Convey("Reserve nicks", func() {
+		// Someone takes the nick before it's reserved.
+		anon := s.Connect("nickreservations2")
+		anon.expectPing()
+		anon.expectSnapshot(s.backend.Version(), nil, nil)
+		anon.send("1", "nick", `{"name":"logan"}`)
+		anon.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"logan"}`)
+		anon.Close()
+
+		conn := s.Connect("nickreservations")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "reserve-nick", `{"name":"logan"}`)
+		conn.expectError("1", "reserve-nick-reply", proto.ErrNotLoggedIn.Error())
+		conn.send("2", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		conn.expect("2", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		conn.Close()
+
+		s.Reconnect(conn)
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// Only accounts with a verified identity may reserve nicks.
+		conn.send("1", "reserve-nick", `{"name":"Logan"}`)
+		conn.expectError("1", "reserve-nick-reply", proto.ErrPersonalIdentityNotVerified.Error())
+		So(s.backend.AccountManager().VerifyPersonalIdentity(ctx, "email", "logan"+nonce), ShouldBeNil)
+
+		conn.send("2", "reserve-nick", `{"name":"  Logan "}`)
+		conn.expect("2", "reserve-nick-reply", `{"nicks":["Logan"]}`)
+		conn.send("3", "reserve-nick", `{"name":"host one"}`)
+		conn.expect("3", "reserve-nick-reply", `{"nicks":["Logan","host one"]}`)
+		conn.send("4", "reserve-nick", `{"name":"host two"}`)
+		conn.expect("4", "reserve-nick-reply", `{"nicks":["Logan","host one","host two"]}`)
+		conn.send("5", "reserve-nick", `{"name":"host three"}`)
+		conn.expectError("5", "reserve-nick-reply", proto.ErrTooManyReservedNicks.Error())
+		conn.send("6", "release-nick", `{"name":"HostTwo"}`)
+		conn.expect("6", "release-nick-reply", `{"nicks":["Logan","host one"]}`)
+		conn.send("7", "release-nick", `{"name":"host three"}`)
+		conn.expectError("7", "release-nick-reply", proto.ErrNickNotReserved.Error())
+		conn.send("8", "list-reserved-nicks", "")
+		conn.expect("8", "list-reserved-nicks-reply", `{"nicks":["Logan","host one"]}`)
+
+		// Logan's messages under a reserved nick are marked as verified.
+		conn.send("9", "nick", `{"name":"LOGAN"}`)
+		conn.expect("9", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"LOGAN"}`)
+		conn.send("10", "send", `{"content":"hi"}`)
+		conn.expect("10", "send-reply",
+			`{"id":"*","time":"*","sender":{"id":"*","name":"LOGAN","server_id":"*","server_era":"*","session_id":"*","verified":true},"content":"hi"}`)
+
+		// The earlier taker of the nick loses it on rejoining, and can't take
+		// it back.
+		delete(anon.nicks, anon.room.ID())
+		s.Reconnect(anon)
+		defer anon.Close()
+		anon.expectPing()
+		anon.expectSnapshot(s.backend.Version(), nil, nil)
+		anon.send("1", "nick", `{"name":"lo gan"}`)
+		anon.expectError("1", "nick-reply", proto.ErrNickReserved.Error())
+		anon.send("2", "nick", `{"name":"host two"}`)
+		anon.expect("2", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host two"}`)
+
+		// Other accounts can't reserve the nick either.
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		So(s.backend.AccountManager().VerifyPersonalIdentity(ctx, "email", "max"+nonce), ShouldBeNil)
+		So(s.backend.NickReservations().Reserve(ctx, max.ID(), "logan"), ShouldEqual, proto.ErrNickReserved)
+	})
+}
+
+func testBlocks(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+	So(err, ShouldBeNil)
+	max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+	So(err, ShouldBeNil)
+
+	login := func(name string, account proto.Account) *testConn {
+		conn := s.Connect("blocksstage")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "login", `{"namespace":"email","id":"%s%s","password":"%spass"}`, name, nonce, name)
+		conn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, account.ID())
+		conn.Close()
+		return conn
+	}
+
+	Convey("Blocked users are filtered out", func() {
+		// Max manages the room, so that he may initiate PMs from it.
+		_, err := s.backend.CreateRoom(ctx, kms, false, "blocks", max)
+		So(err, ShouldBeNil)
+
+		loganConn := login("logan", logan)
+		s.Reconnect(loganConn, "blocks")
+		defer loganConn.Close()
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// Logan is also connected to another room.
+		loganElsewhere := login("logan", logan)
+		s.Reconnect(loganElsewhere, "blockselsewhere")
+		loganElsewhere.expectPing()
+		loganElsewhere.expectSnapshot(s.backend.Version(), nil, nil)
+
+		loganConn.send("1", "block-user", `{"user_id":"nobody"}`)
+		loganConn.expectError("1", "block-user-reply", proto.ErrInvalidUserID.Error())
+		loganConn.send("2", "block-user", `{"user_id":"account:%s"}`, logan.ID())
+		loganConn.expectError("2", "block-user-reply", "you can't block yourself")
+		loganConn.send("3", "block-user", `{"user_id":"account:%s"}`, max.ID())
+		loganConn.expect("3", "block-user-reply", `{}`)
+		loganConn.send("4", "list-blocked-users", "")
+		loganConn.expect("4", "list-blocked-users-reply", `{"user_ids":["account:%s"]}`, max.ID())
+
+		// The block is pushed to Logan's other sessions.
+		loganElsewhere.expect("", "block-user-event", `{"user_id":"account:%s"}`, max.ID())
+
+		maxConn := login("max", max)
+		maxConn.isManager = true
+		s.Reconnect(maxConn, "blocks")
+		defer maxConn.Close()
+		maxConn.expectPing()
+		maxConn.expectSnapshot(s.backend.Version(), []string{
+			fmt.Sprintf(
+				`{"session_id":"%s","id":"account:%s","name":"","server_id":"test1","server_era":"era1","client_address":"*"}`,
+				loganConn.sessionID, logan.ID()),
+		}, nil)
+		loganConn.expect("", "join-event",
+			`{"session_id":"%s","id":"account:%s","name":"","server_id":"test1","server_era":"era1","is_manager":true}`,
+			maxConn.sessionID, max.ID())
+
+		// Max's nick changes and messages don't reach Logan, nor may Max PM him.
+		maxConn.send("1", "nick", `{"name":"max"}`)
+		maxConn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"max"}`)
+		maxConn.send("2", "send", `{"content":"hi logan"}`)
+		maxConn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hi logan"}`)
+		maxConn.send("3", "pm-initiate", `{"user_id":"account:%s"}`, logan.ID())
+		maxConn.expectError("3", "pm-initiate-reply", proto.ErrAccessDenied.Error())
+		loganConn.send("5", "ping", `{"time":1}`)
+		loganConn.expect("5", "ping-reply", `{"time":1}`)
+
+		// Logan's other session heard of the block, so it withholds Max too.
+		maxElsewhere := login("max", max)
+		s.Reconnect(maxElsewhere, "blockselsewhere")
+		defer maxElsewhere.Close()
+		maxElsewhere.expectPing()
+		maxElsewhere.expectSnapshot(s.backend.Version(), []string{
+			fmt.Sprintf(
+				`{"session_id":"%s","id":"account:%s","name":"","server_id":"test1","server_era":"era1"}`,
+				loganElsewhere.sessionID, logan.ID()),
+		}, nil)
+		loganElsewhere.expect("", "join-event",
+			`{"session_id":"%s","id":"account:%s","name":"","server_id":"test1","server_era":"era1"}`,
+			maxElsewhere.sessionID, max.ID())
+		maxElsewhere.send("1", "nick", `{"name":"max"}`)
+		maxElsewhere.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"max"}`)
+		maxElsewhere.send("2", "send", `{"content":"hi again"}`)
+		maxElsewhere.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hi again"}`)
+		loganElsewhere.send("1", "ping", `{"time":1}`)
+		loganElsewhere.expect("1", "ping-reply", `{"time":1}`)
+		loganElsewhere.Close()
+
+		// Max's messages are left out of Logan's logs and snapshots.
+		loganConn.send("6", "log", `{"n":10}`)
+		capture := loganConn.expect("6", "log-reply", `{"log":"*"}`)
+		So(capture["log"], ShouldBeEmpty)
+
+		loganLater := login("logan", logan)
+		s.Reconnect(loganLater, "blockselsewhere")
+		defer loganLater.Close()
+		loganLater.expectPing()
+		capture = loganLater.expect("", "snapshot-event",
+			`{"identity":"*","session_id":"*","version":"*","listing":"*","log":"*"}`)
+		So(capture["log"], ShouldBeEmpty)
+
+		// Once unblocked, Max is heard again.
+		loganConn.send("7", "unblock-user", `{"user_id":"account:%s"}`, max.ID())
+		loganConn.expect("7", "unblock-user-reply", `{}`)
+		loganLater.expect("", "unblock-user-event", `{"user_id":"account:%s"}`, max.ID())
+		loganConn.send("8", "unblock-user", `{"user_id":"account:%s"}`, max.ID())
+		loganConn.expectError("8", "unblock-user-reply", proto.ErrUserNotBlocked.Error())
+		maxConn.send("4", "send", `{"content":"hello?"}`)
+		maxConn.expect("4", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello?"}`)
+		loganConn.expect("", "send-event", `{"id":"*","time":"*","sender":"*","content":"hello?"}`)
+	})
+}
+
+func testAccountIdentities(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	mabel, _, err := s.Account(ctx, kms, "email", "mabel"+nonce, "mabelpass")
+	So(err, ShouldBeNil)
+	am := s.backend.AccountManager()
+	So(am.VerifyPersonalIdentity(ctx, "email", "mabel"+nonce), ShouldBeNil)
+
+	login := func(email string) *testConn {
+		counter := time.Now().UnixNano()
+		c := s.Connect(fmt.Sprintf("identitieslogin%d", counter))
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "login", `{"namespace":"email","id":"%s","password":"mabelpass"}`, email)
+		c.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, mabel.ID())
+		c.accountEmailVerified = true
+		a, err := am.Get(ctx, mabel.ID())
+		So(err, ShouldBeNil)
+		c.accountEmail, _ = a.Email()
+		c = s.Reconnect(c, fmt.Sprintf("identities%d", counter))
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		return c
+	}
+
+	// addBackup adds and verifies a backup address.
+	addBackup := func(email string) {
+		inbox := s.app.heim.MockDeliverer().Inbox(email)
+
+		c := login("mabel" + nonce)
+		c.send("1", "add-identity", `{"namespace":"email","id":"%s","password":"mabelpass"}`, email)
+		c.expect("1", "add-identity-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true,"primary":true},`+
+				`{"namespace":"email","id":"%s","verified":false}]}`, nonce, email)
+		c.Close()
+
+		msg := receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.VerificationEmail)
+		p, ok := msg.Data.(*proto.VerificationEmailParams)
+		So(ok, ShouldBeTrue)
+
+		req := struct {
+			Confirmation string `json:"confirmation"`
+			Email        string `json:"email"`
+		}{
+			Confirmation: p.VerificationToken,
+			Email:        email,
+		}
+		reqBytes, err := json.Marshal(req)
+		So(err, ShouldBeNil)
+		resp, err := http.Post(s.server.URL+"/prefs/verify", "application/json", bytes.NewReader(reqBytes))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, 200)
+	}
+
+	Convey("Adding an identity requires the password", func() {
+		c := login("mabel" + nonce)
+		c.send("1", "add-identity", `{"namespace":"email","id":"mabel2%s","password":"wrongpass"}`, nonce)
+		c.expectError("1", "add-identity-reply", "access denied")
+		c.send("2", "add-identity", `{"namespace":"oidc","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expectError("2", "add-identity-reply", "invalid namespace: oidc")
+		c.Close()
+	})
+
+	Convey("Backup addresses don't become primary when verified", func() {
+		addBackup("mabel2" + nonce)
+
+		a, err := am.Get(ctx, mabel.ID())
+		So(err, ShouldBeNil)
+		email, verified := a.Email()
+		So(email, ShouldEqual, "mabel"+nonce)
+		So(verified, ShouldBeTrue)
+
+		c := login("mabel2" + nonce)
+		c.send("2", "list-identities", `{}`)
+		c.expect("2", "list-identities-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true,"primary":true},`+
+				`{"namespace":"email","id":"mabel2%s","verified":true}]}`, nonce, nonce)
+		c.Close()
+	})
+
+	Convey("Unverified backup addresses can't be used to log in", func() {
+		c := login("mabel" + nonce)
+		c.send("1", "add-identity", `{"namespace":"email","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expect("1", "add-identity-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true,"primary":true},`+
+				`{"namespace":"email","id":"mabel2%s","verified":false}]}`, nonce, nonce)
+		c.Close()
+
+		c = s.Connect(fmt.Sprintf("identitiesunverified%d", time.Now().UnixNano()))
+		defer c.Close()
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "login", `{"namespace":"email","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expect("1", "login-reply", `{"success":false,"reason":"account not found"}`)
+	})
+
+	Convey("Unverified backup addresses don't keep their owners out", func() {
+		c := login("mabel" + nonce)
+		c.send("1", "add-identity", `{"namespace":"email","id":"squat%s","password":"mabelpass"}`, nonce)
+		c.expect("1", "add-identity-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true,"primary":true},`+
+				`{"namespace":"email","id":"squat%s","verified":false}]}`, nonce, nonce)
+		c.Close()
+
+		_, err := am.Resolve(ctx, "email", "squat"+nonce)
+		So(err, ShouldEqual, proto.ErrAccountNotFound)
+
+		// The address's owner can still register it, which drops the backup.
+		owner, _, err := s.Account(ctx, kms, "email", "squat"+nonce, "ownerpass")
+		So(err, ShouldBeNil)
+		a, err := am.Resolve(ctx, "email", "squat"+nonce)
+		So(err, ShouldBeNil)
+		So(a.ID(), ShouldEqual, owner.ID())
+
+		c = login("mabel" + nonce)
+		c.send("1", "list-identities", `{}`)
+		c.expect("1", "list-identities-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true,"primary":true}]}`, nonce)
+		c.Close()
+	})
+
+	Convey("Set primary identity", func() {
+		c := login("mabel" + nonce)
+		c.send("1", "add-identity", `{"namespace":"email","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expect("1", "add-identity-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true,"primary":true},`+
+				`{"namespace":"email","id":"mabel2%s","verified":false}]}`, nonce, nonce)
+		c.send("2", "set-primary-identity", `{"namespace":"email","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expectError("2", "set-primary-identity-reply", "personal identity not verified")
+		c.send("3", "set-primary-identity", `{"namespace":"email","id":"mabel3%s","password":"mabelpass"}`, nonce)
+		c.expectError("3", "set-primary-identity-reply", "personal identity not found")
+		c.Close()
+
+		So(am.VerifyPersonalIdentity(ctx, "email", "mabel2"+nonce), ShouldBeNil)
+
+		c = login("mabel" + nonce)
+		c.send("1", "set-primary-identity", `{"namespace":"email","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expect("1", "set-primary-identity-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true},`+
+				`{"namespace":"email","id":"mabel2%s","verified":true,"primary":true}]}`, nonce, nonce)
+		c.Close()
+
+		a, err := am.Get(ctx, mabel.ID())
+		So(err, ShouldBeNil)
+		email, verified := a.Email()
+		So(email, ShouldEqual, "mabel2"+nonce)
+		So(verified, ShouldBeTrue)
+	})
+
+	Convey("Remove identity", func() {
+		addBackup("mabel2" + nonce)
+
+		c := login("mabel" + nonce)
+		c.send("1", "remove-identity", `{"namespace":"email","id":"mabel%s","password":"mabelpass"}`, nonce)
+		c.expectError("1", "remove-identity-reply", "personal identity is primary")
+		c.send("2", "remove-identity", `{"namespace":"email","id":"mabel2%s","password":"wrongpass"}`, nonce)
+		c.expectError("2", "remove-identity-reply", "access denied")
+		c.send("3", "remove-identity", `{"namespace":"email","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expect("3", "remove-identity-reply",
+			`{"identities":[{"namespace":"email","id":"mabel%s","verified":true,"primary":true}]}`, nonce)
+		c.send("4", "remove-identity", `{"namespace":"email","id":"mabel2%s","password":"mabelpass"}`, nonce)
+		c.expectError("4", "remove-identity-reply", "personal identity not found")
+		c.Close()
+
+		_, err := am.Resolve(ctx, "email", "mabel2"+nonce)
+		So(err, ShouldEqual, proto.ErrAccountNotFound)
+	})
+
+	Convey("Password resets can be sent to a backup address", func() {
+		addBackup("mabel2" + nonce)
+		inbox := s.app.heim.MockDeliverer().Inbox("mabel2" + nonce)
+
+		c := s.Connect(fmt.Sprintf("identitiesreset%d", time.Now().UnixNano()))
+		defer c.Close()
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "reset-password", `{"namespace":"email","id":"mabel2%s"}`, nonce)
+		c.expect("1", "reset-password-reply", `{}`)
+
+		msg := receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.PasswordResetEmail)
+	})
+}
+
 func testAccountChangeEmail(s *serverUnderTest) {
 	ctx := scope.New()
 	kms := s.app.kms
@@ -1513,8 +2183,10 @@ func testAccountChangeEmail(s *serverUnderTest) {
 		p, ok := msg.Data.(*proto.VerificationEmailParams)
 		So(ok, ShouldBeTrue)
 
-		// New email should resolve, but not be the primary email until verified.
-		account, err := s.backend.AccountManager().Resolve(ctx, "email", "logan2"+nonce)
+		// New email shouldn't resolve, or be the primary email, until verified.
+		_, err := s.backend.AccountManager().Resolve(ctx, "email", "logan2"+nonce)
+		So(err, ShouldEqual, proto.ErrAccountNotFound)
+		account, err := s.backend.AccountManager().ResolveUnverified(ctx, "email", "logan2"+nonce)
 		So(err, ShouldBeNil)
 		email, verified := account.Email()
 		So(email, ShouldEqual, "logan"+nonce)
@@ -1948,7 +2620,7 @@ func testRoomGrants(s *serverUnderTest) {
 		conn.expect("1", "auth-reply", `{"success":false,"reason":"passcode incorrect"}`)
 	})
 
-	Convey("Grant access to account", func() {
+	Convey("Grant access to invite", func() {
 		b := s.backend
 		ctx := scope.New()
 		kms := s.app.kms
@@ -1957,41 +2629,208 @@ func testRoomGrants(s *serverUnderTest) {
 		nonce := fmt.Sprintf("%s", time.Now())
 		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
 		So(err, ShouldBeNil)
-		_, err = b.CreateRoom(ctx, kms, true, "grants", logan)
-		So(err, ShouldBeNil)
-
-		// Create access account (without access yet).
-		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		_, err = b.CreateRoom(ctx, kms, true, "invitegrants", logan)
 		So(err, ShouldBeNil)
 
 		// Connect and log into manager account in a throwaway room.
-		loganConn := s.Connect("grantsstage")
+		loganConn := s.Connect("invitegrantsstage")
 		loganConn.expectPing()
 		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
 		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
 		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
 		loganConn.Close()
 
-		// Reconnect manager to private room.
+		// Reconnect manager to private room and create a single-use invite.
 		loganConn.accountHasAccess = true
 		loganConn.isManager = true
-		s.Reconnect(loganConn, "grants")
+		s.Reconnect(loganConn, "invitegrants")
+		defer loganConn.Close()
 		loganConn.expectPing()
 		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "create-invite", `{"max_uses":1}`)
+		capture := loganConn.expect("1", "create-invite-reply",
+			`{"id":"*","creator_id":"%s","created":"*","expires":null,"max_uses":1,"uses":0,"code":"*"}`,
+			logan.ID())
+		inviteID := capture["id"].(string)
+		code := capture["code"].(string)
 
-		// Fail to connect with access account.
-		maxConn := s.Connect("grants")
-		maxConn.expectPing()
-		maxConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
-		maxConn.send("1", "login", `{"namespace":"email","id":"max%s","password":"maxpass"}`, nonce)
-		maxConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, max.ID())
-		maxConn.Close()
-		s.Reconnect(maxConn)
-		maxConn.expectPing()
-		maxConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
-		maxConn.Close()
+		// The invite link redirects to the room.
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get(s.server.URL + "/room/invitegrants/invite/" + code)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		So(resp.Header.Get("Location"), ShouldEqual, "/room/invitegrants/#invite="+code)
+
+		// The invite code can't be used as a plain passcode.
+		conn := s.Connect("invitegrants")
+		conn.expectPing()
+		conn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		conn.send("1", "auth", `{"type":"passcode","passcode":"%s"}`, code)
+		conn.expect("1", "auth-reply", `{"success":false,"reason":"passcode incorrect"}`)
+
+		// Authenticate with invite.
+		conn.send("2", "auth", `{"type":"invite","invite":"%s"}`, code)
+		conn.expect("2", "auth-reply", `{"success":true}`)
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.Close()
+
+		// The invite is used up.
+		conn = s.Connect("invitegrants")
+		conn.expectPing()
+		conn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		conn.send("1", "auth", `{"type":"invite","invite":"%s"}`, code)
+		conn.expect("1", "auth-reply", `{"success":false,"reason":"invite has been used up"}`)
+		conn.Close()
+
+		// List and revoke invites.
+		loganConn.expect(
+			"", "join-event", `{"id":"*", "name":"", "server_id":"*","server_era":"*","session_id":"*","client_address":"*"}`)
+		loganConn.expect(
+			"", "part-event", `{"id":"*", "name":"", "server_id":"*","server_era":"*","session_id":"*","client_address":"*"}`)
+		loganConn.send("2", "list-invites", `{}`)
+		loganConn.expect("2", "list-invites-reply",
+			`{"invites":[{"id":"%s","creator_id":"%s","created":"*","expires":null,"max_uses":1,"uses":1}]}`,
+			inviteID, logan.ID())
+		loganConn.send("3", "revoke-invite", `{"id":"%s"}`, inviteID)
+		loganConn.expect("3", "revoke-invite-reply", `{}`)
+		loganConn.send("4", "list-invites", `{}`)
+		loganConn.expect("4", "list-invites-reply", `{"invites":[]}`)
+		loganConn.send("5", "revoke-invite", `{"id":"%s"}`, inviteID)
+		loganConn.expectError("5", "revoke-invite-reply", "invite not found")
+
+		conn = s.Connect("invitegrants")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		conn.send("1", "auth", `{"type":"invite","invite":"%s"}`, code)
+		conn.expect("1", "auth-reply", `{"success":false,"reason":"invite not found"}`)
+	})
+
+	Convey("Redeeming an invite grants access to the account", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create manager and invited accounts and room.
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		_, err = b.CreateRoom(ctx, kms, true, "inviteaccounts", logan)
+		So(err, ShouldBeNil)
+
+		// Log in as the manager and create a single-use invite.
+		loganConn := s.Connect("inviteaccountsstage")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		loganConn.Close()
+
+		loganConn.accountHasAccess = true
+		loganConn.isManager = true
+		s.Reconnect(loganConn, "inviteaccounts")
+		defer loganConn.Close()
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "create-invite", `{"max_uses":1}`)
+		capture := loganConn.expect("1", "create-invite-reply",
+			`{"id":"*","creator_id":"%s","created":"*","expires":null,"max_uses":1,"uses":0,"code":"*"}`,
+			logan.ID())
+		inviteID := capture["id"].(string)
+		code := capture["code"].(string)
+		loganListing := fmt.Sprintf(
+			`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","is_manager":true}`,
+			loganConn.sessionID, loganConn.userID)
+
+		// Log in as the invited account and redeem the invite.
+		maxConn := s.Connect("inviteaccountsstage")
+		maxConn.expectPing()
+		maxConn.expectSnapshot(s.backend.Version(), nil, nil)
+		maxConn.send("1", "login", `{"namespace":"email","id":"max%s","password":"maxpass"}`, nonce)
+		maxConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, max.ID())
+		maxConn.Close()
+
+		s.Reconnect(maxConn, "inviteaccounts")
+		maxConn.expectPing()
+		maxConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		maxConn.send("1", "auth", `{"type":"invite","invite":"%s"}`, code)
+		maxConn.expect("1", "auth-reply", `{"success":true}`)
+		maxConn.expectSnapshot(s.backend.Version(), []string{loganListing}, nil)
+		maxConn.Close()
+
+		// The account keeps access after reconnecting, without using up the
+		// invite again.
+		maxConn.accountHasAccess = true
+		s.Reconnect(maxConn)
+		maxConn.expectPing()
+		maxConn.expectSnapshot(s.backend.Version(), []string{loganListing}, nil)
+		maxConn.Close()
+
+		for i := 0; i < 2; i++ {
+			loganConn.expect("", "join-event",
+				`{"session_id":"*","id":"%s","name":"","server_id":"test1","server_era":"era1","client_address":"*"}`,
+				maxConn.id())
+			loganConn.expect("", "part-event",
+				`{"session_id":"*","id":"%s","name":"","server_id":"test1","server_era":"era1","client_address":"*"}`,
+				maxConn.id())
+		}
+		loganConn.send("2", "list-invites", `{}`)
+		loganConn.expect("2", "list-invites-reply",
+			`{"invites":[{"id":"%s","creator_id":"%s","created":"*","expires":null,"max_uses":1,"uses":1}]}`,
+			inviteID, logan.ID())
+	})
+
+	Convey("Grant access to account", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create manager account and room.
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		_, err = b.CreateRoom(ctx, kms, true, "grants", logan)
+		So(err, ShouldBeNil)
+
+		// Create access account (without access yet).
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+
+		// Connect and log into manager account in a throwaway room.
+		loganConn := s.Connect("grantsstage")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		loganConn.Close()
+
+		// Reconnect manager to private room.
+		loganConn.accountHasAccess = true
+		loganConn.isManager = true
+		s.Reconnect(loganConn, "grants")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// Fail to connect with access account.
+		maxConn := s.Connect("grants")
+		maxConn.expectPing()
+		maxConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		maxConn.send("1", "login", `{"namespace":"email","id":"max%s","password":"maxpass"}`, nonce)
+		maxConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, max.ID())
+		maxConn.Close()
+		s.Reconnect(maxConn)
+		maxConn.expectPing()
+		maxConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		maxConn.Close()
 
 		// Grant access.
+		loganConn.send("1", "grant-access", `{"account_id":"%s","seconds":-1}`, max.ID())
+		loganConn.expectError("1", "grant-access-reply", "seconds must not be negative")
 		loganConn.send("1", "grant-access", `{"account_id":"%s"}`, max.ID())
 		loganConn.expect("1", "grant-access-reply", `{}`)
 
@@ -2026,6 +2865,322 @@ func testRoomGrants(s *serverUnderTest) {
 		maxConn.Close()
 	})
 
+	Convey("Invite by email", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create manager account, room, and an account to invite.
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		_, err = b.CreateRoom(ctx, kms, true, "emailinvites", logan)
+		So(err, ShouldBeNil)
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		maxInbox := s.app.heim.MockDeliverer().Inbox("max" + nonce)
+		newbieInbox := s.app.heim.MockDeliverer().Inbox("newbie" + nonce)
+
+		hasAccess := func(account proto.Account) bool {
+			room, err := b.GetRoom(ctx, "emailinvites")
+			So(err, ShouldBeNil)
+			mkey, err := room.MessageKey(ctx)
+			So(err, ShouldBeNil)
+			capability, err := mkey.AccountCapability(ctx, account)
+			So(err, ShouldBeNil)
+			return capability != nil
+		}
+
+		// Connect and log into manager account in a throwaway room.
+		loganConn := s.Connect("emailinvitesstage")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		loganConn.Close()
+
+		// Reconnect manager to private room.
+		loganConn.accountHasAccess = true
+		loganConn.isManager = true
+		s.Reconnect(loganConn, "emailinvites")
+		defer loganConn.Close()
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// An account that hasn't verified the address is only sent a pending
+		// invite, which it claims by verifying the address.
+		loganConn.send("1", "invite-by-email", `{"email":"max%s"}`, nonce)
+		loganConn.expect("1", "invite-by-email-reply", `{}`)
+		msg := <-maxInbox
+		So(msg.EmailType, ShouldEqual, proto.RoomInvitationWelcomeEmail)
+		pending, err := b.PendingInvites().List(ctx, "emailinvites")
+		So(err, ShouldBeNil)
+		So(len(pending), ShouldEqual, 1)
+		So(pending[0].Email, ShouldEqual, "max"+nonce)
+		So(hasAccess(max), ShouldBeFalse)
+
+		So(s.app.heim.VerifyEmail(ctx, b, max, "max"+nonce), ShouldBeNil)
+		pending, err = b.PendingInvites().List(ctx, "emailinvites")
+		So(err, ShouldBeNil)
+		So(pending, ShouldBeEmpty)
+		So(hasAccess(max), ShouldBeTrue)
+
+		// Invite an existing account that has verified the address.
+		max, err = b.AccountManager().Get(ctx, max.ID())
+		So(err, ShouldBeNil)
+		loganConn.send("1", "invite-by-email", `{"email":"max%s","message":"come on in"}`, nonce)
+		loganConn.expect("1", "invite-by-email-reply", `{}`)
+
+		msg = <-maxInbox
+		So(msg.EmailType, ShouldEqual, proto.RoomInvitationEmail)
+		params, ok := msg.Data.(*proto.RoomInvitationEmailParams)
+		So(ok, ShouldBeTrue)
+		So(params.RoomName, ShouldEqual, "emailinvites")
+		So(params.SenderMessage, ShouldEqual, "come on in")
+
+		// The invited account has access.
+		maxConn := s.Connect("emailinvitesstage")
+		maxConn.expectPing()
+		maxConn.expectSnapshot(s.backend.Version(), nil, nil)
+		maxConn.send("1", "login", `{"namespace":"email","id":"max%s","password":"maxpass"}`, nonce)
+		maxConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, max.ID())
+		maxConn.Close()
+		maxConn.accountHasAccess = true
+		maxConn.accountEmailVerified = true
+		s.Reconnect(maxConn, "emailinvites")
+		maxConn.expectPing()
+		maxConn.expectSnapshot(
+			s.backend.Version(),
+			[]string{
+				fmt.Sprintf(
+					`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","is_manager":true}`,
+					loganConn.sessionID, loganConn.userID)},
+			nil)
+		maxConn.Close()
+		loganConn.expect("", "join-event", `{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","client_address":"*"}`,
+			maxConn.sessionID, maxConn.id())
+		loganConn.expect("", "part-event", `{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","client_address":"*"}`,
+			maxConn.sessionID, maxConn.id())
+
+		// Invite an unregistered address.
+		loganConn.send("2", "invite-by-email", `{"email":"newbie%s"}`, nonce)
+		loganConn.expect("2", "invite-by-email-reply", `{}`)
+
+		msg = <-newbieInbox
+		So(msg.EmailType, ShouldEqual, proto.RoomInvitationWelcomeEmail)
+		welcomeParams, ok := msg.Data.(*proto.RoomInvitationWelcomeEmailParams)
+		So(ok, ShouldBeTrue)
+		So(welcomeParams.RoomName, ShouldEqual, "emailinvites")
+
+		// Pending invites are listed for managers, and expired invites are
+		// left out.
+		stale := &proto.PendingInvite{
+			Room:      "emailinvites",
+			Email:     "stale" + nonce,
+			CreatorID: logan.ID(),
+			Created:   proto.Time(time.Now().Add(-2 * time.Hour)),
+			Expires:   proto.Time(time.Now().Add(-time.Hour)),
+		}
+		So(b.PendingInvites().Add(ctx, stale), ShouldBeNil)
+		loganConn.send("3", "list-email-invites", "")
+		loganConn.expect("3", "list-email-invites-reply",
+			`{"invites":[{"room":"emailinvites","email":"newbie%s","creator_id":"%s","created":"*","expires":"*"}]}`,
+			nonce, logan.ID())
+		pending, err = b.PendingInvites().List(ctx, "emailinvites")
+		So(err, ShouldBeNil)
+		So(len(pending), ShouldEqual, 1)
+		claimed, err := b.PendingInvites().Claim(ctx, "stale"+nonce)
+		So(err, ShouldBeNil)
+		So(claimed, ShouldBeEmpty)
+
+		// Pending invites can be revoked.
+		loganConn.send("4", "invite-by-email", `{"email":"revoked%s","seconds":60}`, nonce)
+		loganConn.expect("4", "invite-by-email-reply", `{}`)
+		loganConn.send("5", "revoke-email-invite", `{"email":"revoked%s"}`, nonce)
+		loganConn.expect("5", "revoke-email-invite-reply", `{}`)
+		loganConn.send("6", "revoke-email-invite", `{"email":"revoked%s"}`, nonce)
+		loganConn.expectError("6", "revoke-email-invite-reply", "invite not found")
+		claimed, err = b.PendingInvites().Claim(ctx, "revoked"+nonce)
+		So(err, ShouldBeNil)
+		So(claimed, ShouldBeEmpty)
+
+		// Registering with the invited address isn't enough to be granted
+		// access.
+		newbieConn := s.Connect("emailinvitesstage")
+		newbieConn.expectPing()
+		newbieConn.expectSnapshot(s.backend.Version(), nil, nil)
+		newbieConn.send("1", "register-account", `{"namespace":"email","id":"newbie%s","password":"newbiepass"}`, nonce)
+		newbieConn.expect("1", "register-account-reply", `{"success":true,"account_id":"*"}`)
+		newbieConn.expect("", "disconnect-event", `{"reason":"authentication changed"}`)
+		newbieConn.Close()
+		s.Reconnect(newbieConn, "emailinvites")
+		newbieConn.expectPing()
+		newbieConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		newbieConn.Close()
+
+		// Access is granted once the address is verified.
+		msg = <-newbieInbox
+		So(msg.EmailType, ShouldEqual, proto.WelcomeEmail)
+		verifyParams, ok := msg.Data.(*proto.WelcomeEmailParams)
+		So(ok, ShouldBeTrue)
+		req := struct {
+			Confirmation string `json:"confirmation"`
+			Email        string `json:"email"`
+		}{
+			Confirmation: verifyParams.VerificationToken,
+			Email:        "newbie" + nonce,
+		}
+		reqBytes, err := json.Marshal(req)
+		So(err, ShouldBeNil)
+		resp, err := http.Post(s.server.URL+"/prefs/verify", "application/json", bytes.NewReader(reqBytes))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, 200)
+
+		newbieConn.accountHasAccess = true
+		newbieConn.accountEmailVerified = true
+		s.Reconnect(newbieConn, "emailinvites")
+		defer newbieConn.Close()
+		newbieConn.expectPing()
+		newbieConn.expectSnapshot(
+			s.backend.Version(),
+			[]string{
+				fmt.Sprintf(
+					`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","is_manager":true}`,
+					loganConn.sessionID, loganConn.userID)},
+			nil)
+
+		// The claimed invite is no longer pending.
+		pending, err = b.PendingInvites().List(ctx, "emailinvites")
+		So(err, ShouldBeNil)
+		So(pending, ShouldBeEmpty)
+	})
+
+	Convey("Request access", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create manager account and room.
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		_, err = b.CreateRoom(ctx, kms, true, "knock", logan)
+		So(err, ShouldBeNil)
+
+		// Create requesting accounts.
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		jim, _, err := s.Account(ctx, kms, "email", "jim"+nonce, "jimpass")
+		So(err, ShouldBeNil)
+
+		// Log each account in from a throwaway room.
+		loganConn := s.Connect("knockstage")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		loganConn.Close()
+
+		maxConn := s.Connect("knockstage")
+		maxConn.expectPing()
+		maxConn.expectSnapshot(s.backend.Version(), nil, nil)
+		maxConn.send("1", "login", `{"namespace":"email","id":"max%s","password":"maxpass"}`, nonce)
+		maxConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, max.ID())
+		maxConn.Close()
+
+		jimConn := s.Connect("knockstage")
+		jimConn.expectPing()
+		jimConn.expectSnapshot(s.backend.Version(), nil, nil)
+		jimConn.send("1", "login", `{"namespace":"email","id":"jim%s","password":"jimpass"}`, nonce)
+		jimConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, jim.ID())
+		jimConn.Close()
+
+		// Requests require an account.
+		anonConn := s.Connect("knock")
+		anonConn.expectPing()
+		anonConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		anonConn.send("1", "request-access", `{"note":"hi"}`)
+		anonConn.expectError("1", "request-access-reply", "not logged in")
+		anonConn.Close()
+
+		// While the manager is away, requests are sent by email.
+		loganInbox := s.app.heim.MockDeliverer().Inbox("logan" + nonce)
+		s.Reconnect(jimConn, "knock")
+		defer jimConn.Close()
+		jimConn.expectPing()
+		jimConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		jimConn.send("1", "request-access", `{"note":"it's jim"}`)
+		jimReq := jimConn.expect("1", "request-access-reply", `{"id":"*"}`)
+
+		msg := <-loganInbox
+		So(msg.EmailType, ShouldEqual, proto.AccessRequestEmail)
+		params, ok := msg.Data.(*proto.AccessRequestEmailParams)
+		So(ok, ShouldBeTrue)
+		So(params.RoomName, ShouldEqual, "knock")
+		So(params.RequesterNote, ShouldEqual, "it's jim")
+
+		// Asking again doesn't email the managers again.
+		jimConn.send("2", "request-access", `{"note":"it's still jim"}`)
+		jimReq = jimConn.expect("2", "request-access-reply", `{"id":"*"}`)
+		sent, err := b.EmailTracker().List(ctx, logan.ID(), 10, time.Time{})
+		So(err, ShouldBeNil)
+		So(len(sent), ShouldEqual, 1)
+
+		// Managers present in the room are notified directly.
+		loganConn.accountHasAccess = true
+		loganConn.isManager = true
+		s.Reconnect(loganConn, "knock")
+		defer loganConn.Close()
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		s.Reconnect(maxConn, "knock")
+		maxConn.expectPing()
+		maxConn.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		maxConn.send("1", "request-access", `{"note":"let me in"}`)
+		maxReq := maxConn.expect("1", "request-access-reply", `{"id":"*"}`)
+		loganConn.expect("", "access-request-event",
+			`{"id":"%s","room":"knock","account":{"id":"%s","name":"*"},"note":"let me in","requested":"*"}`,
+			maxReq["id"], max.ID())
+
+		loganConn.send("1", "list-access-requests", `{}`)
+		loganConn.expect("1", "list-access-requests-reply",
+			`{"requests":[`+
+				`{"id":"%s","room":"knock","account":{"id":"%s","name":"*"},"note":"it's still jim","requested":"*"},`+
+				`{"id":"%s","room":"knock","account":{"id":"%s","name":"*"},"note":"let me in","requested":"*"}]}`,
+			jimReq["id"], jim.ID(), maxReq["id"], max.ID())
+
+		// Deny one request and approve the other.
+		loganConn.send("2", "resolve-access-request", `{"id":"%s","approve":false}`, jimReq["id"])
+		loganConn.expect("2", "resolve-access-request-reply", `{}`)
+		jimConn.expect("", "access-request-resolved-event",
+			`{"id":"%s","room":"knock","approved":false}`, jimReq["id"])
+
+		loganConn.send("3", "resolve-access-request", `{"id":"%s","approve":true}`, maxReq["id"])
+		loganConn.expect("3", "resolve-access-request-reply", `{}`)
+		maxConn.expect("", "access-request-resolved-event",
+			`{"id":"%s","room":"knock","approved":true}`, maxReq["id"])
+
+		loganConn.send("4", "resolve-access-request", `{"id":"%s","approve":true}`, maxReq["id"])
+		loganConn.expectError("4", "resolve-access-request-reply", "access request not found")
+		loganConn.send("5", "list-access-requests", `{}`)
+		loganConn.expect("5", "list-access-requests-reply", `{"requests":[]}`)
+
+		// The approved account can now join.
+		maxConn.Close()
+		maxConn.accountHasAccess = true
+		s.Reconnect(maxConn)
+		maxConn.expectPing()
+		maxConn.expectSnapshot(
+			s.backend.Version(),
+			[]string{
+				fmt.Sprintf(
+					`{"session_id":"%s","id":"%s","name":"","server_id":"test1","server_era":"era1","is_manager":true}`,
+					loganConn.sessionID, loganConn.userID)},
+			nil)
+		maxConn.Close()
+	})
+
 	Convey("Grant manager and revoke access by staff", func() {
 		b := s.backend
 		ctx := scope.New()
@@ -2135,21 +3290,81 @@ func testRoomGrants(s *serverUnderTest) {
 		So(len(managers), ShouldEqual, 1)
 		So(managers[0].ID(), ShouldEqual, max.ID())
 	})
-}
 
-func testRoomNotFound(s *serverUnderTest) {
-	s.app.AllowRoomCreation(false)
-	url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/roomnotfound/ws"
-	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
-	So(err, ShouldNotBeNil)
-	So(resp, ShouldNotBeNil)
-	So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
-}
+	Convey("List access and managers", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
 
-func testKeepAlive(s *serverUnderTest) {
-	Convey("Ping event, reply, and timeout", func() {
-		save := KeepAlive
-		defer func() { KeepAlive = save }()
+		// Create manager account and room.
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "loganpass")
+		So(err, ShouldBeNil)
+		_, err = b.CreateRoom(ctx, kms, true, "listgrants", logan)
+		So(err, ShouldBeNil)
+
+		// Create access account.
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+
+		// Connect and log into manager account in a throwaway room.
+		loganConn := s.Connect("listgrantsstage")
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+		loganConn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"loganpass"}`, nonce)
+		loganConn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+
+		// Listing is only available to managers.
+		loganConn.send("2", "list-access", `{}`)
+		loganConn.expectError("2", "list-access-reply", "access denied")
+		loganConn.send("3", "list-managers", `{}`)
+		loganConn.expectError("3", "list-managers-reply", "access denied")
+		loganConn.Close()
+
+		// Reconnect manager to private room.
+		loganConn.accountHasAccess = true
+		loganConn.isManager = true
+		s.Reconnect(loganConn, "listgrants")
+		defer loganConn.Close()
+		loganConn.expectPing()
+		loganConn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// Only the manager's own grant is listed at first.
+		loganConn.send("1", "list-access", `{}`)
+		loganConn.expect("1", "list-access-reply",
+			`{"account_grants":[{"id":"%s","name":"*","granted":"*"}],"passcode_grants":[]}`, logan.ID())
+
+		// Grant access to an account and a passcode.
+		loganConn.send("2", "grant-access", `{"account_id":"%s","seconds":3600}`, max.ID())
+		loganConn.expect("2", "grant-access-reply", `{}`)
+		loganConn.send("3", "grant-access", `{"passcode":"hunter2"}`)
+		loganConn.expect("3", "grant-access-reply", `{}`)
+
+		loganConn.send("4", "list-access", `{}`)
+		reply := loganConn.expect("4", "list-access-reply",
+			`{"account_grants":[{"id":"%s","name":"*","granted":"*"},{"id":"%s","name":"*","granted":"*","expires":"*"}],`+
+				`"passcode_grants":[{"capability_id":"*","granted":"*"}]}`,
+			logan.ID(), max.ID())
+		So(reply["account_grants[1].expires"], ShouldNotBeNil)
+
+		loganConn.send("5", "list-managers", `{}`)
+		loganConn.expect("5", "list-managers-reply", `{"managers":[{"id":"%s","name":"*"}]}`, logan.ID())
+	})
+}
+
+func testRoomNotFound(s *serverUnderTest) {
+	s.app.AllowRoomCreation(false)
+	url := strings.Replace(s.server.URL, "http:", "ws:", 1) + "/room/roomnotfound/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	So(err, ShouldNotBeNil)
+	So(resp, ShouldNotBeNil)
+	So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+}
+
+func testKeepAlive(s *serverUnderTest) {
+	Convey("Ping event, reply, and timeout", func() {
+		save := KeepAlive
+		defer func() { KeepAlive = save }()
 		KeepAlive = 10 * time.Millisecond
 
 		conn := s.Connect("ping")
@@ -2371,7 +3586,7 @@ func testMessageTruncation(s *serverUnderTest) {
 		room, err := s.Room(ctx, kms, true, "getmessage", owner)
 		So(err, ShouldBeNil)
 		rkey, err := room.MessageKey(ctx)
-		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2"), ShouldBeNil)
+		So(rkey.GrantToPasscode(ctx, owner, ownerKey, "hunter2", time.Time{}), ShouldBeNil)
 
 		conn := s.Connect("getmessage")
 		defer conn.Close()
@@ -2693,6 +3908,245 @@ func testJobsLowLevel(s *serverUnderTest) {
 		So(job.Complete(ctx), ShouldBeNil)
 	})
 
+	Convey("Delayed jobs", func() {
+		jq, err := js.GetQueue(ctx, "delayed")
+		So(err, ShouldBeNil)
+
+		start := time.Now()
+		jt, jp := makeJob()
+		jobID, err := jq.Add(ctx, jt, jp, jobs.JobOptions.Delay(100*time.Millisecond))
+		So(err, ShouldBeNil)
+
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+		_, err = jq.TrySteal(ctx, "test2")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		stats, err := jq.Stats(ctx)
+		So(err, ShouldBeNil)
+		So(stats, ShouldResemble, jobs.JobQueueStats{
+			Waiting: 1,
+			Due:     0,
+			Claimed: 0,
+		})
+
+		// Waiters are woken when the job becomes claimable.
+		job, err := jobs.Claim(ctx, jq, "test", 5*time.Second, 0)
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, jobID)
+		So(time.Now(), ShouldHappenAfter, start.Add(100*time.Millisecond))
+		So(time.Now(), ShouldHappenBefore, start.Add(5*time.Second))
+		So(job.Due, ShouldHappenOnOrAfter, job.RunAt)
+		So(job.Complete(ctx), ShouldBeNil)
+	})
+
+	Convey("Recurring jobs are enqueued once per tick", func() {
+		jq, err := js.GetQueue(ctx, "recurring")
+		So(err, ShouldBeNil)
+
+		jt, jp := makeJob()
+		rj := &jobs.RecurringJob{
+			Name:     fmt.Sprintf("recurring-%d", time.Now().UnixNano()),
+			Schedule: "* * * * *",
+			Queue:    "recurring",
+			Type:     jt,
+			Payload:  jp,
+			Options:  []jobs.JobOption{jobs.JobOptions.MaxAttempts(1)},
+		}
+		tick := time.Now().Truncate(time.Minute)
+
+		jobID, err := js.AddRecurring(ctx, rj, tick)
+		So(err, ShouldBeNil)
+		_, err = js.AddRecurring(ctx, rj, tick)
+		So(err, ShouldEqual, jobs.ErrJobAlreadyScheduled)
+		_, err = js.AddRecurring(ctx, rj, tick.Add(-time.Minute))
+		So(err, ShouldEqual, jobs.ErrJobAlreadyScheduled)
+
+		job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, jobID)
+		So(job.Due.Equal(tick), ShouldBeTrue)
+		So(job.AttemptsRemaining, ShouldEqual, 0)
+		So(job.Complete(ctx), ShouldBeNil)
+
+		// Only one of several concurrent schedulers enqueues the next tick.
+		tick = tick.Add(time.Minute)
+		results := make(chan error)
+		for i := 0; i < 5; i++ {
+			go func() {
+				_, err := js.AddRecurring(ctx, rj, tick)
+				results <- err
+			}()
+		}
+		added := 0
+		for i := 0; i < 5; i++ {
+			switch err := <-results; err {
+			case nil:
+				added++
+			default:
+				So(err, ShouldEqual, jobs.ErrJobAlreadyScheduled)
+			}
+		}
+		So(added, ShouldEqual, 1)
+
+		job, err = jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		So(job.Due.Equal(tick), ShouldBeTrue)
+		So(job.Complete(ctx), ShouldBeNil)
+	})
+
+	Convey("Failed jobs back off exponentially", func() {
+		jq, err := js.GetQueue(ctx, "backoff")
+		So(err, ShouldBeNil)
+
+		jt, jp := makeJob()
+		jobID, err := jq.Add(ctx, jt, jp,
+			jobs.JobOptions.MaxAttempts(3),
+			jobs.JobOptions.Backoff(100*time.Millisecond))
+		So(err, ShouldBeNil)
+
+		job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, jobID)
+
+		// Each retry waits twice as long as the last.
+		for _, backoff := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+			So(job.Fail(ctx, "error"), ShouldBeNil)
+			failed := time.Now()
+
+			_, err = jq.TryClaim(ctx, "test")
+			So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+			job, err = jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+			So(err, ShouldBeNil)
+			So(job.ID, ShouldEqual, jobID)
+			So(time.Now(), ShouldHappenOnOrAfter, failed.Add(backoff))
+		}
+		So(job.Complete(ctx), ShouldBeNil)
+	})
+
+	Convey("Jobs of higher priority are claimed first", func() {
+		jq, err := js.GetQueue(ctx, "priorities")
+		So(err, ShouldBeNil)
+
+		jt, jp := makeJob()
+		lowJobID, err := jq.Add(ctx, jt, jp, jobs.JobOptions.Due(time.Now().Add(-time.Hour)))
+		So(err, ShouldBeNil)
+		jt, jp = makeJob()
+		highJobID, err := jq.Add(ctx, jt, jp, jobs.JobOptions.Priority(10))
+		So(err, ShouldBeNil)
+		jt, jp = makeJob()
+		midJobID, err := jq.Add(ctx, jt, jp, jobs.JobOptions.Priority(5))
+		So(err, ShouldBeNil)
+
+		for _, jobID := range []snowflake.Snowflake{highJobID, midJobID, lowJobID} {
+			job, err := jq.TryClaim(ctx, "test")
+			So(err, ShouldBeNil)
+			So(job.ID, ShouldEqual, jobID)
+			So(job.Complete(ctx), ShouldBeNil)
+		}
+	})
+
+	Convey("Jobs that fail their final attempt are dead-lettered", func() {
+		jq, err := js.GetQueue(ctx, "dead letters")
+		So(err, ShouldBeNil)
+
+		jt, jp := makeJob()
+		jobID, err := jq.Add(ctx, jt, jp, jobs.JobOptions.MaxAttempts(2), jobs.JobOptions.Backoff(0))
+		So(err, ShouldBeNil)
+
+		for _, reason := range []string{"first", "final"} {
+			job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+			So(err, ShouldBeNil)
+			So(job.ID, ShouldEqual, jobID)
+			So(job.Fail(ctx, reason), ShouldBeNil)
+		}
+
+		_, err = jq.TryClaim(ctx, "test")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+		_, err = jq.TrySteal(ctx, "test2")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		stats, err := jq.Stats(ctx)
+		So(err, ShouldBeNil)
+		So(stats, ShouldResemble, jobs.JobQueueStats{Dead: 1})
+
+		dead, err := jq.DeadLetters(ctx, 10)
+		So(err, ShouldBeNil)
+		So(len(dead), ShouldEqual, 1)
+		So(dead[0].ID, ShouldEqual, jobID)
+		So(dead[0].FailureReason, ShouldEqual, "final")
+		So(dead[0].DeadLettered.IsZero(), ShouldBeFalse)
+
+		job, err := jq.Get(ctx, jobID)
+		So(err, ShouldBeNil)
+		So(job.FailureReason, ShouldEqual, "final")
+
+		// Only dead jobs can be requeued or purged.
+		jt, jp = makeJob()
+		liveJobID, err := jq.Add(ctx, jt, jp)
+		So(err, ShouldBeNil)
+		So(jq.Requeue(ctx, liveJobID, 1), ShouldEqual, jobs.ErrJobNotFound)
+		So(jq.Purge(ctx, liveJobID), ShouldEqual, jobs.ErrJobNotFound)
+		So(jq.Cancel(ctx, liveJobID), ShouldBeNil)
+
+		// A requeued job can be claimed again.
+		So(jq.Requeue(ctx, jobID, 1), ShouldBeNil)
+		So(jq.Requeue(ctx, jobID, 1), ShouldEqual, jobs.ErrJobNotFound)
+		dead, err = jq.DeadLetters(ctx, 10)
+		So(err, ShouldBeNil)
+		So(len(dead), ShouldEqual, 0)
+		job, err = jq.Get(ctx, jobID)
+		So(err, ShouldBeNil)
+		So(job.AttemptsMade, ShouldEqual, 0)
+		So(job.AttemptsRemaining, ShouldEqual, 1)
+
+		job, err = jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, jobID)
+		So(job.AttemptsRemaining, ShouldEqual, 0)
+		So(job.Fail(ctx, "again"), ShouldBeNil)
+
+		// A purged job is gone for good.
+		dead, err = jq.DeadLetters(ctx, 10)
+		So(err, ShouldBeNil)
+		So(len(dead), ShouldEqual, 1)
+		So(dead[0].FailureReason, ShouldEqual, "again")
+		So(jq.Purge(ctx, jobID), ShouldBeNil)
+		So(jq.Purge(ctx, jobID), ShouldEqual, jobs.ErrJobNotFound)
+		_, err = jq.Get(ctx, jobID)
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		stats, err = jq.Stats(ctx)
+		So(err, ShouldBeNil)
+		So(stats, ShouldResemble, jobs.JobQueueStats{})
+	})
+
+	Convey("Expired claims on the final attempt are dead-lettered instead of stolen", func() {
+		jq, err := js.GetQueue(ctx, "expired final attempts")
+		So(err, ShouldBeNil)
+
+		jt, jp := makeJob()
+		jobID, err := jq.Add(ctx, jt, jp,
+			jobs.JobOptions.MaxWorkDuration(0),
+			jobs.JobOptions.MaxAttempts(1))
+		So(err, ShouldBeNil)
+
+		job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		So(job.ID, ShouldEqual, jobID)
+
+		_, err = jq.TrySteal(ctx, "test2")
+		So(err, ShouldEqual, jobs.ErrJobNotFound)
+
+		dead, err := jq.DeadLetters(ctx, 10)
+		So(err, ShouldBeNil)
+		So(len(dead), ShouldEqual, 1)
+		So(dead[0].ID, ShouldEqual, jobID)
+		So(dead[0].AttemptsRemaining, ShouldEqual, 0)
+		So(jq.Purge(ctx, jobID), ShouldBeNil)
+	})
+
 	Convey("Stats", func() {
 		jq, err := js.GetQueue(ctx, "stats")
 		So(err, ShouldBeNil)
@@ -2885,7 +4339,9 @@ func testEmailsLowLevel(s *serverUnderTest) {
 	}
 
 	sendEmail := func(templateName string) *emails.EmailRef {
-		ref, err := et.Send(ctx, js, nil, deliverer, account, "", templateName, nil)
+		msgID, err := proto.EmailMessageID(kms, account, deliverer.LocalName())
+		So(err, ShouldBeNil)
+		ref, err := et.Send(ctx, js, nil, deliverer, account, msgID, "", templateName, nil)
 		So(err, ShouldBeNil)
 		return normalizeRef(ref)
 	}
@@ -3016,85 +4472,353 @@ func testStaffOTP(s *serverUnderTest) {
 	})
 }
 
-func testStaffInvasion(s *serverUnderTest) {
-	Convey("Staff can use OTP to invade room", func() {
-		b := s.backend
-		ctx := scope.New()
-		kms := s.app.kms
-		nonce := fmt.Sprintf("%s", time.Now())
+func testAccountOTP(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+	So(err, ShouldBeNil)
 
-		// Create host account and log into it.
-		host, _, err := s.Account(ctx, kms, "email", "host"+nonce, "password")
-		So(err, ShouldBeNil)
-		c1 := s.Connect("staffinvasionlogin1")
-		c1.expectPing()
-		c1.expectSnapshot(s.backend.Version(), nil, nil)
-		c1.send("1", "login", `{"namespace":"email","id":"host%s","password":"password"}`, nonce)
-		c1.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, host.ID())
+	login := func(id, otp string) *testConn {
+		conn := s.Connect("accountotplogin")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send(id, "login", `{"namespace":"email","id":"logan%s","password":"hunter2","otp":"%s"}`, nonce, otp)
+		return conn
+	}
+
+	Convey("Enroll, log in, and disable", func() {
+		c1 := login("1", "")
+		c1.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
 		c1.Close()
 
-		// Create private room, join, and say something.
-		_, err = b.CreateRoom(ctx, kms, true, "staffinvasion", host)
-		So(err, ShouldBeNil)
-		c1.accountHasAccess = true
-		c1.isManager = true
-		c1 = s.Reconnect(c1, "staffinvasion")
+		c1 = s.Reconnect(c1, "accountotp")
+		defer c1.Close()
 		c1.expectPing()
 		c1.expectSnapshot(s.backend.Version(), nil, nil)
-		c1.send("1", "nick", `{"name":"host"}`)
-		c1.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host"}`)
-		c1.send("2", "send", `{"content":"hi"}`)
-		id := `{"session_id":"*","id":"*","name":"host","server_id":"*","server_era":"*","is_manager":true,"client_address":"*"}`
-		capture := c1.expect("2", "send-reply", `{"id":"*","time":"*","sender":%s,"content":"*","encryption_key_id":"*"}`, id)
-		msg := fmt.Sprintf(`{"id":"%s","time":%f,"sender":%s,"content":"hi","encryption_key_id":"%s"}`,
-			capture["id"], capture["time"], id, capture["encryption_key_id"])
 
-		// Create staff account and log into it.
-		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
-		So(err, ShouldBeNil)
-		So(b.AccountManager().GrantStaff(ctx, logan.ID(), s.kms.KMSCredential()), ShouldBeNil)
-		c2 := s.Connect("staffinvasionlogin2")
-		c2.expectPing()
-		c2.expectSnapshot(s.backend.Version(), nil, nil)
-		c2.send("1", "login", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		c1.send("1", "validate-otp", `{"password":"000000"}`)
+		c1.expectError("1", "validate-otp-reply", proto.ErrOTPNotEnrolled.Error())
+		c1.send("2", "enroll-otp", ``)
+		capture := c1.expect("2", "enroll-otp-reply", `{"uri":"*","qr_uri":"*"}`)
+		uri := capture["uri"].(string)
+
+		// Enrollment isn't required at login until validated.
+		c2 := login("1", "")
 		c2.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
 		c2.Close()
 
-		// Bust into private room and read history.
-		c2.isStaff = true
-		c2 = s.Reconnect(c2, "staffinvasion")
-		c2.expectPing()
-		c2.expect("", "bounce-event", `{"reason":"authentication required"}`)
-		c2.send("2", "staff-enroll-otp", ``)
-		capture = c2.expect("2", "staff-enroll-otp-reply", `{"uri":"*","qr_uri":"*"}`)
-		c2.send("3", "staff-invade", `{"password":"%s"}`, oneTimePassword(capture["uri"].(string)))
-		c2.expect("3", "staff-invade-reply", `{}`)
-		id = `{"session_id":"*","id":"*","name":"host","server_id":"*","server_era":"*","is_manager":true,"client_address":"*","real_client_address":"*"}`
-		c2.expectSnapshot(s.backend.Version(), []string{id}, []string{msg})
-		c1.expect("", "join-event",
-			`{"session_id":"%s","id":"*","name":"","server_id":"*","server_era":"*","is_staff":true,"is_manager":true,"client_address":"*"}`, c2.sessionID)
+		c1.send("3", "validate-otp", `{"password":"%s"}`, oneTimePassword(uri))
+		capture = c1.expect("3", "validate-otp-reply", `{"recovery_codes":"*"}`)
+		codes := capture["recovery_codes"].([]interface{})
+		So(len(codes), ShouldEqual, proto.OTPRecoveryCodeCount)
+		recoveryCode := codes[0].(string)
+
+		c1.send("4", "validate-otp", `{"password":"%s"}`, oneTimePassword(uri))
+		c1.expectError("4", "validate-otp-reply", proto.ErrOTPAlreadyEnrolled.Error())
+
+		// Login now requires a valid one-time password.
+		c2 = login("1", "")
+		c2.expect("1", "login-reply", `{"success":false,"reason":"otp required","otp_required":true}`)
+		c2.send("2", "login", `{"namespace":"email","id":"logan%s","password":"hunter2","otp":"000000"}`, nonce)
+		c2.expect("2", "login-reply", `{"success":false,"reason":"invalid otp","otp_required":true}`)
+		c2.send("3", "login", `{"namespace":"email","id":"logan%s","password":"wrongpass","otp":"%s"}`,
+			nonce, oneTimePassword(uri))
+		c2.expect("3", "login-reply", `{"success":false,"reason":"access denied"}`)
+		c2.send("4", "login", `{"namespace":"email","id":"logan%s","password":"hunter2","otp":"%s"}`,
+			nonce, oneTimePassword(uri))
+		c2.expect("4", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c2.Close()
+
+		// A recovery code may be used once in place of a one-time password.
+		c2 = login("1", strings.ToUpper(recoveryCode))
+		c2.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c2.Close()
+		c2 = login("1", recoveryCode)
+		c2.expect("1", "login-reply", `{"success":false,"reason":"invalid otp","otp_required":true}`)
+		c2.Close()
+
+		// Disable.
+		c1.send("5", "disable-otp", `{"password":"wrongpass","otp":"%s"}`, oneTimePassword(uri))
+		c1.expectError("5", "disable-otp-reply", proto.ErrAccessDenied.Error())
+		c1.send("6", "disable-otp", `{"password":"hunter2","otp":"000000"}`)
+		c1.expectError("6", "disable-otp-reply", proto.ErrAccessDenied.Error())
+		c1.send("7", "disable-otp", `{"password":"hunter2","otp":"%s"}`, codes[1].(string))
+		c1.expect("7", "disable-otp-reply", `{}`)
+
+		c2 = login("1", "")
+		c2.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c2.Close()
 	})
 }
 
-func testNotifyUser(s *serverUnderTest) {
-	Convey("Successful login disconnects all sessions associated with user", func() {
-		ctx := scope.New()
-		kms := s.app.kms
+func testAccountData(s *serverUnderTest) {
+	ctx := scope.New()
+	kms := s.app.kms
+	nonce := fmt.Sprintf("%s", time.Now())
+	logan, loganKey, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+	So(err, ShouldBeNil)
 
-		// Create account
-		nonce := fmt.Sprintf("notify-%s", time.Now())
-		cammie, _, err := s.Account(ctx, kms, "email", "cammie"+nonce, "cammiepass")
+	// Log in, and join a room that logan manages.
+	join := func(roomName string) *testConn {
+		_, err := s.backend.CreateRoom(ctx, kms, false, roomName, logan)
 		So(err, ShouldBeNil)
 
-		// Create an initial connection
-		conn1 := s.Connect("notify1")
-		defer conn1.Close()
-		conn1.expectPing()
-		conn1.expectSnapshot(s.backend.Version(), nil, nil)
+		conn := s.Connect(roomName + "stage")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "login", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		conn.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		conn.Close()
 
-		// Create a second connection with the same cookie
-		conn2 := conn1.clone()
-		s.Reconnect(conn2, "notify1")
+		conn.isManager = true
+		s.Reconnect(conn, roomName)
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"logan"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"logan"}`)
+		conn.send("2", "send", `{"content":"hello"}`)
+		conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"hello"}`)
+		return conn
+	}
+
+	claim := func(queueName string) interface{} {
+		jq, err := s.backend.Jobs().GetQueue(ctx, queueName)
+		So(err, ShouldBeNil)
+		job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		So(job.Complete(ctx), ShouldBeNil)
+		payload, err := job.Payload()
+		So(err, ShouldBeNil)
+		return payload
+	}
+
+	Convey("Export personal data", func() {
+		s.app.pageTemplater = &templates.Templater{
+			Templates: map[string]*template.Template{
+				"error": template.Must(template.New("error.html").Parse("{{.Message}}")),
+			},
+		}
+		inbox := s.app.heim.MockDeliverer().Inbox("logan" + nonce)
+
+		anon := s.Connect("dataexportanon")
+		defer anon.Close()
+		anon.expectPing()
+		anon.expectSnapshot(s.backend.Version(), nil, nil)
+		anon.send("1", "request-data-export", "")
+		anon.expectError("1", "request-data-export-reply", proto.ErrNotLoggedIn.Error())
+
+		conn := join("dataexport")
+		defer conn.Close()
+		conn.send("3", "request-data-export", "")
+		conn.expect("3", "request-data-export-reply", `{}`)
+
+		payload := claim(jobs.AccountDataExportQueue)
+		So(payload.(*jobs.AccountDataExportJob).AccountID, ShouldEqual, logan.ID())
+		So(s.app.heim.ExportAccountData(ctx, logan.ID()), ShouldBeNil)
+
+		msg := receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.AccountDataExportEmail)
+		params, ok := msg.Data.(*proto.AccountDataExportEmailParams)
+		So(ok, ShouldBeTrue)
+
+		// The export is a zip of JSON files.
+		resp, err := http.Get(s.server.URL + "/prefs/data-export/" + params.ExportID)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Content-Type"), ShouldEqual, "application/zip")
+		data, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		So(err, ShouldBeNil)
+
+		files := map[string][]byte{}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			So(err, ShouldBeNil)
+			files[f.Name], err = ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			r.Close()
+		}
+		So(files, ShouldContainKey, "account.json")
+		So(files, ShouldContainKey, "emails.json")
+
+		var messages []proto.RoomMessage
+		So(json.Unmarshal(files["messages.json"], &messages), ShouldBeNil)
+		So(len(messages), ShouldEqual, 1)
+		So(messages[0].Room, ShouldEqual, "dataexport")
+		So(messages[0].Content, ShouldEqual, "hello")
+
+		var grants []proto.RoomGrant
+		So(json.Unmarshal(files["grants.json"], &grants), ShouldBeNil)
+		So(len(grants), ShouldEqual, 1)
+		So(grants[0].Room, ShouldEqual, "dataexport")
+		So(grants[0].Manager, ShouldBeTrue)
+
+		resp, err = http.Get(s.server.URL + "/prefs/data-export/0123456789abcdef")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Delete account", func() {
+		// Say something before logging in, as an agent.
+		agentConn := s.Connect("accountdeletionagent")
+		agentConn.expectPing()
+		agentConn.expectSnapshot(s.backend.Version(), nil, nil)
+		agentConn.send("1", "nick", `{"name":"logan"}`)
+		agentConn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"logan"}`)
+		agentConn.send("2", "send", `{"content":"before login"}`)
+		agentConn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"before login"}`)
+		agentConn.send("3", "login", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		agentConn.expect("3", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		agentConn.Close()
+
+		conn := join("accountdeletion")
+		defer conn.Close()
+
+		// Open a PM with another account, where logan's nick is kept.
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		room, err := s.backend.GetRoom(ctx, "accountdeletion")
+		So(err, ShouldBeNil)
+		client := &proto.Client{Account: logan, Authorization: proto.Authorization{ClientKey: loganKey}}
+		_, err = s.backend.PMTracker().Initiate(
+			ctx, kms, room, client, proto.UserID(fmt.Sprintf("account:%s", max.ID())))
+		So(err, ShouldBeNil)
+		pms, err := s.backend.PMTracker().List(ctx, max.ID())
+		So(err, ShouldBeNil)
+		So(len(pms), ShouldEqual, 1)
+		So(pms[0].WithNick, ShouldEqual, "logan")
+
+		conn.send("3", "delete-account", `{"password":"wrongpass"}`)
+		conn.expectError("3", "delete-account-reply", proto.ErrAccessDenied.Error())
+		conn.send("4", "delete-account", `{"password":"hunter2"}`)
+		conn.expect("4", "delete-account-reply", `{}`)
+
+		payload := claim(jobs.AccountDeletionQueue)
+		So(payload.(*jobs.AccountDeletionJob).AccountID, ShouldEqual, logan.ID())
+		So(s.app.heim.DeleteAccount(ctx, logan.ID()), ShouldBeNil)
+		conn.expect("", "disconnect-event", `{"reason":"account deleted"}`)
+
+		// The account's identities, grants, nicks, and authorship are gone.
+		_, err = s.backend.AccountManager().Resolve(ctx, "email", "logan"+nonce)
+		So(err, ShouldEqual, proto.ErrAccountNotFound)
+
+		grants, err := s.backend.AccountData().Grants(ctx, logan.ID())
+		So(err, ShouldBeNil)
+		So(grants, ShouldBeEmpty)
+
+		pms, err = s.backend.PMTracker().List(ctx, max.ID())
+		So(err, ShouldBeNil)
+		So(len(pms), ShouldEqual, 1)
+		So(pms[0].WithNick, ShouldEqual, "")
+
+		log, err := room.Latest(ctx, 10, 0)
+		So(err, ShouldBeNil)
+		So(len(log), ShouldEqual, 1)
+		So(log[0].Sender.ID, ShouldEqual, proto.DeletedSenderID)
+		So(log[0].Sender.Name, ShouldEqual, "")
+
+		room, err = s.backend.GetRoom(ctx, "accountdeletionagent")
+		So(err, ShouldBeNil)
+		log, err = room.Latest(ctx, 10, 0)
+		So(err, ShouldBeNil)
+		So(len(log), ShouldEqual, 1)
+		So(log[0].Sender.ID, ShouldEqual, proto.DeletedSenderID)
+		So(log[0].Sender.Name, ShouldEqual, "")
+
+		// The session's agent was logged out.
+		conn.Close()
+		conn.accountID = ""
+		conn.isManager = false
+		s.Reconnect(conn, "accountdeletionstage")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		So(conn.userID, ShouldNotStartWith, "account:")
+	})
+}
+
+func testStaffInvasion(s *serverUnderTest) {
+	Convey("Staff can use OTP to invade room", func() {
+		b := s.backend
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%s", time.Now())
+
+		// Create host account and log into it.
+		host, _, err := s.Account(ctx, kms, "email", "host"+nonce, "password")
+		So(err, ShouldBeNil)
+		c1 := s.Connect("staffinvasionlogin1")
+		c1.expectPing()
+		c1.expectSnapshot(s.backend.Version(), nil, nil)
+		c1.send("1", "login", `{"namespace":"email","id":"host%s","password":"password"}`, nonce)
+		c1.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, host.ID())
+		c1.Close()
+
+		// Create private room, join, and say something.
+		_, err = b.CreateRoom(ctx, kms, true, "staffinvasion", host)
+		So(err, ShouldBeNil)
+		c1.accountHasAccess = true
+		c1.isManager = true
+		c1 = s.Reconnect(c1, "staffinvasion")
+		c1.expectPing()
+		c1.expectSnapshot(s.backend.Version(), nil, nil)
+		c1.send("1", "nick", `{"name":"host"}`)
+		c1.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"host"}`)
+		c1.send("2", "send", `{"content":"hi"}`)
+		id := `{"session_id":"*","id":"*","name":"host","server_id":"*","server_era":"*","is_manager":true,"client_address":"*"}`
+		capture := c1.expect("2", "send-reply", `{"id":"*","time":"*","sender":%s,"content":"*","encryption_key_id":"*"}`, id)
+		msg := fmt.Sprintf(`{"id":"%s","time":%f,"sender":%s,"content":"hi","encryption_key_id":"%s"}`,
+			capture["id"], capture["time"], id, capture["encryption_key_id"])
+
+		// Create staff account and log into it.
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		So(b.AccountManager().GrantStaff(ctx, logan.ID(), s.kms.KMSCredential()), ShouldBeNil)
+		c2 := s.Connect("staffinvasionlogin2")
+		c2.expectPing()
+		c2.expectSnapshot(s.backend.Version(), nil, nil)
+		c2.send("1", "login", `{"namespace":"email","id":"logan%s","password":"hunter2"}`, nonce)
+		c2.expect("1", "login-reply", `{"success":true,"account_id":"%s"}`, logan.ID())
+		c2.Close()
+
+		// Bust into private room and read history.
+		c2.isStaff = true
+		c2 = s.Reconnect(c2, "staffinvasion")
+		c2.expectPing()
+		c2.expect("", "bounce-event", `{"reason":"authentication required"}`)
+		c2.send("2", "staff-enroll-otp", ``)
+		capture = c2.expect("2", "staff-enroll-otp-reply", `{"uri":"*","qr_uri":"*"}`)
+		c2.send("3", "staff-invade", `{"password":"%s"}`, oneTimePassword(capture["uri"].(string)))
+		c2.expect("3", "staff-invade-reply", `{}`)
+		id = `{"session_id":"*","id":"*","name":"host","server_id":"*","server_era":"*","is_manager":true,"client_address":"*","real_client_address":"*"}`
+		c2.expectSnapshot(s.backend.Version(), []string{id}, []string{msg})
+		c1.expect("", "join-event",
+			`{"session_id":"%s","id":"*","name":"","server_id":"*","server_era":"*","is_staff":true,"is_manager":true,"client_address":"*"}`, c2.sessionID)
+	})
+}
+
+func testNotifyUser(s *serverUnderTest) {
+	Convey("Successful login disconnects all sessions associated with user", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+
+		// Create account
+		nonce := fmt.Sprintf("notify-%s", time.Now())
+		cammie, _, err := s.Account(ctx, kms, "email", "cammie"+nonce, "cammiepass")
+		So(err, ShouldBeNil)
+
+		// Create an initial connection
+		conn1 := s.Connect("notify1")
+		defer conn1.Close()
+		conn1.expectPing()
+		conn1.expectSnapshot(s.backend.Version(), nil, nil)
+
+		// Create a second connection with the same cookie
+		conn2 := conn1.clone()
+		s.Reconnect(conn2, "notify1")
 		defer conn2.Close()
 		conn2.expectPing()
 		conn2.expectSnapshot(s.backend.Version(), nil, nil)
@@ -3468,3 +5192,1095 @@ func testPMs(s *serverUnderTest) {
 		c.expect("", "join-event", `{"session_id":"*","id":"account:%s","name":"r","server_id":"*","server_era":"*"}`, bob.ID())
 	})
 }
+
+func testPMInbox(s *serverUnderTest) {
+	Convey("List PMs and catch up on unread ones", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%s", time.Now())
+		alice, _, err := s.Account(ctx, kms, "email", "alice"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		bob, _, err := s.Account(ctx, kms, "email", "bob"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		_, err = s.Room(ctx, kms, false, "pminbox", alice)
+		So(err, ShouldBeNil)
+
+		// Log in bob and establish a nick, then go offline.
+		r := s.Login(nil, "email", "bob"+nonce, "hunter2")
+		r.Close()
+		r = s.Reconnect(r, "pminbox")
+		r.expectPing()
+		r.expectSnapshot(s.backend.Version(), nil, nil)
+		r.send("1", "nick", `{"name":"r"}`)
+		r.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"r"}`)
+		r.send("2", "list-pms", "")
+		r.expect("2", "list-pms-reply", `{"pms":[]}`)
+		r.Close()
+
+		// Log in alice, invite bob to a PM, and send him a message.
+		c := s.Login(nil, "email", "alice"+nonce, "hunter2")
+		c.Close()
+		c.isManager = true
+		c = s.Reconnect(c, "pminbox")
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "nick", `{"name":"c"}`)
+		c.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"c"}`)
+		c.send("2", "pm-initiate", `{"user_id":"%s"}`, r.id())
+		capture := c.expect("2", "pm-initiate-reply", `{"pm_id":"*","to_nick":"r"}`)
+		pmID := capture["pm_id"].(string)
+		roomName := fmt.Sprintf("pm:%s", pmID)
+		c.send("3", "list-pms", "")
+		c.expect("3", "list-pms-reply",
+			`{"pms":[{"pm_id":"%s","with":"account:%s","with_nick":"r","last_message_time":null,"unread":0}]}`,
+			pmID, bob.ID())
+		c.Close()
+
+		c.accountHasAccess = true
+		c.isManager = false
+		c = s.Reconnect(c, roomName)
+		defer c.Close()
+		c.nicks[c.room.ID()] = "c"
+		c.pmNick = "r"
+		c.pmUserID = r.id()
+		c.expectPing()
+		c.expectSnapshot(s.backend.Version(), nil, nil)
+		c.send("1", "send", `{"content":"hello"}`)
+		capture = c.expect("1", "send-reply", `{"id":"*","time":"*","sender":"*","content":"*","encryption_key_id":"*"}`)
+		c.send("2", "list-pms", "")
+		c.expect("2", "list-pms-reply",
+			`{"pms":[{"pm_id":"%s","with":"account:%s","with_nick":"r","last_message_time":"*","unread":0}]}`,
+			pmID, bob.ID())
+
+		// Bob comes back online elsewhere and is reminded of the PM.
+		r = s.Reconnect(r, "pminbox2")
+		r.expectPing()
+		r.expectSnapshot(s.backend.Version(), nil, nil)
+		r.expect("", "pm-initiate-event", `{"from":"account:%s","from_nick":"c","from_room":"","pm_id":"%s"}`,
+			alice.ID(), pmID)
+		r.send("1", "list-pms", "")
+		r.expect("1", "list-pms-reply",
+			`{"pms":[{"pm_id":"%s","with":"account:%s","with_nick":"c","last_message_time":%d,"unread":1}]}`,
+			pmID, alice.ID(), int64(capture["time"].(float64)))
+		r.Close()
+
+		// Joining the PM marks it read.
+		r.accountHasAccess = true
+		r = s.Reconnect(r, roomName)
+		r.nicks[r.room.ID()] = "r"
+		r.pmNick = "c"
+		r.pmUserID = c.id()
+		r.expectPing()
+		id := `{"session_id":"*","id":"*","name":"c","server_id":"*","server_era":"*"}`
+		msg := fmt.Sprintf(`{"id":"%s","time":%f,"sender":%s,"content":"hello","encryption_key_id":"%s"}`,
+			capture["id"], capture["time"], id, capture["encryption_key_id"])
+		r.expectSnapshot(s.backend.Version(), []string{id}, []string{msg})
+		r.send("1", "list-pms", "")
+		r.expect("1", "list-pms-reply",
+			`{"pms":[{"pm_id":"%s","with":"account:%s","with_nick":"c","last_message_time":"*","unread":0}]}`,
+			pmID, alice.ID())
+		c.expect("", "join-event", `{"session_id":"*","id":"account:%s","name":"r","server_id":"*","server_era":"*"}`, bob.ID())
+
+		// Messages delivered while bob is in the PM are read as they arrive.
+		c.send("3", "send", `{"content":"still there?"}`)
+		c.expect("3", "send-reply", `{"id":"*","time":"*","sender":"*","content":"*","encryption_key_id":"*"}`)
+		r.expect("", "send-event", `{"id":"*","time":"*","sender":"*","content":"still there?","encryption_key_id":"*"}`)
+		unread := func() int {
+			summaries, err := s.backend.PMTracker().List(ctx, bob.ID())
+			So(err, ShouldBeNil)
+			So(len(summaries), ShouldEqual, 1)
+			return summaries[0].Unread
+		}
+		for i := 0; i < 100 && unread() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(unread(), ShouldEqual, 0)
+		r.Close()
+		c.expect("", "part-event", `{"session_id":"*","id":"account:%s","name":"r","server_id":"*","server_era":"*"}`, bob.ID())
+
+		// No reminder once the PM has been read.
+		r.accountHasAccess = false
+		r.pmNick = ""
+		r.pmUserID = ""
+		r = s.Reconnect(r, "pminbox3")
+		defer r.Close()
+		r.expectPing()
+		r.expectSnapshot(s.backend.Version(), nil, nil)
+		r.send("1", "list-pms", "")
+		r.expect("1", "list-pms-reply",
+			`{"pms":[{"pm_id":"%s","with":"account:%s","with_nick":"c","last_message_time":"*","unread":0}]}`,
+			pmID, alice.ID())
+	})
+}
+
+func testNotifications(s *serverUnderTest) {
+	Convey("Email offline accounts about mentions", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		So(s.backend.AccountManager().VerifyPersonalIdentity(ctx, "email", "logan"+nonce), ShouldBeNil)
+		So(s.backend.NickReservations().Reserve(ctx, logan.ID(), "Logan"), ShouldBeNil)
+		inbox := s.app.heim.MockDeliverer().Inbox("logan" + nonce)
+		s.app.heim.NotificationDigestWindow = time.Millisecond
+
+		pending := func() []*proto.Notification {
+			notifications, err := s.backend.Notifications().Pending(ctx, logan.ID())
+			So(err, ShouldBeNil)
+			return notifications
+		}
+
+		waitOffline := func() {
+			userID := proto.UserID(fmt.Sprintf("account:%s", logan.ID()))
+			for i := 0; i < 100; i++ {
+				online, err := s.backend.IsUserOnline(ctx, userID)
+				So(err, ShouldBeNil)
+				if !online {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So("account still online", ShouldEqual, "")
+		}
+
+		max := s.Connect("notifications")
+		defer max.Close()
+		max.expectPing()
+		max.expectSnapshot(s.backend.Version(), nil, nil)
+		max.send("1", "nick", `{"name":"max"}`)
+		max.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"max"}`)
+
+		// Mentioning logan while he's offline schedules a digest.
+		max.send("2", "send", `{"content":"hey @logan, @LOGAN!"}`)
+		capture := max.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"*"}`)
+		So(len(pending()), ShouldEqual, 1)
+
+		jq, err := s.backend.Jobs().GetQueue(ctx, jobs.NotificationDigestQueue)
+		So(err, ShouldBeNil)
+		job, err := jobs.Claim(ctx, jq, "test", 10*time.Millisecond, 0)
+		So(err, ShouldBeNil)
+		payload, err := job.Payload()
+		So(err, ShouldBeNil)
+		So(payload.(*jobs.NotificationDigestJob).AccountID, ShouldEqual, logan.ID())
+		So(s.app.heim.SendNotificationDigest(ctx, logan.ID()), ShouldBeNil)
+		So(job.Complete(ctx), ShouldBeNil)
+		msg := receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.NotificationDigestEmail)
+		params, ok := msg.Data.(*proto.NotificationDigestEmailParams)
+		So(ok, ShouldBeTrue)
+		So(len(params.Notifications), ShouldEqual, 1)
+		n := params.Notifications[0]
+		So(n.Kind, ShouldEqual, proto.MentionNotification)
+		So(n.Room, ShouldEqual, "notifications")
+		So(n.MessageID.String(), ShouldEqual, capture["id"])
+		So(n.SenderName, ShouldEqual, "max")
+		So(n.Excerpt, ShouldEqual, "hey @logan, @LOGAN!")
+		So(pending(), ShouldBeEmpty)
+
+		// Mentions aren't recorded while logan is online.
+		conn := s.Login(nil, "email", "logan"+nonce, "hunter2")
+		conn.Close()
+		conn.accountEmailVerified = true
+		s.Reconnect(conn, "notifications")
+		conn.expectPing()
+		id := `{"session_id":"*","id":"*","name":"max","server_id":"*","server_era":"*"}`
+		sent := fmt.Sprintf(`{"id":"%s","time":%f,"sender":%s,"content":"hey @logan, @LOGAN!"}`,
+			capture["id"], capture["time"], id)
+		conn.expectSnapshot(s.backend.Version(), []string{id}, []string{sent})
+		max.expect("", "join-event", `{"session_id":"*","id":"account:%s","name":"","server_id":"*","server_era":"*"}`,
+			logan.ID())
+		max.send("3", "send", `{"content":"@logan ping"}`)
+		max.expect("3", "send-reply", `{"id":"*","time":"*","sender":"*","content":"@logan ping"}`)
+		conn.expect("", "send-event", `{"id":"*","time":"*","sender":"*","content":"@logan ping"}`)
+		So(pending(), ShouldBeEmpty)
+
+		// Logan opts out of mention emails.
+		conn.send("1", "get-email-preferences", "")
+		conn.expect("1", "get-email-preferences-reply",
+			`{"preferences":{"access_requests":true,"invitations":true,"mentions":true,"pms":true}}`)
+		conn.send("2", "set-email-preferences",
+			`{"preferences":{"access_requests":true,"invitations":true,"mentions":false,"pms":true}}`)
+		conn.expect("2", "set-email-preferences-reply", `{}`)
+		conn.send("3", "get-email-preferences", "")
+		conn.expect("3", "get-email-preferences-reply",
+			`{"preferences":{"access_requests":true,"invitations":true,"mentions":false,"pms":true}}`)
+		conn.Close()
+		waitOffline()
+
+		max.expect("", "part-event", `{"session_id":"*","id":"account:%s","name":"","server_id":"*","server_era":"*"}`,
+			logan.ID())
+		max.send("4", "send", `{"content":"@logan ping"}`)
+		max.expect("4", "send-reply", `{"id":"*","time":"*","sender":"*","content":"@logan ping"}`)
+		So(pending(), ShouldBeEmpty)
+
+		anon := s.Connect("notifications2")
+		defer anon.Close()
+		anon.expectPing()
+		anon.expectSnapshot(s.backend.Version(), nil, nil)
+		anon.send("1", "set-email-preferences", `{"preferences":{"mentions":true,"pms":true}}`)
+		anon.expectError("1", "set-email-preferences-reply", proto.ErrNotLoggedIn.Error())
+	})
+
+	Convey("Schedule one digest at a time", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		s.app.heim.NotificationDigestWindow = time.Millisecond
+
+		notify := func() {
+			n := &proto.Notification{
+				AccountID:  logan.ID(),
+				Kind:       proto.MentionNotification,
+				Room:       "digests",
+				SenderName: "max",
+				Excerpt:    "@logan",
+			}
+			So(s.app.heim.Notify(ctx, n), ShouldBeNil)
+		}
+
+		// Claim every digest job that's due, and count the ones for logan.
+		jq, err := s.backend.Jobs().GetQueue(ctx, jobs.NotificationDigestQueue)
+		So(err, ShouldBeNil)
+		scheduled := func() int {
+			time.Sleep(10 * time.Millisecond)
+			count := 0
+			for {
+				job, err := jq.TryClaim(ctx, "test")
+				if err == jobs.ErrJobNotFound {
+					return count
+				}
+				So(err, ShouldBeNil)
+				payload, err := job.Payload()
+				So(err, ShouldBeNil)
+				if payload.(*jobs.NotificationDigestJob).AccountID == logan.ID() {
+					count++
+				}
+				So(job.Complete(ctx), ShouldBeNil)
+			}
+		}
+
+		notify()
+		notify()
+		So(scheduled(), ShouldEqual, 1)
+
+		// A notification that arrives while the digest is being sent
+		// schedules another, though older ones are still pending.
+		So(s.backend.Notifications().ReleaseDigest(ctx, logan.ID()), ShouldBeNil)
+		notify()
+		So(scheduled(), ShouldEqual, 1)
+		notifications, err := s.backend.Notifications().Pending(ctx, logan.ID())
+		So(err, ShouldBeNil)
+		So(len(notifications), ShouldEqual, 3)
+	})
+
+	Convey("Mentions in private rooms only notify accounts with access", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		_, err = s.backend.CreateRoom(ctx, kms, true, "notifyprivate", logan)
+		So(err, ShouldBeNil)
+		max, _, err := s.Account(ctx, kms, "email", "max"+nonce, "maxpass")
+		So(err, ShouldBeNil)
+		maxNick := fmt.Sprintf("max%d", time.Now().UnixNano())
+		So(s.backend.NickReservations().Reserve(ctx, max.ID(), maxNick), ShouldBeNil)
+
+		pending := func() []*proto.Notification {
+			notifications, err := s.backend.Notifications().Pending(ctx, max.ID())
+			So(err, ShouldBeNil)
+			return notifications
+		}
+
+		conn := s.Login(nil, "email", "logan"+nonce, "hunter2")
+		conn.Close()
+		conn.accountHasAccess = true
+		conn.isManager = true
+		s.Reconnect(conn, "notifyprivate")
+		defer conn.Close()
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "nick", `{"name":"keeper"}`)
+		conn.expect("1", "nick-reply", `{"session_id":"*","id":"*","from":"","to":"keeper"}`)
+
+		// Max can't read the room, so mentioning him records nothing.
+		conn.send("2", "send", `{"content":"hey @%s"}`, maxNick)
+		conn.expect("2", "send-reply", `{"id":"*","time":"*","sender":"*","content":"*","encryption_key_id":"*"}`)
+		So(pending(), ShouldBeEmpty)
+
+		// Once Max is granted access, he's notified.
+		conn.send("3", "grant-access", `{"account_id":"%s"}`, max.ID())
+		conn.expect("3", "grant-access-reply", `{}`)
+		conn.send("4", "send", `{"content":"hey @%s"}`, maxNick)
+		conn.expect("4", "send-reply", `{"id":"*","time":"*","sender":"*","content":"*","encryption_key_id":"*"}`)
+		notifications := pending()
+		So(len(notifications), ShouldEqual, 1)
+		So(notifications[0].Kind, ShouldEqual, proto.MentionNotification)
+		So(notifications[0].Excerpt, ShouldEqual, "")
+	})
+}
+
+func testEmailPreferences(s *serverUnderTest) {
+	Convey("Manage email preferences from emailed links", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%s", time.Now())
+		logan, _, err := s.Account(ctx, kms, "email", "logan"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		inbox := s.app.heim.MockDeliverer().Inbox("logan" + nonce)
+		s.app.pageTemplater = &templates.Templater{
+			Templates: map[string]*template.Template{
+				"error":             template.Must(template.New("error.html").Parse("{{.Message}}")),
+				"email-preferences": template.Must(template.New("email-preferences.html").Parse("{{.Data}}")),
+			},
+		}
+
+		prefs := func() proto.EmailPreferences {
+			p, err := s.backend.EmailPreferences().Get(ctx, logan.ID())
+			So(err, ShouldBeNil)
+			return *p
+		}
+
+		// Optional emails carry a preferences link and one-click unsubscribe.
+		params := &proto.AccessRequestEmailParams{
+			CommonEmailParams: proto.DefaultCommonEmailParams,
+			AccountName:       "logan",
+			RoomName:          "emailprefs",
+		}
+		params.SiteURL = s.server.URL
+		_, err = s.app.heim.SendEmail(ctx, s.backend, logan, "", proto.AccessRequestEmail, params)
+		So(err, ShouldBeNil)
+		msg := receiveEmail(inbox)
+		sent := msg.Data.(*proto.AccessRequestEmailParams)
+		token := sent.EmailPreferencesToken
+		So(token, ShouldStartWith, logan.ID().String()+"-")
+		So(string(sent.EmailPreferencesURL()), ShouldEndWith, "/prefs/emails?token="+token)
+		So(sent.UnsubscribeURL(), ShouldEndWith, "/prefs/emails/unsubscribe?email=access-request&token="+token)
+
+		// Other emails don't.
+		changed := &proto.PasswordChangedEmailParams{CommonEmailParams: proto.DefaultCommonEmailParams}
+		_, err = s.app.heim.SendEmail(ctx, s.backend, logan, "", proto.PasswordChangedEmail, changed)
+		So(err, ShouldBeNil)
+		msg = receiveEmail(inbox)
+		So(msg.Data.(*proto.PasswordChangedEmailParams).EmailPreferencesURL(), ShouldEqual, "")
+		So(msg.Data.(*proto.PasswordChangedEmailParams).UnsubscribeURL(), ShouldEqual, "")
+
+		// The preferences page requires a valid token.
+		resp, err := http.Get(s.server.URL + "/prefs/emails?token=" + logan.ID().String() + "-00")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+		resp, err = http.Get(string(sent.EmailPreferencesURL()))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		var page struct {
+			Email       string                 `json:"email"`
+			Token       string                 `json:"token"`
+			Preferences proto.EmailPreferences `json:"preferences"`
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(json.Unmarshal([]byte(html.UnescapeString(string(data))), &page), ShouldBeNil)
+		So(page.Token, ShouldEqual, token)
+		So(page.Preferences, ShouldResemble, proto.DefaultEmailPreferences)
+
+		// Saving the form replaces the preferences.
+		body := fmt.Sprintf(
+			`{"token":"%s","preferences":{"access_requests":true,"invitations":false,"mentions":true,"pms":false}}`,
+			token)
+		resp, err = http.Post(s.server.URL+"/prefs/emails", "application/json", strings.NewReader(body))
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(prefs(), ShouldResemble, proto.EmailPreferences{AccessRequests: true, Mentions: true})
+
+		body = `{"token":"bogus","preferences":{}}`
+		resp, err = http.Post(s.server.URL+"/prefs/emails", "application/json", strings.NewReader(body))
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+
+		// Following the unsubscribe link by hand leads to the preferences page.
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err = client.Get(sent.UnsubscribeURL())
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusSeeOther)
+		So(resp.Header.Get("Location"), ShouldEqual, "/prefs/emails?token="+token)
+		So(prefs().AccessRequests, ShouldBeTrue)
+
+		// A one-click POST unsubscribes.
+		resp, err = http.Post(
+			sent.UnsubscribeURL(), "application/x-www-form-urlencoded",
+			strings.NewReader("List-Unsubscribe=One-Click"))
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(prefs(), ShouldResemble, proto.EmailPreferences{Mentions: true})
+
+		// Opted-out emails aren't sent, but others still are.
+		_, err = s.app.heim.SendEmail(ctx, s.backend, logan, "", proto.AccessRequestEmail, params)
+		So(err, ShouldEqual, proto.ErrEmailOptedOut)
+		_, err = s.app.heim.SendEmail(ctx, s.backend, logan, "", proto.PasswordChangedEmail, changed)
+		So(err, ShouldBeNil)
+		msg = receiveEmail(inbox)
+		So(msg.EmailType, ShouldEqual, proto.PasswordChangedEmail)
+	})
+}
+
+func testEmailFeedback(s *serverUnderTest) {
+	Convey("Bounces suppress further email", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%s", time.Now())
+		addr := "bouncy" + nonce
+		bouncy, _, err := s.Account(ctx, kms, "email", addr, "hunter2")
+		So(err, ShouldBeNil)
+		inbox := s.app.heim.MockDeliverer().Inbox(addr)
+
+		params := &proto.AccessRequestEmailParams{
+			CommonEmailParams: proto.DefaultCommonEmailParams,
+			AccountName:       "bouncy",
+			RoomName:          "bounces",
+		}
+		ref, err := s.app.heim.SendEmail(ctx, s.backend, bouncy, "", proto.AccessRequestEmail, params)
+		So(err, ShouldBeNil)
+		receiveEmail(inbox)
+
+		// Transient failures and unknown emails are ignored.
+		handler := proto.EmailFeedbackHandler(kms, s.backend)
+		dsn := func(messageID, action, status string) *emails.InboundMessage {
+			report := fmt.Sprintf(
+				"Content-Type: multipart/report; report-type=delivery-status; boundary=B\r\n\r\n"+
+					"--B\r\nContent-Type: message/delivery-status\r\n\r\n"+
+					"Reporting-MTA: dns; mx.example.com\r\n\r\n"+
+					"Final-Recipient: rfc822; %s\r\nAction: %s\r\nStatus: %s\r\n\r\n"+
+					"--B\r\nContent-Type: text/rfc822-headers\r\n\r\nMessage-ID: %s\r\n\r\n--B--\r\n",
+				addr, action, status, messageID)
+			return &emails.InboundMessage{Message: []byte(report)}
+		}
+		So(handler(ctx, dsn(ref.ID, "delayed", "4.4.1")), ShouldBeNil)
+		So(handler(ctx, dsn("<unknown@heim.invalid>", "failed", "5.1.1")), ShouldBeNil)
+		So(handler(ctx, &emails.InboundMessage{Message: []byte("Subject: hi\r\n\r\nhello\r\n")}), ShouldBeNil)
+
+		// So are reports about Message-IDs we didn't sign.
+		local := strings.Trim(ref.ID, "<>")
+		local = local[:strings.LastIndex(local, "@")]
+		parts := strings.Split(local, ".")
+		So(parts, ShouldHaveLength, 3)
+		unsigned := fmt.Sprintf("<%s@%s>", parts[0], s.app.heim.EmailDeliverer.LocalName())
+		forged := fmt.Sprintf("<%s.%s.%032x@%s>", parts[0], parts[1], 0, s.app.heim.EmailDeliverer.LocalName())
+		So(handler(ctx, dsn(unsigned, "failed", "5.1.1")), ShouldBeNil)
+		So(handler(ctx, dsn(forged, "failed", "5.1.1")), ShouldBeNil)
+
+		stored, err := s.backend.EmailTracker().Get(ctx, bouncy.ID(), ref.ID)
+		So(err, ShouldBeNil)
+		So(stored.Failed.IsZero(), ShouldBeTrue)
+
+		// A hard bounce marks the email failed and the address undeliverable.
+		So(handler(ctx, dsn(ref.ID, "failed", "5.1.1")), ShouldBeNil)
+		stored, err = s.backend.EmailTracker().Get(ctx, bouncy.ID(), ref.ID)
+		So(err, ShouldBeNil)
+		So(stored.Failed.IsZero(), ShouldBeFalse)
+
+		bouncy, err = s.backend.AccountManager().Get(ctx, bouncy.ID())
+		So(err, ShouldBeNil)
+		So(proto.PersonalIdentityViews(bouncy), ShouldResemble, []proto.PersonalIdentityView{
+			{Namespace: "email", ID: addr, Primary: true, Undeliverable: true},
+		})
+
+		// Further email isn't sent, unless it's needed to fix the address.
+		_, err = s.app.heim.SendEmail(ctx, s.backend, bouncy, "", proto.AccessRequestEmail, params)
+		So(err, ShouldEqual, proto.ErrEmailUndeliverable)
+		changed := &proto.PasswordChangedEmailParams{CommonEmailParams: proto.DefaultCommonEmailParams}
+		_, err = s.app.heim.SendEmail(ctx, s.backend, bouncy, "", proto.PasswordChangedEmail, changed)
+		So(err, ShouldEqual, proto.ErrEmailUndeliverable)
+		verify := &proto.VerificationEmailParams{CommonEmailParams: proto.DefaultCommonEmailParams}
+		_, err = s.app.heim.SendEmail(ctx, s.backend, bouncy, "", proto.VerificationEmail, verify)
+		So(err, ShouldBeNil)
+		So(receiveEmail(inbox).EmailType, ShouldEqual, proto.VerificationEmail)
+
+		// Verifying the address again lifts the suppression.
+		So(s.backend.AccountManager().VerifyPersonalIdentity(ctx, "email", addr), ShouldBeNil)
+		bouncy, err = s.backend.AccountManager().Get(ctx, bouncy.ID())
+		So(err, ShouldBeNil)
+		_, err = s.app.heim.SendEmail(ctx, s.backend, bouncy, "", proto.PasswordChangedEmail, changed)
+		So(err, ShouldBeNil)
+		So(receiveEmail(inbox).EmailType, ShouldEqual, proto.PasswordChangedEmail)
+	})
+
+	Convey("Complaints suppress further email", func() {
+		ctx := scope.New()
+		nonce := fmt.Sprintf("%s", time.Now())
+		addr := "grumpy" + nonce
+		grumpy, _, err := s.Account(ctx, s.app.kms, "email", addr, "hunter2")
+		So(err, ShouldBeNil)
+		inbox := s.app.heim.MockDeliverer().Inbox(addr)
+
+		changed := &proto.PasswordChangedEmailParams{CommonEmailParams: proto.DefaultCommonEmailParams}
+		ref, err := s.app.heim.SendEmail(ctx, s.backend, grumpy, "", proto.PasswordChangedEmail, changed)
+		So(err, ShouldBeNil)
+		receiveEmail(inbox)
+
+		fb := &emails.Feedback{Kind: emails.ComplaintFeedback, MessageID: ref.ID, Permanent: true}
+		So(proto.ProcessEmailFeedback(ctx, s.app.kms, s.backend, fb), ShouldBeNil)
+
+		grumpy, err = s.backend.AccountManager().Get(ctx, grumpy.ID())
+		So(err, ShouldBeNil)
+		_, err = s.app.heim.SendEmail(ctx, s.backend, grumpy, "", proto.PasswordChangedEmail, changed)
+		So(err, ShouldEqual, proto.ErrEmailUndeliverable)
+	})
+}
+
+func testEmailReplies(s *serverUnderTest) {
+	Convey("Replies to notification emails are posted", func() {
+		ctx := scope.New()
+		defer ctx.Cancel()
+		kms := s.app.kms
+		nonce := time.Now().UnixNano()
+		const domain = "reply.heim.invalid"
+
+		email := func(name string) string { return fmt.Sprintf("%s%d@example.com", name, nonce) }
+		verifiedAccount := func(name string) (proto.Account, *security.ManagedKey) {
+			account, clientKey, err := s.Account(ctx, kms, "email", email(name), "hunter2")
+			So(err, ShouldBeNil)
+			So(s.backend.AccountManager().VerifyPersonalIdentity(ctx, "email", email(name)), ShouldBeNil)
+			account, err = s.backend.AccountManager().Get(ctx, account.ID())
+			So(err, ShouldBeNil)
+			return account, clientKey
+		}
+		alice, aliceKey := verifiedAccount("alice")
+		bob, _ := verifiedAccount("bob")
+
+		post := func(room proto.Room, content string) proto.Message {
+			msgID, err := snowflake.New()
+			So(err, ShouldBeNil)
+			msg, err := room.Send(ctx, nil, proto.Message{
+				ID:      msgID,
+				Content: content,
+				Sender:  proto.SessionView{IdentityView: proto.IdentityView{ID: "agent:tester", Name: "tester"}},
+			})
+			So(err, ShouldBeNil)
+			return msg
+		}
+
+		latest := func(room proto.Room) proto.Message {
+			log, err := room.Latest(ctx, 1, 0)
+			So(err, ShouldBeNil)
+			So(len(log), ShouldEqual, 1)
+			return log[0]
+		}
+
+		// Replies are vouched for by the receiving MTA.
+		s.app.heim.EmailReplyAuthServID = "mx.heim.invalid"
+		defer func() { s.app.heim.EmailReplyAuthServID = "" }()
+		authenticatedReply := func(authResults, from, to, text string) *emails.InboundMessage {
+			message := fmt.Sprintf(
+				"Authentication-Results: %s\r\nFrom: %s\r\nTo: %s\r\nSubject: Re: notification\r\n\r\n%s\r\n\r\n"+
+					"On Mon, Jan 1, 2018 at 12:00 AM, heim <%s> wrote:\r\n> you were mentioned\r\n",
+				authResults, from, to, text, to)
+			return &emails.InboundMessage{From: from, To: []string{to}, Message: []byte(message)}
+		}
+		reply := func(from, to, text string) *emails.InboundMessage {
+			return authenticatedReply("mx.heim.invalid; dkim=pass header.d=example.com", from, to, text)
+		}
+
+		rejected := func(err error) bool {
+			_, ok := err.(*emails.RejectedError)
+			return ok
+		}
+
+		handler := proto.EmailReplyHandler(s.app.heim)
+
+		// A reply to a public room is posted in the clear, under the message.
+		public, err := s.Room(ctx, kms, false, "emailreplies")
+		So(err, ShouldBeNil)
+		parent := post(public, "@alice you there?")
+		addr, err := proto.EmailReplyAddress(kms, alice, domain, "emailreplies", parent.ID)
+		So(err, ShouldBeNil)
+		So(addr, ShouldStartWith, proto.EmailReplyPrefix)
+		So(addr, ShouldEndWith, "@"+domain)
+
+		// Replies the MTA couldn't authenticate are rejected, and don't use up
+		// the address.
+		So(rejected(handler(ctx, authenticatedReply(
+			"mx.heim.invalid; dkim=fail header.d=example.com", email("alice"), addr, "yes!"))), ShouldBeTrue)
+		So(rejected(handler(ctx, authenticatedReply(
+			"mx.evil.invalid; dkim=pass header.d=example.com", email("alice"), addr, "yes!"))), ShouldBeTrue)
+		So(latest(public).ID, ShouldEqual, parent.ID)
+
+		So(handler(ctx, reply(email("alice"), addr, "yes!")), ShouldBeNil)
+		msg := latest(public)
+		So(msg.Content, ShouldEqual, "yes!")
+		So(msg.Parent, ShouldEqual, parent.ID)
+		So(msg.EncryptionKeyID, ShouldEqual, "")
+		So(msg.Sender.ID, ShouldEqual, proto.UserID(fmt.Sprintf("account:%s", alice.ID())))
+		So(msg.Sender.Name, ShouldEqual, alice.Name())
+
+		// Replies must come from the account, to an address issued to it.
+		So(rejected(handler(ctx, reply(email("bob"), addr, "imposter"))), ShouldBeTrue)
+		forged := strings.Replace(addr, alice.ID().String(), bob.ID().String(), 1)
+		So(rejected(handler(ctx, reply(email("bob"), forged, "imposter"))), ShouldBeTrue)
+		So(rejected(handler(ctx, reply(email("alice"), addr, ""))), ShouldBeTrue)
+		So(latest(public).ID, ShouldEqual, msg.ID)
+
+		// Each address can only be replied to once.
+		So(rejected(handler(ctx, reply(email("alice"), addr, "yes again!"))), ShouldBeTrue)
+		So(latest(public).ID, ShouldEqual, msg.ID)
+		parent = post(public, "@alice and now?")
+		addr, err = proto.EmailReplyAddress(kms, alice, domain, "emailreplies", parent.ID)
+		So(err, ShouldBeNil)
+		msg = parent
+
+		// Expired addresses are rejected.
+		saved := proto.EmailReplyLifetime
+		proto.EmailReplyLifetime = -time.Minute
+		expired, err := proto.EmailReplyAddress(kms, alice, domain, "emailreplies", parent.ID)
+		proto.EmailReplyLifetime = saved
+		So(err, ShouldBeNil)
+		_, _, _, err = proto.ResolveEmailReplyAddress(ctx, kms, s.backend, expired)
+		So(err, ShouldEqual, proto.ErrEmailReplyExpired)
+		So(rejected(handler(ctx, reply(email("alice"), expired, "too late"))), ShouldBeTrue)
+		So(latest(public).ID, ShouldEqual, msg.ID)
+
+		// Banned accounts can't reply, whether banned from the room or globally.
+		aliceBan := proto.Ban{ID: proto.UserID(fmt.Sprintf("account:%s", alice.ID()))}
+		So(public.Ban(ctx, aliceBan, time.Time{}), ShouldBeNil)
+		So(rejected(handler(ctx, reply(email("alice"), addr, "let me back in"))), ShouldBeTrue)
+		So(public.Unban(ctx, aliceBan), ShouldBeNil)
+		So(s.backend.Ban(ctx, aliceBan, time.Time{}), ShouldBeNil)
+		So(rejected(handler(ctx, reply(email("alice"), addr, "let me back in"))), ShouldBeTrue)
+		So(s.backend.Unban(ctx, aliceBan), ShouldBeNil)
+		So(latest(public).ID, ShouldEqual, msg.ID)
+		So(handler(ctx, reply(email("alice"), addr, "thanks")), ShouldBeNil)
+		msg = latest(public)
+		So(msg.Content, ShouldEqual, "thanks")
+
+		// A reply to a private room is encrypted, and only accepted from
+		// accounts with access.
+		private, err := s.Room(ctx, kms, true, "emailrepliesprivate", alice)
+		So(err, ShouldBeNil)
+		mkey, err := private.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		roomKey := mkey.ManagedKey()
+		So(kms.DecryptKey(&roomKey), ShouldBeNil)
+		parent = post(private, "@alice secret plans")
+
+		addr, err = proto.EmailReplyAddress(kms, bob, domain, "emailrepliesprivate", parent.ID)
+		So(err, ShouldBeNil)
+		So(rejected(handler(ctx, reply(email("bob"), addr, "let me in"))), ShouldBeTrue)
+
+		addr, err = proto.EmailReplyAddress(kms, alice, domain, "emailrepliesprivate", parent.ID)
+		So(err, ShouldBeNil)
+		So(handler(ctx, reply(email("alice"), addr, "count me in")), ShouldBeNil)
+		msg = latest(private)
+		So(msg.EncryptionKeyID, ShouldEqual, "v1/"+mkey.KeyID())
+		So(msg.Content, ShouldNotEqual, "count me in")
+		decrypted, err := proto.DecryptMessage(msg, map[string]*security.ManagedKey{mkey.KeyID(): &roomKey}, proto.General)
+		So(err, ShouldBeNil)
+		So(decrypted.Content, ShouldEqual, "count me in")
+		So(decrypted.Parent, ShouldEqual, parent.ID)
+
+		// A reply to a PM is encrypted with the PM's key, and only accepted
+		// from its participants.
+		client := &proto.Client{Account: alice, Authorization: proto.Authorization{ClientKey: aliceKey}}
+		pmID, err := s.backend.PMTracker().Initiate(
+			ctx, kms, public, client, proto.UserID(fmt.Sprintf("account:%s", bob.ID())))
+		So(err, ShouldBeNil)
+		pmName := fmt.Sprintf("pm:%s", pmID)
+
+		carol, _ := verifiedAccount("carol")
+		addr, err = proto.EmailReplyAddress(kms, carol, domain, pmName, 0)
+		So(err, ShouldBeNil)
+		So(rejected(handler(ctx, reply(email("carol"), addr, "eavesdropping"))), ShouldBeTrue)
+
+		addr, err = proto.EmailReplyAddress(kms, bob, domain, pmName, 0)
+		So(err, ShouldBeNil)
+		So(handler(ctx, reply(email("bob"), addr, "hi alice")), ShouldBeNil)
+		pmRoom, pmKey, err := s.backend.PMTracker().AccountRoom(ctx, kms, pmID, bob)
+		So(err, ShouldBeNil)
+		msg = latest(pmRoom)
+		So(msg.EncryptionKeyID, ShouldEqual, "v1/"+pmName)
+		decrypted, err = proto.DecryptMessage(msg, map[string]*security.ManagedKey{pmName: pmKey}, proto.General)
+		So(err, ShouldBeNil)
+		So(decrypted.Content, ShouldEqual, "hi alice")
+		So(decrypted.Sender.ID, ShouldEqual, proto.UserID(fmt.Sprintf("account:%s", bob.ID())))
+
+		// Replies are accepted over SMTP, and rejections are permanent.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go emails.ServeSMTP(ctx, l, domain, handler)
+
+		parent = latest(public)
+		addr, err = proto.EmailReplyAddress(kms, alice, domain, "emailreplies", parent.ID)
+		So(err, ShouldBeNil)
+		err = smtp.SendMail(l.Addr().String(), nil, email("bob"), []string{addr},
+			reply(email("bob"), addr, "imposter").Message)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "550")
+
+		err = smtp.SendMail(l.Addr().String(), nil, email("alice"), []string{addr},
+			reply(email("alice"), addr, "by smtp").Message)
+		So(err, ShouldBeNil)
+		msg = latest(public)
+		So(msg.Content, ShouldEqual, "by smtp")
+		So(msg.Parent, ShouldEqual, parent.ID)
+
+		// Notification digests carry reply addresses.
+		s.app.heim.EmailReplyDomain = domain
+		defer func() { s.app.heim.EmailReplyDomain = "" }()
+		inbox := s.app.heim.MockDeliverer().Inbox(email("bob"))
+		n := &proto.Notification{
+			AccountID:  bob.ID(),
+			Kind:       proto.MentionNotification,
+			Room:       "emailreplies",
+			MessageID:  msg.ID,
+			SenderName: "alice",
+		}
+		So(s.app.heim.Notify(ctx, n), ShouldBeNil)
+		So(s.app.heim.SendNotificationDigest(ctx, bob.ID()), ShouldBeNil)
+		params := receiveEmail(inbox).Data.(*proto.NotificationDigestEmailParams)
+		So(params.ReplyTo(), ShouldNotEqual, "")
+		So(params.ReplyTo(), ShouldEqual, params.ReplyAddress(params.Notifications[0]))
+		account, room, replyParent, err := proto.ResolveEmailReplyAddress(ctx, kms, s.backend, params.ReplyTo())
+		So(err, ShouldBeNil)
+		So(account.ID(), ShouldEqual, bob.ID())
+		So(room, ShouldEqual, "emailreplies")
+		So(replyParent, ShouldEqual, msg.ID)
+	})
+}
+
+// testOIDCProvider is a minimal stand-in for an OpenID Connect provider. It
+// hands out a code for whichever subject a test authorizes, and redeems it
+// for a signed ID token.
+type testOIDCProvider struct {
+	*httptest.Server
+	clientID string
+	key      *rsa.PrivateKey
+
+	m      sync.Mutex
+	codes  map[string]*oidcClaims
+	emails map[string]string // verified email addresses, by subject
+}
+
+func newTestOIDCProvider(clientID string) *testOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	So(err, ShouldBeNil)
+
+	p := &testOIDCProvider{
+		clientID: clientID,
+		key:      key,
+		codes:    map[string]*oidcClaims{},
+		emails:   map[string]string{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	mux.HandleFunc("/token", p.handleToken)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *testOIDCProvider) authorize(subject, nonce string) string {
+	return p.authorizeFor(subject, nonce, oidcAudience{p.clientID}, "")
+}
+
+// authorizeFor is like authorize, but issues the token to the given audience
+// and authorized party.
+func (p *testOIDCProvider) authorizeFor(subject, nonce string, aud oidcAudience, azp string) string {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	code := fmt.Sprintf("code%d", len(p.codes))
+	p.codes[code] = &oidcClaims{
+		Issuer:          p.URL,
+		Subject:         subject,
+		Audience:        aud,
+		Expires:         time.Now().Add(5 * time.Minute).Unix(),
+		Nonce:           nonce,
+		AuthorizedParty: azp,
+	}
+	if email, ok := p.emails[subject]; ok {
+		p.codes[code].Email = email
+		p.codes[code].EmailVerified = true
+	}
+	return code
+}
+
+func (p *testOIDCProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                p.URL,
+		AuthorizationEndpoint: p.URL + "/authorize",
+		TokenEndpoint:         p.URL + "/token",
+		JWKSURI:               p.URL + "/jwks",
+	})
+}
+
+func (p *testOIDCProvider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"test","n":"%s","e":"%s"}]}`,
+		b64(p.key.N.Bytes()), b64(big.NewInt(int64(p.key.E)).Bytes()))
+}
+
+func (p *testOIDCProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	p.m.Lock()
+	claims, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.m.Unlock()
+
+	if clientID, _, _ := r.BasicAuth(); !ok || clientID != p.clientID {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":"invalid_grant"}`)
+		return
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	claimsJSON, _ := json.Marshal(claims)
+	signed := b64([]byte(`{"alg":"RS256","kid":"test"}`)) + "." + b64(claimsJSON)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, `{"access_token":"x","token_type":"Bearer","id_token":"%s.%s"}`, signed, b64(sig))
+}
+
+func testAccountOIDC(s *serverUnderTest) {
+	provider := newTestOIDCProvider("heim")
+	defer provider.Close()
+
+	cfg := OIDCProviderConfig{
+		Issuer:       provider.URL,
+		ClientID:     "heim",
+		ClientSecret: "secret",
+		RedirectURL:  s.server.URL + "/login/oidc/test/callback",
+	}
+	So(s.app.AddOIDCProvider("test", cfg), ShouldBeNil)
+	s.app.pageTemplater = &templates.Templater{
+		Templates: map[string]*template.Template{
+			"error": template.Must(template.New("error.html").Parse("{{.Message}}")),
+		},
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	get := func(path string, cookies ...*http.Cookie) (*http.Response, string) {
+		req, err := http.NewRequest("GET", s.server.URL+path, nil)
+		So(err, ShouldBeNil)
+		for _, cookie := range cookies {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		resp, err := client.Do(req)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		return resp, string(body)
+	}
+
+	// begin starts a login from the given connection's browser, and returns
+	// the parameters sent to the provider along with the login state cookie.
+	begin := func(conn *testConn, returnPath string) (url.Values, *http.Cookie) {
+		resp, _ := get("/login/oidc/test?return="+url.QueryEscape(returnPath), conn.cookies...)
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		So(err, ShouldBeNil)
+		So(loc.Scheme+"://"+loc.Host+loc.Path, ShouldEqual, provider.URL+"/authorize")
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == oidcCookieName {
+				return loc.Query(), cookie
+			}
+		}
+		So("login state cookie", ShouldEqual, "missing")
+		return nil, nil
+	}
+
+	// finish returns from the provider to the callback with the given code.
+	finish := func(conn *testConn, params url.Values, state *http.Cookie, code string) (*http.Response, string) {
+		vs := url.Values{"code": {code}, "state": {params.Get("state")}}
+		return get("/login/oidc/test/callback?"+vs.Encode(), append(conn.cookies, state)...)
+	}
+
+	Convey("Register and log in through provider", func() {
+		conn := s.Connect("oidc1")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+
+		params, state := begin(conn, "/room/oidc1/")
+		So(params.Get("client_id"), ShouldEqual, "heim")
+		So(params.Get("scope"), ShouldEqual, "openid")
+		So(params.Get("redirect_uri"), ShouldEqual, cfg.RedirectURL)
+
+		// The first login registers an account with a verified identity.
+		resp, _ := finish(conn, params, state, provider.authorize("alice", params.Get("nonce")))
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		So(resp.Header.Get("Location"), ShouldEqual, "/room/oidc1/")
+		capture := conn.expect("", "login-event", `{"account_id":"*"}`)
+		conn.Close()
+
+		account, err := s.backend.AccountManager().Resolve(
+			scope.New(), proto.OIDCNamespace, proto.OIDCIdentity(provider.URL, "alice"))
+		So(err, ShouldBeNil)
+		So(account.ID().String(), ShouldEqual, capture["account_id"])
+		So(account.PersonalIdentities()[0].Verified(), ShouldBeTrue)
+
+		// The agent is logged in, but password-based commands don't apply.
+		conn.accountID = account.ID().String()
+		s.Reconnect(conn, "oidc2")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		conn.send("1", "change-password", `{"old_password":"x","new_password":"hunter22"}`)
+		conn.expectError("1", "change-password-reply", "account logs in through an identity provider")
+		conn.send("2", "enroll-otp", `{}`)
+		conn.expectError("2", "enroll-otp-reply", "account logs in through an identity provider")
+
+		// Commands that would ask for a password need a recent login instead.
+		conn.send("3", "remove-identity", `{"namespace":"email","id":"nobody@example.com","password":""}`)
+		conn.expectError("3", "remove-identity-reply", proto.ErrPersonalIdentityNotFound.Error())
+		s.app.oidcRecentLogin = 0
+		conn.send("4", "remove-identity", `{"namespace":"email","id":"nobody@example.com","password":""}`)
+		conn.expectError("4", "remove-identity-reply", proto.ErrOIDCLoginRequired.Error())
+		conn.send("5", "delete-account", `{"password":""}`)
+		conn.expectError("5", "delete-account-reply", proto.ErrOIDCLoginRequired.Error())
+		s.app.oidcRecentLogin = proto.OIDCRecentLogin
+
+		conn.send("6", "logout", `{}`)
+		conn.expect("6", "logout-reply", `{}`)
+		conn.Close()
+
+		// Logging in again with the same subject finds the same account.
+		conn.accountID = ""
+		s.Reconnect(conn, "oidc3")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		params, state = begin(conn, "//evil.example/")
+		resp, _ = finish(conn, params, state, provider.authorize("alice", params.Get("nonce")))
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		So(resp.Header.Get("Location"), ShouldEqual, "/")
+		conn.expect("", "login-event", `{"account_id":"%s"}`, account.ID())
+		conn.Close()
+
+		// A different subject gets a different account.
+		other := s.Connect("oidc4")
+		other.expectPing()
+		other.expectSnapshot(s.backend.Version(), nil, nil)
+		params, state = begin(other, "/")
+		resp, _ = finish(other, params, state, provider.authorize("bob", params.Get("nonce")))
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		capture = other.expect("", "login-event", `{"account_id":"*"}`)
+		So(capture["account_id"], ShouldNotEqual, account.ID().String())
+		other.Close()
+	})
+
+	Convey("Email addresses verified by the provider claim pending invites", func() {
+		ctx := scope.New()
+		kms := s.app.kms
+		nonce := fmt.Sprintf("%d", time.Now().UnixNano())
+		email := "dana" + nonce + "@example.com"
+
+		manager, _, err := s.Account(ctx, kms, "email", "oidcmanager"+nonce, "hunter2")
+		So(err, ShouldBeNil)
+		room, err := s.backend.CreateRoom(ctx, kms, true, "oidcinvites", manager)
+		So(err, ShouldBeNil)
+		invite := &proto.PendingInvite{
+			Room:      "oidcinvites",
+			Email:     email,
+			CreatorID: manager.ID(),
+			Created:   proto.Now(),
+			Expires:   proto.Time(time.Now().Add(time.Hour)),
+		}
+		So(s.backend.PendingInvites().Add(ctx, invite), ShouldBeNil)
+
+		provider.m.Lock()
+		provider.emails["dana"+nonce] = email
+		provider.m.Unlock()
+
+		conn := s.Connect("oidc6")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		params, state := begin(conn, "/")
+		resp, _ := finish(conn, params, state, provider.authorize("dana"+nonce, params.Get("nonce")))
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		conn.expect("", "login-event", `{"account_id":"*"}`)
+		conn.Close()
+
+		account, err := s.backend.AccountManager().Resolve(
+			ctx, proto.OIDCNamespace, proto.OIDCIdentity(provider.URL, "dana"+nonce))
+		So(err, ShouldBeNil)
+		mkey, err := room.MessageKey(ctx)
+		So(err, ShouldBeNil)
+		capability, err := mkey.AccountCapability(ctx, account)
+		So(err, ShouldBeNil)
+		So(capability, ShouldNotBeNil)
+		pending, err := s.backend.PendingInvites().List(ctx, "oidcinvites")
+		So(err, ShouldBeNil)
+		So(pending, ShouldBeEmpty)
+	})
+
+	Convey("Reject logins that don't check out", func() {
+		conn := s.Connect("oidc5")
+		conn.expectPing()
+		conn.expectSnapshot(s.backend.Version(), nil, nil)
+		defer conn.Close()
+
+		// Unknown provider.
+		resp, _ := get("/login/oidc/nope", conn.cookies...)
+		So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+		// Mismatched state.
+		params, state := begin(conn, "/")
+		params.Set("state", "forged")
+		resp, body := finish(conn, params, state, provider.authorize("carol", params.Get("nonce")))
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		So(body, ShouldEqual, "invalid or expired login attempt")
+
+		// Token issued for a different login attempt.
+		params, state = begin(conn, "/")
+		resp, body = finish(conn, params, state, provider.authorize("carol", "othernonce"))
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		So(body, ShouldEqual, "login failed")
+
+		// Code that the provider never issued.
+		params, state = begin(conn, "/")
+		resp, _ = finish(conn, params, state, "bogus")
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+		// Token shared with other audiences, without naming us as the party
+		// it was issued to.
+		shared := oidcAudience{"heim", "other"}
+		params, state = begin(conn, "/")
+		resp, _ = finish(conn, params, state, provider.authorizeFor("carol", params.Get("nonce"), shared, ""))
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		params, state = begin(conn, "/")
+		resp, _ = finish(conn, params, state, provider.authorizeFor("carol", params.Get("nonce"), shared, "other"))
+		So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+		_, err := s.backend.AccountManager().Resolve(
+			scope.New(), proto.OIDCNamespace, proto.OIDCIdentity(provider.URL, "carol"))
+		So(err, ShouldEqual, proto.ErrAccountNotFound)
+
+		// OIDC identities can't be used with a password.
+		id := proto.OIDCIdentity(provider.URL, "carol")
+		conn.send("1", "register-account", `{"namespace":"oidc","id":"%s","password":"hunter22"}`, id)
+		conn.expect("1", "register-account-reply",
+			`{"success":false,"reason":"oidc identities must register through their provider"}`)
+		conn.send("2", "login", `{"namespace":"oidc","id":"%s","password":"hunter22"}`, id)
+		conn.expect("2", "login-reply",
+			`{"success":false,"reason":"account logs in through an identity provider"}`)
+
+		// A shared token is accepted if it names us as the authorized party.
+		params, state = begin(conn, "/")
+		resp, _ = finish(conn, params, state, provider.authorizeFor("carol", params.Get("nonce"), shared, "heim"))
+		So(resp.StatusCode, ShouldEqual, http.StatusFound)
+		conn.expect("", "login-event", `{"account_id":"*"}`)
+	})
+}
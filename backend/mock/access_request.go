@@ -0,0 +1,103 @@
+package mock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type accessRequests struct {
+	sync.Mutex
+	requests map[string]map[snowflake.Snowflake]*proto.AccessRequest
+	emailed  map[string]map[snowflake.Snowflake]time.Time
+}
+
+func (ars *accessRequests) Add(ctx scope.Context, req *proto.AccessRequest) error {
+	ars.Lock()
+	defer ars.Unlock()
+
+	if ars.requests == nil {
+		ars.requests = map[string]map[snowflake.Snowflake]*proto.AccessRequest{}
+	}
+	byID, ok := ars.requests[req.Room]
+	if !ok {
+		byID = map[snowflake.Snowflake]*proto.AccessRequest{}
+		ars.requests[req.Room] = byID
+	}
+	for id, other := range byID {
+		if other.Account.ID == req.Account.ID {
+			delete(byID, id)
+		}
+	}
+	dup := *req
+	byID[req.ID] = &dup
+	return nil
+}
+
+func (ars *accessRequests) Get(
+	ctx scope.Context, room string, id snowflake.Snowflake) (*proto.AccessRequest, error) {
+
+	ars.Lock()
+	defer ars.Unlock()
+
+	req, ok := ars.requests[room][id]
+	if !ok {
+		return nil, proto.ErrAccessRequestNotFound
+	}
+	dup := *req
+	return &dup, nil
+}
+
+func (ars *accessRequests) List(ctx scope.Context, room string) ([]proto.AccessRequest, error) {
+	ars.Lock()
+	defer ars.Unlock()
+
+	result := make(accessRequestList, 0, len(ars.requests[room]))
+	for _, req := range ars.requests[room] {
+		result = append(result, *req)
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+func (ars *accessRequests) Remove(ctx scope.Context, room string, id snowflake.Snowflake) error {
+	ars.Lock()
+	defer ars.Unlock()
+
+	if _, ok := ars.requests[room][id]; !ok {
+		return proto.ErrAccessRequestNotFound
+	}
+	delete(ars.requests[room], id)
+	return nil
+}
+
+func (ars *accessRequests) MarkEmailed(
+	ctx scope.Context, room string, accountID snowflake.Snowflake, since time.Time) (bool, error) {
+
+	ars.Lock()
+	defer ars.Unlock()
+
+	if ars.emailed == nil {
+		ars.emailed = map[string]map[snowflake.Snowflake]time.Time{}
+	}
+	byAccount, ok := ars.emailed[room]
+	if !ok {
+		byAccount = map[snowflake.Snowflake]time.Time{}
+		ars.emailed[room] = byAccount
+	}
+	if emailed, ok := byAccount[accountID]; ok && emailed.After(since) {
+		return false, nil
+	}
+	byAccount[accountID] = time.Now()
+	return true, nil
+}
+
+type accessRequestList []proto.AccessRequest
+
+func (l accessRequestList) Len() int           { return len(l) }
+func (l accessRequestList) Less(i, j int) bool { return l[i].ID.Before(l[j].ID) }
+func (l accessRequestList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
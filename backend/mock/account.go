@@ -35,6 +35,7 @@ type memAccount struct {
 	id                 snowflake.Snowflake
 	name               string
 	email              string
+	locale             string
 	sec                proto.AccountSecurity
 	staffCapability    security.Capability
 	personalIdentities []proto.PersonalIdentity
@@ -42,6 +43,7 @@ type memAccount struct {
 
 func (a *memAccount) ID() snowflake.Snowflake { return a.id }
 func (a *memAccount) Name() string            { return a.name }
+func (a *memAccount) Locale() string          { return a.locale }
 
 func (a *memAccount) Email() (string, bool) {
 	for _, pid := range a.personalIdentities {
@@ -113,16 +115,50 @@ type personalIdentity struct {
 	namespace string
 	id        string
 	verified  bool
+	backup    bool
+
+	undeliverable bool
 }
 
-func (pid *personalIdentity) Namespace() string { return pid.namespace }
-func (pid *personalIdentity) ID() string        { return pid.id }
-func (pid *personalIdentity) Verified() bool    { return pid.verified }
+func (pid *personalIdentity) Namespace() string   { return pid.namespace }
+func (pid *personalIdentity) ID() string          { return pid.id }
+func (pid *personalIdentity) Verified() bool      { return pid.verified }
+func (pid *personalIdentity) Undeliverable() bool { return pid.undeliverable }
 
 type accountManager struct {
 	b *TestBackend
 }
 
+// held returns true if the personal identity holds its address against other
+// accounts, because it's verified or its account registered with it. The
+// caller must hold the backend's lock.
+func (m *accountManager) held(pid *personalIdentity) bool {
+	if pid.verified || pid.namespace != "email" {
+		return true
+	}
+	account, ok := m.b.accounts[pid.accountID]
+	return ok && account.(*memAccount).email == pid.id
+}
+
+// release drops another account's unverified claim on the identity with the
+// given key, so that it may be taken. The caller must hold the backend's lock.
+func (m *accountManager) release(key string, accountID snowflake.Snowflake) {
+	pid, ok := m.b.accountIDs[key]
+	if !ok || pid.accountID == accountID || m.held(pid) {
+		return
+	}
+	delete(m.b.accountIDs, key)
+	if account, ok := m.b.accounts[pid.accountID]; ok {
+		pids := account.(*memAccount).personalIdentities
+		for i, other := range pids {
+			if other == proto.PersonalIdentity(pid) {
+				account.(*memAccount).personalIdentities = append(pids[:i:i], pids[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
 func (m *accountManager) VerifyPersonalIdentity(ctx scope.Context, namespace, id string) error {
 	m.b.Lock()
 	defer m.b.Unlock()
@@ -133,16 +169,31 @@ func (m *accountManager) VerifyPersonalIdentity(ctx scope.Context, namespace, id
 		return proto.ErrAccountNotFound
 	}
 	pid.verified = true
+	pid.undeliverable = false
 
 	if namespace == "email" {
 		if a, ok := m.b.accounts[pid.accountID]; ok {
-			a.(*memAccount).email = id
+			if !pid.backup || a.(*memAccount).email == "" {
+				a.(*memAccount).email = id
+			}
 		}
 	}
 
 	return nil
 }
 
+func (m *accountManager) MarkPersonalIdentityUndeliverable(ctx scope.Context, namespace, id string) error {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	pid, ok := m.b.accountIDs[fmt.Sprintf("%s:%s", namespace, id)]
+	if !ok {
+		return proto.ErrPersonalIdentityNotFound
+	}
+	pid.undeliverable = true
+	return nil
+}
+
 func (m *accountManager) ChangeClientKey(
 	ctx scope.Context, accountID snowflake.Snowflake,
 	oldClientKey, newClientKey *security.ManagedKey) error {
@@ -167,6 +218,7 @@ func (m *accountManager) Register(
 	defer m.b.Unlock()
 
 	key := fmt.Sprintf("%s:%s", namespace, id)
+	m.release(key, 0)
 	if _, ok := m.b.accountIDs[key]; ok {
 		return nil, nil, proto.ErrPersonalIdentityInUse
 	}
@@ -217,6 +269,18 @@ func (m *accountManager) Resolve(ctx scope.Context, namespace, id string) (proto
 	m.b.Lock()
 	defer m.b.Unlock()
 
+	key := fmt.Sprintf("%s:%s", namespace, id)
+	pid, ok := m.b.accountIDs[key]
+	if !ok || !m.held(pid) {
+		return nil, proto.ErrAccountNotFound
+	}
+	return m.b.accounts[pid.accountID], nil
+}
+
+func (m *accountManager) ResolveUnverified(ctx scope.Context, namespace, id string) (proto.Account, error) {
+	m.b.Lock()
+	defer m.b.Unlock()
+
 	key := fmt.Sprintf("%s:%s", namespace, id)
 	pid, ok := m.b.accountIDs[key]
 	if !ok {
@@ -371,6 +435,7 @@ func (m *accountManager) ChangeEmail(ctx scope.Context, accountID snowflake.Snow
 	}
 
 	key := fmt.Sprintf("email:%s", email)
+	m.release(key, accountID)
 	conflict, ok := m.b.accountIDs[key]
 	if ok && conflict.accountID != accountID {
 		return false, proto.ErrPersonalIdentityInUse
@@ -382,6 +447,7 @@ func (m *accountManager) ChangeEmail(ctx scope.Context, accountID snowflake.Snow
 				account.(*memAccount).email = email
 				return true, nil
 			}
+			pid.(*personalIdentity).backup = false
 			return false, nil
 		}
 	}
@@ -400,6 +466,67 @@ func (m *accountManager) ChangeEmail(ctx scope.Context, accountID snowflake.Snow
 	return false, nil
 }
 
+func (m *accountManager) AddPersonalIdentity(
+	ctx scope.Context, accountID snowflake.Snowflake, namespace, id string) error {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	account, ok := m.b.accounts[accountID]
+	if !ok {
+		return proto.ErrAccountNotFound
+	}
+
+	key := fmt.Sprintf("%s:%s", namespace, id)
+	m.release(key, accountID)
+	if conflict, ok := m.b.accountIDs[key]; ok {
+		if conflict.accountID != accountID {
+			return proto.ErrPersonalIdentityInUse
+		}
+		return nil
+	}
+
+	pid := &personalIdentity{
+		accountID: accountID,
+		namespace: namespace,
+		id:        id,
+		backup:    true,
+	}
+	account.(*memAccount).personalIdentities = append(account.(*memAccount).personalIdentities, pid)
+	if m.b.accountIDs == nil {
+		m.b.accountIDs = map[string]*personalIdentity{key: pid}
+	} else {
+		m.b.accountIDs[key] = pid
+	}
+	return nil
+}
+
+func (m *accountManager) RemovePersonalIdentity(
+	ctx scope.Context, accountID snowflake.Snowflake, namespace, id string) error {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	account, ok := m.b.accounts[accountID]
+	if !ok {
+		return proto.ErrAccountNotFound
+	}
+
+	if namespace == "email" && account.(*memAccount).email == id {
+		return proto.ErrPersonalIdentityIsPrimary
+	}
+
+	pids := account.(*memAccount).personalIdentities
+	for i, pid := range pids {
+		if pid.Namespace() == namespace && pid.ID() == id {
+			account.(*memAccount).personalIdentities = append(pids[:i:i], pids[i+1:]...)
+			delete(m.b.accountIDs, fmt.Sprintf("%s:%s", namespace, id))
+			return nil
+		}
+	}
+	return proto.ErrPersonalIdentityNotFound
+}
+
 func (m *accountManager) ChangeName(ctx scope.Context, accountID snowflake.Snowflake, name string) error {
 	m.b.Lock()
 	defer m.b.Unlock()
@@ -412,6 +539,18 @@ func (m *accountManager) ChangeName(ctx scope.Context, accountID snowflake.Snowf
 	return nil
 }
 
+func (m *accountManager) ChangeLocale(ctx scope.Context, accountID snowflake.Snowflake, locale string) error {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	account, ok := m.b.accounts[accountID]
+	if !ok {
+		return proto.ErrAccountNotFound
+	}
+	account.(*memAccount).locale = locale
+	return nil
+}
+
 func (m *accountManager) OTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake) (*proto.OTP, error) {
 	return m.b.otps[accountID], nil
 }
@@ -454,3 +593,45 @@ func (m *accountManager) ValidateOTP(ctx scope.Context, kms security.KMS, accoun
 	m.b.otps[accountID].Validated = true
 	return nil
 }
+
+func (m *accountManager) DisableOTP(ctx scope.Context, accountID snowflake.Snowflake) error {
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.otps[accountID]; !ok {
+		return proto.ErrOTPNotEnrolled
+	}
+	delete(m.b.otps, accountID)
+	delete(m.b.otpRecovery, accountID)
+	return nil
+}
+
+func (m *accountManager) SetOTPRecoveryCodes(
+	ctx scope.Context, accountID snowflake.Snowflake, digests []string) error {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if m.b.otpRecovery == nil {
+		m.b.otpRecovery = map[snowflake.Snowflake]map[string]struct{}{}
+	}
+	codes := make(map[string]struct{}, len(digests))
+	for _, digest := range digests {
+		codes[digest] = struct{}{}
+	}
+	m.b.otpRecovery[accountID] = codes
+	return nil
+}
+
+func (m *accountManager) RedeemOTPRecoveryCode(
+	ctx scope.Context, accountID snowflake.Snowflake, digest string) error {
+
+	m.b.Lock()
+	defer m.b.Unlock()
+
+	if _, ok := m.b.otpRecovery[accountID][digest]; !ok {
+		return proto.ErrAccessDenied
+	}
+	delete(m.b.otpRecovery[accountID], digest)
+	return nil
+}
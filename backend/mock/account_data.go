@@ -0,0 +1,245 @@
+package mock
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type accountData struct {
+	b *TestBackend
+}
+
+// logs returns the message logs of every room and PM, by room name.
+func (ad *accountData) logs() map[string]*memLog {
+	logs := map[string]*memLog{}
+	for name, room := range ad.b.rooms {
+		if r, ok := room.(*memRoom); ok {
+			logs[name] = r.log
+		}
+	}
+	for id, pm := range ad.b.pms.pms {
+		logs[fmt.Sprintf("pm:%s", id)] = pm.log
+	}
+	return logs
+}
+
+// grantTables returns the access and manager capability tables of every
+// room, by room name.
+func (ad *accountData) grantTables() (access, manager map[string]*capabilities) {
+	access = map[string]*capabilities{}
+	manager = map[string]*capabilities{}
+	for name, room := range ad.b.rooms {
+		r, ok := room.(*memRoom)
+		if !ok {
+			continue
+		}
+		if r.messageKey != nil {
+			access[name] = r.messageKey.Capabilities.(*capabilities)
+		}
+		manager[name] = r.managerKey.Capabilities.(*capabilities)
+	}
+	return access, manager
+}
+
+func (ad *accountData) Messages(
+	ctx scope.Context, accountID snowflake.Snowflake, n int, before snowflake.Snowflake) (
+	[]proto.RoomMessage, error) {
+
+	ad.b.Lock()
+	defer ad.b.Unlock()
+
+	sender := proto.UserID(fmt.Sprintf("account:%s", accountID))
+	result := []proto.RoomMessage{}
+	for name, log := range ad.logs() {
+		log.Lock()
+		for _, msg := range log.msgs {
+			if msg.Sender.ID == sender && (before == 0 || msg.ID.Before(before)) {
+				result = append(result, proto.RoomMessage{Room: name, Message: *msg})
+			}
+		}
+		log.Unlock()
+	}
+
+	sort.Sort(roomMessagesNewestFirst(result))
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
+}
+
+type roomMessagesNewestFirst []proto.RoomMessage
+
+func (ms roomMessagesNewestFirst) Len() int           { return len(ms) }
+func (ms roomMessagesNewestFirst) Less(i, j int) bool { return ms[j].ID.Before(ms[i].ID) }
+func (ms roomMessagesNewestFirst) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
+
+func (ad *accountData) Grants(ctx scope.Context, accountID snowflake.Snowflake) ([]proto.RoomGrant, error) {
+	ad.b.Lock()
+	defer ad.b.Unlock()
+
+	result := []proto.RoomGrant{}
+	collect := func(tables map[string]*capabilities, manager bool) error {
+		for name, cs := range tables {
+			grants, err := cs.List(ctx)
+			if err != nil {
+				return err
+			}
+			for _, grant := range grants {
+				if grant.AccountID == accountID {
+					result = append(result, proto.RoomGrant{
+						Room:    name,
+						Manager: manager,
+						Granted: grant.Granted,
+						Expires: grant.Expires,
+					})
+				}
+			}
+		}
+		return nil
+	}
+
+	access, manager := ad.grantTables()
+	if err := collect(access, false); err != nil {
+		return nil, err
+	}
+	if err := collect(manager, true); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (ad *accountData) RevokeGrants(ctx scope.Context, accountID snowflake.Snowflake) error {
+	ad.b.Lock()
+	defer ad.b.Unlock()
+
+	access, manager := ad.grantTables()
+	for _, tables := range []map[string]*capabilities{access, manager} {
+		for _, cs := range tables {
+			cs.Lock()
+			for cid, account := range cs.accounts {
+				if account != nil && account.ID() == accountID {
+					delete(cs.capabilities, cid)
+					delete(cs.accounts, cid)
+					delete(cs.expires, cid)
+					delete(cs.granted, cid)
+				}
+			}
+			cs.Unlock()
+		}
+	}
+	return nil
+}
+
+func (ad *accountData) AnonymizeMessages(
+	ctx scope.Context, accountID snowflake.Snowflake, agentIDs []string) error {
+
+	ad.b.Lock()
+	defer ad.b.Unlock()
+
+	senders := map[proto.UserID]bool{proto.UserID(fmt.Sprintf("account:%s", accountID)): true}
+	for _, agentID := range agentIDs {
+		senders[proto.UserID(fmt.Sprintf("agent:%s", agentID))] = true
+		senders[proto.UserID(fmt.Sprintf("bot:%s", agentID))] = true
+	}
+	for _, log := range ad.logs() {
+		log.Lock()
+		for _, msg := range log.msgs {
+			if senders[msg.Sender.ID] {
+				msg.Sender = proto.SessionView{
+					IdentityView: proto.IdentityView{
+						ID:        proto.DeletedSenderID,
+						ServerID:  msg.Sender.ServerID,
+						ServerEra: msg.Sender.ServerEra,
+					},
+				}
+			}
+		}
+		log.Unlock()
+	}
+	return nil
+}
+
+func (ad *accountData) Delete(ctx scope.Context, accountID snowflake.Snowflake) error {
+	ad.b.Lock()
+	defer ad.b.Unlock()
+
+	account, ok := ad.b.accounts[accountID]
+	if !ok {
+		return proto.ErrAccountNotFound
+	}
+
+	a := account.(*memAccount)
+	for _, pid := range a.personalIdentities {
+		delete(ad.b.accountIDs, fmt.Sprintf("%s:%s", pid.Namespace(), pid.ID()))
+	}
+	a.personalIdentities = nil
+	a.name = ""
+	a.email = ""
+	a.staffCapability = nil
+
+	delete(ad.b.otps, accountID)
+	delete(ad.b.otpRecovery, accountID)
+	for id, req := range ad.b.resetReqs {
+		if req.AccountID == accountID {
+			delete(ad.b.resetReqs, id)
+		}
+	}
+
+	ad.b.et.m.Lock()
+	delete(ad.b.et.emailsByAccount, accountID)
+	ad.b.et.m.Unlock()
+
+	ad.b.accessRequests.Lock()
+	for _, byID := range ad.b.accessRequests.requests {
+		for id, req := range byID {
+			if req.Account.ID == accountID {
+				delete(byID, id)
+			}
+		}
+	}
+	for _, byAccount := range ad.b.accessRequests.emailed {
+		delete(byAccount, accountID)
+	}
+	ad.b.accessRequests.Unlock()
+
+	ad.b.blocks.clear(accountID)
+	ad.b.nicks.releaseAll(accountID)
+	ad.b.pms.forget(accountID)
+	ad.b.notifications.clear(accountID)
+	ad.b.emailPrefs.clear(accountID)
+
+	for id, export := range ad.b.exports {
+		if export.AccountID == accountID {
+			delete(ad.b.exports, id)
+		}
+	}
+
+	return nil
+}
+
+func (ad *accountData) SaveExport(ctx scope.Context, export *proto.AccountDataExport) error {
+	ad.b.Lock()
+	defer ad.b.Unlock()
+
+	if ad.b.exports == nil {
+		ad.b.exports = map[string]*proto.AccountDataExport{}
+	}
+	ad.b.exports[export.ID] = export
+	return nil
+}
+
+func (ad *accountData) GetExport(ctx scope.Context, id string) (*proto.AccountDataExport, error) {
+	ad.b.Lock()
+	defer ad.b.Unlock()
+
+	export, ok := ad.b.exports[id]
+	if !ok || !time.Now().Before(export.Expires) {
+		return nil, proto.ErrAccountDataExportNotFound
+	}
+	return export, nil
+}
@@ -1,6 +1,9 @@
 package mock
 
 import (
+	"sort"
+	"time"
+
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
@@ -66,3 +69,45 @@ func (t *agentTracker) ClearClientKey(ctx scope.Context, agentID string) error {
 	agent.AccountID = ""
 	return nil
 }
+
+func (t *agentTracker) RecordConnection(ctx scope.Context, agentID, ip, userAgent string) error {
+	t.b.Lock()
+	defer t.b.Unlock()
+
+	agent, err := t.Get(ctx, agentID)
+	if err != nil {
+		return err
+	}
+
+	agent.LastSeen = time.Now()
+	agent.LastIP = ip
+	agent.LastUserAgent = userAgent
+	return nil
+}
+
+func (t *agentTracker) ListForAccount(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.Agent, error) {
+	t.b.Lock()
+	defer t.b.Unlock()
+
+	agents := agentList{}
+	for _, agent := range t.b.agents {
+		if agent.AccountID == accountID.String() {
+			dup := *agent
+			agents = append(agents, &dup)
+		}
+	}
+	sort.Sort(agents)
+	return agents, nil
+}
+
+type agentList []*proto.Agent
+
+func (l agentList) Len() int      { return len(l) }
+func (l agentList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l agentList) Less(i, j int) bool {
+	if !l[i].LastSeen.Equal(l[j].LastSeen) {
+		return l[i].LastSeen.After(l[j].LastSeen)
+	}
+	return l[i].Created.After(l[j].Created)
+}
@@ -14,25 +14,47 @@ import (
 
 type TestBackend struct {
 	sync.Mutex
+	accessRequests accessRequests
 	accountManager *accountManager
 	accounts       map[snowflake.Snowflake]proto.Account
 	accountIDs     map[string]*personalIdentity
 	agents         map[string]*proto.Agent
 	agentBans      map[proto.UserID]time.Time
+	blocks         blocks
+	emailPrefs     emailPreferences
 	et             EmailTracker
+	exports        map[string]*proto.AccountDataExport
 	ipBans         map[string]time.Time
 	js             JobService
+	loginAttempts  loginAttempts
+	nicks          nickReservations
+	notifications  notifications
 	otps           map[snowflake.Snowflake]*proto.OTP
+	otpRecovery    map[snowflake.Snowflake]map[string]struct{}
+	pendingInvites pendingInvites
 	pms            PMTracker
 	resetReqs      map[snowflake.Snowflake]*proto.PasswordResetRequest
 	rooms          map[string]proto.ManagedRoom
 	version        string
 }
 
-func (b *TestBackend) AccountManager() proto.AccountManager { return &accountManager{b: b} }
-func (b *TestBackend) AgentTracker() proto.AgentTracker     { return &agentTracker{b} }
-func (b *TestBackend) EmailTracker() proto.EmailTracker     { return &b.et }
-func (b *TestBackend) Jobs() jobs.JobService                { return &b.js }
+func (b *TestBackend) AccessRequests() proto.AccessRequestTracker     { return &b.accessRequests }
+func (b *TestBackend) AccountData() proto.AccountDataTracker          { return &accountData{b} }
+func (b *TestBackend) AccountManager() proto.AccountManager           { return &accountManager{b: b} }
+func (b *TestBackend) AgentTracker() proto.AgentTracker               { return &agentTracker{b} }
+func (b *TestBackend) Blocks() proto.BlockTracker                     { return &b.blocks }
+func (b *TestBackend) EmailPreferences() proto.EmailPreferenceTracker { return &b.emailPrefs }
+func (b *TestBackend) Jobs() jobs.JobService                          { return &b.js }
+func (b *TestBackend) LoginAttempts() proto.LoginAttemptTracker       { return &b.loginAttempts }
+func (b *TestBackend) NickReservations() proto.NickReservationTracker { return &b.nicks }
+func (b *TestBackend) Notifications() proto.NotificationTracker       { return &b.notifications }
+
+func (b *TestBackend) PendingInvites() proto.PendingInviteTracker { return &b.pendingInvites }
+
+func (b *TestBackend) EmailTracker() proto.EmailTracker {
+	b.et.prefs = &b.emailPrefs
+	return &b.et
+}
 
 func (b *TestBackend) PMTracker() proto.PMTracker {
 	b.pms.b = b
@@ -122,6 +144,25 @@ func (b *TestBackend) Ban(ctx scope.Context, ban proto.Ban, until time.Time) err
 	}
 }
 
+func (b *TestBackend) IsBanned(ctx scope.Context, room string, id proto.UserID) (bool, error) {
+	b.Lock()
+	until, ok := b.agentBans[id]
+	mRoom, _ := b.rooms[room].(*memRoom)
+	b.Unlock()
+
+	if ok && (until.IsZero() || until.After(time.Now())) {
+		return true, nil
+	}
+	if mRoom == nil {
+		return false, nil
+	}
+
+	mRoom.m.Lock()
+	until, ok = mRoom.agentBans[id]
+	mRoom.m.Unlock()
+	return ok && until.After(time.Now()), nil
+}
+
 func (b *TestBackend) Unban(ctx scope.Context, ban proto.Ban) error {
 	b.Lock()
 	defer b.Unlock()
@@ -146,20 +187,48 @@ func isExcluded(toCheck proto.Session, excluding []proto.Session) bool {
 }
 
 func (b *TestBackend) NotifyUser(ctx scope.Context, userID proto.UserID, packetType proto.PacketType, payload interface{}, excluding ...proto.Session) error {
-	kind, id := userID.Parse()
 	for _, room := range b.rooms {
 		mRoom, _ := room.(*memRoom)
-		for u, sessList := range mRoom.live {
-			for _, sess := range sessList {
-				if u == userID || (kind == "agent" && sess.AgentID() == id) {
-					if !isExcluded(sess, excluding) {
-						if err := sess.Send(ctx, packetType, payload); err != nil {
-							return err
-						}
-					}
-				}
-			}
+		if err := mRoom.notifyUser(ctx, userID, packetType, payload, excluding...); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+func (b *TestBackend) IsUserOnline(ctx scope.Context, userID proto.UserID) (bool, error) {
+	b.Lock()
+	rooms := make([]*RoomBase, 0, len(b.rooms))
+	for _, room := range b.rooms {
+		if mRoom, ok := room.(*memRoom); ok {
+			rooms = append(rooms, &mRoom.RoomBase)
+		}
+	}
+	b.Unlock()
+
+	b.pms.m.Lock()
+	for _, pm := range b.pms.pms {
+		rooms = append(rooms, &pm.RoomBase)
+	}
+	b.pms.m.Unlock()
+
+	for _, room := range rooms {
+		room.m.Lock()
+		n := len(room.live[userID])
+		room.m.Unlock()
+		if n > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *TestBackend) NotifyUserInRoom(
+	ctx scope.Context, room string, userID proto.UserID, packetType proto.PacketType, payload interface{}) error {
+
+	mRoom, ok := b.rooms[room].(*memRoom)
+	if !ok {
+		return nil
+	}
+	return mRoom.notifyUser(ctx, userID, packetType, payload)
+}
@@ -0,0 +1,71 @@
+package mock
+
+import (
+	"sync"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type blocks struct {
+	sync.Mutex
+	byAccount map[snowflake.Snowflake][]proto.UserID
+}
+
+func (bl *blocks) Block(ctx scope.Context, accountID snowflake.Snowflake, userID proto.UserID) error {
+	bl.Lock()
+	defer bl.Unlock()
+
+	for _, blocked := range bl.byAccount[accountID] {
+		if blocked == userID {
+			return nil
+		}
+	}
+	if bl.byAccount == nil {
+		bl.byAccount = map[snowflake.Snowflake][]proto.UserID{}
+	}
+	bl.byAccount[accountID] = append(bl.byAccount[accountID], userID)
+	return nil
+}
+
+func (bl *blocks) Unblock(ctx scope.Context, accountID snowflake.Snowflake, userID proto.UserID) error {
+	bl.Lock()
+	defer bl.Unlock()
+
+	blocked := bl.byAccount[accountID]
+	for i, id := range blocked {
+		if id == userID {
+			bl.byAccount[accountID] = append(blocked[:i], blocked[i+1:]...)
+			return nil
+		}
+	}
+	return proto.ErrUserNotBlocked
+}
+
+func (bl *blocks) List(ctx scope.Context, accountID snowflake.Snowflake) ([]proto.UserID, error) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	return append([]proto.UserID{}, bl.byAccount[accountID]...), nil
+}
+
+func (bl *blocks) IsBlocked(ctx scope.Context, accountID snowflake.Snowflake, userID proto.UserID) (bool, error) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	for _, blocked := range bl.byAccount[accountID] {
+		if blocked == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// clear drops an account's block list.
+func (bl *blocks) clear(accountID snowflake.Snowflake) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	delete(bl.byAccount, accountID)
+}
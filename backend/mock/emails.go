@@ -1,7 +1,6 @@
 package mock
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
@@ -17,24 +16,27 @@ import (
 type EmailTracker struct {
 	m               sync.Mutex
 	emailsByAccount map[snowflake.Snowflake][]*emails.EmailRef
+	usedReplies     map[string]bool
+	prefs           proto.EmailPreferenceTracker
 }
 
 func (et *EmailTracker) Send(
 	ctx scope.Context, js jobs.JobService, templater *templates.Templater, deliverer emails.Deliverer,
-	account proto.Account, to, templateName string, data interface{}) (
+	account proto.Account, msgID, to, templateName string, data interface{}) (
 	*emails.EmailRef, error) {
 
+	if err := proto.CheckEmailPreferences(ctx, et.prefs, account.ID(), templateName); err != nil {
+		return nil, err
+	}
+
 	if to == "" {
 		to, _ = account.Email()
 	}
-
-	sf, err := snowflake.New()
-	if err != nil {
+	if err := proto.CheckEmailDeliverable(account, to, templateName); err != nil {
 		return nil, err
 	}
-	msgID := fmt.Sprintf("<%s@%s>", sf, deliverer.LocalName())
 
-	ref, err := emails.NewEmail(templater, msgID, to, templateName, data)
+	ref, err := emails.NewEmail(templater, msgID, to, templateName, account.Locale(), data)
 	if err != nil {
 		return nil, err
 	}
@@ -98,19 +100,18 @@ func (et *EmailTracker) List(ctx scope.Context, accountID snowflake.Snowflake, n
 	et.m.Lock()
 	defer et.m.Unlock()
 
+	if before.IsZero() {
+		before = time.Now()
+	}
+
 	refs := et.emailsByAccount[accountID]
-	var i int
-	for i = len(refs) - 1; i >= 0; i-- {
+	result := []*emails.EmailRef{}
+	for i := len(refs) - 1; i >= 0 && len(result) < n; i-- {
 		if refs[i].Created.Before(before) {
-			break
+			result = append(result, refs[i])
 		}
 	}
-	i += 1
-	j := i - n
-	if j < 0 {
-		j = 0
-	}
-	return refs[i:j], nil
+	return result, nil
 }
 
 func (et *EmailTracker) MarkDelivered(ctx scope.Context, accountID snowflake.Snowflake, id string) error {
@@ -129,3 +130,34 @@ func (et *EmailTracker) MarkDelivered(ctx scope.Context, accountID snowflake.Sno
 	ref.Delivered = time.Now()
 	return nil
 }
+
+func (et *EmailTracker) UseReplyAddress(
+	ctx scope.Context, accountID snowflake.Snowflake, token string, expires time.Time) error {
+
+	et.m.Lock()
+	defer et.m.Unlock()
+
+	if et.usedReplies[token] {
+		return proto.ErrEmailReplyUsed
+	}
+	if et.usedReplies == nil {
+		et.usedReplies = map[string]bool{}
+	}
+	et.usedReplies[token] = true
+	return nil
+}
+
+func (et *EmailTracker) MarkFailed(ctx scope.Context, id string) (*emails.EmailRef, error) {
+	et.m.Lock()
+	defer et.m.Unlock()
+
+	for _, refs := range et.emailsByAccount {
+		for _, ref := range refs {
+			if ref.ID == id {
+				ref.Failed = time.Now()
+				return ref, nil
+			}
+		}
+	}
+	return nil, proto.ErrEmailNotFound
+}
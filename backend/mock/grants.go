@@ -1,7 +1,9 @@
 package mock
 
 import (
+	"sort"
 	"sync"
+	"time"
 
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/security"
@@ -13,6 +15,8 @@ type capabilities struct {
 	accountCapabilityIDs map[string]string
 	accounts             map[string]proto.Account
 	capabilities         map[string]security.Capability
+	expires              map[string]time.Time
+	granted              map[string]time.Time
 }
 
 func (cs *capabilities) Get(ctx scope.Context, cid string) (security.Capability, error) {
@@ -20,21 +24,34 @@ func (cs *capabilities) Get(ctx scope.Context, cid string) (security.Capability,
 	if !ok {
 		return nil, proto.ErrCapabilityNotFound
 	}
+	if expires, ok := cs.expires[cid]; ok && !time.Now().Before(expires) {
+		return nil, proto.ErrCapabilityNotFound
+	}
 	return c, nil
 }
 
-func (cs *capabilities) Save(ctx scope.Context, account proto.Account, c security.Capability) error {
+func (cs *capabilities) Save(
+	ctx scope.Context, account proto.Account, c security.Capability, expires time.Time) error {
+
 	cs.Lock()
 	defer cs.Unlock()
 
 	if cs.capabilities == nil {
 		cs.capabilities = map[string]security.Capability{}
 		cs.accounts = map[string]proto.Account{}
+		cs.expires = map[string]time.Time{}
+		cs.granted = map[string]time.Time{}
 	}
 
 	cid := c.CapabilityID()
 	cs.capabilities[cid] = c
 	cs.accounts[cid] = account
+	cs.granted[cid] = time.Now()
+	if expires.IsZero() {
+		delete(cs.expires, cid)
+	} else {
+		cs.expires[cid] = expires
+	}
 	return nil
 }
 
@@ -47,5 +64,208 @@ func (cs *capabilities) Remove(ctx scope.Context, cid string) error {
 	}
 	delete(cs.capabilities, cid)
 	delete(cs.accounts, cid)
+	delete(cs.expires, cid)
+	delete(cs.granted, cid)
+	return nil
+}
+
+func (cs *capabilities) List(ctx scope.Context) ([]proto.CapabilityGrant, error) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	now := time.Now()
+	result := make([]proto.CapabilityGrant, 0, len(cs.capabilities))
+	for cid := range cs.capabilities {
+		expires := cs.expires[cid]
+		if !expires.IsZero() && !now.Before(expires) {
+			continue
+		}
+		grant := proto.CapabilityGrant{
+			CapabilityID: cid,
+			Granted:      cs.granted[cid],
+			Expires:      expires,
+		}
+		if account := cs.accounts[cid]; account != nil {
+			grant.AccountID = account.ID()
+		}
+		result = append(result, grant)
+	}
+	sort.Sort(grantList(result))
+	return result, nil
+}
+
+type grantList []proto.CapabilityGrant
+
+func (l grantList) Len() int      { return len(l) }
+func (l grantList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l grantList) Less(i, j int) bool {
+	if l[i].Granted.Equal(l[j].Granted) {
+		return l[i].CapabilityID < l[j].CapabilityID
+	}
+	return l[i].Granted.Before(l[j].Granted)
+}
+
+type invites struct {
+	sync.Mutex
+	invites map[string]*proto.Invite
+}
+
+func (is *invites) Get(ctx scope.Context, inviteID string) (*proto.Invite, error) {
+	is.Lock()
+	defer is.Unlock()
+
+	invite, ok := is.invites[inviteID]
+	if !ok {
+		return nil, proto.ErrInviteNotFound
+	}
+	dup := *invite
+	return &dup, nil
+}
+
+func (is *invites) List(ctx scope.Context) ([]proto.Invite, error) {
+	is.Lock()
+	defer is.Unlock()
+
+	result := make([]proto.Invite, 0, len(is.invites))
+	for _, invite := range is.invites {
+		result = append(result, *invite)
+	}
+	sort.Sort(inviteList(result))
+	return result, nil
+}
+
+func (is *invites) Save(ctx scope.Context, invite *proto.Invite) error {
+	is.Lock()
+	defer is.Unlock()
+
+	if is.invites == nil {
+		is.invites = map[string]*proto.Invite{}
+	}
+	dup := *invite
+	is.invites[invite.ID] = &dup
+	return nil
+}
+
+func (is *invites) Remove(ctx scope.Context, inviteID string) error {
+	is.Lock()
+	defer is.Unlock()
+
+	if _, ok := is.invites[inviteID]; !ok {
+		return proto.ErrInviteNotFound
+	}
+	delete(is.invites, inviteID)
+	return nil
+}
+
+func (is *invites) Redeem(ctx scope.Context, inviteID string) (*proto.Invite, error) {
+	is.Lock()
+	defer is.Unlock()
+
+	invite, ok := is.invites[inviteID]
+	if !ok {
+		return nil, proto.ErrInviteNotFound
+	}
+	if err := invite.Check(time.Now()); err != nil {
+		return nil, err
+	}
+	invite.Uses++
+	dup := *invite
+	return &dup, nil
+}
+
+type inviteList []proto.Invite
+
+func (l inviteList) Len() int      { return len(l) }
+func (l inviteList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l inviteList) Less(i, j int) bool {
+	ti, tj := time.Time(l[i].Created), time.Time(l[j].Created)
+	if ti.Equal(tj) {
+		return l[i].ID < l[j].ID
+	}
+	return ti.Before(tj)
+}
+
+type pendingInvites struct {
+	sync.Mutex
+	invites map[string]map[string]*proto.PendingInvite
+}
+
+func (pis *pendingInvites) Add(ctx scope.Context, invite *proto.PendingInvite) error {
+	pis.Lock()
+	defer pis.Unlock()
+
+	if pis.invites == nil {
+		pis.invites = map[string]map[string]*proto.PendingInvite{}
+	}
+	byRoom, ok := pis.invites[invite.Email]
+	if !ok {
+		byRoom = map[string]*proto.PendingInvite{}
+		pis.invites[invite.Email] = byRoom
+	}
+	dup := *invite
+	byRoom[invite.Room] = &dup
 	return nil
 }
+
+func (pis *pendingInvites) Claim(ctx scope.Context, email string) ([]*proto.PendingInvite, error) {
+	pis.Lock()
+	defer pis.Unlock()
+
+	byRoom := pis.invites[email]
+	delete(pis.invites, email)
+
+	now := time.Now()
+	result := make([]*proto.PendingInvite, 0, len(byRoom))
+	for _, invite := range byRoom {
+		if !invite.Expired(now) {
+			result = append(result, invite)
+		}
+	}
+	return result, nil
+}
+
+func (pis *pendingInvites) List(ctx scope.Context, room string) ([]*proto.PendingInvite, error) {
+	pis.Lock()
+	defer pis.Unlock()
+
+	now := time.Now()
+	result := pendingInviteList{}
+	for _, byRoom := range pis.invites {
+		if invite, ok := byRoom[room]; ok && !invite.Expired(now) {
+			dup := *invite
+			result = append(result, &dup)
+		}
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+func (pis *pendingInvites) Remove(ctx scope.Context, room, email string) error {
+	pis.Lock()
+	defer pis.Unlock()
+
+	byRoom := pis.invites[email]
+	if _, ok := byRoom[room]; !ok {
+		return proto.ErrInviteNotFound
+	}
+	delete(byRoom, room)
+	if len(byRoom) == 0 {
+		delete(pis.invites, email)
+	}
+	return nil
+}
+
+type pendingInviteList []*proto.PendingInvite
+
+func (l pendingInviteList) Len() int      { return len(l) }
+func (l pendingInviteList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l pendingInviteList) Less(i, j int) bool {
+	ti, tj := time.Time(l[i].Created), time.Time(l[j].Created)
+	if ti.Equal(tj) {
+		return l[i].Email < l[j].Email
+	}
+	return ti.Before(tj)
+}
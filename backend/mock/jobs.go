@@ -14,8 +14,9 @@ import (
 )
 
 type JobService struct {
-	m  sync.Mutex
-	qs map[string]*JobQueue
+	m     sync.Mutex
+	qs    map[string]*JobQueue
+	ticks map[string]time.Time
 }
 
 func (js *JobService) GetQueue(ctx scope.Context, name string) (jobs.JobQueue, error) {
@@ -36,6 +37,28 @@ func (js *JobService) GetQueue(ctx scope.Context, name string) (jobs.JobQueue, e
 	return jq, nil
 }
 
+func (js *JobService) AddRecurring(ctx scope.Context, rj *jobs.RecurringJob, tick time.Time) (
+	snowflake.Snowflake, error) {
+
+	js.m.Lock()
+	if last, ok := js.ticks[rj.Name]; ok && !last.Before(tick) {
+		js.m.Unlock()
+		return 0, jobs.ErrJobAlreadyScheduled
+	}
+	if js.ticks == nil {
+		js.ticks = map[string]time.Time{}
+	}
+	js.ticks[rj.Name] = tick
+	js.m.Unlock()
+
+	jq, err := js.GetQueue(ctx, rj.Queue)
+	if err != nil {
+		return 0, err
+	}
+	options := append([]jobs.JobOption{jobs.JobOptions.Due(tick)}, rj.Options...)
+	return jq.Add(ctx, rj.Type, rj.Payload, options...)
+}
+
 type entry struct {
 	jobs.Job
 	claimed time.Time
@@ -60,6 +83,7 @@ type JobQueue struct {
 	name      string
 	available jobHeap
 	working   jobHeap
+	dead      []entry
 	logs      map[snowflake.Snowflake]map[int32]*jobs.JobLog
 }
 
@@ -77,8 +101,10 @@ func (jq *JobQueue) newJob(jobType jobs.JobType, payload interface{}, options ..
 		Type:              jobType,
 		Created:           now,
 		Due:               now,
+		RunAt:             now,
 		AttemptsRemaining: math.MaxInt32,
 		MaxWorkDuration:   jobs.DefaultMaxWorkDuration,
+		Backoff:           jobs.BackoffDuration,
 	}
 	data, err := json.Marshal(payload)
 	if err != nil {
@@ -181,6 +207,19 @@ func (jq *JobQueue) Fail(ctx scope.Context, jobID snowflake.Snowflake, handlerID
 		Log:           log,
 	}
 	jq.release(jobID, 0)
+	for i, entry := range jq.available {
+		if entry.ID == jobID {
+			if entry.AttemptsRemaining <= 0 {
+				heap.Remove(&jq.available, i)
+				entry.DeadLettered = time.Now()
+				entry.FailureReason = reason
+				jq.dead = append(jq.dead, entry)
+				return nil
+			}
+			jq.available[i].RunAt = time.Now().Add(jobs.RetryBackoff(entry.Backoff, attempt))
+			break
+		}
+	}
 	jq.c.Signal()
 	return nil
 }
@@ -220,9 +259,23 @@ func (jq *JobQueue) remove(jobID snowflake.Snowflake, err error) error {
 		}
 	}
 
+	if _, ok := jq.removeDead(jobID); ok {
+		return nil
+	}
+
 	return jobs.ErrJobNotFound
 }
 
+func (jq *JobQueue) removeDead(jobID snowflake.Snowflake) (entry, bool) {
+	for i, e := range jq.dead {
+		if e.ID == jobID {
+			jq.dead = append(jq.dead[:i], jq.dead[i+1:]...)
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
 func (jq *JobQueue) Stats(ctx scope.Context) (jobs.JobQueueStats, error) {
 	jq.m.Lock()
 	defer jq.m.Unlock()
@@ -231,10 +284,11 @@ func (jq *JobQueue) Stats(ctx scope.Context) (jobs.JobQueueStats, error) {
 	stats := jobs.JobQueueStats{}
 	for _, entry := range jq.available {
 		stats.Waiting++
-		if !now.Before(entry.Due) {
+		if !now.Before(entry.Due) && !now.Before(entry.RunAt) {
 			stats.Due++
 		}
 	}
+	stats.Dead = int64(len(jq.dead))
 	for _, entry := range jq.working {
 		if now.Before(entry.claimed.Add(entry.MaxWorkDuration)) {
 			stats.Claimed++
@@ -248,7 +302,32 @@ func (jq *JobQueue) Stats(ctx scope.Context) (jobs.JobQueueStats, error) {
 	return stats, nil
 }
 
+// nextRunAt returns the earliest time a delayed job in the queue becomes
+// claimable, or the zero time if there are no delayed jobs.
+func (jq *JobQueue) nextRunAt() time.Time {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	var next time.Time
+	now := time.Now()
+	for _, entry := range jq.available {
+		if entry.RunAt.After(now) && (next.IsZero() || entry.RunAt.Before(next)) {
+			next = entry.RunAt
+		}
+	}
+	return next
+}
+
 func (jq *JobQueue) WaitForJob(ctx scope.Context) error {
+	if next := jq.nextRunAt(); !next.IsZero() {
+		timer := time.AfterFunc(next.Sub(time.Now()), func() {
+			jq.m.Lock()
+			jq.c.Broadcast()
+			jq.m.Unlock()
+		})
+		defer timer.Stop()
+	}
+
 	ch := make(chan error)
 
 	go func() {
@@ -274,11 +353,34 @@ func (jq *JobQueue) TryClaim(ctx scope.Context, handlerID string) (*jobs.Job, er
 	jq.m.Lock()
 	defer jq.m.Unlock()
 
-	if len(jq.available) == 0 {
+	// Claim the job of highest priority that's been due longest, among
+	// those past their RunAt.
+	idx := -1
+	now := time.Now()
+	for i, entry := range jq.available {
+		if now.Before(entry.RunAt) {
+			continue
+		}
+		if idx < 0 {
+			idx = i
+			continue
+		}
+		best := jq.available[idx]
+		switch {
+		case entry.Priority != best.Priority:
+			if entry.Priority > best.Priority {
+				idx = i
+			}
+		case jq.available.Less(i, idx) ||
+			(!jq.available.Less(idx, i) && entry.ID < best.ID):
+			idx = i
+		}
+	}
+	if idx < 0 {
 		return nil, jobs.ErrJobNotFound
 	}
 
-	e := heap.Pop(&jq.available).(entry)
+	e := heap.Remove(&jq.available, idx).(entry)
 	e.AttemptsRemaining -= 1
 	e.JobClaim = &jobs.JobClaim{
 		JobID:         e.ID,
@@ -302,7 +404,7 @@ func (jq *JobQueue) TrySteal(ctx scope.Context, handlerID string) (*jobs.Job, er
 	idx := -1
 	now := time.Now()
 	for i, entry := range jq.working {
-		if entry.JobClaim.HandlerID == handlerID {
+		if entry.JobClaim.HandlerID == handlerID || now.Before(entry.RunAt) {
 			continue
 		}
 		overrun := now.Sub(entry.claimed) - entry.MaxWorkDuration
@@ -323,6 +425,12 @@ func (jq *JobQueue) TrySteal(ctx scope.Context, handlerID string) (*jobs.Job, er
 	for i, entry := range jq.available {
 		if entry.ID == jobID {
 			heap.Remove(&jq.available, i)
+			if entry.AttemptsRemaining <= 0 {
+				entry.DeadLettered = now
+				entry.FailureReason = "claim expired on final attempt"
+				jq.dead = append(jq.dead, entry)
+				return nil, jobs.ErrJobNotFound
+			}
 			entry.claimed = now
 			entry.AttemptsMade += 1
 			entry.AttemptsRemaining -= 1
@@ -341,6 +449,9 @@ func (jq *JobQueue) TrySteal(ctx scope.Context, handlerID string) (*jobs.Job, er
 }
 
 func (jq *JobQueue) Log(ctx scope.Context, jobID snowflake.Snowflake, attempt int32) (*jobs.JobLog, error) {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
 	logs, ok := jq.logs[jobID]
 	if !ok {
 		return nil, jobs.ErrJobNotFound
@@ -353,3 +464,59 @@ func (jq *JobQueue) Log(ctx scope.Context, jobID snowflake.Snowflake, attempt in
 
 	return jl, nil
 }
+
+func (jq *JobQueue) Get(ctx scope.Context, jobID snowflake.Snowflake) (*jobs.Job, error) {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	for _, es := range [][]entry{jq.available, jq.working, jq.dead} {
+		for _, e := range es {
+			if e.ID == jobID {
+				job := e.Job
+				return &job, nil
+			}
+		}
+	}
+	return nil, jobs.ErrJobNotFound
+}
+
+func (jq *JobQueue) DeadLetters(ctx scope.Context, n int) ([]*jobs.Job, error) {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	result := []*jobs.Job{}
+	for i := len(jq.dead) - 1; i >= 0 && len(result) < n; i-- {
+		job := jq.dead[i].Job
+		result = append(result, &job)
+	}
+	return result, nil
+}
+
+func (jq *JobQueue) Requeue(ctx scope.Context, jobID snowflake.Snowflake, attempts int32) error {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	e, ok := jq.removeDead(jobID)
+	if !ok {
+		return jobs.ErrJobNotFound
+	}
+	e.DeadLettered = time.Time{}
+	e.FailureReason = ""
+	e.AttemptsMade = 0
+	e.AttemptsRemaining = attempts
+	e.RunAt = time.Now()
+	delete(jq.logs, jobID)
+	heap.Push(&jq.available, e)
+	jq.c.Signal()
+	return nil
+}
+
+func (jq *JobQueue) Purge(ctx scope.Context, jobID snowflake.Snowflake) error {
+	jq.m.Lock()
+	defer jq.m.Unlock()
+
+	if _, ok := jq.removeDead(jobID); !ok {
+		return jobs.ErrJobNotFound
+	}
+	return nil
+}
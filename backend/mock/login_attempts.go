@@ -0,0 +1,53 @@
+package mock
+
+import (
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/scope"
+)
+
+type loginAttempts struct {
+	sync.Mutex
+	failures map[string]*proto.LoginFailures
+}
+
+func (la *loginAttempts) Attempt(
+	ctx scope.Context, key string, window time.Duration) (*proto.LoginFailures, error) {
+
+	la.Lock()
+	defer la.Unlock()
+
+	if la.failures == nil {
+		la.failures = map[string]*proto.LoginFailures{}
+	}
+	now := time.Now()
+	failures, ok := la.failures[key]
+	if !ok || now.Sub(failures.LastFailure) > window {
+		failures = &proto.LoginFailures{Key: key}
+		la.failures[key] = failures
+	}
+	prev := *failures
+	failures.Count++
+	failures.LastFailure = now
+	return &prev, nil
+}
+
+func (la *loginAttempts) Forgive(ctx scope.Context, key string) error {
+	la.Lock()
+	defer la.Unlock()
+
+	if failures, ok := la.failures[key]; ok && failures.Count > 0 {
+		failures.Count--
+	}
+	return nil
+}
+
+func (la *loginAttempts) Reset(ctx scope.Context, key string) error {
+	la.Lock()
+	defer la.Unlock()
+
+	delete(la.failures, key)
+	return nil
+}
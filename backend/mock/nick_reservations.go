@@ -0,0 +1,100 @@
+package mock
+
+import (
+	"sync"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type nickReservation struct {
+	accountID snowflake.Snowflake
+	nick      string
+}
+
+type nickReservations struct {
+	sync.Mutex
+	byKey     map[string]*nickReservation
+	byAccount map[snowflake.Snowflake][]*nickReservation
+}
+
+func (nr *nickReservations) Reserve(ctx scope.Context, accountID snowflake.Snowflake, nick string) error {
+	nr.Lock()
+	defer nr.Unlock()
+
+	key := proto.ReservedNickKey(nick)
+	if res, ok := nr.byKey[key]; ok {
+		if res.accountID != accountID {
+			return proto.ErrNickReserved
+		}
+		res.nick = nick
+		return nil
+	}
+	if len(nr.byAccount[accountID]) >= proto.MaxReservedNicks {
+		return proto.ErrTooManyReservedNicks
+	}
+
+	if nr.byKey == nil {
+		nr.byKey = map[string]*nickReservation{}
+		nr.byAccount = map[snowflake.Snowflake][]*nickReservation{}
+	}
+	res := &nickReservation{accountID: accountID, nick: nick}
+	nr.byKey[key] = res
+	nr.byAccount[accountID] = append(nr.byAccount[accountID], res)
+	return nil
+}
+
+func (nr *nickReservations) Release(ctx scope.Context, accountID snowflake.Snowflake, nick string) error {
+	nr.Lock()
+	defer nr.Unlock()
+
+	key := proto.ReservedNickKey(nick)
+	res, ok := nr.byKey[key]
+	if !ok || res.accountID != accountID {
+		return proto.ErrNickNotReserved
+	}
+	delete(nr.byKey, key)
+
+	held := nr.byAccount[accountID]
+	for i, r := range held {
+		if r == res {
+			nr.byAccount[accountID] = append(held[:i], held[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (nr *nickReservations) List(ctx scope.Context, accountID snowflake.Snowflake) ([]string, error) {
+	nr.Lock()
+	defer nr.Unlock()
+
+	nicks := make([]string, len(nr.byAccount[accountID]))
+	for i, res := range nr.byAccount[accountID] {
+		nicks[i] = res.nick
+	}
+	return nicks, nil
+}
+
+func (nr *nickReservations) Owner(ctx scope.Context, nick string) (snowflake.Snowflake, bool, error) {
+	nr.Lock()
+	defer nr.Unlock()
+
+	res, ok := nr.byKey[proto.ReservedNickKey(nick)]
+	if !ok {
+		return 0, false, nil
+	}
+	return res.accountID, true, nil
+}
+
+// releaseAll drops all of an account's reservations.
+func (nr *nickReservations) releaseAll(accountID snowflake.Snowflake) {
+	nr.Lock()
+	defer nr.Unlock()
+
+	for _, res := range nr.byAccount[accountID] {
+		delete(nr.byKey, proto.ReservedNickKey(res.nick))
+	}
+	delete(nr.byAccount, accountID)
+}
@@ -0,0 +1,112 @@
+package mock
+
+import (
+	"sync"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type notifications struct {
+	sync.Mutex
+	pending   map[snowflake.Snowflake][]*proto.Notification
+	scheduled map[snowflake.Snowflake]bool
+}
+
+func (ns *notifications) Add(ctx scope.Context, n *proto.Notification) (bool, error) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.pending == nil {
+		ns.pending = map[snowflake.Snowflake][]*proto.Notification{}
+	}
+	copy := *n
+	ns.pending[n.AccountID] = append(ns.pending[n.AccountID], &copy)
+
+	if ns.scheduled[n.AccountID] {
+		return false, nil
+	}
+	if ns.scheduled == nil {
+		ns.scheduled = map[snowflake.Snowflake]bool{}
+	}
+	ns.scheduled[n.AccountID] = true
+	return true, nil
+}
+
+func (ns *notifications) ReleaseDigest(ctx scope.Context, accountID snowflake.Snowflake) error {
+	ns.Lock()
+	defer ns.Unlock()
+
+	delete(ns.scheduled, accountID)
+	return nil
+}
+
+func (ns *notifications) Pending(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.Notification, error) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	return append([]*proto.Notification{}, ns.pending[accountID]...), nil
+}
+
+func (ns *notifications) Clear(ctx scope.Context, accountID, through snowflake.Snowflake) error {
+	ns.Lock()
+	defer ns.Unlock()
+
+	remaining := []*proto.Notification{}
+	for _, n := range ns.pending[accountID] {
+		if through.Before(n.ID) {
+			remaining = append(remaining, n)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(ns.pending, accountID)
+	} else {
+		ns.pending[accountID] = remaining
+	}
+	return nil
+}
+
+// clear drops an account's pending notifications.
+func (ns *notifications) clear(accountID snowflake.Snowflake) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	delete(ns.pending, accountID)
+	delete(ns.scheduled, accountID)
+}
+
+type emailPreferences struct {
+	sync.Mutex
+	byAccount map[snowflake.Snowflake]proto.EmailPreferences
+}
+
+func (ep *emailPreferences) Get(ctx scope.Context, accountID snowflake.Snowflake) (*proto.EmailPreferences, error) {
+	ep.Lock()
+	defer ep.Unlock()
+
+	prefs, ok := ep.byAccount[accountID]
+	if !ok {
+		prefs = proto.DefaultEmailPreferences
+	}
+	return &prefs, nil
+}
+
+func (ep *emailPreferences) Set(ctx scope.Context, accountID snowflake.Snowflake, prefs *proto.EmailPreferences) error {
+	ep.Lock()
+	defer ep.Unlock()
+
+	if ep.byAccount == nil {
+		ep.byAccount = map[snowflake.Snowflake]proto.EmailPreferences{}
+	}
+	ep.byAccount[accountID] = *prefs
+	return nil
+}
+
+// clear drops an account's preferences.
+func (ep *emailPreferences) clear(accountID snowflake.Snowflake) {
+	ep.Lock()
+	defer ep.Unlock()
+
+	delete(ep.byAccount, accountID)
+}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,9 +13,15 @@ import (
 )
 
 type PMTracker struct {
-	m   sync.Mutex
-	b   *TestBackend
-	pms map[snowflake.Snowflake]*PM
+	m    sync.Mutex
+	b    *TestBackend
+	pms  map[snowflake.Snowflake]*PM
+	read map[pmReader]snowflake.Snowflake
+}
+
+type pmReader struct {
+	pmID      snowflake.Snowflake
+	accountID snowflake.Snowflake
 }
 
 func (t *PMTracker) Initiate(
@@ -98,11 +105,113 @@ func (t *PMTracker) Room(ctx scope.Context, kms security.KMS, pmID snowflake.Sno
 	return pm, pmKey, nil
 }
 
+func (t *PMTracker) AccountRoom(
+	ctx scope.Context, kms security.KMS, pmID snowflake.Snowflake, account proto.Account) (
+	proto.Room, *security.ManagedKey, error) {
+
+	t.m.Lock()
+	pm, ok := t.pms[pmID]
+	t.m.Unlock()
+	if !ok {
+		return nil, nil, proto.ErrPMNotFound
+	}
+
+	pmKey, _, err := pm.pm.SystemAccess(kms, account)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pm, pmKey, nil
+}
+
+func (t *PMTracker) List(ctx scope.Context, accountID snowflake.Snowflake) ([]proto.PMSummary, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	userID := proto.UserID(fmt.Sprintf("account:%s", accountID))
+	result := []proto.PMSummary{}
+	for pmID, pm := range t.pms {
+		if pm.pm.Initiator != accountID && pm.pm.Receiver != userID {
+			continue
+		}
+		summary := pm.pm.Summarize(accountID)
+		lastRead := t.read[pmReader{pmID, accountID}]
+		pm.log.Lock()
+		for _, msg := range pm.log.msgs {
+			if !time.Time(msg.Deleted).IsZero() {
+				continue
+			}
+			summary.LastMessageTime = msg.UnixTime
+			if msg.Sender.ID != userID && lastRead.Before(msg.ID) {
+				summary.Unread++
+			}
+		}
+		pm.log.Unlock()
+		result = append(result, summary)
+	}
+
+	sort.Sort(pmSummariesByActivity(result))
+	return result, nil
+}
+
+func (t *PMTracker) MarkRead(ctx scope.Context, pmID, accountID, messageID snowflake.Snowflake) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if _, ok := t.pms[pmID]; !ok {
+		return proto.ErrPMNotFound
+	}
+	key := pmReader{pmID, accountID}
+	if t.read == nil {
+		t.read = map[pmReader]snowflake.Snowflake{}
+	}
+	if t.read[key].Before(messageID) {
+		t.read[key] = messageID
+	}
+	return nil
+}
+
+// forget drops an account's read positions and the nicks it had in PMs.
+func (t *PMTracker) forget(accountID snowflake.Snowflake) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for key := range t.read {
+		if key.accountID == accountID {
+			delete(t.read, key)
+		}
+	}
+
+	receiver := proto.UserID(fmt.Sprintf("account:%s", accountID))
+	for _, pm := range t.pms {
+		if pm.pm.Initiator == accountID {
+			pm.pm.InitiatorNick = ""
+		}
+		if pm.pm.Receiver == receiver {
+			pm.pm.ReceiverNick = ""
+		}
+	}
+}
+
+type pmSummariesByActivity []proto.PMSummary
+
+func (ss pmSummariesByActivity) Len() int      { return len(ss) }
+func (ss pmSummariesByActivity) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
+
+func (ss pmSummariesByActivity) Less(i, j int) bool {
+	ti, tj := time.Time(ss[i].LastMessageTime), time.Time(ss[j].LastMessageTime)
+	if !ti.Equal(tj) {
+		return ti.After(tj)
+	}
+	return ss[j].PMID.Before(ss[i].PMID)
+}
+
 type PM struct {
 	RoomBase
 	pm *proto.PM
 }
 
+func (pm *PM) PM() *proto.PM { return pm.pm }
+
 func (pm *PM) ResolveNick(ctx scope.Context, userID proto.UserID) (string, bool, error) {
 	if userID == proto.UserID(fmt.Sprintf("account:%s", pm.pm.Initiator)) {
 		return pm.pm.InitiatorNick, true, nil
@@ -26,6 +26,7 @@ type RoomBase struct {
 	identities  map[proto.UserID]proto.Identity
 	nicks       map[proto.UserID]string
 	live        map[proto.UserID][]proto.Session
+	knocking    map[string]proto.Session
 	clients     map[string]*proto.Client
 	partWaiters map[string]chan struct{}
 	messageKey  *roomMessageKey
@@ -82,6 +83,7 @@ func (r *RoomBase) Join(ctx scope.Context, session proto.Session) (string, error
 
 	r.live[id] = append(r.live[id], session)
 	r.clients[session.ID()] = client
+	delete(r.knocking, session.ID())
 
 	event := proto.PresenceEvent(session.View(proto.Staff))
 	return "virt:" + event.RealClientAddress, r.broadcast(ctx, proto.JoinType, &event, session)
@@ -109,6 +111,59 @@ func (r *RoomBase) Part(ctx scope.Context, session proto.Session) error {
 	return r.broadcast(ctx, proto.PartEventType, &event, session)
 }
 
+func (r *RoomBase) Knock(ctx scope.Context, session proto.Session) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.knocking == nil {
+		r.knocking = map[string]proto.Session{}
+	}
+	r.knocking[session.ID()] = session
+	return nil
+}
+
+func (r *RoomBase) CancelKnock(ctx scope.Context, session proto.Session) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	delete(r.knocking, session.ID())
+	return nil
+}
+
+func (r *RoomBase) notifyUser(
+	ctx scope.Context, userID proto.UserID, packetType proto.PacketType, payload interface{},
+	excluding ...proto.Session) error {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	kind, id := userID.Parse()
+	matches := func(sess proto.Session) bool {
+		if isExcluded(sess, excluding) {
+			return false
+		}
+		return sess.Identity().ID() == userID || (kind == "agent" && sess.AgentID() == id)
+	}
+
+	for _, sessList := range r.live {
+		for _, sess := range sessList {
+			if matches(sess) {
+				if err := sess.Send(ctx, packetType, payload); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, sess := range r.knocking {
+		if matches(sess) {
+			if err := sess.Send(ctx, packetType, payload); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (r *RoomBase) Send(ctx scope.Context, session proto.Session, message proto.Message) (
 	proto.Message, error) {
 
@@ -388,7 +443,7 @@ func NewRoom(
 		if err != nil {
 			return nil, err
 		}
-		room.managerKey.Capabilities.Save(ctx, manager, c)
+		room.managerKey.Capabilities.Save(ctx, manager, c, time.Time{})
 
 		if private {
 			c, err = security.GrantPublicKeyCapability(
@@ -396,7 +451,7 @@ func NewRoom(
 			if err != nil {
 				return nil, err
 			}
-			room.messageKey.Capabilities.Save(ctx, manager, c)
+			room.messageKey.Capabilities.Save(ctx, manager, c, time.Time{})
 		}
 	}
 
@@ -421,6 +476,7 @@ func (r *memRoom) GenerateMessageKey(ctx scope.Context, kms security.KMS) (proto
 		GrantManager: &proto.GrantManager{
 			Capabilities:     &capabilities{},
 			Managers:         r.managerKey,
+			Invites:          &invites{},
 			KeyEncryptingKey: &r.sec.KeyEncryptingKey,
 			SubjectKeyPair:   &kp,
 			SubjectNonce:     nonce,
@@ -499,8 +555,12 @@ func (r *memRoom) Managers(ctx scope.Context) ([]proto.Account, error) {
 	caps.Lock()
 	defer caps.Unlock()
 
+	now := time.Now()
 	managers := make([]proto.Account, 0, len(caps.accounts))
-	for _, manager := range caps.accounts {
+	for cid, manager := range caps.accounts {
+		if expires, ok := caps.expires[cid]; ok && !now.Before(expires) {
+			continue
+		}
 		managers = append(managers, manager)
 	}
 	return managers, nil
@@ -546,9 +606,9 @@ func (r *memRoom) ManagerCapability(ctx scope.Context, manager proto.Account) (
 
 func (r *memRoom) AddManager(
 	ctx scope.Context, kms security.KMS, actor proto.Account, actorKey *security.ManagedKey,
-	newManager proto.Account) error {
+	newManager proto.Account, expires time.Time) error {
 
-	return r.managerKey.GrantToAccount(ctx, kms, actor, actorKey, newManager)
+	return r.managerKey.GrantToAccount(ctx, kms, actor, actorKey, newManager, expires)
 }
 
 func (r *memRoom) RemoveManager(
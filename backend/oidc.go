@@ -0,0 +1,646 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/scope"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	oidcCookieName     = "o"
+	oidcCookieDuration = 10 * time.Minute
+	oidcClockSkew      = time.Minute
+	oidcRequestTimeout = 10 * time.Second
+)
+
+var (
+	errOIDCInvalidToken = fmt.Errorf("oidc: invalid id token")
+	errOIDCUnknownKey   = fmt.Errorf("oidc: unknown signing key")
+)
+
+// OIDCProviderConfig configures an OpenID Connect identity provider that
+// accounts may log in and register through.
+type OIDCProviderConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url,omitempty"` // defaults to {site_url}/login/oidc/{name}/callback
+	Scopes       []string `yaml:"scopes,flow,omitempty"`  // requested in addition to "openid"
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcClaims struct {
+	Issuer   string       `json:"iss"`
+	Subject  string       `json:"sub"`
+	Audience oidcAudience `json:"aud"`
+	Expires  int64        `json:"exp"`
+	Nonce    string       `json:"nonce"`
+
+	// AuthorizedParty must be present if there are several audiences.
+	AuthorizedParty string `json:"azp,omitempty"`
+
+	// Email is only present if the provider is asked for the "email" scope.
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+}
+
+// oidcAudience is the aud claim of an ID token, which may be given as either
+// a single string or an array.
+type oidcAudience []string
+
+func (aud *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = oidcAudience{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*aud = oidcAudience(multi)
+	return nil
+}
+
+func (aud oidcAudience) contains(clientID string) bool {
+	for _, id := range aud {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcProvider implements the authorization code flow against a single
+// provider. Its endpoints and signing keys are discovered on first use.
+type oidcProvider struct {
+	name   string
+	cfg    OIDCProviderConfig
+	client *http.Client
+
+	m         sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(name string, cfg OIDCProviderConfig) *oidcProvider {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = fmt.Sprintf("%s/login/oidc/%s/callback", Config.SiteURL, name)
+	}
+	return &oidcProvider{
+		name:   name,
+		cfg:    cfg,
+		client: &http.Client{Timeout: oidcRequestTimeout},
+	}
+}
+
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	doc := &oidcDiscovery{}
+	if err := p.getJSON(p.cfg.Issuer+"/.well-known/openid-configuration", doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: discovered issuer %s does not match %s", doc.Issuer, p.cfg.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: incomplete discovery document from %s", p.cfg.Issuer)
+	}
+	p.discovery = doc
+	return doc, nil
+}
+
+// key returns the signing key with the given ID. The provider's key set is
+// fetched again if the key isn't known, in case it has been rotated.
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	doc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(doc.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, errOIDCUnknownKey
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) authURL(state, nonce string) (string, error) {
+	doc, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	vs := url.Values{}
+	vs.Set("response_type", "code")
+	vs.Set("client_id", p.cfg.ClientID)
+	vs.Set("redirect_uri", p.cfg.RedirectURL)
+	vs.Set("scope", strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " "))
+	vs.Set("state", state)
+	vs.Set("nonce", nonce)
+
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + vs.Encode(), nil
+}
+
+// exchange redeems an authorization code for an ID token, and returns the
+// token's claims once verified.
+func (p *oidcProvider) exchange(code, nonce string) (*oidcClaims, error) {
+	doc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	req, err := http.NewRequest("POST", doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token request failed: %s %s", resp.Status, token.Error)
+	}
+
+	return p.verify(token.IDToken, nonce)
+}
+
+// verify checks the signature and claims of an RS256-signed ID token.
+func (p *oidcProvider) verify(idToken, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errOIDCInvalidToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errOIDCInvalidToken
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errOIDCInvalidToken
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("oidc: unsupported signing algorithm: %s", header.Algorithm)
+	}
+
+	key, err := p.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errOIDCInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errOIDCInvalidToken
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errOIDCInvalidToken
+	}
+	claims := &oidcClaims{}
+	if err := json.Unmarshal(claimsJSON, claims); err != nil {
+		return nil, errOIDCInvalidToken
+	}
+
+	switch {
+	case claims.Issuer != p.cfg.Issuer:
+		return nil, fmt.Errorf("oidc: unexpected issuer: %s", claims.Issuer)
+	case !claims.Audience.contains(p.cfg.ClientID):
+		return nil, fmt.Errorf("oidc: token not issued to %s", p.cfg.ClientID)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty == "":
+		return nil, fmt.Errorf("oidc: token has several audiences but no authorized party")
+	case claims.AuthorizedParty != "" && claims.AuthorizedParty != p.cfg.ClientID:
+		return nil, fmt.Errorf("oidc: token authorized for %s", claims.AuthorizedParty)
+	case time.Unix(claims.Expires, 0).Add(oidcClockSkew).Before(time.Now()):
+		return nil, fmt.Errorf("oidc: token expired")
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("oidc: nonce mismatch")
+	case claims.Subject == "":
+		return nil, fmt.Errorf("oidc: token has no subject")
+	}
+	return claims, nil
+}
+
+// oidcState is kept in a cookie between sending the user to the provider and
+// receiving them back, to tie the callback to the browser that started it.
+type oidcState struct {
+	Provider string    `json:"p"`
+	State    string    `json:"s"`
+	Nonce    string    `json:"n"`
+	Return   string    `json:"r"`
+	Expires  time.Time `json:"e"`
+}
+
+func (st *oidcState) Cookie(s *Server) (*http.Cookie, error) {
+	encoded, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	secured, err := s.sc.Encode(oidcCookieName, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    secured,
+		Path:     "/login/oidc/",
+		Expires:  st.Expires,
+		HttpOnly: true,
+	}
+	if !Config.SetInsecureCookies {
+		cookie.Secure = true
+	}
+	return cookie, nil
+}
+
+func getOIDCState(s *Server, r *http.Request) (*oidcState, error) {
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := []byte{}
+	if err := s.sc.Decode(oidcCookieName, cookie.Value, &encoded); err != nil {
+		return nil, err
+	}
+
+	st := &oidcState{}
+	if err := json.Unmarshal(encoded, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// localReturnPath only allows redirecting back to a path on this site.
+func localReturnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// AddOIDCProvider allows accounts to log in and register through the given
+// OpenID Connect provider, at /login/oidc/{name}.
+func (s *Server) AddOIDCProvider(name string, cfg OIDCProviderConfig) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.oidcProviders == nil {
+		s.oidcProviders = map[string]*oidcProvider{}
+	}
+	s.oidcProviders[name] = newOIDCProvider(name, cfg)
+	return nil
+}
+
+func (s *Server) getOIDCProvider(name string) *oidcProvider {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.oidcProviders[name]
+}
+
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := s.rootCtx.Fork()
+
+	provider := s.getOIDCProvider(mux.Vars(r)["provider"])
+	if provider == nil {
+		s.serveErrorPage("login provider not found", http.StatusNotFound, w, r)
+		return
+	}
+
+	// Make sure this browser has an agent to log in, the same way as visiting
+	// a room would.
+	if err := r.ParseForm(); err != nil {
+		s.serveErrorPage("bad request", http.StatusBadRequest, w, r)
+		return
+	}
+	r.Form.Set("h", "1")
+	_, agentCookie, _, err := getAgent(ctx, s, r)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+
+	authURL, err := provider.authURL(state, nonce)
+	if err != nil {
+		logging.Logger(ctx).Printf("oidc provider %s: %s", provider.name, err)
+		s.serveErrorPage("login provider unavailable", http.StatusBadGateway, w, r)
+		return
+	}
+
+	st := &oidcState{
+		Provider: provider.name,
+		State:    state,
+		Nonce:    nonce,
+		Return:   localReturnPath(r.Form.Get("return")),
+		Expires:  time.Now().Add(oidcCookieDuration),
+	}
+	stateCookie, err := st.Cookie(s)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+
+	w.Header().Add("Set-Cookie", agentCookie.String())
+	w.Header().Add("Set-Cookie", stateCookie.String())
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := s.rootCtx.Fork()
+
+	provider := s.getOIDCProvider(mux.Vars(r)["provider"])
+	if provider == nil {
+		s.serveErrorPage("login provider not found", http.StatusNotFound, w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		s.serveErrorPage("bad request", http.StatusBadRequest, w, r)
+		return
+	}
+	if reason := r.Form.Get("error"); reason != "" {
+		s.serveErrorPage("login failed: "+reason, http.StatusUnauthorized, w, r)
+		return
+	}
+
+	// The state is good for one attempt only.
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/login/oidc/", MaxAge: -1})
+	st, err := getOIDCState(s, r)
+	if err != nil || st.Provider != provider.name || st.State != r.Form.Get("state") ||
+		time.Now().After(st.Expires) {
+		s.serveErrorPage("invalid or expired login attempt", http.StatusBadRequest, w, r)
+		return
+	}
+
+	r.Form.Set("h", "1")
+	client, agentCookie, agentKey, err := getClient(ctx, s, r)
+	if err != nil {
+		s.serveErrorPage(err.Error(), http.StatusInternalServerError, w, r)
+		return
+	}
+	w.Header().Add("Set-Cookie", agentCookie.String())
+
+	account, status, err := s.oidcLogin(ctx, provider, st, r.Form.Get("code"), client, agentKey)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			logging.Logger(ctx).Printf("oidc login via %s: %s", provider.name, err)
+		}
+		s.serveErrorPage(err.Error(), status, w, r)
+		return
+	}
+
+	// Let the agent's other sessions know they've been logged in.
+	err = s.b.NotifyUser(
+		ctx, proto.UserID("agent:"+client.Agent.IDString()), proto.LoginEventType,
+		proto.LoginEvent{AccountID: account.ID()})
+	if err != nil {
+		// Log this error only.
+		logging.Logger(ctx).Printf("error notifying agent of oidc login: %s", err)
+	}
+
+	http.Redirect(w, r, st.Return, http.StatusFound)
+}
+
+// oidcLogin completes a login through an OIDC provider, registering a new
+// account for the identity if necessary. On failure, it returns the HTTP
+// status with which to report the error.
+func (s *Server) oidcLogin(
+	ctx scope.Context, provider *oidcProvider, st *oidcState, code string,
+	client *proto.Client, agentKey *security.ManagedKey) (proto.Account, int, error) {
+
+	// Count the attempt up front, and refuse clients that have failed too
+	// often recently.
+	ipKey := proto.ClientLoginKey(client.IP)
+	failures, err := s.b.LoginAttempts().Attempt(ctx, ipKey, s.clientLoginThrottle.Window)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !s.clientLoginThrottle.RetryAfter(failures).IsZero() {
+		if err := s.b.LoginAttempts().Forgive(ctx, ipKey); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return nil, http.StatusTooManyRequests, fmt.Errorf("too many attempts")
+	}
+
+	claims, err := provider.exchange(code, st.Nonce)
+	if err != nil {
+		logging.Logger(ctx).Printf("oidc login via %s rejected: %s", provider.name, err)
+		return nil, http.StatusUnauthorized, fmt.Errorf("login failed")
+	}
+
+	// The provider vouched for the client, so this attempt wasn't a failure.
+	if err := s.b.LoginAttempts().Forgive(ctx, ipKey); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	identity := proto.OIDCIdentity(claims.Issuer, claims.Subject)
+	agentID := client.Agent.IDString()
+
+	account, err := s.b.AccountManager().Resolve(ctx, proto.OIDCNamespace, identity)
+	switch err {
+	case nil:
+		clientKey, err := proto.OIDCAccountClientKey(s.kms, account, identity)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if _, err := account.Unlock(clientKey); err != nil {
+			if err == proto.ErrAccessDenied {
+				return nil, http.StatusForbidden, fmt.Errorf("account can't be unlocked by login provider")
+			}
+			return nil, http.StatusInternalServerError, err
+		}
+		err = s.b.AgentTracker().SetClientKey(ctx, agentID, agentKey, account.ID(), clientKey)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		s.claimOIDCEmailInvites(ctx, account, claims)
+		return account, http.StatusOK, nil
+	case proto.ErrAccountNotFound:
+	default:
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// First login with this identity, so register a new account.
+	if time.Now().Sub(client.Agent.Created) < s.newAccountMinAgentAge {
+		return nil, http.StatusForbidden, fmt.Errorf("not familiar yet, try again later")
+	}
+
+	// The account's key material doesn't exist until it's registered, so
+	// register it with a throwaway password and then switch to the client
+	// key derived from it.
+	password, err := randomToken()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	account, initialKey, err := s.b.AccountManager().Register(
+		ctx, s.kms, proto.OIDCNamespace, identity, password, agentID, agentKey)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	clientKey, err := proto.OIDCAccountClientKey(s.kms, account, identity)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := s.b.AccountManager().ChangeClientKey(ctx, account.ID(), initialKey, clientKey); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// The provider has vouched for the identity.
+	if err := s.b.AccountManager().VerifyPersonalIdentity(ctx, proto.OIDCNamespace, identity); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if err := s.heim.OnAccountRegistration(ctx, s.b, account, clientKey); err != nil {
+		// Log this error only.
+		logging.Logger(ctx).Printf("error on account registration: %s", err)
+	}
+	s.claimOIDCEmailInvites(ctx, account, claims)
+
+	err = s.b.AgentTracker().SetClientKey(ctx, agentID, agentKey, account.ID(), clientKey)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return account, http.StatusOK, nil
+}
+
+// claimOIDCEmailInvites grants the account any room invites sent to the email
+// address its provider has verified for it. Errors are only logged, since they
+// shouldn't stand in the way of logging in.
+func (s *Server) claimOIDCEmailInvites(ctx scope.Context, account proto.Account, claims *oidcClaims) {
+	if claims.Email == "" || !claims.EmailVerified {
+		return
+	}
+	if err := s.heim.OnEmailVerified(ctx, s.b, account, claims.Email); err != nil {
+		logging.Logger(ctx).Printf("error claiming invites to %s: %s", claims.Email, err)
+	}
+}
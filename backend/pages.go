@@ -10,9 +10,10 @@ import (
 )
 
 const (
-	RoomPage          = "room.html"
-	ResetPasswordPage = "reset-password.html"
-	VerifyEmailPage   = "verify-email.html"
+	RoomPage             = "room.html"
+	EmailPreferencesPage = "email-preferences.html"
+	ResetPasswordPage    = "reset-password.html"
+	VerifyEmailPage      = "verify-email.html"
 )
 
 var PageScenarios = map[string]map[string]templates.TemplateTest{
@@ -21,6 +22,22 @@ var PageScenarios = map[string]map[string]templates.TemplateTest{
 			Data: map[string]interface{}{"RoomName": "test"},
 		},
 	},
+	EmailPreferencesPage: map[string]templates.TemplateTest{
+		"default": templates.TemplateTest{
+			Data: map[string]interface{}{
+				"Data": map[string]interface{}{
+					"email": "test@test.invalid",
+					"token": "emailpreferencestoken",
+					"preferences": map[string]interface{}{
+						"access_requests": true,
+						"invitations":     true,
+						"mentions":        true,
+						"pms":             true,
+					},
+				},
+			},
+		},
+	},
 	ResetPasswordPage: map[string]templates.TemplateTest{
 		"default": templates.TemplateTest{
 			Data: map[string]interface{}{
@@ -0,0 +1,177 @@
+package psql
+
+import (
+	"database/sql"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type RoomAccessRequest struct {
+	ID          string
+	Room        string
+	AccountID   string `db:"account_id"`
+	AccountName string `db:"account_name"`
+	Note        string
+	Requested   time.Time
+}
+
+func (r *RoomAccessRequest) AccessRequest() (*proto.AccessRequest, error) {
+	req := &proto.AccessRequest{
+		Room:      r.Room,
+		Account:   proto.AccountView{Name: r.AccountName},
+		Note:      r.Note,
+		Requested: proto.Time(r.Requested),
+	}
+	if err := req.ID.FromString(r.ID); err != nil {
+		return nil, err
+	}
+	if err := req.Account.ID.FromString(r.AccountID); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+type RoomAccessRequestEmail struct {
+	Room      string
+	AccountID string `db:"account_id"`
+	Emailed   time.Time
+}
+
+type AccessRequestTracker struct {
+	*Backend
+}
+
+func (t *AccessRequestTracker) Add(ctx scope.Context, req *proto.AccessRequest) error {
+	row := &RoomAccessRequest{
+		ID:          req.ID.String(),
+		Room:        req.Room,
+		AccountID:   req.Account.ID.String(),
+		AccountName: req.Account.Name,
+		Note:        req.Note,
+		Requested:   time.Time(req.Requested),
+	}
+
+	tx, err := t.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"DELETE FROM room_access_request WHERE room = $1 AND account_id = $2", row.Room, row.AccountID)
+	if err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+
+	if err := tx.Insert(row); err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (t *AccessRequestTracker) Get(
+	ctx scope.Context, room string, id snowflake.Snowflake) (*proto.AccessRequest, error) {
+
+	var row RoomAccessRequest
+	err := t.DbMap.SelectOne(
+		&row,
+		"SELECT id, room, account_id, account_name, note, requested FROM room_access_request"+
+			" WHERE room = $1 AND id = $2",
+		room, id.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrAccessRequestNotFound
+		}
+		return nil, err
+	}
+	return row.AccessRequest()
+}
+
+func (t *AccessRequestTracker) List(ctx scope.Context, room string) ([]proto.AccessRequest, error) {
+	var rows []RoomAccessRequest
+	_, err := t.DbMap.Select(
+		&rows,
+		"SELECT id, room, account_id, account_name, note, requested FROM room_access_request"+
+			" WHERE room = $1 ORDER BY requested, id",
+		room)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make([]proto.AccessRequest, len(rows))
+	for i, row := range rows {
+		req, err := row.AccessRequest()
+		if err != nil {
+			return nil, err
+		}
+		reqs[i] = *req
+	}
+	return reqs, nil
+}
+
+func (t *AccessRequestTracker) Remove(ctx scope.Context, room string, id snowflake.Snowflake) error {
+	result, err := t.DbMap.Exec(
+		"DELETE FROM room_access_request WHERE room = $1 AND id = $2", room, id.String())
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrAccessRequestNotFound
+	}
+	return nil
+}
+
+func (t *AccessRequestTracker) MarkEmailed(
+	ctx scope.Context, room string, accountID snowflake.Snowflake, since time.Time) (bool, error) {
+
+	tx, err := t.DbMap.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var row RoomAccessRequestEmail
+	err = tx.SelectOne(
+		&row,
+		"SELECT room, account_id, emailed FROM room_access_request_email"+
+			" WHERE room = $1 AND account_id = $2 FOR UPDATE",
+		room, accountID.String())
+	switch err {
+	case nil:
+		if row.Emailed.After(since) {
+			rollback(ctx, tx)
+			return false, nil
+		}
+		row.Emailed = time.Now()
+		if _, err := tx.Update(&row); err != nil {
+			rollback(ctx, tx)
+			return false, err
+		}
+	case sql.ErrNoRows:
+		row = RoomAccessRequestEmail{
+			Room:      room,
+			AccountID: accountID.String(),
+			Emailed:   time.Now(),
+		}
+		if err := tx.Insert(&row); err != nil {
+			rollback(ctx, tx)
+			return false, err
+		}
+	default:
+		rollback(ctx, tx)
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
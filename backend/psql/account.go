@@ -23,6 +23,7 @@ type Account struct {
 	ID                  string
 	Name                string
 	Email               string
+	Locale              string
 	Nonce               []byte
 	MAC                 []byte
 	EncryptedSystemKey  []byte         `db:"encrypted_system_key"`
@@ -70,20 +71,29 @@ type OTP struct {
 	Validated    bool
 }
 
+type OTPRecoveryCode struct {
+	AccountID string `db:"account_id"`
+	Digest    string
+}
+
 type PersonalIdentity struct {
 	Namespace string
 	ID        string
 	AccountID string `db:"account_id"`
 	Verified  bool
+	Backup    bool
+
+	Undeliverable bool
 }
 
 type PersonalIdentityBinding struct {
 	pid *PersonalIdentity
 }
 
-func (pib *PersonalIdentityBinding) Namespace() string { return pib.pid.Namespace }
-func (pib *PersonalIdentityBinding) ID() string        { return pib.pid.ID }
-func (pib *PersonalIdentityBinding) Verified() bool    { return pib.pid.Verified }
+func (pib *PersonalIdentityBinding) Namespace() string   { return pib.pid.Namespace }
+func (pib *PersonalIdentityBinding) ID() string          { return pib.pid.ID }
+func (pib *PersonalIdentityBinding) Verified() bool      { return pib.pid.Verified }
+func (pib *PersonalIdentityBinding) Undeliverable() bool { return pib.pid.Undeliverable }
 
 type PasswordResetRequest struct {
 	ID          string
@@ -108,7 +118,8 @@ func (ab *AccountBinding) ID() snowflake.Snowflake {
 	return id
 }
 
-func (ab *AccountBinding) Name() string { return ab.Account.Name }
+func (ab *AccountBinding) Name() string   { return ab.Account.Name }
+func (ab *AccountBinding) Locale() string { return ab.Account.Locale }
 
 func (ab *AccountBinding) Email() (string, bool) {
 	for _, pid := range ab.identities {
@@ -262,7 +273,7 @@ func (b *AccountManagerBinding) VerifyPersonalIdentity(ctx scope.Context, namesp
 	}
 
 	res, err := t.Exec(
-		"UPDATE personal_identity SET verified = true WHERE namespace = $1 and id = $2",
+		"UPDATE personal_identity SET verified = true, undeliverable = false WHERE namespace = $1 and id = $2",
 		namespace, id)
 	if err != nil {
 		rollback(ctx, t)
@@ -279,9 +290,11 @@ func (b *AccountManagerBinding) VerifyPersonalIdentity(ctx scope.Context, namesp
 	if namespace == "email" {
 		// Look up ID of account that was verified.
 		var row struct {
-			ID string `db:"account_id"`
+			ID     string `db:"account_id"`
+			Backup bool
 		}
-		err = t.SelectOne(&row, "SELECT account_id FROM personal_identity WHERE namespace = 'email' AND id = $1", id)
+		err = t.SelectOne(
+			&row, "SELECT account_id, backup FROM personal_identity WHERE namespace = 'email' AND id = $1", id)
 		if err != nil {
 			rollback(ctx, t)
 			if err == sql.ErrNoRows {
@@ -289,7 +302,13 @@ func (b *AccountManagerBinding) VerifyPersonalIdentity(ctx scope.Context, namesp
 			}
 			return err
 		}
-		res, err = t.Exec("UPDATE account SET email = $2 WHERE id = $1", row.ID, id)
+
+		// Backup addresses only become primary if the account has none.
+		query := "UPDATE account SET email = $2 WHERE id = $1"
+		if row.Backup {
+			query += " AND (email IS NULL OR email = '')"
+		}
+		res, err = t.Exec(query, row.ID, id)
 		if err != nil {
 			rollback(ctx, t)
 			if err == sql.ErrNoRows {
@@ -297,9 +316,11 @@ func (b *AccountManagerBinding) VerifyPersonalIdentity(ctx scope.Context, namesp
 			}
 			return err
 		}
-		if err := checkResult(res); err != nil {
-			rollback(ctx, t)
-			return err
+		if !row.Backup {
+			if err := checkResult(res); err != nil {
+				rollback(ctx, t)
+				return err
+			}
 		}
 	}
 
@@ -310,6 +331,22 @@ func (b *AccountManagerBinding) VerifyPersonalIdentity(ctx scope.Context, namesp
 	return nil
 }
 
+func (b *AccountManagerBinding) MarkPersonalIdentityUndeliverable(ctx scope.Context, namespace, id string) error {
+	res, err := b.DbMap.Exec(
+		"UPDATE personal_identity SET undeliverable = true WHERE namespace = $1 AND id = $2", namespace, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrPersonalIdentityNotFound
+	}
+	return nil
+}
+
 func (b *AccountManagerBinding) ChangeClientKey(
 	ctx scope.Context, accountID snowflake.Snowflake, oldKey, newKey *security.ManagedKey) error {
 
@@ -443,6 +480,10 @@ func (b *AccountManagerBinding) Register(
 		rollback()
 		return nil, nil, err
 	}
+	if err := b.release(t, namespace, id, account.ID); err != nil {
+		rollback()
+		return nil, nil, err
+	}
 	if err := t.Insert(personalIdentity); err != nil {
 		rollback()
 		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
@@ -494,13 +535,47 @@ func (b *AccountManagerBinding) Resolve(ctx scope.Context, namespace, id string)
 	return account, nil
 }
 
+func (b *AccountManagerBinding) ResolveUnverified(ctx scope.Context, namespace, id string) (proto.Account, error) {
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return nil, err
+	}
+	account, err := b.resolveUnverified(t, namespace, id)
+	if err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+	if err := t.Commit(); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// heldIdentity is the condition under which a personal identity holds its
+// address against other accounts: it's verified, or its account registered
+// with it.
+const heldIdentity = "(pi.verified OR pi.namespace != 'email' OR a.email = pi.id)"
+
 func (b *AccountManagerBinding) resolve(
 	db gorp.SqlExecutor, namespace, id string) (*AccountBinding, error) {
 
+	return b.resolveWhere(db, namespace, id, heldIdentity)
+}
+
+func (b *AccountManagerBinding) resolveUnverified(
+	db gorp.SqlExecutor, namespace, id string) (*AccountBinding, error) {
+
+	return b.resolveWhere(db, namespace, id, "true")
+}
+
+func (b *AccountManagerBinding) resolveWhere(
+	db gorp.SqlExecutor, namespace, id, cond string) (*AccountBinding, error) {
+
 	var pid PersonalIdentity
 	err := db.SelectOne(
 		&pid,
-		"SELECT account_id FROM personal_identity WHERE namespace = $1 AND id = $2",
+		"SELECT pi.account_id FROM personal_identity pi, account a"+
+			" WHERE pi.namespace = $1 AND pi.id = $2 AND a.id = pi.account_id AND "+cond,
 		namespace, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -517,6 +592,17 @@ func (b *AccountManagerBinding) resolve(
 	return b.get(db, accountID)
 }
 
+// release drops another account's unverified claim on the given personal
+// identity, so that it may be taken.
+func (b *AccountManagerBinding) release(db gorp.SqlExecutor, namespace, id, accountID string) error {
+	_, err := db.Exec(
+		"DELETE FROM personal_identity pi USING account a"+
+			" WHERE pi.namespace = $1 AND pi.id = $2 AND pi.account_id != $3 AND a.id = pi.account_id"+
+			" AND NOT "+heldIdentity,
+		namespace, id, accountID)
+	return err
+}
+
 func (b *AccountManagerBinding) Get(ctx scope.Context, id snowflake.Snowflake) (proto.Account, error) {
 	t, err := b.DbMap.Begin()
 	account, err := b.get(t, id)
@@ -851,6 +937,23 @@ func (b *AccountManagerBinding) ChangeName(ctx scope.Context, accountID snowflak
 	return nil
 }
 
+func (b *AccountManagerBinding) ChangeLocale(
+	ctx scope.Context, accountID snowflake.Snowflake, locale string) error {
+
+	res, err := b.DbMap.Exec("UPDATE account SET locale = $2 WHERE id = $1", accountID.String(), locale)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return proto.ErrAccountNotFound
+	}
+	return nil
+}
+
 func (b *AccountManagerBinding) ChangeEmail(ctx scope.Context, accountID snowflake.Snowflake, email string) (bool, error) {
 	t, err := b.DbMap.Begin()
 	if err != nil {
@@ -863,7 +966,12 @@ func (b *AccountManagerBinding) ChangeEmail(ctx scope.Context, accountID snowfla
 		return false, err
 	}
 
-	other, err := b.resolve(t, "email", email)
+	if err := b.release(t, "email", email, accountID.String()); err != nil {
+		rollback(ctx, t)
+		return false, err
+	}
+
+	other, err := b.resolveUnverified(t, "email", email)
 	if err != nil && err != proto.ErrAccountNotFound {
 		rollback(ctx, t)
 		return false, err
@@ -898,7 +1006,16 @@ func (b *AccountManagerBinding) ChangeEmail(ctx scope.Context, accountID snowfla
 				}
 				return true, nil
 			}
-			rollback(ctx, t)
+			// Verifying the address should now make it primary.
+			_, err := t.Exec(
+				"UPDATE personal_identity SET backup = false WHERE namespace = 'email' AND id = $1", email)
+			if err != nil {
+				rollback(ctx, t)
+				return false, err
+			}
+			if err := t.Commit(); err != nil {
+				return false, err
+			}
 			return false, nil
 		}
 	}
@@ -920,6 +1037,100 @@ func (b *AccountManagerBinding) ChangeEmail(ctx scope.Context, accountID snowfla
 	return false, nil
 }
 
+func (b *AccountManagerBinding) AddPersonalIdentity(
+	ctx scope.Context, accountID snowflake.Snowflake, namespace, id string) error {
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.get(t, accountID); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	if err := b.release(t, namespace, id, accountID.String()); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	other, err := b.resolveUnverified(t, namespace, id)
+	if err != nil && err != proto.ErrAccountNotFound {
+		rollback(ctx, t)
+		return err
+	}
+	if err == nil {
+		rollback(ctx, t)
+		if other.ID() != accountID {
+			return proto.ErrPersonalIdentityInUse
+		}
+		return nil
+	}
+
+	pid := &PersonalIdentity{
+		Namespace: namespace,
+		ID:        id,
+		AccountID: accountID.String(),
+		Backup:    true,
+	}
+	if err := t.Insert(pid); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	if err := t.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *AccountManagerBinding) RemovePersonalIdentity(
+	ctx scope.Context, accountID snowflake.Snowflake, namespace, id string) error {
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	account, err := b.get(t, accountID)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	if namespace == "email" {
+		if email, _ := account.Email(); email == id {
+			rollback(ctx, t)
+			return proto.ErrPersonalIdentityIsPrimary
+		}
+	}
+
+	res, err := t.Exec(
+		"DELETE FROM personal_identity WHERE account_id = $1 AND namespace = $2 AND id = $3",
+		accountID.String(), namespace, id)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if n < 1 {
+		rollback(ctx, t)
+		return proto.ErrPersonalIdentityNotFound
+	}
+
+	if err := t.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (b *AccountManagerBinding) getRawOTP(db gorp.SqlExecutor, accountID snowflake.Snowflake) (*OTP, error) {
 	row, err := db.Get(OTP{}, accountID.String())
 	if row == nil || err != nil {
@@ -1078,3 +1289,74 @@ func (b *AccountManagerBinding) ValidateOTP(ctx scope.Context, kms security.KMS,
 
 	return nil
 }
+
+func (b *AccountManagerBinding) DisableOTP(ctx scope.Context, accountID snowflake.Snowflake) error {
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.Exec("DELETE FROM otp_recovery_code WHERE account_id = $1", accountID.String()); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	res, err := t.Exec("DELETE FROM otp WHERE account_id = $1", accountID.String())
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if n == 0 {
+		rollback(ctx, t)
+		return proto.ErrOTPNotEnrolled
+	}
+
+	return t.Commit()
+}
+
+func (b *AccountManagerBinding) SetOTPRecoveryCodes(
+	ctx scope.Context, accountID snowflake.Snowflake, digests []string) error {
+
+	t, err := b.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := t.Exec("DELETE FROM otp_recovery_code WHERE account_id = $1", accountID.String()); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	for _, digest := range digests {
+		row := &OTPRecoveryCode{AccountID: accountID.String(), Digest: digest}
+		if err := t.Insert(row); err != nil {
+			rollback(ctx, t)
+			return err
+		}
+	}
+
+	return t.Commit()
+}
+
+func (b *AccountManagerBinding) RedeemOTPRecoveryCode(
+	ctx scope.Context, accountID snowflake.Snowflake, digest string) error {
+
+	res, err := b.DbMap.Exec(
+		"DELETE FROM otp_recovery_code WHERE account_id = $1 AND digest = $2", accountID.String(), digest)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrAccessDenied
+	}
+	return nil
+}
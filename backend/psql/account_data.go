@@ -0,0 +1,246 @@
+package psql
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"gopkg.in/gorp.v1"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type AccountDataExport struct {
+	ID        string
+	AccountID string `db:"account_id"`
+	Created   time.Time
+	Expires   time.Time
+	Data      []byte
+}
+
+type AccountDataTracker struct {
+	*Backend
+}
+
+func (t *AccountDataTracker) Messages(
+	ctx scope.Context, accountID snowflake.Snowflake, n int, before snowflake.Snowflake) (
+	[]proto.RoomMessage, error) {
+
+	cols, err := allColumns(t.DbMap, Message{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sender := fmt.Sprintf("account:%s", accountID)
+	var rows []interface{}
+	if before == 0 {
+		rows, err = t.DbMap.Select(
+			Message{},
+			fmt.Sprintf("SELECT %s FROM message WHERE sender_id = $1 ORDER BY id DESC LIMIT $2", cols),
+			sender, n)
+	} else {
+		rows, err = t.DbMap.Select(
+			Message{},
+			fmt.Sprintf("SELECT %s FROM message WHERE sender_id = $1 AND id < $3 ORDER BY id DESC LIMIT $2", cols),
+			sender, n, before.String())
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	messages := make([]proto.RoomMessage, len(rows))
+	for i, row := range rows {
+		msg := row.(*Message)
+		messages[i] = proto.RoomMessage{Room: msg.Room, Message: msg.ToBackend()}
+	}
+	return messages, nil
+}
+
+func (t *AccountDataTracker) Grants(ctx scope.Context, accountID snowflake.Snowflake) ([]proto.RoomGrant, error) {
+	var rows []struct {
+		Room    string
+		Manager bool
+		Granted time.Time
+		Expires gorp.NullTime
+	}
+	_, err := t.DbMap.Select(
+		&rows,
+		"SELECT room, false AS manager, granted, expires FROM room_capability"+
+			" WHERE account_id = $1 AND revoked < granted AND (expires IS NULL OR expires > NOW())"+
+			" UNION ALL"+
+			" SELECT room, true AS manager, granted, expires FROM room_manager_capability"+
+			" WHERE account_id = $1 AND revoked < granted AND (expires IS NULL OR expires > NOW())"+
+			" ORDER BY granted",
+		accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	grants := make([]proto.RoomGrant, len(rows))
+	for i, row := range rows {
+		grants[i] = proto.RoomGrant{
+			Room:    row.Room,
+			Manager: row.Manager,
+			Granted: row.Granted,
+		}
+		if row.Expires.Valid {
+			grants[i].Expires = row.Expires.Time
+		}
+	}
+	return grants, nil
+}
+
+func (t *AccountDataTracker) RevokeGrants(ctx scope.Context, accountID snowflake.Snowflake) error {
+	// Deleting the capabilities cascades to the grants that refer to them.
+	_, err := t.DbMap.Exec(
+		"DELETE FROM capability WHERE account_id = $1 AND id IN"+
+			" (SELECT capability_id FROM room_capability WHERE account_id = $1"+
+			" UNION SELECT capability_id FROM room_manager_capability WHERE account_id = $1)",
+		accountID.String())
+	return err
+}
+
+func (t *AccountDataTracker) AnonymizeMessages(
+	ctx scope.Context, accountID snowflake.Snowflake, agentIDs []string) error {
+
+	senders := []string{fmt.Sprintf("account:%s", accountID)}
+	for _, agentID := range agentIDs {
+		senders = append(senders, fmt.Sprintf("agent:%s", agentID), fmt.Sprintf("bot:%s", agentID))
+	}
+
+	tx, err := t.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, sender := range senders {
+		_, err := tx.Exec(
+			"UPDATE message SET sender_id = $2, sender_name = '', sender_client_address = '', session_id = '',"+
+				" sender_is_verified = false"+
+				" WHERE sender_id = $1",
+			sender, string(proto.DeletedSenderID))
+		if err != nil {
+			rollback(ctx, tx)
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE message_edit_log SET editor_id = $2 WHERE editor_id = $1", sender, string(proto.DeletedSenderID))
+		if err != nil {
+			rollback(ctx, tx)
+			return err
+		}
+
+		// Session statistics count distinct senders, so each one gets its
+		// own random pseudonym rather than all sharing DeletedSenderID.
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			rollback(ctx, tx)
+			return err
+		}
+		pseudonym := fmt.Sprintf("%s:%x", proto.DeletedSenderID, buf)
+		for _, table := range []string{"stats_sessions_global", "stats_sessions_per_room"} {
+			_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET sender_id = $2 WHERE sender_id = $1", table), sender, pseudonym)
+			if err != nil {
+				rollback(ctx, tx)
+				return fmt.Errorf("%s: %s", table, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (t *AccountDataTracker) Delete(ctx scope.Context, accountID snowflake.Snowflake) error {
+	tx, err := t.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Drop the staff capability first; the account refers to it.
+	_, err = tx.Exec(
+		"DELETE FROM capability WHERE id = (SELECT staff_capability_id FROM account WHERE id = $1)",
+		accountID.String())
+	if err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+
+	for _, table := range []string{
+		"personal_identity", "otp", "otp_recovery_code", "password_reset_request", "email",
+		"room_access_request", "room_access_request_email", "email_reply", "account_data_export", "nick_reservation", "account_block",
+		"pm_read", "notification", "notification_digest", "email_preferences",
+	} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE account_id = $1", table), accountID.String()); err != nil {
+			rollback(ctx, tx)
+			return fmt.Errorf("%s: %s", table, err)
+		}
+	}
+
+	// PMs outlive the account, but not the nick it had in them.
+	if _, err := tx.Exec("UPDATE pm SET initiator_nick = '' WHERE initiator = $1", accountID.String()); err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+	_, err = tx.Exec("UPDATE pm SET receiver_nick = '' WHERE receiver = $1", fmt.Sprintf("account:%s", accountID))
+	if err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE account SET name = '', email = '' WHERE id = $1", accountID.String())
+	if err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+	if n < 1 {
+		rollback(ctx, tx)
+		return proto.ErrAccountNotFound
+	}
+
+	return tx.Commit()
+}
+
+func (t *AccountDataTracker) SaveExport(ctx scope.Context, export *proto.AccountDataExport) error {
+	row := &AccountDataExport{
+		ID:        export.ID,
+		AccountID: export.AccountID.String(),
+		Created:   export.Created,
+		Expires:   export.Expires,
+		Data:      export.Data,
+	}
+	return t.DbMap.Insert(row)
+}
+
+func (t *AccountDataTracker) GetExport(ctx scope.Context, id string) (*proto.AccountDataExport, error) {
+	var row AccountDataExport
+	err := t.DbMap.SelectOne(
+		&row,
+		"SELECT id, account_id, created, expires, data FROM account_data_export WHERE id = $1 AND expires > NOW()",
+		id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrAccountDataExportNotFound
+		}
+		return nil, err
+	}
+
+	export := &proto.AccountDataExport{
+		ID:      row.ID,
+		Created: row.Created,
+		Expires: row.Expires,
+		Data:    row.Data,
+	}
+	if err := export.AccountID.FromString(row.AccountID); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
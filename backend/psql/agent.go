@@ -26,6 +26,37 @@ type Agent struct {
 	Created            time.Time
 	Blessed            bool
 	Bot                bool
+	LastSeen           gorp.NullTime  `db:"last_seen"`
+	LastIP             sql.NullString `db:"last_ip"`
+	LastUserAgent      sql.NullString `db:"last_user_agent"`
+	LoggedIn           gorp.NullTime  `db:"logged_in"`
+}
+
+func (a *Agent) ToBackend() (*proto.Agent, error) {
+	idBytes, err := base64.URLEncoding.DecodeString(a.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent id %s: %s", a.ID, err)
+	}
+
+	agent := &proto.Agent{
+		ID:  idBytes,
+		IV:  a.IV,
+		MAC: a.MAC,
+		EncryptedClientKey: &security.ManagedKey{
+			KeyType:    proto.AgentKeyType,
+			IV:         a.IV,
+			Ciphertext: a.EncryptedClientKey,
+		},
+		AccountID:     a.AccountID.String,
+		Created:       a.Created,
+		Blessed:       a.Blessed,
+		Bot:           a.Bot,
+		LastSeen:      a.LastSeen.Time,
+		LastIP:        a.LastIP.String,
+		LastUserAgent: a.LastUserAgent.String,
+		LoggedIn:      a.LoggedIn.Time,
+	}
+	return agent, nil
 }
 
 type AgentTrackerBinding struct {
@@ -56,8 +87,7 @@ func (atb *AgentTrackerBinding) Register(ctx scope.Context, agent *proto.Agent)
 }
 
 func (atb *AgentTrackerBinding) getFromDB(agentID string, db gorp.SqlExecutor) (*proto.Agent, error) {
-	idBytes, err := base64.URLEncoding.DecodeString(agentID)
-	if err != nil {
+	if _, err := base64.URLEncoding.DecodeString(agentID); err != nil {
 		return nil, fmt.Errorf("invalid agent id %s: %s", agentID, err)
 	}
 
@@ -69,22 +99,7 @@ func (atb *AgentTrackerBinding) getFromDB(agentID string, db gorp.SqlExecutor) (
 		return nil, proto.ErrAgentNotFound
 	}
 
-	agentRow := row.(*Agent)
-	agent := &proto.Agent{
-		ID:  idBytes,
-		IV:  agentRow.IV,
-		MAC: agentRow.MAC,
-		EncryptedClientKey: &security.ManagedKey{
-			KeyType:    proto.AgentKeyType,
-			IV:         agentRow.IV,
-			Ciphertext: agentRow.EncryptedClientKey,
-		},
-		AccountID: agentRow.AccountID.String,
-		Created:   agentRow.Created,
-		Blessed:   agentRow.Blessed,
-		Bot:       agentRow.Bot,
-	}
-	return agent, nil
+	return row.(*Agent).ToBackend()
 }
 
 func (atb *AgentTrackerBinding) Get(ctx scope.Context, agentID string) (*proto.Agent, error) {
@@ -95,7 +110,7 @@ func (atb *AgentTrackerBinding) setClientKeyInDB(
 	agentID, accountID string, keyBytes []byte, db gorp.SqlExecutor) error {
 
 	_, err := db.Exec(
-		"UPDATE agent SET account_id = $2, encrypted_client_key = $3 WHERE id = $1",
+		"UPDATE agent SET account_id = $2, encrypted_client_key = $3, logged_in = NOW() WHERE id = $1",
 		agentID, accountID, keyBytes)
 	if err != nil {
 		return err
@@ -162,3 +177,47 @@ func (atb *AgentTrackerBinding) ClearClientKey(ctx scope.Context, agentID string
 
 	return nil
 }
+
+func (atb *AgentTrackerBinding) RecordConnection(ctx scope.Context, agentID, ip, userAgent string) error {
+	resp, err := atb.Backend.DbMap.Exec(
+		"UPDATE agent SET last_seen = NOW(), last_ip = $2, last_user_agent = $3 WHERE id = $1",
+		agentID, ip, userAgent)
+	if err != nil {
+		return err
+	}
+
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrAgentNotFound
+	}
+
+	return nil
+}
+
+func (atb *AgentTrackerBinding) ListForAccount(
+	ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.Agent, error) {
+
+	var rows []Agent
+	_, err := atb.Backend.DbMap.Select(
+		&rows,
+		"SELECT id, iv, mac, encrypted_client_key, account_id, created, blessed, bot,"+
+			" last_seen, last_ip, last_user_agent FROM agent"+
+			" WHERE account_id = $1 ORDER BY last_seen DESC NULLS LAST, created DESC",
+		accountID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make([]*proto.Agent, len(rows))
+	for i, row := range rows {
+		agent, err := row.ToBackend()
+		if err != nil {
+			return nil, err
+		}
+		agents[i] = agent
+	}
+	return agents, nil
+}
@@ -38,6 +38,10 @@ var schema = []struct {
 	{"room_master_key", RoomMessageKey{}, []string{"Room", "KeyID"}},
 	{"room_capability", RoomCapability{}, []string{"Room", "CapabilityID"}},
 	{"room_manager_capability", RoomManagerCapability{}, []string{"Room", "CapabilityID"}},
+	{"room_invite", RoomInvite{}, []string{"ID"}},
+	{"pending_room_invite", PendingRoomInvite{}, []string{"Email", "Room"}},
+	{"room_access_request", RoomAccessRequest{}, []string{"ID"}},
+	{"room_access_request_email", RoomAccessRequestEmail{}, []string{"Room", "AccountID"}},
 	{"room", Room{}, []string{"Name"}},
 
 	// Presence.
@@ -53,20 +57,30 @@ var schema = []struct {
 	{"message", Message{}, []string{"Room", "ID"}},
 	{"message_edit_log", MessageEditLog{}, []string{"EditID"}},
 	{"pm", PM{}, []string{"ID"}},
+	{"pm_read", PMRead{}, []string{"PMID", "AccountID"}},
 
 	// Sessions.
 	{"session_log", SessionLog{}, []string{"SessionID"}},
 
 	// Emails.
 	{"email", Email{}, []string{"ID"}},
+	{"email_reply", EmailReply{}, []string{"Token"}},
+	{"email_preferences", EmailPreferences{}, []string{"AccountID"}},
+	{"notification", Notification{}, []string{"ID"}},
+	{"notification_digest", NotificationDigest{}, []string{"AccountID"}},
 
 	// Keys and capabilities.
 	{"master_key", MessageKey{}, []string{"ID"}},
 	{"capability", Capability{}, []string{"ID"}},
 
 	// Accounts.
+	{"account_block", AccountBlock{}, []string{"AccountID", "UserID"}},
+	{"account_data_export", AccountDataExport{}, []string{"ID"}},
 	{"agent", Agent{}, []string{"ID"}},
+	{"login_failure", LoginFailure{}, []string{"Key"}},
+	{"nick_reservation", NickReservation{}, []string{"Key"}},
 	{"otp", OTP{}, []string{"AccountID"}},
+	{"otp_recovery_code", OTPRecoveryCode{}, []string{"AccountID", "Digest"}},
 	{"password_reset_request", PasswordResetRequest{}, []string{"ID"}},
 	{"personal_identity", PersonalIdentity{}, []string{"Namespace", "ID"}},
 	{"account", Account{}, []string{"ID"}},
@@ -75,6 +89,7 @@ var schema = []struct {
 	{"job_log", JobLog{}, []string{"JobID", "Attempt"}},
 	{"job_item", JobItem{}, []string{"ID"}},
 	{"job_queue", JobQueue{}, []string{"Name"}},
+	{"job_schedule", JobSchedule{}, []string{"Name"}},
 }
 
 var connCount = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -272,6 +287,14 @@ func (b *Backend) background(wg *sync.WaitGroup) {
 
 			// Check for UserID- if so, notify user instead of room
 			if msg.UserID != "" {
+				if msg.Room != "" {
+					if lm, ok := b.listeners[msg.Room]; ok {
+						if err := lm.NotifyUser(ctx, msg.UserID, msg.Event, msg.Exclude...); err != nil {
+							logger.Printf("error: pq listen: notify user error on userID %s: %s", msg.UserID, err)
+						}
+					}
+					continue
+				}
 				for _, lm := range b.listeners {
 					if err := lm.NotifyUser(ctx, msg.UserID, msg.Event, msg.Exclude...); err != nil {
 						logger.Printf("error: pq listen: notify user error on userID %s: %s", msg.Room, err)
@@ -425,7 +448,7 @@ func (b *Backend) CreateRoom(
 		Executor: t,
 	}
 	for i, capability := range managerCaps {
-		if err := managerCapTable.Save(ctx, managers[i], capability); err != nil {
+		if err := managerCapTable.Save(ctx, managers[i], capability, time.Time{}); err != nil {
 			logging.Logger(ctx).Printf(
 				"room creation error on %s (manager %s): %s", name, managers[i].ID().String(), err)
 			rollback()
@@ -438,7 +461,7 @@ func (b *Backend) CreateRoom(
 		Executor: t,
 	}
 	for i, capability := range accessCaps {
-		if err := messageCapTable.Save(ctx, managers[i], capability); err != nil {
+		if err := messageCapTable.Save(ctx, managers[i], capability, time.Time{}); err != nil {
 			logging.Logger(ctx).Printf(
 				"room creation error on %s (access capability): %s", name, err)
 			rollback()
@@ -460,6 +483,17 @@ func (b *Backend) Ban(ctx scope.Context, ban proto.Ban, until time.Time) error {
 
 func (b *Backend) Unban(ctx scope.Context, ban proto.Ban) error { return b.unban(ctx, global, ban) }
 
+func (b *Backend) IsBanned(ctx scope.Context, room string, id proto.UserID) (bool, error) {
+	n, err := b.DbMap.SelectInt(
+		"SELECT COUNT(*) FROM banned_agent"+
+			" WHERE agent_id = $1 AND (room IS NULL OR room = $2) AND (expires IS NULL OR expires > NOW())",
+		id.String(), room)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 func (b *Backend) ban(ctx scope.Context, rb *RoomBinding, ban proto.Ban, until time.Time) error {
 	switch {
 	case ban.IP != "":
@@ -602,6 +636,11 @@ func (b *Backend) sendMessageToRoom(
 		return proto.Message{}, err
 	}
 
+	if err := notePMMessage(t, stored); err != nil {
+		rollback(ctx, t)
+		return proto.Message{}, err
+	}
+
 	result := stored.ToTransmission()
 	event := proto.SendEvent(result)
 	if err := rb.broadcast(ctx, t, proto.SendEventType, &event, exclude...); err != nil {
@@ -684,15 +723,6 @@ func (b *Backend) join(ctx scope.Context, rb *RoomBinding, session proto.Session
 	}
 	virtualAddress := row.Address
 
-	// Look up session's nick.
-	nickRow, err := t.Get(Nick{}, string(session.Identity().ID()), rb.RoomName)
-	if err != nil && err != sql.ErrNoRows {
-		return "", err
-	}
-	if nickRow != nil {
-		session.SetName(nickRow.(*Nick).Nick)
-	}
-
 	// Write to session log.
 	// TODO: do proper upsert simulation
 	entry := &SessionLog{
@@ -763,6 +793,38 @@ func (b *Backend) join(ctx scope.Context, rb *RoomBinding, session proto.Session
 	return virtualAddress, nil
 }
 
+func (b *Backend) knock(ctx scope.Context, rb *RoomBinding, session proto.Session) error {
+	client := &proto.Client{}
+	if !client.FromContext(ctx) {
+		return fmt.Errorf("client data not found in scope")
+	}
+
+	// The listener is left disabled, so it receives notifications addressed to
+	// its user but not broadcasts to the room.
+	b.Lock()
+	lm, ok := b.listeners[rb.RoomName]
+	if !ok {
+		lm = ListenerMap{}
+		b.listeners[rb.RoomName] = lm
+	}
+	lm[session.ID()] = Listener{Session: session, Client: client}
+	b.Unlock()
+
+	return nil
+}
+
+func (b *Backend) cancelKnock(ctx scope.Context, rb *RoomBinding, session proto.Session) error {
+	b.Lock()
+	if lm, ok := b.listeners[rb.RoomName]; ok {
+		if listener, ok := lm[session.ID()]; ok && !listener.enabled {
+			delete(lm, session.ID())
+		}
+	}
+	b.Unlock()
+
+	return nil
+}
+
 func (b *Backend) part(ctx scope.Context, rb *RoomBinding, session proto.Session) error {
 	t, err := b.DbMap.Begin()
 	if err != nil {
@@ -917,10 +979,19 @@ func (b *Backend) Peers() []cluster.PeerDesc { return b.cluster.Peers() }
 
 func (b *Backend) AccountManager() proto.AccountManager { return &AccountManagerBinding{b} }
 func (b *Backend) AgentTracker() proto.AgentTracker     { return &AgentTrackerBinding{b} }
+func (b *Backend) Blocks() proto.BlockTracker           { return &BlockTracker{b} }
 func (b *Backend) EmailTracker() proto.EmailTracker     { return &EmailTracker{b} }
 func (b *Backend) Jobs() jobs.JobService                { return &JobService{b} }
 func (b *Backend) PMTracker() proto.PMTracker           { return &PMTracker{b} }
 
+func (b *Backend) AccessRequests() proto.AccessRequestTracker     { return &AccessRequestTracker{b} }
+func (b *Backend) AccountData() proto.AccountDataTracker           { return &AccountDataTracker{b} }
+func (b *Backend) EmailPreferences() proto.EmailPreferenceTracker { return &EmailPreferenceTracker{b} }
+func (b *Backend) LoginAttempts() proto.LoginAttemptTracker       { return &LoginAttemptTracker{b} }
+func (b *Backend) NickReservations() proto.NickReservationTracker { return &NickReservationTracker{b} }
+func (b *Backend) Notifications() proto.NotificationTracker       { return &NotificationTracker{b} }
+func (b *Backend) PendingInvites() proto.PendingInviteTracker     { return &PendingInviteTracker{b} }
+
 func (b *Backend) jobQueueListener() *jobQueueListener {
 	b.Lock()
 	defer b.Unlock()
@@ -931,6 +1002,28 @@ func (b *Backend) jobQueueListener() *jobQueueListener {
 	return b.jql
 }
 
+func (b *Backend) IsUserOnline(ctx scope.Context, userID proto.UserID) (bool, error) {
+	var rows []struct {
+		ServerID  string `db:"server_id"`
+		ServerEra string `db:"server_era"`
+	}
+	_, err := b.DbMap.Select(
+		&rows, "SELECT server_id, server_era FROM presence WHERE user_id = $1", string(userID))
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	// Ignore presence left behind by servers that have since gone away.
+	b.Lock()
+	defer b.Unlock()
+	for _, row := range rows {
+		if b.peers[row.ServerID] == row.ServerEra {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 type BroadcastMessage struct {
 	Room    string
 	Exclude []string
@@ -939,12 +1032,28 @@ type BroadcastMessage struct {
 }
 
 func (b *Backend) NotifyUser(ctx scope.Context, userID proto.UserID, packetType proto.PacketType, payload interface{}, excluding ...proto.Session) error {
+	return b.notifyUser(ctx, "", userID, packetType, payload, excluding...)
+}
+
+// NotifyUserInRoom is like NotifyUser, but only reaches the user's sessions in
+// the given room.
+func (b *Backend) NotifyUserInRoom(
+	ctx scope.Context, room string, userID proto.UserID, packetType proto.PacketType, payload interface{}) error {
+
+	return b.notifyUser(ctx, room, userID, packetType, payload)
+}
+
+func (b *Backend) notifyUser(
+	ctx scope.Context, room string, userID proto.UserID, packetType proto.PacketType, payload interface{},
+	excluding ...proto.Session) error {
+
 	encodedPayload, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
 	packet := &proto.Packet{Type: packetType, Data: json.RawMessage(encodedPayload)}
 	broadcastMsg := BroadcastMessage{
+		Room:    room,
 		Event:   packet,
 		Exclude: make([]string, 0, len(excluding)),
 		UserID:  userID,
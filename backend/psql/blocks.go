@@ -0,0 +1,79 @@
+package psql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type AccountBlock struct {
+	AccountID string `db:"account_id"`
+	UserID    string `db:"user_id"`
+	Created   time.Time
+}
+
+type BlockTracker struct {
+	*Backend
+}
+
+func (t *BlockTracker) Block(ctx scope.Context, accountID snowflake.Snowflake, userID proto.UserID) error {
+	row := &AccountBlock{
+		AccountID: accountID.String(),
+		UserID:    string(userID),
+		Created:   time.Now(),
+	}
+	if err := t.DbMap.Insert(row); err != nil {
+		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *BlockTracker) Unblock(ctx scope.Context, accountID snowflake.Snowflake, userID proto.UserID) error {
+	res, err := t.DbMap.Exec(
+		"DELETE FROM account_block WHERE account_id = $1 AND user_id = $2", accountID.String(), string(userID))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return proto.ErrUserNotBlocked
+	}
+	return nil
+}
+
+func (t *BlockTracker) List(ctx scope.Context, accountID snowflake.Snowflake) ([]proto.UserID, error) {
+	var rows []AccountBlock
+	_, err := t.DbMap.Select(
+		&rows,
+		"SELECT account_id, user_id, created FROM account_block WHERE account_id = $1 ORDER BY created",
+		accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	userIDs := make([]proto.UserID, len(rows))
+	for i, row := range rows {
+		userIDs[i] = proto.UserID(row.UserID)
+	}
+	return userIDs, nil
+}
+
+func (t *BlockTracker) IsBlocked(ctx scope.Context, accountID snowflake.Snowflake, userID proto.UserID) (bool, error) {
+	n, err := t.DbMap.SelectInt(
+		"SELECT COUNT(*) FROM account_block WHERE account_id = $1 AND user_id = $2",
+		accountID.String(), string(userID))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -3,6 +3,7 @@ package psql
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"euphoria.io/heim/proto"
@@ -78,32 +79,35 @@ func (e *Email) FromBackend(ref *emails.EmailRef) {
 	}
 }
 
+// An EmailReply records the use of an email reply address.
+type EmailReply struct {
+	Token     string
+	AccountID string `db:"account_id"`
+	Expires   time.Time
+}
+
 type EmailTracker struct {
 	Backend *Backend
 }
 
 func (et *EmailTracker) Send(
 	ctx scope.Context, js jobs.JobService, templater *templates.Templater, deliverer emails.Deliverer,
-	account proto.Account, to, templateName string, data interface{}) (
+	account proto.Account, msgID, to, templateName string, data interface{}) (
 	*emails.EmailRef, error) {
 
+	if err := proto.CheckEmailPreferences(ctx, et.Backend.EmailPreferences(), account.ID(), templateName); err != nil {
+		return nil, err
+	}
+
 	if to == "" {
 		to, _ = account.Email()
 	}
-
-	// choose a Message-ID
-	sf, err := snowflake.New()
-	if err != nil {
+	if err := proto.CheckEmailDeliverable(account, to, templateName); err != nil {
 		return nil, err
 	}
-	domain := "heim"
-	if deliverer != nil {
-		domain = deliverer.LocalName()
-	}
-	msgID := fmt.Sprintf("<%s@%s>", sf, domain)
 
 	// construct the email
-	ref, err := emails.NewEmail(templater, msgID, to, templateName, data)
+	ref, err := emails.NewEmail(templater, msgID, to, templateName, account.Locale(), data)
 	if err != nil {
 		return nil, err
 	}
@@ -196,7 +200,35 @@ func (et *EmailTracker) Get(ctx scope.Context, accountID snowflake.Snowflake, id
 }
 
 func (et *EmailTracker) List(ctx scope.Context, accountID snowflake.Snowflake, n int, before time.Time) ([]*emails.EmailRef, error) {
-	return nil, notImpl
+	if before.IsZero() {
+		before = time.Now()
+	}
+
+	cols, err := allColumns(et.Backend.DbMap, Email{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := et.Backend.DbMap.Select(
+		Email{},
+		fmt.Sprintf("SELECT %s FROM email WHERE account_id = $1 AND created < $2 ORDER BY created DESC LIMIT $3", cols),
+		accountID.String(), before, n)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []*emails.EmailRef{}, nil
+		}
+		return nil, err
+	}
+
+	refs := make([]*emails.EmailRef, len(rows))
+	for i, row := range rows {
+		ref, err := row.(*Email).ToBackend()
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = ref
+	}
+	return refs, nil
 }
 
 func (et *EmailTracker) MarkDelivered(ctx scope.Context, accountID snowflake.Snowflake, id string) error {
@@ -236,3 +268,44 @@ func (et *EmailTracker) MarkDelivered(ctx scope.Context, accountID snowflake.Sno
 
 	return nil
 }
+
+func (et *EmailTracker) UseReplyAddress(
+	ctx scope.Context, accountID snowflake.Snowflake, token string, expires time.Time) error {
+
+	// Forget addresses that can no longer be used anyway.
+	if _, err := et.Backend.DbMap.Exec("DELETE FROM email_reply WHERE expires < NOW()"); err != nil {
+		return err
+	}
+
+	row := &EmailReply{
+		Token:     token,
+		AccountID: accountID.String(),
+		Expires:   expires,
+	}
+	if err := et.Backend.DbMap.Insert(row); err != nil {
+		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+			return proto.ErrEmailReplyUsed
+		}
+		return err
+	}
+	return nil
+}
+
+func (et *EmailTracker) MarkFailed(ctx scope.Context, id string) (*emails.EmailRef, error) {
+	cols, err := allColumns(et.Backend.DbMap, Email{}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var email Email
+	err = et.Backend.DbMap.SelectOne(
+		&email, fmt.Sprintf("UPDATE email SET failed = NOW() WHERE id = $1 RETURNING %s", cols), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrEmailNotFound
+		}
+		return nil, err
+	}
+
+	return email.ToBackend()
+}
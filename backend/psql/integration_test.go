@@ -48,6 +48,7 @@ func TestBackend(t *testing.T) {
 		"job_steal(text, text)",
 		"job_complete(bigint, integer, bytea)",
 		"job_fail(bigint, integer, text, bytea)",
+		"job_fail(bigint, integer, text, bytea, bigint)",
 		"job_cancel(bigint)",
 		"virtualize_address(text, inet)",
 		"virtualize_inet4(text, inet)",
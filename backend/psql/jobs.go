@@ -43,11 +43,37 @@ type JobItem struct {
 	Data                   []byte
 	Created                time.Time
 	Due                    time.Time
+	RunAt                  time.Time `db:"run_at"`
 	Claimed                gorp.NullTime
 	Completed              gorp.NullTime
 	MaxWorkDurationSeconds int32 `db:"max_work_duration_seconds"`
 	AttemptsMade           int32 `db:"attempts_made"`
 	AttemptsRemaining      int32 `db:"attempts_remaining"`
+	BackoffMilliseconds    int64 `db:"backoff_milliseconds"`
+	Priority               int32
+	DeadLettered           gorp.NullTime `db:"dead_lettered"`
+	FailureReason          string        `db:"failure_reason"`
+}
+
+func (row *JobItem) Job() *jobs.Job {
+	job := &jobs.Job{
+		ID:                snowflake.Snowflake(row.ID),
+		Type:              jobs.JobType(row.JobType),
+		Data:              json.RawMessage(row.Data),
+		Created:           row.Created,
+		Due:               row.Due,
+		RunAt:             row.RunAt,
+		MaxWorkDuration:   time.Duration(row.MaxWorkDurationSeconds) * time.Second,
+		Backoff:           time.Duration(row.BackoffMilliseconds) * time.Millisecond,
+		Priority:          row.Priority,
+		AttemptsMade:      row.AttemptsMade,
+		AttemptsRemaining: row.AttemptsRemaining,
+		FailureReason:     row.FailureReason,
+	}
+	if row.DeadLettered.Valid {
+		job.DeadLettered = row.DeadLettered.Time
+	}
+	return job
 }
 
 type JobLog struct {
@@ -62,6 +88,11 @@ type JobLog struct {
 	Log       []byte
 }
 
+type JobSchedule struct {
+	Name     string
+	LastTick time.Time `db:"last_tick"`
+}
+
 type JobService struct {
 	*Backend
 }
@@ -105,6 +136,68 @@ func (js *JobService) GetQueue(ctx scope.Context, name string) (jobs.JobQueue, e
 	return jq.Bind(js.Backend), nil
 }
 
+func (js *JobService) AddRecurring(ctx scope.Context, rj *jobs.RecurringJob, tick time.Time) (
+	snowflake.Snowflake, error) {
+
+	q, err := js.GetQueue(ctx, rj.Queue)
+	if err != nil {
+		return 0, err
+	}
+	jq := q.(*JobQueueBinding)
+
+	options := append([]jobs.JobOption{jobs.JobOptions.Due(tick)}, rj.Options...)
+	job, err := jq.newJob(rj.Type, rj.Payload, options...)
+	if err != nil {
+		return 0, err
+	}
+
+	t, err := js.DbMap.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Claim the tick by advancing the recurring job's last tick to it, or
+	// recording its first. Concurrent schedulers block on the row, and then
+	// find the tick already claimed.
+	res, err := t.Exec(
+		"UPDATE job_schedule SET last_tick = $2 WHERE name = $1 AND last_tick < $2", rj.Name, tick)
+	if err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+	if n == 0 {
+		_, err := t.Exec("INSERT INTO job_schedule (name, last_tick) VALUES ($1, $2)", rj.Name, tick)
+		if err != nil {
+			rollback(ctx, t)
+			if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+				return 0, jobs.ErrJobAlreadyScheduled
+			}
+			return 0, err
+		}
+	}
+
+	if err := jq.insertJob(t, job); err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+
+	if err := jq.notify(t); err != nil {
+		rollback(ctx, t)
+		return 0, err
+	}
+
+	if err := t.Commit(); err != nil {
+		return 0, err
+	}
+
+	return job.ID, nil
+}
+
 func (jq *JobQueueBinding) Name() string { return jq.JobQueue.Name }
 
 func (jq *JobQueueBinding) newJob(
@@ -121,8 +214,10 @@ func (jq *JobQueueBinding) newJob(
 		Type:              jobType,
 		Created:           now,
 		Due:               now,
+		RunAt:             now,
 		AttemptsRemaining: math.MaxInt32,
 		MaxWorkDuration:   jobs.DefaultMaxWorkDuration,
+		Backoff:           jobs.BackoffDuration,
 	}
 	data, err := json.Marshal(payload)
 	if err != nil {
@@ -149,9 +244,12 @@ func (jq *JobQueueBinding) insertJob(db gorp.SqlExecutor, job *jobs.Job) error {
 		Data:                   []byte(job.Data),
 		Created:                job.Created,
 		Due:                    job.Due,
+		RunAt:                  job.RunAt,
 		AttemptsMade:           job.AttemptsMade,
 		AttemptsRemaining:      job.AttemptsRemaining,
 		MaxWorkDurationSeconds: int32(job.MaxWorkDuration / time.Second),
+		BackoffMilliseconds:    int64(job.Backoff / time.Millisecond),
+		Priority:               job.Priority,
 	}
 	if job.JobClaim != nil {
 		item.Claimed = gorp.NullTime{
@@ -179,6 +277,13 @@ func (jq *JobQueueBinding) insertJob(db gorp.SqlExecutor, job *jobs.Job) error {
 	return nil
 }
 
+// notify wakes waiters on the queue, once the given transaction commits.
+func (jq *JobQueueBinding) notify(db gorp.SqlExecutor) error {
+	escaped := strings.Replace(jq.Name(), "'", "''", -1)
+	_, err := db.Exec(fmt.Sprintf("NOTIFY job_item, '%s'", escaped))
+	return err
+}
+
 func (jq *JobQueueBinding) Add(
 	ctx scope.Context, jobType jobs.JobType, payload interface{}, options ...jobs.JobOption) (
 	snowflake.Snowflake, error) {
@@ -198,8 +303,7 @@ func (jq *JobQueueBinding) Add(
 		return 0, err
 	}
 
-	escaped := strings.Replace(jq.Name(), "'", "''", -1)
-	if _, err := t.Exec(fmt.Sprintf("NOTIFY job_item, '%s'", escaped)); err != nil {
+	if err := jq.notify(t); err != nil {
 		rollback(ctx, t)
 		return 0, err
 	}
@@ -261,6 +365,27 @@ func (jq *JobQueueBinding) addAndClaim(
 }
 
 func (jq *JobQueueBinding) WaitForJob(ctx scope.Context) error {
+	// Nothing is notified when a delayed job becomes claimable, so set a
+	// timer for the next one.
+	var row struct {
+		Next gorp.NullTime
+	}
+	err := jq.Backend.DbMap.SelectOne(
+		&row,
+		"SELECT MIN(run_at) AS next FROM job_item"+
+			" WHERE queue = $1 AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0"+
+			" AND run_at > NOW()",
+		jq.Name())
+	if err != nil {
+		return err
+	}
+	if row.Next.Valid {
+		timer := time.AfterFunc(row.Next.Time.Sub(time.Now()), func() {
+			jq.Backend.jobQueueListener().wakeAll(jq.Name())
+		})
+		defer timer.Stop()
+	}
+
 	ch := make(chan error)
 
 	// background goroutine to wait on condition
@@ -304,21 +429,13 @@ func (jq *JobQueueBinding) TryClaim(ctx scope.Context, handlerID string) (*jobs.
 		}
 		return nil, err
 	}
-	job := &jobs.Job{
-		ID:                snowflake.Snowflake(row.ID),
-		Type:              jobs.JobType(row.JobType),
-		Data:              json.RawMessage(row.Data),
-		Created:           row.Created,
-		Due:               row.Due,
-		MaxWorkDuration:   time.Duration(row.MaxWorkDurationSeconds) * time.Second,
-		AttemptsMade:      row.AttemptsMade,
-		AttemptsRemaining: row.AttemptsRemaining - 1,
-		JobClaim: &jobs.JobClaim{
-			JobID:         snowflake.Snowflake(row.ID),
-			HandlerID:     handlerID,
-			AttemptNumber: row.AttemptsMade,
-			Queue:         jq,
-		},
+	job := row.Job()
+	job.AttemptsRemaining -= 1
+	job.JobClaim = &jobs.JobClaim{
+		JobID:         job.ID,
+		HandlerID:     handlerID,
+		AttemptNumber: row.AttemptsMade,
+		Queue:         jq,
 	}
 	return job, nil
 }
@@ -336,21 +453,13 @@ func (jq *JobQueueBinding) TrySteal(ctx scope.Context, handlerID string) (*jobs.
 		}
 		return nil, err
 	}
-	job := &jobs.Job{
-		ID:                snowflake.Snowflake(row.ID),
-		Type:              jobs.JobType(row.JobType),
-		Data:              json.RawMessage(row.Data),
-		Created:           row.Created,
-		Due:               row.Due,
-		MaxWorkDuration:   time.Duration(row.MaxWorkDurationSeconds) * time.Second,
-		AttemptsMade:      row.AttemptsMade,
-		AttemptsRemaining: row.AttemptsRemaining - 1,
-		JobClaim: &jobs.JobClaim{
-			JobID:         snowflake.Snowflake(row.ID),
-			HandlerID:     handlerID,
-			AttemptNumber: row.AttemptsMade + 1,
-			Queue:         jq,
-		},
+	job := row.Job()
+	job.AttemptsRemaining -= 1
+	job.JobClaim = &jobs.JobClaim{
+		JobID:         job.ID,
+		HandlerID:     handlerID,
+		AttemptNumber: row.AttemptsMade + 1,
+		Queue:         jq,
 	}
 	return job, nil
 }
@@ -369,7 +478,9 @@ func (jq *JobQueueBinding) Complete(
 func (jq *JobQueueBinding) Fail(
 	ctx scope.Context, jobID snowflake.Snowflake, handlerID string, attemptNumber int32, reason string, log []byte) error {
 
-	_, err := jq.Backend.DbMap.Exec("SELECT job_fail($1,$2,$3,$4)", jobID, attemptNumber, reason, log)
+	_, err := jq.Backend.DbMap.Exec(
+		"SELECT job_fail($1,$2,$3,$4,$5)",
+		jobID, attemptNumber, reason, log, int64(jobs.MaxBackoffDuration/time.Millisecond))
 	return err
 }
 
@@ -378,13 +489,16 @@ func (jq *JobQueueBinding) Stats(ctx scope.Context) (jobs.JobQueueStats, error)
 		Waiting sql.NullInt64
 		Due     sql.NullInt64
 		Claimed sql.NullInt64
+		Dead    sql.NullInt64
 	}
 
 	err := jq.Backend.DbMap.SelectOne(
 		&row,
-		"SELECT COUNT(*)-SUM(is_claimed) AS waiting, SUM(is_due) AS due, SUM(is_claimed) AS claimed FROM ("+
-			"SELECT CASE WHEN due <= NOW() THEN 1 ELSE 0 END AS is_due,"+
-			" CASE WHEN jl.job_id IS NOT NULL AND jl.started + job.max_work_duration_seconds * interval '1 second' > NOW() THEN 1 ELSE 0 END AS is_claimed"+
+		"SELECT COUNT(*)-SUM(is_claimed)-SUM(is_dead) AS waiting, SUM(is_due) AS due, SUM(is_claimed) AS claimed,"+
+			" SUM(is_dead) AS dead FROM ("+
+			"SELECT CASE WHEN dead_lettered IS NULL AND due <= NOW() AND run_at <= NOW() THEN 1 ELSE 0 END AS is_due,"+
+			" CASE WHEN dead_lettered IS NULL AND jl.job_id IS NOT NULL AND jl.started + job.max_work_duration_seconds * interval '1 second' > NOW() THEN 1 ELSE 0 END AS is_claimed,"+
+			" CASE WHEN dead_lettered IS NOT NULL THEN 1 ELSE 0 END AS is_dead"+
 			" FROM job_item job LEFT JOIN job_log jl ON job.id = jl.job_id AND jl.attempt = job.attempts_made-1"+
 			" WHERE job.queue = $1 AND job.completed IS NULL) AS t1",
 		jq.Name())
@@ -399,6 +513,9 @@ func (jq *JobQueueBinding) Stats(ctx scope.Context) (jobs.JobQueueStats, error)
 	if row.Claimed.Valid {
 		stats.Claimed = row.Claimed.Int64
 	}
+	if row.Dead.Valid {
+		stats.Dead = row.Dead.Int64
+	}
 	return stats, err
 }
 
@@ -430,6 +547,106 @@ func (jq *JobQueueBinding) Log(ctx scope.Context, jobID snowflake.Snowflake, att
 	return jl, nil
 }
 
+func (jq *JobQueueBinding) Get(ctx scope.Context, jobID snowflake.Snowflake) (*jobs.Job, error) {
+	var row JobItem
+	cols, err := allColumns(jq.Backend.DbMap, JobItem{}, "")
+	if err != nil {
+		return nil, err
+	}
+	err = jq.Backend.DbMap.SelectOne(
+		&row,
+		fmt.Sprintf("SELECT %s FROM job_item WHERE id = $1 AND queue = $2 AND completed IS NULL", cols),
+		jobID, jq.Name())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, jobs.ErrJobNotFound
+		}
+		return nil, err
+	}
+	return row.Job(), nil
+}
+
+func (jq *JobQueueBinding) DeadLetters(ctx scope.Context, n int) ([]*jobs.Job, error) {
+	cols, err := allColumns(jq.Backend.DbMap, JobItem{}, "")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := jq.Backend.DbMap.Select(
+		JobItem{},
+		fmt.Sprintf(
+			"SELECT %s FROM job_item"+
+				" WHERE queue = $1 AND completed IS NULL AND dead_lettered IS NOT NULL"+
+				" ORDER BY dead_lettered DESC, id DESC LIMIT $2",
+			cols),
+		jq.Name(), n)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*jobs.Job, len(rows))
+	for i, row := range rows {
+		result[i] = row.(*JobItem).Job()
+	}
+	return result, nil
+}
+
+func (jq *JobQueueBinding) Requeue(ctx scope.Context, jobID snowflake.Snowflake, attempts int32) error {
+	t, err := jq.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := t.Exec(
+		"UPDATE job_item SET dead_lettered = NULL, failure_reason = '', attempts_made = 0, attempts_remaining = $3, run_at = NOW()"+
+			" WHERE id = $1 AND queue = $2 AND completed IS NULL AND dead_lettered IS NOT NULL",
+		jobID, jq.Name(), attempts)
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		rollback(ctx, t)
+		return err
+	}
+	if n == 0 {
+		rollback(ctx, t)
+		return jobs.ErrJobNotFound
+	}
+
+	// Attempts are numbered from zero again, so the logs of the attempts
+	// that got the job dead-lettered have to go.
+	if _, err := t.Exec("DELETE FROM job_log WHERE job_id = $1", jobID); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	if err := jq.notify(t); err != nil {
+		rollback(ctx, t)
+		return err
+	}
+
+	return t.Commit()
+}
+
+func (jq *JobQueueBinding) Purge(ctx scope.Context, jobID snowflake.Snowflake) error {
+	res, err := jq.Backend.DbMap.Exec(
+		"UPDATE job_item SET completed = NOW()"+
+			" WHERE id = $1 AND queue = $2 AND completed IS NULL AND dead_lettered IS NOT NULL",
+		jobID, jq.Name())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return jobs.ErrJobNotFound
+	}
+	return nil
+}
+
 func newJobQueueListener(b *Backend) *jobQueueListener {
 	jql := &jobQueueListener{
 		Backend: b,
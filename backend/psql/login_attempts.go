@@ -0,0 +1,78 @@
+package psql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/scope"
+
+	"gopkg.in/gorp.v1"
+)
+
+type LoginFailure struct {
+	Key             string
+	Count           int
+	LastFailure     time.Time     `db:"last_failure"`
+	PreviousFailure gorp.NullTime `db:"previous_failure"`
+}
+
+type LoginAttemptTracker struct {
+	*Backend
+}
+
+func (t *LoginAttemptTracker) Attempt(
+	ctx scope.Context, key string, window time.Duration) (*proto.LoginFailures, error) {
+
+	now := time.Now()
+	failures, err := t.attempt(ctx, key, now, window)
+	if err != nil && strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+		// Another server recorded the first attempt concurrently; count on top of it.
+		failures, err = t.attempt(ctx, key, now, window)
+	}
+	return failures, err
+}
+
+func (t *LoginAttemptTracker) attempt(
+	ctx scope.Context, key string, now time.Time, window time.Duration) (*proto.LoginFailures, error) {
+
+	// Count the attempt and read back the failures before it in one
+	// statement, so that concurrent attempts each see the ones before them.
+	var row LoginFailure
+	err := t.DbMap.SelectOne(
+		&row,
+		"UPDATE login_failure SET"+
+			" count = CASE WHEN last_failure >= $3 THEN count + 1 ELSE 1 END,"+
+			" previous_failure = CASE WHEN last_failure >= $3 THEN last_failure END,"+
+			" last_failure = $2"+
+			" WHERE key = $1"+
+			" RETURNING key, count, last_failure, previous_failure",
+		key, now, now.Add(-window))
+	switch err {
+	case nil:
+		failures := &proto.LoginFailures{Key: key, Count: row.Count - 1}
+		if row.PreviousFailure.Valid {
+			failures.LastFailure = row.PreviousFailure.Time
+		}
+		return failures, nil
+	case sql.ErrNoRows:
+		row = LoginFailure{Key: key, Count: 1, LastFailure: now}
+		if err := t.DbMap.Insert(&row); err != nil {
+			return nil, err
+		}
+		return &proto.LoginFailures{Key: key}, nil
+	default:
+		return nil, err
+	}
+}
+
+func (t *LoginAttemptTracker) Forgive(ctx scope.Context, key string) error {
+	_, err := t.DbMap.Exec("UPDATE login_failure SET count = count - 1 WHERE key = $1 AND count > 0", key)
+	return err
+}
+
+func (t *LoginAttemptTracker) Reset(ctx scope.Context, key string) error {
+	_, err := t.DbMap.Exec("DELETE FROM login_failure WHERE key = $1", key)
+	return err
+}
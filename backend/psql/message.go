@@ -25,6 +25,7 @@ type Message struct {
 	SenderClientAddress string `db:"sender_client_address"`
 	SenderIsManager     bool   `db:"sender_is_manager"`
 	SenderIsStaff       bool   `db:"sender_is_staff"`
+	SenderIsVerified    bool   `db:"sender_is_verified"`
 
 	ServerID        string `db:"server_id"`
 	ServerEra       string `db:"server_era"`
@@ -50,6 +51,7 @@ func NewMessage(
 		SenderClientAddress: sessionView.ClientAddress,
 		SenderIsManager:     sessionView.IsManager,
 		SenderIsStaff:       sessionView.IsStaff,
+		SenderIsVerified:    sessionView.Verified,
 	}
 	if keyID != "" {
 		msg.EncryptionKeyID = sql.NullString{
@@ -69,6 +71,7 @@ func (m *Message) ToBackend() proto.Message {
 				Name:      m.SenderName,
 				ServerID:  m.ServerID,
 				ServerEra: m.ServerEra,
+				Verified:  m.SenderIsVerified,
 			},
 			ClientAddress: m.SenderClientAddress,
 			SessionID:     m.SessionID,
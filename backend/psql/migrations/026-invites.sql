@@ -0,0 +1,18 @@
+-- +migrate Up
+
+CREATE TABLE room_invite (
+    id text NOT NULL PRIMARY KEY,
+    room text NOT NULL,
+    key_id text NOT NULL,
+    creator_id text NOT NULL,
+    created timestamp with time zone NOT NULL,
+    expires timestamp with time zone,
+    max_uses integer NOT NULL DEFAULT 0,
+    uses integer NOT NULL DEFAULT 0
+);
+
+CREATE INDEX room_invite_room_key_id ON room_invite(room, key_id);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS room_invite;
@@ -0,0 +1,16 @@
+-- +migrate Up
+
+CREATE TABLE pending_room_invite (
+    email text NOT NULL,
+    room text NOT NULL,
+    creator_id text NOT NULL,
+    created timestamp with time zone NOT NULL,
+    expires timestamp with time zone NOT NULL,
+    PRIMARY KEY (email, room)
+);
+CREATE INDEX pending_room_invite_room ON pending_room_invite(room, created);
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS pending_room_invite_room;
+DROP TABLE IF EXISTS pending_room_invite;
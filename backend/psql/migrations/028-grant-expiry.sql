@@ -0,0 +1,15 @@
+-- +migrate Up
+
+ALTER TABLE room_capability ADD COLUMN expires timestamp with time zone;
+ALTER TABLE room_manager_capability ADD COLUMN expires timestamp with time zone;
+
+CREATE INDEX room_capability_expires ON room_capability(expires) WHERE expires IS NOT NULL;
+CREATE INDEX room_manager_capability_expires ON room_manager_capability(expires) WHERE expires IS NOT NULL;
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS room_manager_capability_expires;
+DROP INDEX IF EXISTS room_capability_expires;
+
+ALTER TABLE room_manager_capability DROP COLUMN IF EXISTS expires;
+ALTER TABLE room_capability DROP COLUMN IF EXISTS expires;
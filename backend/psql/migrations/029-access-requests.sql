@@ -0,0 +1,23 @@
+-- +migrate Up
+
+CREATE TABLE room_access_request (
+    id text NOT NULL PRIMARY KEY,
+    room text NOT NULL,
+    account_id text NOT NULL,
+    account_name text NOT NULL,
+    note text NOT NULL,
+    requested timestamp with time zone NOT NULL,
+    UNIQUE (room, account_id)
+);
+
+CREATE TABLE room_access_request_email (
+    room text NOT NULL,
+    account_id text NOT NULL,
+    emailed timestamp with time zone NOT NULL,
+    PRIMARY KEY (room, account_id)
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS room_access_request_email;
+DROP TABLE IF EXISTS room_access_request;
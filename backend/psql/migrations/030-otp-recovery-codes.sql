@@ -0,0 +1,11 @@
+-- +migrate Up
+
+CREATE TABLE otp_recovery_code (
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    digest text NOT NULL,
+    PRIMARY KEY (account_id, digest)
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS otp_recovery_code;
@@ -0,0 +1,12 @@
+-- +migrate Up
+-- track where logged in agents last connected from
+
+ALTER TABLE agent ADD last_seen timestamp with time zone;
+ALTER TABLE agent ADD last_ip text;
+ALTER TABLE agent ADD last_user_agent text;
+
+-- +migrate Down
+
+ALTER TABLE agent DROP IF EXISTS last_seen;
+ALTER TABLE agent DROP IF EXISTS last_ip;
+ALTER TABLE agent DROP IF EXISTS last_user_agent;
@@ -0,0 +1,14 @@
+-- +migrate Up
+-- count failed login attempts per account and per client address
+
+CREATE TABLE login_failure (
+    key text NOT NULL,
+    count integer NOT NULL,
+    last_failure timestamp with time zone NOT NULL,
+    previous_failure timestamp with time zone,
+    PRIMARY KEY (key)
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS login_failure;
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- distinguish backup identities, which don't become primary when verified
+
+ALTER TABLE personal_identity ADD backup boolean NOT NULL DEFAULT false;
+
+-- +migrate Down
+
+ALTER TABLE personal_identity DROP IF EXISTS backup;
@@ -0,0 +1,16 @@
+-- +migrate Up
+-- personal data exports, kept for download for a limited time
+
+CREATE TABLE account_data_export (
+    id text NOT NULL PRIMARY KEY,
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    created timestamp with time zone NOT NULL,
+    expires timestamp with time zone NOT NULL,
+    data bytea NOT NULL
+);
+
+CREATE INDEX account_data_export_account_id ON account_data_export(account_id);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS account_data_export;
@@ -0,0 +1,21 @@
+-- +migrate Up
+-- nicks reserved by accounts, keyed by their case- and space-folded form
+
+CREATE TABLE nick_reservation (
+    key text NOT NULL PRIMARY KEY,
+    nick text NOT NULL,
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    reserved timestamp with time zone NOT NULL
+);
+
+CREATE INDEX nick_reservation_account_id ON nick_reservation(account_id);
+
+ALTER TABLE message
+    ADD sender_is_verified BOOL DEFAULT false;
+
+-- +migrate Down
+
+ALTER TABLE message
+    DROP IF EXISTS sender_is_verified;
+
+DROP TABLE IF EXISTS nick_reservation;
@@ -0,0 +1,13 @@
+-- +migrate Up
+-- users blocked by each account
+
+CREATE TABLE account_block (
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    user_id text NOT NULL,
+    created timestamp with time zone NOT NULL,
+    PRIMARY KEY (account_id, user_id)
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS account_block;
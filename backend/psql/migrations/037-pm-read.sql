@@ -0,0 +1,31 @@
+-- +migrate Up
+-- how far each account has read in each of its private chats, and how many
+-- messages it has yet to read
+
+CREATE TABLE pm_read (
+    pm_id text NOT NULL REFERENCES pm(id) ON DELETE CASCADE,
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    last_read text NOT NULL,
+    unread integer NOT NULL DEFAULT 0,
+    last_message timestamp with time zone,
+    PRIMARY KEY (pm_id, account_id)
+);
+
+CREATE INDEX pm_read_account_id ON pm_read(account_id);
+
+-- Existing private chats start out read.
+INSERT INTO pm_read (pm_id, account_id, last_read, last_message)
+    SELECT pm.id, pm.initiator, COALESCE(MAX(m.id), ''), MAX(m.posted)
+        FROM pm LEFT JOIN message m ON m.room = 'pm:' || pm.id
+        GROUP BY pm.id, pm.initiator;
+
+INSERT INTO pm_read (pm_id, account_id, last_read, last_message)
+    SELECT pm.id, a.id, COALESCE(MAX(m.id), ''), MAX(m.posted)
+        FROM pm
+        JOIN account a ON pm.receiver = 'account:' || a.id
+        LEFT JOIN message m ON m.room = 'pm:' || pm.id
+        GROUP BY pm.id, a.id;
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS pm_read;
@@ -0,0 +1,41 @@
+-- +migrate Up
+-- mentions and private messages waiting to be emailed to offline accounts
+
+CREATE TABLE notification (
+    id text NOT NULL PRIMARY KEY,
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    kind text NOT NULL,
+    room text NOT NULL,
+    message_id text NOT NULL,
+    sender_name text NOT NULL,
+    excerpt text NOT NULL,
+    created timestamp with time zone NOT NULL
+);
+
+CREATE INDEX notification_account_id ON notification(account_id, id);
+
+-- accounts with a notification digest scheduled
+
+CREATE TABLE notification_digest (
+    account_id text NOT NULL PRIMARY KEY REFERENCES account(id) ON DELETE CASCADE
+);
+
+-- Index to find the live sessions of a user, to tell whether they're offline.
+ALTER TABLE presence ADD COLUMN user_id text NOT NULL DEFAULT '';
+CREATE INDEX presence_user_id ON presence(user_id);
+
+-- which optional emails each account wants to receive
+
+CREATE TABLE email_preferences (
+    account_id text NOT NULL PRIMARY KEY REFERENCES account(id) ON DELETE CASCADE,
+    mentions boolean NOT NULL DEFAULT true,
+    pms boolean NOT NULL DEFAULT true
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS email_preferences;
+DROP TABLE IF EXISTS notification_digest;
+DROP TABLE IF EXISTS notification;
+DROP INDEX IF EXISTS presence_user_id;
+ALTER TABLE presence DROP COLUMN IF EXISTS user_id;
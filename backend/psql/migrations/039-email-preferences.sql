@@ -0,0 +1,10 @@
+-- +migrate Up
+-- opt-outs for the remaining optional emails
+
+ALTER TABLE email_preferences ADD COLUMN access_requests boolean NOT NULL DEFAULT true;
+ALTER TABLE email_preferences ADD COLUMN invitations boolean NOT NULL DEFAULT true;
+
+-- +migrate Down
+
+ALTER TABLE email_preferences DROP COLUMN IF EXISTS invitations;
+ALTER TABLE email_preferences DROP COLUMN IF EXISTS access_requests;
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- personal identities whose email has bounced or drawn a complaint
+
+ALTER TABLE personal_identity ADD COLUMN undeliverable boolean NOT NULL DEFAULT false;
+
+-- +migrate Down
+
+ALTER TABLE personal_identity DROP COLUMN IF EXISTS undeliverable;
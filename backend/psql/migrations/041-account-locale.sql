@@ -0,0 +1,8 @@
+-- +migrate Up
+-- the locale each account prefers to receive email in
+
+ALTER TABLE account ADD COLUMN locale text NOT NULL DEFAULT '';
+
+-- +migrate Down
+
+ALTER TABLE account DROP COLUMN IF EXISTS locale;
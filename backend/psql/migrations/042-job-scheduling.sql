@@ -0,0 +1,257 @@
+-- +migrate Up
+-- not-before times for delayed jobs, and per-job retry backoff
+
+ALTER TABLE job_item ADD COLUMN run_at timestamp with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE job_item ADD COLUMN backoff_milliseconds bigint NOT NULL DEFAULT 5000;
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job
+                    WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                        AND run_at <= NOW()
+                    ORDER BY due, id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job
+                            WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                                AND run_at <= NOW()
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                        FROM jobs
+                        WHERE jobs.id IS NOT NULL
+                        LIMIT 1
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_steal(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job, job_log as jl
+                    WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                        AND job.completed IS NULL
+                        AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                        AND jl.handler_id != _handler_id
+                        AND job.run_at <= NOW()
+                    ORDER BY job.due, job.id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job, job_log AS jl
+                            WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                                AND job.completed IS NULL
+                                AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                                AND jl.handler_id != _handler_id
+                                AND job.run_at <= NOW()
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item
+        SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1
+        WHERE id = item.id;
+
+    UPDATE job_log SET stolen = NOW(), stolen_by = _handler_id WHERE job_id = item.id AND attempt = item.attempts_made-1;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+DROP FUNCTION IF EXISTS job_fail(bigint, integer, text, bytea);
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_fail(_job_id bigint, _attempt integer, _error text, _log bytea, _max_backoff_milliseconds bigint) RETURNS VOID AS
+$$
+BEGIN
+    PERFORM pg_advisory_lock(_job_id);
+    UPDATE job_item
+        SET claimed = NULL,
+            run_at = NOW() + LEAST(backoff_milliseconds * power(2, LEAST(_attempt, 30)), _max_backoff_milliseconds) * interval '1 millisecond'
+        WHERE id = _job_id;
+    UPDATE job_log SET finished = NOW(), outcome = _error, log = _log WHERE job_id = _job_id AND attempt = _attempt;
+    PERFORM pg_advisory_unlock(_job_id);
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_fail(bigint, integer, text, bytea, bigint) IS 'Releases a claim on a job but leaves it uncompleted, to be retried after a backoff that doubles with each attempt.';
+
+-- +migrate Down
+
+DROP FUNCTION IF EXISTS job_fail(bigint, integer, text, bytea, bigint);
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_fail(_job_id bigint, _attempt integer, _error text, _log bytea) RETURNS VOID AS
+$$
+BEGIN
+    PERFORM pg_advisory_lock(_job_id);
+    UPDATE job_item SET claimed = NULL WHERE id = _job_id;
+    UPDATE job_log SET finished = NOW(), outcome = _error, log = _log WHERE job_id = _job_id AND attempt = _attempt;
+    PERFORM pg_advisory_unlock(_job_id);
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_fail(bigint, integer, text, bytea) IS 'Releases a claim on a job but leaves it uncompleted.';
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_steal(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job, job_log as jl
+                    WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                        AND job.completed IS NULL
+                        AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                        AND jl.handler_id != _handler_id
+                    ORDER BY job.due, job.id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job, job_log AS jl
+                            WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                                AND job.completed IS NULL
+                                AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                                AND jl.handler_id != _handler_id
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item
+        SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1
+        WHERE id = item.id;
+
+    UPDATE job_log SET stolen = NOW(), stolen_by = _handler_id WHERE job_id = item.id AND attempt = item.attempts_made-1;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job
+                    WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                    ORDER BY due, id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job
+                            WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                        FROM jobs
+                        WHERE jobs.id IS NOT NULL
+                        LIMIT 1
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+ALTER TABLE job_item DROP COLUMN IF EXISTS backoff_milliseconds;
+ALTER TABLE job_item DROP COLUMN IF EXISTS run_at;
@@ -0,0 +1,11 @@
+-- +migrate Up
+-- the last tick each recurring job was enqueued for
+
+CREATE TABLE job_schedule (
+    name text NOT NULL PRIMARY KEY,
+    last_tick timestamp with time zone NOT NULL
+);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS job_schedule;
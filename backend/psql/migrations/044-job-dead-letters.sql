@@ -0,0 +1,287 @@
+-- +migrate Up
+-- job priorities, and dead letters for jobs that fail their final attempt
+
+ALTER TABLE job_item ADD COLUMN priority integer NOT NULL DEFAULT 0;
+ALTER TABLE job_item ADD COLUMN dead_lettered timestamp with time zone;
+ALTER TABLE job_item ADD COLUMN failure_reason text NOT NULL DEFAULT '';
+CREATE INDEX job_item_queue_dead_lettered ON job_item(queue, dead_lettered) WHERE dead_lettered IS NOT NULL;
+CREATE INDEX job_item_queue_priority_due ON job_item(queue, priority DESC, due, id)
+    WHERE claimed IS NULL AND completed IS NULL;
+
+-- jobs that already used up their attempts would otherwise sit in the queue forever
+UPDATE job_item SET dead_lettered = NOW() WHERE completed IS NULL AND attempts_remaining <= 0;
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job
+                    WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                        AND run_at <= NOW()
+                    ORDER BY priority DESC, due, id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job
+                            WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                                AND run_at <= NOW()
+                                AND (-job.priority, job.due, job.id) > (-jobs.priority, jobs.due, jobs.id)
+                            ORDER BY priority DESC, due, id
+                            LIMIT 1
+                        ) AS job
+                        FROM jobs
+                        WHERE jobs.id IS NOT NULL
+                        LIMIT 1
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_steal(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job, job_log as jl
+                    WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                        AND job.completed IS NULL
+                        AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                        AND jl.handler_id != _handler_id
+                        AND job.run_at <= NOW() AND job.dead_lettered IS NULL
+                    ORDER BY job.due, job.id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job, job_log AS jl
+                            WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                                AND job.completed IS NULL
+                                AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                                AND jl.handler_id != _handler_id
+                                AND job.run_at <= NOW() AND job.dead_lettered IS NULL
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    IF item.attempts_remaining <= 0 THEN
+        UPDATE job_item
+            SET claimed = NULL, dead_lettered = NOW(), failure_reason = 'claim expired on final attempt'
+            WHERE id = item.id;
+        UPDATE job_log SET finished = NOW(), outcome = 'claim expired'
+            WHERE job_id = item.id AND attempt = item.attempts_made-1;
+        PERFORM pg_advisory_unlock(item.id);
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item
+        SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1
+        WHERE id = item.id;
+
+    UPDATE job_log SET stolen = NOW(), stolen_by = _handler_id WHERE job_id = item.id AND attempt = item.attempts_made-1;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_steal(text, text) IS 'Steals an expired outstanding claim from another _handler_id on an uncompleted job. Returns the job_item row of the job, or NULL if there are no claims to steal. An expired claim on the final attempt dead-letters the job instead.';
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_fail(_job_id bigint, _attempt integer, _error text, _log bytea, _max_backoff_milliseconds bigint) RETURNS VOID AS
+$$
+BEGIN
+    PERFORM pg_advisory_lock(_job_id);
+    UPDATE job_item
+        SET claimed = NULL,
+            run_at = NOW() + LEAST(backoff_milliseconds * power(2, LEAST(_attempt, 30)), _max_backoff_milliseconds) * interval '1 millisecond'
+        WHERE id = _job_id;
+    UPDATE job_item
+        SET dead_lettered = NOW(), failure_reason = _error
+        WHERE id = _job_id AND attempts_remaining <= 0 AND attempts_made = _attempt+1;
+    UPDATE job_log SET finished = NOW(), outcome = _error, log = _log WHERE job_id = _job_id AND attempt = _attempt;
+    PERFORM pg_advisory_unlock(_job_id);
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_fail(bigint, integer, text, bytea, bigint) IS 'Releases a claim on a job but leaves it uncompleted, to be retried after a backoff that doubles with each attempt, or dead-lettered if that was its final attempt.';
+
+-- +migrate Down
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_fail(_job_id bigint, _attempt integer, _error text, _log bytea, _max_backoff_milliseconds bigint) RETURNS VOID AS
+$$
+BEGIN
+    PERFORM pg_advisory_lock(_job_id);
+    UPDATE job_item
+        SET claimed = NULL,
+            run_at = NOW() + LEAST(backoff_milliseconds * power(2, LEAST(_attempt, 30)), _max_backoff_milliseconds) * interval '1 millisecond'
+        WHERE id = _job_id;
+    UPDATE job_log SET finished = NOW(), outcome = _error, log = _log WHERE job_id = _job_id AND attempt = _attempt;
+    PERFORM pg_advisory_unlock(_job_id);
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_fail(bigint, integer, text, bytea, bigint) IS 'Releases a claim on a job but leaves it uncompleted, to be retried after a backoff that doubles with each attempt.';
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_steal(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job, job_log as jl
+                    WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                        AND job.completed IS NULL
+                        AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                        AND jl.handler_id != _handler_id
+                        AND job.run_at <= NOW()
+                    ORDER BY job.due, job.id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job, job_log AS jl
+                            WHERE job.queue = _queue AND jl.job_id = job.id AND attempt = job.attempts_made-1
+                                AND job.completed IS NULL
+                                AND jl.started < NOW() - max_work_duration_seconds * interval '1 second'
+                                AND jl.handler_id != _handler_id
+                                AND job.run_at <= NOW()
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item
+        SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1
+        WHERE id = item.id;
+
+    UPDATE job_log SET stolen = NOW(), stolen_by = _handler_id WHERE job_id = item.id AND attempt = item.attempts_made-1;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+COMMENT ON FUNCTION job_steal(text, text) IS 'Steals an expired outstanding claim from another _handler_id on an uncompleted job. Returns the job_item row of the job, or NULL if there are no claims to steal.';
+
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION job_claim(_queue text, _handler_id text) RETURNS SETOF job_item AS
+$$
+DECLARE
+    item job_item%rowtype;
+BEGIN
+    WITH RECURSIVE jobs AS (
+        SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+            FROM (
+                SELECT job
+                    FROM job_item AS job
+                    WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                        AND run_at <= NOW()
+                    ORDER BY due, id
+                    LIMIT 1
+                ) AS t1
+        UNION ALL (
+            SELECT (job).*, pg_try_advisory_lock((job).id) AS locked
+                FROM (
+                    SELECT (
+                        SELECT job
+                            FROM job_item AS job
+                            WHERE job.queue = _queue AND claimed IS NULL AND completed IS NULL AND attempts_remaining > 0
+                                AND run_at <= NOW()
+                                AND (due, id) > (job.due, job.id)
+                            ORDER BY due, id
+                            LIMIT 1
+                        ) AS job
+                        FROM jobs
+                        WHERE jobs.id IS NOT NULL
+                        LIMIT 1
+                    ) AS t1
+                )
+            ) SELECT * INTO item FROM jobs WHERE locked LIMIT 1;
+
+    IF item IS NULL THEN
+        RETURN;
+    END IF;
+
+    item.claimed := NOW();
+    UPDATE job_item SET claimed = item.claimed, attempts_made = attempts_made+1, attempts_remaining = attempts_remaining-1 WHERE id = item.id;
+    INSERT INTO job_log (job_id, attempt, handler_id, started) VALUES (item.id, item.attempts_made, _handler_id, item.claimed);
+
+    PERFORM pg_advisory_unlock(item.id);
+    RETURN NEXT item;
+    RETURN;
+END;
+$$
+LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+DROP INDEX IF EXISTS job_item_queue_priority_due;
+DROP INDEX IF EXISTS job_item_queue_dead_lettered;
+ALTER TABLE job_item DROP COLUMN IF EXISTS failure_reason;
+ALTER TABLE job_item DROP COLUMN IF EXISTS dead_lettered;
+ALTER TABLE job_item DROP COLUMN IF EXISTS priority;
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- record when each agent last logged into an account
+
+ALTER TABLE agent ADD COLUMN logged_in timestamp with time zone;
+
+-- +migrate Down
+
+ALTER TABLE agent DROP COLUMN IF EXISTS logged_in;
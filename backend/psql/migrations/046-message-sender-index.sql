@@ -0,0 +1,24 @@
+-- +migrate Up
+-- index messages by sender, to find an account's messages for export and deletion
+--
+-- Building this index blocks writes to the message table until it's done,
+-- which on a large deployment can take a long while. To avoid that, build it
+-- by hand before migrating, with:
+--
+--     CREATE INDEX CONCURRENTLY message_sender_id ON message(sender_id);
+--
+-- and this migration will leave it be.
+
+-- +migrate StatementBegin
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_class WHERE relname = 'message_sender_id' AND relkind = 'i') THEN
+        CREATE INDEX message_sender_id ON message(sender_id);
+    END IF;
+END
+$$;
+-- +migrate StatementEnd
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS message_sender_id;
@@ -0,0 +1,14 @@
+-- +migrate Up
+-- email reply addresses that have been used, until they expire
+
+CREATE TABLE email_reply (
+    token text NOT NULL PRIMARY KEY,
+    account_id text NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+    expires timestamp with time zone NOT NULL
+);
+
+CREATE INDEX email_reply_expires ON email_reply(expires);
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS email_reply;
@@ -0,0 +1,127 @@
+package psql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type NickReservation struct {
+	Key       string
+	Nick      string
+	AccountID string `db:"account_id"`
+	Reserved  time.Time
+}
+
+type NickReservationTracker struct {
+	*Backend
+}
+
+func (t *NickReservationTracker) Reserve(ctx scope.Context, accountID snowflake.Snowflake, nick string) error {
+	tx, err := t.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	row := &NickReservation{
+		Key:       proto.ReservedNickKey(nick),
+		Nick:      nick,
+		AccountID: accountID.String(),
+		Reserved:  time.Now(),
+	}
+
+	var prev NickReservation
+	err = tx.SelectOne(
+		&prev, "SELECT key, nick, account_id, reserved FROM nick_reservation WHERE key = $1 FOR UPDATE", row.Key)
+	switch err {
+	case nil:
+		if prev.AccountID != row.AccountID {
+			rollback(ctx, tx)
+			return proto.ErrNickReserved
+		}
+		if _, err := tx.Exec("UPDATE nick_reservation SET nick = $2 WHERE key = $1", row.Key, nick); err != nil {
+			rollback(ctx, tx)
+			return err
+		}
+		return tx.Commit()
+	case sql.ErrNoRows:
+	default:
+		rollback(ctx, tx)
+		return err
+	}
+
+	n, err := tx.SelectInt("SELECT COUNT(*) FROM nick_reservation WHERE account_id = $1", row.AccountID)
+	if err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+	if n >= proto.MaxReservedNicks {
+		rollback(ctx, tx)
+		return proto.ErrTooManyReservedNicks
+	}
+
+	if err := tx.Insert(row); err != nil {
+		rollback(ctx, tx)
+		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+			return proto.ErrNickReserved
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (t *NickReservationTracker) Release(ctx scope.Context, accountID snowflake.Snowflake, nick string) error {
+	res, err := t.DbMap.Exec(
+		"DELETE FROM nick_reservation WHERE key = $1 AND account_id = $2",
+		proto.ReservedNickKey(nick), accountID.String())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return proto.ErrNickNotReserved
+	}
+	return nil
+}
+
+func (t *NickReservationTracker) List(ctx scope.Context, accountID snowflake.Snowflake) ([]string, error) {
+	var rows []NickReservation
+	_, err := t.DbMap.Select(
+		&rows,
+		"SELECT key, nick, account_id, reserved FROM nick_reservation WHERE account_id = $1 ORDER BY reserved",
+		accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	nicks := make([]string, len(rows))
+	for i, row := range rows {
+		nicks[i] = row.Nick
+	}
+	return nicks, nil
+}
+
+func (t *NickReservationTracker) Owner(ctx scope.Context, nick string) (snowflake.Snowflake, bool, error) {
+	accountID, err := t.DbMap.SelectStr(
+		"SELECT account_id FROM nick_reservation WHERE key = $1", proto.ReservedNickKey(nick))
+	if err != nil {
+		return 0, false, err
+	}
+	if accountID == "" {
+		return 0, false, nil
+	}
+
+	var id snowflake.Snowflake
+	if err := id.FromString(accountID); err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
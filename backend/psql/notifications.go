@@ -0,0 +1,156 @@
+package psql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+type Notification struct {
+	ID         string
+	AccountID  string `db:"account_id"`
+	Kind       string
+	Room       string
+	MessageID  string `db:"message_id"`
+	SenderName string `db:"sender_name"`
+	Excerpt    string
+	Created    time.Time
+}
+
+func (n *Notification) ToBackend() *proto.Notification {
+	notification := &proto.Notification{
+		Kind:       n.Kind,
+		Room:       n.Room,
+		SenderName: n.SenderName,
+		Excerpt:    n.Excerpt,
+		Created:    n.Created,
+	}
+	// ignore id parsing errors
+	_ = notification.ID.FromString(n.ID)
+	_ = notification.AccountID.FromString(n.AccountID)
+	_ = notification.MessageID.FromString(n.MessageID)
+	return notification
+}
+
+// A NotificationDigest marks an account as having a digest scheduled.
+type NotificationDigest struct {
+	AccountID string `db:"account_id"`
+}
+
+type NotificationTracker struct {
+	*Backend
+}
+
+func (t *NotificationTracker) Add(ctx scope.Context, n *proto.Notification) (bool, error) {
+	row := &Notification{
+		ID:         n.ID.String(),
+		AccountID:  n.AccountID.String(),
+		Kind:       n.Kind,
+		Room:       n.Room,
+		MessageID:  n.MessageID.String(),
+		SenderName: n.SenderName,
+		Excerpt:    n.Excerpt,
+		Created:    n.Created,
+	}
+	if err := t.DbMap.Insert(row); err != nil {
+		return false, err
+	}
+
+	// The notification is stored before the digest is claimed, so a digest
+	// that releases its claim will find the notification afterward.
+	if err := t.DbMap.Insert(&NotificationDigest{AccountID: row.AccountID}); err != nil {
+		if strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (t *NotificationTracker) ReleaseDigest(ctx scope.Context, accountID snowflake.Snowflake) error {
+	_, err := t.DbMap.Exec("DELETE FROM notification_digest WHERE account_id = $1", accountID.String())
+	return err
+}
+
+func (t *NotificationTracker) Pending(ctx scope.Context, accountID snowflake.Snowflake) ([]*proto.Notification, error) {
+	var rows []Notification
+	_, err := t.DbMap.Select(
+		&rows,
+		"SELECT id, account_id, kind, room, message_id, sender_name, excerpt, created FROM notification"+
+			" WHERE account_id = $1 ORDER BY id",
+		accountID.String())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	notifications := make([]*proto.Notification, len(rows))
+	for i, row := range rows {
+		notifications[i] = row.ToBackend()
+	}
+	return notifications, nil
+}
+
+func (t *NotificationTracker) Clear(ctx scope.Context, accountID, through snowflake.Snowflake) error {
+	_, err := t.DbMap.Exec(
+		"DELETE FROM notification WHERE account_id = $1 AND id <= $2", accountID.String(), through.String())
+	return err
+}
+
+type EmailPreferences struct {
+	AccountID      string `db:"account_id"`
+	AccessRequests bool   `db:"access_requests"`
+	Invitations    bool
+	Mentions       bool
+	PMs            bool `db:"pms"`
+}
+
+func (p *EmailPreferences) ToBackend() *proto.EmailPreferences {
+	return &proto.EmailPreferences{
+		AccessRequests: p.AccessRequests,
+		Invitations:    p.Invitations,
+		Mentions:       p.Mentions,
+		PMs:            p.PMs,
+	}
+}
+
+type EmailPreferenceTracker struct {
+	*Backend
+}
+
+func (t *EmailPreferenceTracker) Get(ctx scope.Context, accountID snowflake.Snowflake) (*proto.EmailPreferences, error) {
+	var row EmailPreferences
+	err := t.DbMap.SelectOne(
+		&row,
+		"SELECT account_id, access_requests, invitations, mentions, pms FROM email_preferences WHERE account_id = $1",
+		accountID.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			prefs := proto.DefaultEmailPreferences
+			return &prefs, nil
+		}
+		return nil, err
+	}
+	return row.ToBackend(), nil
+}
+
+func (t *EmailPreferenceTracker) Set(ctx scope.Context, accountID snowflake.Snowflake, prefs *proto.EmailPreferences) error {
+	row := &EmailPreferences{
+		AccountID:      accountID.String(),
+		AccessRequests: prefs.AccessRequests,
+		Invitations:    prefs.Invitations,
+		Mentions:       prefs.Mentions,
+		PMs:            prefs.PMs,
+	}
+	n, err := t.DbMap.Update(row)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	return t.DbMap.Insert(row)
+}
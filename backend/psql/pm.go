@@ -3,6 +3,9 @@ package psql
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+
+	"gopkg.in/gorp.v1"
 
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/security"
@@ -55,11 +58,54 @@ func (pm *PM) ToBackend() *proto.PM {
 	return bpm
 }
 
+type PMRead struct {
+	PMID        string        `db:"pm_id"`
+	AccountID   string        `db:"account_id"`
+	LastRead    string        `db:"last_read"`
+	Unread      int           `db:"unread"`
+	LastMessage gorp.NullTime `db:"last_message"`
+}
+
+// insertPMRead adds a participant's read position to a private chat, counting
+// the messages from others after it. Its parameters are the PM's ID, the
+// account's ID, the last message read, the PM's room name, and the account's
+// user ID.
+const insertPMRead = "INSERT INTO pm_read (pm_id, account_id, last_read, unread, last_message)" +
+	" SELECT $1, $2, $3," +
+	" (SELECT COUNT(*) FROM message WHERE room = $4 AND id > $3 AND deleted IS NULL AND sender_id <> $5)," +
+	" (SELECT MAX(posted) FROM message WHERE room = $4)"
+
+func addPMReader(db gorp.SqlExecutor, pmID, accountID snowflake.Snowflake, lastRead string) error {
+	_, err := db.Exec(
+		insertPMRead, pmID.String(), accountID.String(), lastRead,
+		fmt.Sprintf("pm:%s", pmID), fmt.Sprintf("account:%s", accountID))
+	if err != nil && strings.HasPrefix(err.Error(), "pq: duplicate key value") {
+		return nil
+	}
+	return err
+}
+
+// notePMMessage updates the unread counts of a private chat's participants
+// for a newly posted message.
+func notePMMessage(db gorp.SqlExecutor, msg *Message) error {
+	if !strings.HasPrefix(msg.Room, "pm:") {
+		return nil
+	}
+	_, err := db.Exec(
+		"UPDATE pm_read SET last_message = $3,"+
+			" unread = unread + CASE WHEN 'account:' || account_id = $2 THEN 0 ELSE 1 END"+
+			" WHERE pm_id = $1",
+		strings.TrimPrefix(msg.Room, "pm:"), msg.SenderID, msg.Posted)
+	return err
+}
+
 type PMRoomBinding struct {
 	RoomBinding
 	pm *proto.PM
 }
 
+func (pmrb *PMRoomBinding) PM() *proto.PM { return pmrb.pm }
+
 func (pmrb *PMRoomBinding) MessageKeyID(ctx scope.Context) (string, bool, error) {
 	return fmt.Sprintf("pm:%s", pmrb.pm.ID), true, nil
 }
@@ -185,6 +231,22 @@ func (t *PMTracker) Initiate(
 		return 0, err
 	}
 
+	readers := []snowflake.Snowflake{pm.Initiator}
+	if kind == "account" {
+		var receiverID snowflake.Snowflake
+		if err := receiverID.FromString(id); err != nil {
+			rollback(ctx, tx)
+			return 0, err
+		}
+		readers = append(readers, receiverID)
+	}
+	for _, accountID := range readers {
+		if err := tx.Insert(&PMRead{PMID: row.ID, AccountID: accountID.String()}); err != nil {
+			rollback(ctx, tx)
+			return 0, err
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
@@ -213,6 +275,11 @@ func (t *PMTracker) Room(ctx scope.Context, kms security.KMS, pmID snowflake.Sno
 		if err != nil {
 			return nil, nil, err
 		}
+		if client.Account != nil && pm.Receiver == client.UserID() {
+			if err := addPMReader(t.DbMap, pm.ID, client.Account.ID(), ""); err != nil {
+				return nil, nil, err
+			}
+		}
 	}
 
 	room := &PMRoomBinding{
@@ -226,3 +293,91 @@ func (t *PMTracker) Room(ctx scope.Context, kms security.KMS, pmID snowflake.Sno
 
 	return room, pmKey, nil
 }
+
+func (t *PMTracker) AccountRoom(
+	ctx scope.Context, kms security.KMS, pmID snowflake.Snowflake, account proto.Account) (
+	proto.Room, *security.ManagedKey, error) {
+
+	row, err := t.Backend.Get(PM{}, pmID.String())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, proto.ErrPMNotFound
+		}
+		return nil, nil, err
+	}
+	if row == nil {
+		return nil, nil, proto.ErrPMNotFound
+	}
+
+	pm := row.(*PM).ToBackend()
+	pmKey, otherName, err := pm.SystemAccess(kms, account)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	room := &PMRoomBinding{
+		RoomBinding: RoomBinding{
+			RoomName:  fmt.Sprintf("pm:%s", pm.ID),
+			RoomTitle: fmt.Sprintf("%s (private chat)", otherName),
+			Backend:   t.Backend,
+		},
+		pm: pm,
+	}
+	return room, pmKey, nil
+}
+
+func (t *PMTracker) List(ctx scope.Context, accountID snowflake.Snowflake) ([]proto.PMSummary, error) {
+	var rows []struct {
+		PM
+		LastMessage gorp.NullTime `db:"last_message"`
+		Unread      int
+	}
+	userID := fmt.Sprintf("account:%s", accountID)
+	_, err := t.DbMap.Select(
+		&rows,
+		"SELECT pm.id, pm.initiator, pm.initiator_nick, pm.receiver, pm.receiver_nick,"+
+			" r.last_message, COALESCE(r.unread, 0) AS unread"+
+			" FROM pm"+
+			" LEFT JOIN pm_read r ON r.pm_id = pm.id AND r.account_id = $1"+
+			" WHERE pm.initiator = $1 OR pm.receiver = $2"+
+			" ORDER BY r.last_message DESC NULLS LAST, pm.id DESC",
+		accountID.String(), userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	summaries := make([]proto.PMSummary, len(rows))
+	for i, row := range rows {
+		summaries[i] = row.PM.ToBackend().Summarize(accountID)
+		if row.LastMessage.Valid {
+			summaries[i].LastMessageTime = proto.Time(row.LastMessage.Time)
+		}
+		summaries[i].Unread = row.Unread
+	}
+	return summaries, nil
+}
+
+func (t *PMTracker) MarkRead(ctx scope.Context, pmID, accountID, messageID snowflake.Snowflake) error {
+	// Recount only the messages after the new read position.
+	res, err := t.DbMap.Exec(
+		"UPDATE pm_read SET last_read = $3,"+
+			" unread = (SELECT COUNT(*) FROM message"+
+			" WHERE room = $4 AND id > $3 AND deleted IS NULL AND sender_id <> $5)"+
+			" WHERE pm_id = $1 AND account_id = $2 AND last_read < $3",
+		pmID.String(), accountID.String(), messageID.String(),
+		fmt.Sprintf("pm:%s", pmID), fmt.Sprintf("account:%s", accountID))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	// Either the account has already read this far, or it has no read
+	// position yet.
+	return addPMReader(t.DbMap, pmID, accountID, messageID.String())
+}
@@ -15,6 +15,7 @@ type Presence struct {
 	SessionID string `db:"session_id"`
 	Updated   time.Time
 	KeyID     string `db:"key_id"`
+	UserID    string `db:"user_id"`
 	Fact      []byte
 }
 
@@ -23,6 +24,7 @@ func (p *Presence) SetFact(fact *proto.Presence) error {
 	if err != nil {
 		return err
 	}
+	p.UserID = string(fact.ID)
 	p.Fact = data
 	return nil
 }
@@ -214,6 +214,14 @@ func (rb *RoomBinding) Part(ctx scope.Context, session proto.Session) error {
 	return rb.Backend.part(ctx, rb, session)
 }
 
+func (rb *RoomBinding) Knock(ctx scope.Context, session proto.Session) error {
+	return rb.Backend.knock(ctx, rb, session)
+}
+
+func (rb *RoomBinding) CancelKnock(ctx scope.Context, session proto.Session) error {
+	return rb.Backend.cancelKnock(ctx, rb, session)
+}
+
 func (rb *RoomBinding) Send(ctx scope.Context, session proto.Session, msg proto.Message) (
 	proto.Message, error) {
 
@@ -718,7 +726,8 @@ func (rb *ManagedRoomBinding) Managers(ctx scope.Context) ([]proto.Account, erro
 	rows, err := rb.Select(
 		Account{},
 		fmt.Sprintf(
-			"SELECT %s FROM account a, room_manager_capability m WHERE m.room = $1 AND m.account_id = a.id AND revoked < granted",
+			"SELECT %s FROM account a, room_manager_capability m WHERE m.room = $1 AND m.account_id = a.id AND revoked < granted"+
+				" AND (expires IS NULL OR expires > NOW())",
 			cols),
 		rb.Name)
 	if err != nil {
@@ -748,7 +757,7 @@ func (rb *ManagedRoomBinding) ManagerCapability(ctx scope.Context, manager proto
 		&c,
 		fmt.Sprintf("SELECT %s FROM capability c, room_manager_capability rm"+
 			" WHERE rm.room = $1 AND c.id = rm.capability_id AND c.account_id = $2"+
-			" AND rm.revoked < rm.granted",
+			" AND rm.revoked < rm.granted AND (rm.expires IS NULL OR rm.expires > NOW())",
 			cols),
 		rb.Name, manager.ID().String())
 	if err != nil {
@@ -761,10 +770,10 @@ func (rb *ManagedRoomBinding) ManagerCapability(ctx scope.Context, manager proto
 
 func (rb *ManagedRoomBinding) AddManager(
 	ctx scope.Context, kms security.KMS, actor proto.Account, actorKey *security.ManagedKey,
-	newManager proto.Account) error {
+	newManager proto.Account, expires time.Time) error {
 
 	rmkb := NewRoomManagerKeyBinding(rb)
-	if err := rmkb.GrantToAccount(ctx, kms, actor, actorKey, newManager); err != nil {
+	if err := rmkb.GrantToAccount(ctx, kms, actor, actorKey, newManager, expires); err != nil {
 		if err == proto.ErrCapabilityNotFound {
 			return proto.ErrAccessDenied
 		}
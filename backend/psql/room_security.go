@@ -18,6 +18,7 @@ type RoomCapability struct {
 	AccountID    string `db:"account_id"`
 	Granted      time.Time
 	Revoked      time.Time
+	Expires      gorp.NullTime
 }
 
 type RoomCapabilityBinding struct {
@@ -38,6 +39,47 @@ type RoomManagerCapabilityBinding struct {
 
 func (rmcb *RoomManagerCapabilityBinding) CapabilityID() string { return rmcb.Capability.CapabilityID() }
 
+func (rc *RoomCapability) CapabilityGrant() (proto.CapabilityGrant, error) {
+	grant := proto.CapabilityGrant{
+		CapabilityID: rc.CapabilityID,
+		Granted:      rc.Granted,
+	}
+	if rc.AccountID != "" {
+		if err := grant.AccountID.FromString(rc.AccountID); err != nil {
+			return grant, err
+		}
+	}
+	if rc.Expires.Valid {
+		grant.Expires = rc.Expires.Time
+	}
+	return grant, nil
+}
+
+// listCapabilityGrants returns the unexpired grants in the given room
+// capability table.
+func listCapabilityGrants(executor gorp.SqlExecutor, table, room string) ([]proto.CapabilityGrant, error) {
+	var rows []RoomCapability
+	_, err := executor.Select(
+		&rows,
+		"SELECT room, capability_id, COALESCE(account_id, '') AS account_id, granted, revoked, expires"+
+			" FROM "+table+" WHERE room = $1 AND revoked < granted AND (expires IS NULL OR expires > NOW())"+
+			" ORDER BY granted, capability_id",
+		room)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make([]proto.CapabilityGrant, len(rows))
+	for i, row := range rows {
+		grant, err := row.CapabilityGrant()
+		if err != nil {
+			return nil, err
+		}
+		grants[i] = grant
+	}
+	return grants, nil
+}
+
 type RoomManagerCapabilities struct {
 	Room     *Room
 	Executor gorp.SqlExecutor
@@ -47,10 +89,11 @@ func (rmc *RoomManagerCapabilities) Get(ctx scope.Context, cid string) (security
 	rmcb := &RoomManagerCapabilityBinding{}
 	err := rmc.Executor.SelectOne(
 		rmcb,
-		`SELECT r.room, r.capability_id, r.granted, r.revoked,`+
+		`SELECT r.room, r.capability_id, r.granted, r.revoked, r.expires,`+
 			` c.id, c.account_id, c.nonce, c.encrypted_private_data, c.public_data`+
 			` FROM room_manager_capability r, capability c`+
-			` WHERE r.room = $1 AND c.id = $2 AND r.capability_id = c.id AND r.revoked < r.granted`,
+			` WHERE r.room = $1 AND c.id = $2 AND r.capability_id = c.id AND r.revoked < r.granted`+
+			` AND (r.expires IS NULL OR r.expires > NOW())`,
 		rmc.Room.Name, cid)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -63,7 +106,7 @@ func (rmc *RoomManagerCapabilities) Get(ctx scope.Context, cid string) (security
 }
 
 func (rmc *RoomManagerCapabilities) Save(
-	ctx scope.Context, account proto.Account, c security.Capability) error {
+	ctx scope.Context, account proto.Account, c security.Capability, expires time.Time) error {
 
 	capRow := &Capability{
 		ID:                   c.CapabilityID(),
@@ -76,13 +119,31 @@ func (rmc *RoomManagerCapabilities) Save(
 		CapabilityID: c.CapabilityID(),
 		Granted:      time.Now(),
 	}
+	if !expires.IsZero() {
+		rmCapRow.Expires = gorp.NullTime{Valid: true, Time: expires}
+	}
 	if account != nil {
 		capRow.AccountID = account.ID().String()
 		rmCapRow.AccountID = account.ID().String()
 	}
+
+	// Clear out an expired grant of the same capability that hasn't been
+	// revoked yet, so it can be granted again.
+	_, err := rmc.Executor.Exec(
+		"DELETE FROM capability WHERE id IN"+
+			" (SELECT capability_id FROM room_manager_capability WHERE room = $1 AND capability_id = $2 AND expires <= NOW())",
+		rmc.Room.Name, c.CapabilityID())
+	if err != nil {
+		return err
+	}
+
 	return rmc.Executor.Insert(capRow, rmCapRow)
 }
 
+func (rmc *RoomManagerCapabilities) List(ctx scope.Context) ([]proto.CapabilityGrant, error) {
+	return listCapabilityGrants(rmc.Executor, "room_manager_capability", rmc.Room.Name)
+}
+
 func (rmc *RoomManagerCapabilities) Remove(ctx scope.Context, capabilityID string) error {
 	resp, err := rmc.Executor.Exec("DELETE FROM capability WHERE id = $1", capabilityID)
 	if err != nil {
@@ -110,10 +171,11 @@ func (rmc *RoomMessageCapabilities) Get(ctx scope.Context, cid string) (security
 	rcb := &RoomCapabilityBinding{}
 	err := rmc.Executor.SelectOne(
 		rcb,
-		`SELECT r.room, r.capability_id, r.granted, r.revoked,`+
+		`SELECT r.room, r.capability_id, r.granted, r.revoked, r.expires,`+
 			` c.id, c.account_id, c.nonce, c.encrypted_private_data, c.public_data`+
 			` FROM room_capability r, capability c`+
-			` WHERE r.room = $1 AND c.id = $2 AND r.capability_id = c.id AND r.revoked < r.granted`,
+			` WHERE r.room = $1 AND c.id = $2 AND r.capability_id = c.id AND r.revoked < r.granted`+
+			` AND (r.expires IS NULL OR r.expires > NOW())`,
 		rmc.Room.Name, cid)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -126,7 +188,7 @@ func (rmc *RoomMessageCapabilities) Get(ctx scope.Context, cid string) (security
 }
 
 func (rmc *RoomMessageCapabilities) Save(
-	ctx scope.Context, account proto.Account, c security.Capability) error {
+	ctx scope.Context, account proto.Account, c security.Capability, expires time.Time) error {
 
 	capRow := &Capability{
 		ID:                   c.CapabilityID(),
@@ -139,13 +201,31 @@ func (rmc *RoomMessageCapabilities) Save(
 		CapabilityID: c.CapabilityID(),
 		Granted:      time.Now(),
 	}
+	if !expires.IsZero() {
+		roomCapRow.Expires = gorp.NullTime{Valid: true, Time: expires}
+	}
 	if account != nil {
 		capRow.AccountID = account.ID().String()
 		roomCapRow.AccountID = account.ID().String()
 	}
+
+	// Clear out an expired grant of the same capability that hasn't been
+	// revoked yet, so it can be granted again.
+	_, err := rmc.Executor.Exec(
+		"DELETE FROM capability WHERE id IN"+
+			" (SELECT capability_id FROM room_capability WHERE room = $1 AND capability_id = $2 AND expires <= NOW())",
+		rmc.Room.Name, c.CapabilityID())
+	if err != nil {
+		return err
+	}
+
 	return rmc.Executor.Insert(capRow, roomCapRow)
 }
 
+func (rmc *RoomMessageCapabilities) List(ctx scope.Context) ([]proto.CapabilityGrant, error) {
+	return listCapabilityGrants(rmc.Executor, "room_capability", rmc.Room.Name)
+}
+
 func (rmc *RoomMessageCapabilities) Remove(ctx scope.Context, capabilityID string) error {
 	resp, err := rmc.Executor.Exec("DELETE FROM capability WHERE id = $1", capabilityID)
 	if err != nil {
@@ -164,6 +244,246 @@ func (rmc *RoomMessageCapabilities) Remove(ctx scope.Context, capabilityID strin
 	return nil
 }
 
+type RoomInvite struct {
+	ID        string
+	Room      string
+	KeyID     string `db:"key_id"`
+	CreatorID string `db:"creator_id"`
+	Created   time.Time
+	Expires   gorp.NullTime
+	MaxUses   int `db:"max_uses"`
+	Uses      int
+}
+
+func (ri *RoomInvite) Invite() *proto.Invite {
+	invite := &proto.Invite{
+		ID:      ri.ID,
+		Created: proto.Time(ri.Created),
+		MaxUses: ri.MaxUses,
+		Uses:    ri.Uses,
+	}
+	invite.CreatorID.FromString(ri.CreatorID)
+	if ri.Expires.Valid {
+		invite.Expires = proto.Time(ri.Expires.Time)
+	}
+	return invite
+}
+
+type RoomInvites struct {
+	Room     *Room
+	KeyID    string
+	Executor gorp.SqlExecutor
+}
+
+const roomInviteColumns = "id, room, key_id, creator_id, created, expires, max_uses, uses"
+
+func (ris *RoomInvites) Get(ctx scope.Context, inviteID string) (*proto.Invite, error) {
+	var row RoomInvite
+	err := ris.Executor.SelectOne(
+		&row,
+		"SELECT "+roomInviteColumns+" FROM room_invite WHERE id = $1 AND room = $2 AND key_id = $3",
+		inviteID, ris.Room.Name, ris.KeyID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, proto.ErrInviteNotFound
+		}
+		return nil, err
+	}
+	return row.Invite(), nil
+}
+
+func (ris *RoomInvites) List(ctx scope.Context) ([]proto.Invite, error) {
+	var rows []RoomInvite
+	_, err := ris.Executor.Select(
+		&rows,
+		"SELECT "+roomInviteColumns+" FROM room_invite WHERE room = $1 AND key_id = $2 ORDER BY created, id",
+		ris.Room.Name, ris.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	invites := make([]proto.Invite, len(rows))
+	for i, row := range rows {
+		invites[i] = *row.Invite()
+	}
+	return invites, nil
+}
+
+func (ris *RoomInvites) Save(ctx scope.Context, invite *proto.Invite) error {
+	row := &RoomInvite{
+		ID:        invite.ID,
+		Room:      ris.Room.Name,
+		KeyID:     ris.KeyID,
+		CreatorID: invite.CreatorID.String(),
+		Created:   time.Time(invite.Created),
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+	}
+	if expires := time.Time(invite.Expires); !expires.IsZero() {
+		row.Expires = gorp.NullTime{Valid: true, Time: expires}
+	}
+	return ris.Executor.Insert(row)
+}
+
+func (ris *RoomInvites) Remove(ctx scope.Context, inviteID string) error {
+	resp, err := ris.Executor.Exec(
+		"DELETE FROM room_invite WHERE id = $1 AND room = $2 AND key_id = $3",
+		inviteID, ris.Room.Name, ris.KeyID)
+	if err != nil {
+		return err
+	}
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrInviteNotFound
+	}
+	return nil
+}
+
+func (ris *RoomInvites) Redeem(ctx scope.Context, inviteID string) (*proto.Invite, error) {
+	var row RoomInvite
+	err := ris.Executor.SelectOne(
+		&row,
+		"UPDATE room_invite SET uses = uses + 1"+
+			" WHERE id = $1 AND room = $2 AND key_id = $3"+
+			" AND (expires IS NULL OR expires > NOW()) AND (max_uses = 0 OR uses < max_uses)"+
+			" RETURNING "+roomInviteColumns,
+		inviteID, ris.Room.Name, ris.KeyID)
+	if err == nil {
+		return row.Invite(), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Nothing was updated, so find out why.
+	invite, err := ris.Get(ctx, inviteID)
+	if err != nil {
+		return nil, err
+	}
+	if err := invite.Check(time.Now()); err != nil {
+		return nil, err
+	}
+	return nil, proto.ErrInviteExhausted
+}
+
+type PendingRoomInvite struct {
+	Email     string
+	Room      string
+	CreatorID string `db:"creator_id"`
+	Created   time.Time
+	Expires   time.Time
+}
+
+func (pri *PendingRoomInvite) PendingInvite() (*proto.PendingInvite, error) {
+	invite := &proto.PendingInvite{
+		Email:   pri.Email,
+		Room:    pri.Room,
+		Created: proto.Time(pri.Created),
+		Expires: proto.Time(pri.Expires),
+	}
+	if err := invite.CreatorID.FromString(pri.CreatorID); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+type PendingInviteTracker struct {
+	*Backend
+}
+
+func (t *PendingInviteTracker) Add(ctx scope.Context, invite *proto.PendingInvite) error {
+	row := &PendingRoomInvite{
+		Email:     invite.Email,
+		Room:      invite.Room,
+		CreatorID: invite.CreatorID.String(),
+		Created:   time.Time(invite.Created),
+		Expires:   time.Time(invite.Expires),
+	}
+
+	tx, err := t.DbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"DELETE FROM pending_room_invite WHERE email = $1 AND room = $2", invite.Email, invite.Room)
+	if err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+
+	if err := tx.Insert(row); err != nil {
+		rollback(ctx, tx)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (t *PendingInviteTracker) List(ctx scope.Context, room string) ([]*proto.PendingInvite, error) {
+	var rows []PendingRoomInvite
+	_, err := t.DbMap.Select(
+		&rows,
+		"SELECT email, room, creator_id, created, expires FROM pending_room_invite"+
+			" WHERE room = $1 AND expires > NOW() ORDER BY created, email",
+		room)
+	if err != nil {
+		return nil, err
+	}
+
+	invites := make([]*proto.PendingInvite, len(rows))
+	for i, row := range rows {
+		invite, err := row.PendingInvite()
+		if err != nil {
+			return nil, err
+		}
+		invites[i] = invite
+	}
+	return invites, nil
+}
+
+func (t *PendingInviteTracker) Remove(ctx scope.Context, room, email string) error {
+	result, err := t.DbMap.Exec(
+		"DELETE FROM pending_room_invite WHERE email = $1 AND room = $2", email, room)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return proto.ErrInviteNotFound
+	}
+	return nil
+}
+
+func (t *PendingInviteTracker) Claim(ctx scope.Context, email string) ([]*proto.PendingInvite, error) {
+	var rows []PendingRoomInvite
+	_, err := t.DbMap.Select(
+		&rows,
+		"DELETE FROM pending_room_invite WHERE email = $1 RETURNING email, room, creator_id, created, expires",
+		email)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invites := make([]*proto.PendingInvite, 0, len(rows))
+	for _, row := range rows {
+		invite, err := row.PendingInvite()
+		if err != nil {
+			return nil, err
+		}
+		if !invite.Expired(now) {
+			invites = append(invites, invite)
+		}
+	}
+	return invites, nil
+}
+
 type RoomMessageKey struct {
 	Room      string
 	KeyID     string `db:"key_id"`
@@ -176,6 +496,8 @@ type RoomMessageKeyBinding struct {
 	*proto.GrantManager
 	MessageKey
 	RoomMessageKey
+
+	dbMap *gorp.DbMap
 }
 
 func NewRoomMessageKeyBinding(
@@ -189,6 +511,11 @@ func NewRoomMessageKeyBinding(
 				Executor: rb.Backend.DbMap,
 			},
 			Managers: NewRoomManagerKeyBinding(rb),
+			Invites: &RoomInvites{
+				Room:     rb.Room,
+				KeyID:    keyID.String(),
+				Executor: rb.Backend.DbMap,
+			},
 			KeyEncryptingKey: &security.ManagedKey{
 				Ciphertext:   rb.Room.EncryptedManagementKey,
 				ContextKey:   "room",
@@ -214,10 +541,42 @@ func NewRoomMessageKeyBinding(
 			KeyID:     keyID.String(),
 			Activated: time.Now(),
 		},
+		dbMap: rb.Backend.DbMap,
 	}
 	return rmkb
 }
 
+// RedeemInvite looks up an invite's capability, counts the use, and grants
+// access to the account in a single transaction.
+func (rmkb *RoomMessageKeyBinding) RedeemInvite(
+	ctx scope.Context, kms security.KMS, code string, account proto.Account) (
+	*security.SharedSecretCapability, error) {
+
+	t, err := rmkb.dbMap.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities := *rmkb.GrantManager.Capabilities.(*RoomMessageCapabilities)
+	capabilities.Executor = t
+	invites := *rmkb.GrantManager.Invites.(*RoomInvites)
+	invites.Executor = t
+
+	gm := *rmkb.GrantManager
+	gm.Capabilities = &capabilities
+	gm.Invites = &invites
+	capability, err := gm.RedeemInvite(ctx, kms, code, account)
+	if err != nil {
+		rollback(ctx, t)
+		return nil, err
+	}
+
+	if err := t.Commit(); err != nil {
+		return nil, err
+	}
+	return capability, nil
+}
+
 func (rmkb *RoomMessageKeyBinding) KeyID() string        { return rmkb.RoomMessageKey.KeyID }
 func (rmkb *RoomMessageKeyBinding) Timestamp() time.Time { return rmkb.RoomMessageKey.Activated }
 func (rmkb *RoomMessageKeyBinding) Nonce() []byte        { return rmkb.MessageKey.Nonce }
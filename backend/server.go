@@ -44,10 +44,15 @@ type Server struct {
 	rootCtx       scope.Context
 
 	allowRoomCreation     bool
+	accountLoginThrottle  proto.LoginThrottle
+	clientLoginThrottle   proto.LoginThrottle
 	newAccountMinAgentAge time.Duration
 	roomEntryMinAgentAge  time.Duration
 	setInsecureCookies    bool
 
+	oidcProviders   map[string]*oidcProvider
+	oidcRecentLogin time.Duration
+
 	m sync.Mutex
 
 	agentIDGenerator func() ([]byte, error)
@@ -72,6 +77,10 @@ func NewServer(heim *proto.Heim, id, era string) (*Server, error) {
 		staticPath:    heim.StaticPath,
 		sc:            securecookie.New(cookieSecret, nil),
 		rootCtx:       heim.Context,
+
+		accountLoginThrottle: proto.AccountLoginThrottle,
+		clientLoginThrottle:  proto.ClientLoginThrottle,
+		oidcRecentLogin:      proto.OIDCRecentLogin,
 	}
 	s.route()
 	return s, nil
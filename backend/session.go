@@ -14,6 +14,7 @@ import (
 	"euphoria.io/heim/proto"
 	"euphoria.io/heim/proto/logging"
 	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
 	"euphoria.io/scope"
 
 	"github.com/gorilla/websocket"
@@ -120,6 +121,7 @@ type session struct {
 
 	m                   sync.Mutex
 	joined              bool
+	blocked             map[proto.UserID]struct{}
 	maybeAbandoned      bool
 	outstandingPings    int
 	expectedPingReply   int64
@@ -211,8 +213,17 @@ func (s *session) writeMessage(messageType int, data []byte) error {
 }
 
 func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload interface{}) error {
+	// Withhold anything said or done by users the session's account has blocked.
+	if s.isFromBlockedUser(payload) {
+		return nil
+	}
+
 	// Special case: certain events have privileged info that may need to be stripped from them
 	switch event := payload.(type) {
+	case *proto.BlockUserEvent:
+		s.setBlocked(event.UserID, true)
+	case *proto.UnblockUserEvent:
+		s.setBlocked(event.UserID, false)
 	case *proto.PresenceEvent:
 		switch s.privilegeLevel() {
 		case proto.Staff:
@@ -226,6 +237,8 @@ func (s *session) Send(ctx scope.Context, cmdType proto.PacketType, payload inte
 		if s.privilegeLevel() == proto.General {
 			event.Sender.ClientAddress = ""
 		}
+	case *proto.SendEvent:
+		s.readPMLive(event.ID)
 	case *proto.EditMessageEvent:
 		if s.privilegeLevel() == proto.General {
 			event.Sender.ClientAddress = ""
@@ -479,6 +492,7 @@ func (s *session) sendSnapshot() error {
 	}
 
 	s.identity.name = snapshot.Nick
+	snapshot.Log = s.withoutBlockedMessages(snapshot.Log)
 
 	for i, msg := range snapshot.Log {
 		if msg.EncryptionKeyID != "" {
@@ -535,12 +549,26 @@ func (s *session) privilegeLevel() proto.PrivilegeLevel {
 }
 
 func (s *session) join() error {
+	if err := s.loadBlocks(); err != nil {
+		return err
+	}
+
 	nick, ok, err := s.room.ResolveNick(s.ctx, s.Identity().ID())
 	if err != nil {
 		return err
 	}
 	if ok {
-		s.identity.name = nick
+		// If the nick has since been reserved by someone else, drop it and leave
+		// the session to choose another.
+		verified, err := s.checkNick(nick)
+		switch err {
+		case nil:
+			s.identity.name = nick
+			s.identity.verified = verified
+		case proto.ErrNickReserved:
+		default:
+			return err
+		}
 	}
 
 	addr, err := s.room.Join(s.ctx, s)
@@ -558,6 +586,9 @@ func (s *session) join() error {
 			logging.Logger(ctx).Printf("room part failed: %s", err)
 			return
 		}
+		if err := s.markPMRead(ctx); err != nil {
+			logging.Logger(ctx).Printf("pm mark read failed: %s", err)
+		}
 	}
 
 	if err := s.sendSnapshot(); err != nil {
@@ -565,10 +596,175 @@ func (s *session) join() error {
 		return err
 	}
 
+	if err := s.markPMRead(s.ctx); err != nil {
+		logging.Logger(s.ctx).Printf("pm mark read failed: %s", err)
+	}
+
+	if err := s.sendUnreadPMs(); err != nil {
+		logging.Logger(s.ctx).Printf("unread pms failed: %s", err)
+		return err
+	}
+
 	s.joined = true
 	return nil
 }
 
+// markPMRead records that the session's account has read the private chat
+// the session is in, up to its latest message.
+func (s *session) markPMRead(ctx scope.Context) error {
+	pmRoom, ok := s.room.(proto.PMRoom)
+	if !ok || s.client.Account == nil {
+		return nil
+	}
+	latest, err := s.room.Latest(ctx, 1, 0)
+	if err != nil || len(latest) == 0 {
+		return err
+	}
+	return s.backend.PMTracker().MarkRead(ctx, pmRoom.PM().ID, s.client.Account.ID(), latest[0].ID)
+}
+
+// readPMLive records in the background that the session's account has read a
+// message delivered live to the private chat the session is in.
+func (s *session) readPMLive(messageID snowflake.Snowflake) {
+	pmRoom, ok := s.room.(proto.PMRoom)
+	if !ok || s.client.Account == nil {
+		return
+	}
+	pmID, accountID := pmRoom.PM().ID, s.client.Account.ID()
+	go func() {
+		if err := s.backend.PMTracker().MarkRead(s.ctx, pmID, accountID, messageID); err != nil {
+			logging.Logger(s.ctx).Printf("pm mark read failed: %s", err)
+		}
+	}()
+}
+
+// sendUnreadPMs sends a pm-initiate-event for each of the account's other
+// private chats with unread messages, so invitations aren't lost while the
+// account is offline.
+func (s *session) sendUnreadPMs() error {
+	if s.client.Account == nil {
+		return nil
+	}
+	summaries, err := s.backend.PMTracker().List(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return err
+	}
+
+	var current snowflake.Snowflake
+	if pmRoom, ok := s.room.(proto.PMRoom); ok {
+		current = pmRoom.PM().ID
+	}
+	for _, summary := range summaries {
+		if summary.Unread == 0 || summary.PMID == current {
+			continue
+		}
+		payload := &proto.PMInitiateEvent{
+			From:     summary.With,
+			FromNick: summary.WithNick,
+			PMID:     summary.PMID,
+		}
+		if s.isFromBlockedUser(payload) {
+			continue
+		}
+		event, err := proto.MakeEvent(payload)
+		if err != nil {
+			return err
+		}
+		s.outgoing <- event
+	}
+	return nil
+}
+
+// checkNick returns ErrNickReserved if the nick is reserved by an account
+// other than the one the session is logged into. Otherwise it reports whether
+// the nick is reserved by the session's own account.
+func (s *session) checkNick(nick string) (bool, error) {
+	owner, ok, err := s.backend.NickReservations().Owner(s.ctx, nick)
+	if err != nil || !ok {
+		return false, err
+	}
+	if s.client.Account == nil || s.client.Account.ID() != owner {
+		return false, proto.ErrNickReserved
+	}
+	return true, nil
+}
+
+// loadBlocks fetches the block list of the session's account.
+func (s *session) loadBlocks() error {
+	if s.client.Account == nil {
+		return nil
+	}
+	userIDs, err := s.backend.Blocks().List(s.ctx, s.client.Account.ID())
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.blocked = make(map[proto.UserID]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		s.blocked[userID] = struct{}{}
+	}
+	return nil
+}
+
+// setBlocked updates the session's copy of its account's block list.
+func (s *session) setBlocked(userID proto.UserID, blocked bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !blocked {
+		delete(s.blocked, userID)
+		return
+	}
+	if s.blocked == nil {
+		s.blocked = map[proto.UserID]struct{}{}
+	}
+	s.blocked[userID] = struct{}{}
+}
+
+// withoutBlockedMessages filters messages sent by blocked users out of a log.
+func (s *session) withoutBlockedMessages(msgs []proto.Message) []proto.Message {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if len(s.blocked) == 0 {
+		return msgs
+	}
+	filtered := make([]proto.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if _, ok := s.blocked[msg.Sender.ID]; !ok {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+// isFromBlockedUser returns true if the given event was sent, edited, or
+// renamed by a user the session's account has blocked.
+func (s *session) isFromBlockedUser(payload interface{}) bool {
+	var userID proto.UserID
+	switch event := payload.(type) {
+	case *proto.Message:
+		userID = event.Sender.ID
+	case *proto.SendEvent:
+		userID = event.Sender.ID
+	case *proto.EditMessageEvent:
+		userID = event.Sender.ID
+	case *proto.NickEvent:
+		userID = event.ID
+	case *proto.PMInitiateEvent:
+		userID = event.From
+	default:
+		return false
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.blocked[userID]
+	return ok
+}
+
 func (s *session) sendHello(roomIsPrivate, accountHasAccess bool) error {
 	logger := logging.Logger(s.ctx)
 	event := &proto.HelloEvent{
@@ -580,6 +776,7 @@ func (s *session) sendHello(roomIsPrivate, accountHasAccess bool) error {
 	if s.client.Account != nil {
 		event.AccountView = &proto.PersonalAccountView{
 			AccountView: *s.client.Account.View(s.roomName),
+			Locale:      s.client.Account.Locale(),
 		}
 		event.AccountView.Email, event.AccountEmailVerified = s.client.Account.Email()
 	}
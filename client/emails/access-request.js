@@ -0,0 +1,29 @@
+import React from 'react'
+
+import { Item, Span, A } from 'react-html-email'
+import { StandardEmail, TopBubbleBox, BodyBox, standardFooter, textDefaults } from './common'
+
+
+module.exports = (
+  <StandardEmail>
+    <TopBubbleBox logo="logo-active.png">
+      <Item align="center">
+        <Span {...textDefaults} fontSize={18}><strong>{'{{.RequesterName}}'}</strong> is asking to join</Span>
+      </Item>
+      <Item align="center">
+        <A href="{{.RoomURL}}">
+          <Span {...textDefaults} fontSize={28} color={null}>&{'{{.RoomName}}'}</Span>
+        </A>
+      </Item>
+    </TopBubbleBox>
+    <BodyBox>
+      <Item align="center">
+        <Span {...textDefaults} color="#7d7d7d">A note from {'{{.RequesterName}}'}:</Span>
+      </Item>
+      <Item>
+        <Span {...textDefaults}>{'{{.RequesterNote}}'}</Span>
+      </Item>
+    </BodyBox>
+    {standardFooter}
+  </StandardEmail>
+)
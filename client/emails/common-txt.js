@@ -1,5 +1,10 @@
 const standardFooter = `
 This message was sent to {{.AccountEmailAddress}} because an account is registered on {{.SiteURL}} with this email address.
+{{if .EmailPreferencesURL}}
+You can choose which emails you receive in your email preferences:
+
+{{.EmailPreferencesURL}}
+{{end}}
 `.trim()
 
 export default { standardFooter }
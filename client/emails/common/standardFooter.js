@@ -8,6 +8,7 @@ export default (
   <Footer>
     <Span {...textDefaults} fontSize={13} color="#7d7d7d">
       This message was sent to <A {...textDefaults} textDecoration="none" href="mailto:{{.AccountEmailAddress}}">{'{{.AccountEmailAddress}}'}</A> because an account is registered on <A {...textDefaults} textDecoration="none" href="{{.SiteURL}}">{'{{.SiteURLShort}}'}</A> with this email address.
+      {'{{if .EmailPreferencesURL}}'} You can choose which emails you receive in your <A {...textDefaults} href="{{.EmailPreferencesURL}}">email preferences</A>.{'{{end}}'}
     </Span>
   </Footer>
 )
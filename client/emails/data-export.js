@@ -0,0 +1,27 @@
+import React from 'react'
+
+import { Item, Span, A } from 'react-html-email'
+import { StandardEmail, TopBubbleBox, BodyBox, BigButton, standardFooter, textDefaults } from './common'
+
+
+module.exports = (
+  <StandardEmail>
+    <TopBubbleBox logo="logo.png" padding={15}>
+      <Item align="center">
+        <Span {...textDefaults} fontSize={20}>Your data export is ready.</Span>
+      </Item>
+    </TopBubbleBox>
+    <BodyBox>
+      <Item>
+        <Span {...textDefaults}>Hey, the copy of your <A {...textDefaults} href="{{.SiteURL}}">{'{{.SiteName}}'}</A> data that you asked for is ready. It includes your account details, the messages you've posted, the emails we've sent you, and the rooms you have access to.</Span>
+      </Item>
+      <BigButton color="#80c080" href="{{.DownloadURL}}">
+        download your data
+      </BigButton>
+      <Item>
+        <Span {...textDefaults}>The link works until {'{{.ExpiresDate}}'}. If you did not ask for this and suspect something fishy is going on, please reply to this email immediately.</Span>
+      </Item>
+    </BodyBox>
+    {standardFooter}
+  </StandardEmail>
+)
@@ -0,0 +1,24 @@
+import React from 'react'
+
+import { Item, Span, A } from 'react-html-email'
+import { StandardEmail, TopBubbleBox, BodyBox, standardFooter, textDefaults } from './common'
+
+
+module.exports = (
+  <StandardEmail>
+    <TopBubbleBox logo="logo-warning.png" padding={15}>
+      <Item align="center">
+        <Span {...textDefaults} fontSize={20}>Logins to your account have been paused.</Span>
+      </Item>
+    </TopBubbleBox>
+    <BodyBox>
+      <Item>
+        <Span {...textDefaults}>There have been several failed attempts to log into your <A {...textDefaults} href="{{.SiteURL}}">{'{{.SiteName}}'}</A> account, most recently from {'{{.ClientAddress}}'}. To keep your account safe, we've paused logins to it for {'{{.LockoutMinutes}}'} minutes.</Span>
+      </Item>
+      <Item>
+        <Span {...textDefaults}>If this was you, you can try again once the time is up. If it wasn't, your password may be under attack. Consider changing it to something long and unique, and turning on two-factor authentication. If you think something fishy is going on, please reply to this email.</Span>
+      </Item>
+    </BodyBox>
+    {standardFooter}
+  </StandardEmail>
+)
@@ -0,0 +1,35 @@
+import React from 'react'
+
+import { Item, Span, A } from 'react-html-email'
+import { StandardEmail, TopBubbleBox, BodyBox, standardFooter, textDefaults } from './common'
+
+
+module.exports = (
+  <StandardEmail>
+    <TopBubbleBox logo="logo-active.png" padding={15}>
+      <Item align="center">
+        <Span {...textDefaults} fontSize={20}>Here's what you missed while you were away.</Span>
+      </Item>
+    </TopBubbleBox>
+    <BodyBox>
+      {'{{range .Notifications}}'}
+      <Item>
+        <Span {...textDefaults}>
+          <strong>{'{{.SenderName}}'}</strong> {'{{if .IsPM}}'}sent you a <A {...textDefaults} href="{{$.RoomURL .Room}}">private message</A>{'{{else}}'}mentioned you in <A {...textDefaults} href="{{$.RoomURL .Room}}">&{'{{.Room}}'}</A>{'{{end}}'}
+        </Span>
+      </Item>
+      {'{{if .Excerpt}}'}
+      <Item>
+        <Span {...textDefaults} color="#7d7d7d">{'{{.Excerpt}}'}</Span>
+      </Item>
+      {'{{end}}'}
+      {'{{with $.ReplyAddress .}}'}
+      <Item>
+        <Span {...textDefaults} fontSize={12} color="#7d7d7d">Reply by <A {...textDefaults} fontSize={12} href="mailto:{{.}}">email</A></Span>
+      </Item>
+      {'{{end}}'}
+      {'{{end}}'}
+    </BodyBox>
+    {standardFooter}
+  </StandardEmail>
+)
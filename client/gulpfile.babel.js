@@ -212,6 +212,7 @@ gulp.task('site-templates', ['heim-git-commit'], () => {
     'error',
     'verify-email',
     'reset-password',
+    'email-preferences',
     'about',
     'about/values',
     'about/conduct',
@@ -232,7 +233,15 @@ gulp.task('email-templates', () => {
   ReactHTMLEmail.injectReactEmailAttributes()
   ReactHTMLEmail.configStyleValidator({platforms: ['gmail']})
   const renderEmail = require('react-html-email').renderEmail
-  const emails = ['welcome', 'room-invitation', 'room-invitation-welcome', 'verification', 'password-changed', 'password-reset']
+  const baseEmails = ['welcome', 'room-invitation', 'room-invitation-welcome', 'access-request', 'login-lockout', 'verification', 'password-changed', 'password-reset', 'data-export', 'notification-digest']
+
+  // localized emails are named with the locale as a second extension, e.g. welcome.de.js
+  const localizedEmails = _.filter(
+    _.map(_.filter(fs.readdirSync('./emails'), filename => path.extname(filename) === '.js'),
+      filename => path.basename(filename, '.js')),
+    name => name.split('.').length === 2 && _.includes(baseEmails, name.split('.')[0])
+  )
+  const emails = _.uniq(baseEmails.concat(localizedEmails))
 
   const htmls = merge(_.map(emails, name => {
     const html = renderEmail(reload('./emails/' + name))
@@ -4,6 +4,7 @@ import 'whatwg-fetch'
 import clientRoom from './clientRoom'
 import clientVerifyEmail from './clientVerifyEmail'
 import clientResetPassword from './clientResetPassword'
+import clientEmailPreferences from './clientEmailPreferences'
 
 
 // setup globals (used by env frame)
@@ -27,5 +28,7 @@ if (!entrypoint) {
     clientVerifyEmail()
   } else if (entrypoint === 'reset-password') {
     clientResetPassword()
+  } else if (entrypoint === 'email-preferences') {
+    clientEmailPreferences()
   }
 }
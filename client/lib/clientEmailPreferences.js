@@ -0,0 +1,17 @@
+import React from 'react'
+import ReactDOM from 'react-dom'
+
+import emailPreferencesFlow from './stores/emailPreferencesFlow'
+import EmailPreferencesForm from './ui/EmailPreferencesForm'
+
+
+export default function clientEmailPreferences() {
+  const attachPoint = uidocument.getElementById('form-container')
+  const contextData = JSON.parse(attachPoint.getAttribute('data-context'))
+  emailPreferencesFlow.initData(contextData)
+
+  ReactDOM.render(
+    <EmailPreferencesForm />,
+    attachPoint
+  )
+}
@@ -338,7 +338,8 @@ export default function clientRoom() {
     }
 
     Heim.plugins.load(roomName)
-    Heim.actions.setup(roomName)
+    // invite links in emails land here with the code in the fragment
+    Heim.actions.setup(roomName, hashFlags.invite)
 
     setImmediate(() => {
       if (window.onReady) {
@@ -70,7 +70,8 @@ module.exports.store = Reflux.createStore({
   },
 
   loginCompleted() {
-    if (this.state.get('step') === 'signin') {
+    const step = this.state.get('step')
+    if (step === 'signin' || step === 'otp') {
       this._reloadPage()
     }
   },
@@ -78,9 +79,14 @@ module.exports.store = Reflux.createStore({
   loginFailed(data) {
     this.triggerUpdate(this.state.withMutations(state => {
       const step = state.get('step')
-      if (step === 'signin' || step === 'forgot') {
+      if (step === 'signin' || step === 'otp' || step === 'forgot') {
         state.set('working', false)
-        if (data.reason === 'account not found') {
+        if (data.otp_required) {
+          state.set('step', 'otp')
+          if (data.reason === 'invalid otp') {
+            state.set('errors', Immutable.Map({otp: 'invalid code'}))
+          }
+        } else if (data.reason === 'account not found') {
           state.set('errors', Immutable.Map({email: 'account not found'}))
         } else if (data.reason === 'access denied') {
           state.set('errors', Immutable.Map({password: 'no dice, sorry!'}))
@@ -165,12 +171,12 @@ module.exports.store = Reflux.createStore({
     this.triggerUpdate(this.state.set('step', 'forgot'))
   },
 
-  signIn(email, password) {
+  signIn(email, password, otp) {
     this.triggerUpdate(this.state.merge({
       working: true,
       errors: Immutable.Map(),
     }))
-    chat.login(email, password)
+    chat.login(email, password, otp)
   },
 
   register(email, password) {
@@ -93,6 +93,7 @@ module.exports.store = Reflux.createStore({
     this._seenMessages = Immutable.Map()
     this._joinWhenReady = false
     this._lastDismissedPM = null
+    this._inviteCode = null
 
     this.lastActive = null
     this.lastVisit = null
@@ -111,7 +112,10 @@ module.exports.store = Reflux.createStore({
   socketOpen() {
     storage.set('dismissedPM', null)
     this.state.connected = true
-    if (this.state.authType === 'passcode' && this.state.authData) {
+    if (this._inviteCode) {
+      this._sendInvite(this._inviteCode)
+      this.state.authState = 'trying-stored'
+    } else if (this.state.authType === 'passcode' && this.state.authData) {
       this._sendPasscode(this.state.authData)
       this.state.authState = 'trying-stored'
     }
@@ -406,6 +410,19 @@ module.exports.store = Reflux.createStore({
   },
 
   _handleAuthReply(error, data) {
+    if (this._inviteCode) {
+      // Invites have limited uses, so they're never saved. A working code is
+      // kept to authenticate again on reconnect; redeeming it while logged in
+      // grants the account access, and doesn't use it up again.
+      if (!error && data.success) {
+        this.state.authState = null
+        return
+      }
+      if (error !== 'already joined') {
+        this._inviteCode = null
+      }
+    }
+
     if (!error && data.success) {
       this.state.authState = null
       storage.setRoom(this.state.roomName, 'auth', {
@@ -483,8 +500,9 @@ module.exports.store = Reflux.createStore({
     }
   },
 
-  setup(roomName) {
+  setup(roomName, inviteCode) {
     this.state.roomName = roomName
+    this._inviteCode = inviteCode || null
     storage.load()
     this.trigger(this.state)
   },
@@ -530,6 +548,16 @@ module.exports.store = Reflux.createStore({
     })
   },
 
+  _sendInvite(code) {
+    this._authSendId = this.socket.send({
+      type: 'auth',
+      data: {
+        type: 'invite',
+        invite: code,
+      },
+    })
+  },
+
   tryRoomPasscode(passcode) {
     this.state.authData = passcode
     this.state.authState = 'trying'
@@ -618,13 +646,14 @@ module.exports.store = Reflux.createStore({
     })
   },
 
-  login(email, password) {
+  login(email, password, otp) {
     this.socket.send({
       type: 'login',
       data: {
         namespace: 'email',
         id: email,
         password: password,
+        otp: otp,
       },
     })
   },
@@ -0,0 +1,57 @@
+import _ from 'lodash'
+import Reflux from 'reflux'
+import Immutable from 'immutable'
+
+import heimURL from '../heimURL'
+import ImmutableMixin from './ImmutableMixin'
+import PostFlowMixin from './PostFlowMixin'
+
+
+const storeActions = Reflux.createActions([
+  'initData',
+  'save',
+])
+_.extend(module.exports, storeActions)
+
+storeActions.initData.sync = true
+
+const StateRecord = Immutable.Record({
+  email: null,
+  token: null,
+  preferences: Immutable.Map(),
+  done: false,
+  errors: Immutable.Map(),
+  working: false,
+})
+
+module.exports.store = Reflux.createStore({
+  listenables: [
+    storeActions,
+  ],
+
+  mixins: [
+    ImmutableMixin,
+    PostFlowMixin,
+  ],
+
+  init() {
+    this.state = new StateRecord()
+  },
+
+  getInitialState() {
+    return this.state
+  },
+
+  initData(data) {
+    this.triggerUpdate(this.state.merge(data))
+  },
+
+  save(preferences) {
+    const merged = this.state.preferences.merge(preferences)
+    this.triggerUpdate(this.state.set('preferences', merged))
+    this._postAPI(heimURL('/prefs/emails'), {
+      token: this.state.token,
+      preferences: merged.toJS(),
+    })
+  },
+})
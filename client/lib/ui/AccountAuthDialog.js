@@ -34,6 +34,8 @@ export default React.createClass({
     const step = this.state.flow.step
     if (step === 'signin') {
       accountAuthFlow.signIn(values.email, values.password.text)
+    } else if (step === 'otp') {
+      accountAuthFlow.signIn(values.email, values.password.text, values.otp)
     } else if (step === 'register') {
       accountAuthFlow.register(values.email, values.password.text)
     } else if (step === 'forgot') {
@@ -108,6 +110,17 @@ export default React.createClass({
             </div>
           </div>
         )
+      } else if (flow.step === 'otp') {
+        title = 'two-factor authentication'
+        bottom = (
+          <div className="bottom">
+            <div className="action-line">
+              <div className="spacer" />
+              <button type="button" tabIndex="4" className="open-sign-in minor-action" onClick={accountAuthFlow.openSignIn}>back<span className="long"> to sign in</span></button>
+              <button key="sign-in" type="submit" tabIndex="3" className="sign-in major-action">sign in</button>
+            </div>
+          </div>
+        )
       } else {
         title = 'sign in or register'
         bottom = (
@@ -124,7 +137,7 @@ export default React.createClass({
 
       let passwordField
       let passwordValidator
-      if (flow.step === 'signin' || flow.step === 'register') {
+      if (flow.step === 'signin' || flow.step === 'otp' || flow.step === 'register') {
         passwordField = (
           <PasswordStrengthField
             name="password"
@@ -137,6 +150,19 @@ export default React.createClass({
         passwordValidator = validatePassword
       }
 
+      let otpField
+      if (flow.step === 'otp') {
+        otpField = (
+          <TextField
+            name="otp"
+            label="authenticator or recovery code"
+            tabIndex={2}
+            spellCheck={false}
+            autoFocus
+          />
+        )
+      }
+
       dialogContent = (
         <Form
           ref="form"
@@ -160,6 +186,7 @@ export default React.createClass({
             autoFocus
           />
           {passwordField}
+          {otpField}
           {bottom}
         </Form>
       )
@@ -0,0 +1,41 @@
+import React from 'react'
+import Reflux from 'reflux'
+
+import emailPreferencesFlow from '../stores/emailPreferencesFlow'
+import { Form, CheckField, ErrorMessage } from './forms'
+
+
+export default React.createClass({
+  displayName: 'EmailPreferencesForm',
+
+  mixins: [
+    Reflux.connect(emailPreferencesFlow.store, 'flow'),
+  ],
+
+  onSubmit(values) {
+    emailPreferencesFlow.save(values)
+  },
+
+  render() {
+    const flow = this.state.flow
+    return (
+      <Form
+        ref="form"
+        className="email-preferences"
+        onSubmit={this.onSubmit}
+        initialValues={flow.preferences.toJS()}
+        working={flow.working}
+        errors={flow.errors.toJS()}
+      >
+        <h1>email preferences</h1>
+        <h2>which emails should we send to <strong>{flow.email}</strong>?</h2>
+        <CheckField name="mentions" tabIndex={1}>someone mentions me while i'm away</CheckField>
+        <CheckField name="pms" tabIndex={1}>someone sends me a private message while i'm away</CheckField>
+        <CheckField name="access_requests" tabIndex={1}>someone asks for access to a room i manage</CheckField>
+        <CheckField name="invitations" tabIndex={1}>someone invites me to a private room</CheckField>
+        <ErrorMessage name="reason" />
+        {flow.done ? <button className="major-action done" disabled>your preferences are saved.</button> : <button type="submit" tabIndex={2} className="major-action">save preferences</button>}
+      </Form>
+    )
+  },
+})
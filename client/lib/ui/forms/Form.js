@@ -8,6 +8,7 @@ export default React.createClass({
 
   propTypes: {
     context: React.PropTypes.object,
+    initialValues: React.PropTypes.object,
     errors: React.PropTypes.objectOf(React.PropTypes.string),
     validators: React.PropTypes.objectOf(React.PropTypes.func),
     working: React.PropTypes.bool,
@@ -26,7 +27,7 @@ export default React.createClass({
 
   getInitialState() {
     return {
-      values: {},
+      values: _.assign({}, this.props.initialValues),
       errors: {},
     }
   },
@@ -0,0 +1,10 @@
+import React from 'react'
+
+import { MainPage, HeimAttachPoint } from './common'
+
+
+module.exports = (
+  <MainPage title="euphoria: email preferences" className="form-page" heimPage="email-preferences">
+    <HeimAttachPoint id="form-container" />
+  </MainPage>
+)
@@ -267,6 +267,11 @@ describe('chat store', () => {
       chat.store.setup('ezzie')
       sinon.assert.calledOnce(storage.load)
     })
+
+    it('should save invite code', () => {
+      chat.store.setup('ezzie', 'abc123')
+      assert.equal(chat.store._inviteCode, 'abc123')
+    })
   })
 
   describe('connect action', () => {
@@ -387,6 +392,25 @@ describe('chat store', () => {
       })
       chat.store.socketOpen()
     })
+
+    it('should send invite authentication instead if given an invite code', done => {
+      chat.store.state.roomName = 'ezzie'
+      chat.store.storageChange(mockStorage)
+      chat.store._inviteCode = 'abc123'
+      support.listenOnce(chat.store, () => {
+        assert.equal(chat.store.state.authState, 'trying-stored')
+        sinon.assert.calledOnce(chat.store.socket.send)
+        sinon.assert.calledWithExactly(chat.store.socket.send, {
+          type: 'auth',
+          data: {
+            type: 'invite',
+            invite: 'abc123',
+          },
+        })
+        done()
+      })
+      chat.store.socketOpen()
+    })
   })
 
   describe('when disconnected', () => {
@@ -1237,6 +1261,38 @@ describe('chat store', () => {
       chat.store.state.authData = 'hunter2'
     })
 
+    describe('if invite successful', () => {
+      it('should not save the invite in storage', done => {
+        chat.store._inviteCode = 'abc123'
+        chat.store.state.authState = 'trying-stored'
+        handleSocket(successfulAuthReplyEvent, state => {
+          sinon.assert.notCalled(storage.setRoom)
+          assert.equal(state.authState, null)
+          done()
+        })
+      })
+
+      it('should keep the invite code for reconnecting', done => {
+        chat.store._inviteCode = 'abc123'
+        chat.store.state.authState = 'trying-stored'
+        handleSocket(successfulAuthReplyEvent, () => {
+          assert.equal(chat.store._inviteCode, 'abc123')
+          done()
+        })
+      })
+    })
+
+    describe('if invite unsuccessful', () => {
+      it('should set auth state to "needs-passcode"', () => {
+        chat.store._inviteCode = 'abc123'
+        chat.store.state.authState = 'trying-stored'
+        handleSocket(incorrectAuthReplyEvent, state => {
+          assert.equal(state.authState, 'needs-passcode')
+          assert.equal(chat.store._inviteCode, null)
+        })
+      })
+    })
+
     describe('if successful', () => {
       it('should save auth data in storage', done => {
         handleSocket(successfulAuthReplyEvent, state => {
@@ -256,11 +256,20 @@ func run() error {
 	ts.registerType("int")
 	ts.registerType("object")
 	ts.registerType("string")
+	ts.registerType("AccessRequest")
+	ts.registerType("AccountGrant")
 	ts.registerType("AccountView")
+	ts.registerType("AgentView")
 	ts.registerType("AuthOption")
+	ts.registerType("EmailPreferences")
+	ts.registerType("Invite")
 	ts.registerType("Message")
 	ts.registerType("PacketType")
+	ts.registerType("PasscodeGrant")
+	ts.registerType("PendingInvite")
 	ts.registerType("PersonalAccountView")
+	ts.registerType("PersonalIdentityView")
+	ts.registerType("PMSummary")
 	ts.registerType("SessionView")
 	ts.registerType("Snowflake")
 	ts.registerType("Time")
@@ -5,8 +5,7 @@ import (
 	"fmt"
 	"time"
 
-	"gopkg.in/gorp.v1"
-
+	"euphoria.io/heim/heimctl/stats"
 	"euphoria.io/scope"
 )
 
@@ -29,6 +28,9 @@ func (cmd *analyzeStatsCmd) longdesc() string {
 	By default, this command runs one round of analysis. Multiple rounds
 	may be required to catch up to the current time. Run with -backfill
 	to automatically loop until caught up.
+
+	Workers for the stats-analysis queue run this analysis on a schedule,
+	so this command is only needed to catch up by hand.
 `[1:]
 }
 
@@ -45,22 +47,20 @@ func (cmd *analyzeStatsCmd) run(ctx scope.Context, args []string) error {
 	}
 	defer heim.Backend.Close()
 
-	for {
-		var row struct {
-			Last gorp.NullTime
-		}
-		err := b.DbMap.SelectOne(&row, "SELECT stats_sessions_analyze() AS last")
-		if err != nil {
-			return err
-		}
-		if !row.Last.Valid {
-			fmt.Printf("stored procedure returned NULL, finished?\n")
-			break
-		}
-		fmt.Printf("analyzed up to %s\n", row.Last.Time)
-		if !cmd.backfill || row.Last.Time.After(time.Now().Add(-time.Hour-time.Minute)) {
-			break
-		}
+	progress := func(last time.Time) { fmt.Printf("analyzed up to %s\n", last) }
+
+	if cmd.backfill {
+		return stats.Backfill(ctx, b, progress)
+	}
+
+	last, ok, err := stats.Analyze(ctx, b)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Printf("stored procedure returned NULL, finished?\n")
+		return nil
 	}
+	progress(last)
 	return nil
 }
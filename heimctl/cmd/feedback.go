@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("email-feedback", &feedbackCmd{})
+}
+
+type feedbackCmd struct {
+	smtpAddr string
+	maildir  string
+	interval time.Duration
+}
+
+func (feedbackCmd) desc() string {
+	return "process bounces and complaints about email we've sent"
+}
+
+func (feedbackCmd) usage() string {
+	return "email-feedback (--smtp=<interface:port> | --maildir=DIR [--interval=DURATION])"
+}
+
+func (feedbackCmd) longdesc() string {
+	return `
+	Process delivery status notifications (bounces) and abuse reports
+	(complaints) sent back to us by remote mail servers. Each report is
+	matched to the email it's about by Message-ID. Permanent failures mark
+	the email failed, and the recipient's address undeliverable, so that
+	no more optional email is sent to it.
+
+	Reports are received either over SMTP, from an MTA configured to relay
+	the bounce address to --smtp, or by polling a Maildir the MTA delivers
+	the bounce address to.
+`[1:]
+}
+
+func (cmd *feedbackCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("email-feedback", flag.ExitOnError)
+	flags.StringVar(&cmd.smtpAddr, "smtp", "", "address to accept reports over SMTP on")
+	flags.StringVar(&cmd.maildir, "maildir", "", "path to Maildir to poll for reports")
+	flags.DurationVar(&cmd.interval, "interval", time.Minute, "sleep interval between Maildir scans")
+	return flags
+}
+
+func (cmd *feedbackCmd) run(ctx scope.Context, args []string) error {
+	if (cmd.smtpAddr == "") == (cmd.maildir == "") {
+		return fmt.Errorf("exactly one of --smtp or --maildir is required")
+	}
+
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	heim, err := cfg.Heim(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		ctx.Cancel()
+		ctx.WaitGroup().Wait()
+		heim.Backend.Close()
+	}()
+
+	handler := proto.EmailFeedbackHandler(heim.KMS, heim.Backend)
+	if cmd.maildir != "" {
+		return emails.PollMaildir(ctx, cmd.maildir, cmd.interval, handler)
+	}
+
+	l, err := net.Listen("tcp", cmd.smtpAddr)
+	if err != nil {
+		return err
+	}
+	return emails.ServeSMTP(ctx, l, cfg.CommonEmailParams.EmailDomain, handler)
+}
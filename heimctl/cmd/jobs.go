@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("jobs", &jobsCmd{})
+}
+
+type jobsCmd struct {
+	n        int
+	attempts int
+}
+
+func (jobsCmd) desc() string { return "list, inspect, requeue, or purge dead jobs" }
+
+func (jobsCmd) usage() string {
+	return "jobs (list [--n=COUNT] QUEUE | inspect QUEUE JOB-ID | requeue [--attempts=N] QUEUE JOB-ID... | purge QUEUE JOB-ID...)"
+}
+
+func (jobsCmd) longdesc() string {
+	return `
+	Manage jobs that failed their final attempt. Dead jobs stay in their
+	queue, along with the reason they failed, until they're requeued or
+	purged.
+
+	  list     lists the most recently failed dead jobs in a queue
+	  inspect  shows a job and the log of each of its attempts
+	  requeue  returns dead jobs to their queue, with --attempts attempts
+	  purge    removes dead jobs from their queue for good
+`[1:]
+}
+
+func (cmd *jobsCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("jobs", flag.ExitOnError)
+	flags.IntVar(&cmd.n, "n", 20, "maximum number of jobs to list")
+	flags.IntVar(&cmd.attempts, "attempts", 1, "number of attempts to give each requeued job")
+	return flags
+}
+
+// parseArgs splits the command line into the action, queue, and job IDs,
+// parsing any flags given after the action.
+func (cmd *jobsCmd) parseArgs(args []string) (string, string, []snowflake.Snowflake, error) {
+	if len(args) < 1 {
+		return "", "", nil, fmt.Errorf("usage: %s", cmd.usage())
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("jobs "+action, flag.ContinueOnError)
+	switch action {
+	case "list":
+		flags.IntVar(&cmd.n, "n", cmd.n, "maximum number of jobs to list")
+	case "requeue":
+		flags.IntVar(&cmd.attempts, "attempts", cmd.attempts, "number of attempts to give each requeued job")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return "", "", nil, err
+	}
+	if flags.NArg() < 1 {
+		return "", "", nil, fmt.Errorf("usage: %s", cmd.usage())
+	}
+	queueName, jobArgs := flags.Arg(0), flags.Args()[1:]
+
+	jobIDs := make([]snowflake.Snowflake, len(jobArgs))
+	for i, arg := range jobArgs {
+		if err := jobIDs[i].FromString(arg); err != nil {
+			return "", "", nil, fmt.Errorf("%s: %s", arg, err)
+		}
+	}
+
+	switch action {
+	case "list":
+	case "inspect":
+		if len(jobIDs) != 1 {
+			return "", "", nil, fmt.Errorf("usage: %s", cmd.usage())
+		}
+	case "requeue", "purge":
+		if len(jobIDs) < 1 {
+			return "", "", nil, fmt.Errorf("usage: %s", cmd.usage())
+		}
+		if action == "requeue" && cmd.attempts < 1 {
+			return "", "", nil, fmt.Errorf("--attempts must be positive")
+		}
+	default:
+		return "", "", nil, fmt.Errorf("invalid action: %s", action)
+	}
+	return action, queueName, jobIDs, nil
+}
+
+func (cmd *jobsCmd) run(ctx scope.Context, args []string) error {
+	action, queueName, jobIDs, err := cmd.parseArgs(args)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	heim, err := cfg.Heim(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		ctx.Cancel()
+		ctx.WaitGroup().Wait()
+		heim.Backend.Close()
+	}()
+
+	jq, err := heim.Backend.Jobs().GetQueue(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		dead, err := jq.DeadLetters(ctx, cmd.n)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+		for _, job := range dead {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d attempts\t%s\n",
+				job.ID, job.Type, job.DeadLettered, job.AttemptsMade, job.FailureReason)
+		}
+		return w.Flush()
+	case "inspect":
+		return jobs.Inspect(ctx, jq, jobIDs[0], os.Stdout)
+	case "requeue":
+		for _, jobID := range jobIDs {
+			if err := jq.Requeue(ctx, jobID, int32(cmd.attempts)); err != nil {
+				return fmt.Errorf("%s: %s", jobID, err)
+			}
+			fmt.Printf("requeued %s\n", jobID)
+		}
+	case "purge":
+		for _, jobID := range jobIDs {
+			if err := jq.Purge(ctx, jobID); err != nil {
+				return fmt.Errorf("%s: %s", jobID, err)
+			}
+			fmt.Printf("purged %s\n", jobID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"testing"
+
+	"euphoria.io/heim/proto/snowflake"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJobsArgs(t *testing.T) {
+	parse := func(args ...string) (*jobsCmd, string, string, []snowflake.Snowflake, error) {
+		cmd := &jobsCmd{}
+		fs := cmd.flags()
+		So(fs.Parse(args), ShouldBeNil)
+		action, queue, jobIDs, err := cmd.parseArgs(fs.Args())
+		return cmd, action, queue, jobIDs, err
+	}
+
+	Convey("Flags are parsed after the action", t, func() {
+		cmd, action, queue, jobIDs, err := parse("list", "--n=5", "email")
+		So(err, ShouldBeNil)
+		So(action, ShouldEqual, "list")
+		So(queue, ShouldEqual, "email")
+		So(jobIDs, ShouldBeEmpty)
+		So(cmd.n, ShouldEqual, 5)
+
+		cmd, action, queue, jobIDs, err = parse("requeue", "--attempts=3", "email", "1", "2")
+		So(err, ShouldBeNil)
+		So(action, ShouldEqual, "requeue")
+		So(queue, ShouldEqual, "email")
+		So(jobIDs, ShouldResemble, []snowflake.Snowflake{1, 2})
+		So(cmd.attempts, ShouldEqual, 3)
+	})
+
+	Convey("Flags are still accepted before the action", t, func() {
+		cmd, _, queue, _, err := parse("--n=7", "list", "email")
+		So(err, ShouldBeNil)
+		So(queue, ShouldEqual, "email")
+		So(cmd.n, ShouldEqual, 7)
+	})
+
+	Convey("Defaults apply when no flags are given", t, func() {
+		cmd, _, _, _, err := parse("requeue", "email", "1")
+		So(err, ShouldBeNil)
+		So(cmd.attempts, ShouldEqual, 1)
+		So(cmd.n, ShouldEqual, 20)
+	})
+
+	Convey("Invalid command lines are rejected", t, func() {
+		_, _, _, _, err := parse()
+		So(err, ShouldNotBeNil)
+		_, _, _, _, err = parse("list")
+		So(err, ShouldNotBeNil)
+		_, _, _, _, err = parse("inspect", "email")
+		So(err, ShouldNotBeNil)
+		_, _, _, _, err = parse("requeue", "--attempts=0", "email", "1")
+		So(err, ShouldNotBeNil)
+		_, _, _, _, err = parse("purge", "email", "not-a-job")
+		So(err, ShouldNotBeNil)
+		_, _, _, _, err = parse("list", "--attempts=3", "email")
+		So(err, ShouldNotBeNil)
+		_, _, _, _, err = parse("explode", "email")
+		So(err, ShouldNotBeNil)
+	})
+}
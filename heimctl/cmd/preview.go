@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/templates"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("email-preview", &previewCmd{})
+}
+
+type previewCmd struct {
+	addr      string
+	templates string
+}
+
+func (previewCmd) desc() string {
+	return "preview email templates in a browser"
+}
+
+func (previewCmd) usage() string {
+	return "email-preview [--http=<interface:port>] [--templates=<path>]"
+}
+
+func (previewCmd) longdesc() string {
+	return `
+	Serve a preview of every email template, rendered with the sample data
+	that testmail sends, at the address given by --http. The text and HTML
+	parts of each email are shown side by side, along with its headers and
+	attachments, and any localizations of a template can be previewed with
+	its sample data too.
+
+	Templates are loaded from --templates, which should point at the
+	client's build/email directory. They're reloaded whenever a file there
+	changes, so rebuilding the client's emails and refreshing the page
+	shows the result. Errors loading or validating the templates are
+	reported on the page, instead of preventing the server from starting.
+`[1:]
+}
+
+func (cmd *previewCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("email-preview", flag.ExitOnError)
+	flags.StringVar(&cmd.addr, "http", ":8081", "address to serve http on")
+	flags.StringVar(&cmd.templates, "templates", "client/build/email", "path to email templates")
+	return flags
+}
+
+func (cmd *previewCmd) run(ctx scope.Context, args []string) error {
+	previewer := &templates.Previewer{
+		Path:      cmd.templates,
+		Scenarios: proto.EmailScenarios,
+		Validate:  proto.ValidateEmailTemplates,
+	}
+
+	listener, err := net.Listen("tcp", cmd.addr)
+	if err != nil {
+		return err
+	}
+
+	// Spin off goroutine to watch ctx and close listener if shutdown requested.
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	fmt.Printf("previewing %s on %s\n", cmd.templates, cmd.addr)
+	if err := http.Serve(listener, previewer); err != nil {
+		if strings.HasSuffix(err.Error(), "use of closed network connection") {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/scope"
+)
+
+func init() {
+	register("email-replies", &repliesCmd{})
+}
+
+type repliesCmd struct {
+	smtpAddr string
+	maildir  string
+	interval time.Duration
+}
+
+func (repliesCmd) desc() string {
+	return "post replies to notification emails into their rooms"
+}
+
+func (repliesCmd) usage() string {
+	return "email-replies (--smtp=<interface:port> | --maildir=DIR [--interval=DURATION])"
+}
+
+func (repliesCmd) longdesc() string {
+	return `
+	Post replies to notification emails as messages, in the room or private
+	chat they were about, on behalf of the account they were sent to. Each
+	notification carries a signed reply address at the configured
+	email-reply-domain, which identifies the account, room, and message
+	being replied to. Each address can be replied to only once. Quoted text
+	and signatures are stripped from replies, and replies from addresses
+	other than the account's verified email, or to rooms the account can no
+	longer access, are rejected.
+
+	Replies are received either over SMTP, from an MTA configured to relay
+	the reply domain to --smtp, or by polling a Maildir the MTA delivers the
+	reply domain to. The MTA must check DKIM, SPF, or DMARC on the way in
+	and record the outcome in an Authentication-Results header under the
+	configured email-reply-authserv-id. Replies it didn't find to come from
+	their sender's domain are rejected.
+`[1:]
+}
+
+func (cmd *repliesCmd) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("email-replies", flag.ExitOnError)
+	flags.StringVar(&cmd.smtpAddr, "smtp", "", "address to accept replies over SMTP on")
+	flags.StringVar(&cmd.maildir, "maildir", "", "path to Maildir to poll for replies")
+	flags.DurationVar(&cmd.interval, "interval", time.Minute, "sleep interval between Maildir scans")
+	return flags
+}
+
+func (cmd *repliesCmd) run(ctx scope.Context, args []string) error {
+	if (cmd.smtpAddr == "") == (cmd.maildir == "") {
+		return fmt.Errorf("exactly one of --smtp or --maildir is required")
+	}
+
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Email.ReplyDomain == "" {
+		return fmt.Errorf("email reply domain must be configured")
+	}
+	if cfg.Email.ReplyAuthServID == "" {
+		return fmt.Errorf("email reply authserv-id must be configured")
+	}
+
+	heim, err := cfg.Heim(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		ctx.Cancel()
+		ctx.WaitGroup().Wait()
+		heim.Backend.Close()
+	}()
+
+	handler := proto.EmailReplyHandler(heim)
+	if cmd.maildir != "" {
+		return emails.PollMaildir(ctx, cmd.maildir, cmd.interval, handler)
+	}
+
+	l, err := net.Listen("tcp", cmd.smtpAddr)
+	if err != nil {
+		return err
+	}
+	return emails.ServeSMTP(ctx, l, cfg.Email.ReplyDomain, handler)
+}
@@ -94,6 +94,11 @@ func (cmd *serveCmd) run(ctx scope.Context, args []string) error {
 	server.SetInsecureCookies(backend.Config.SetInsecureCookies)
 	server.AllowRoomCreation(backend.Config.AllowRoomCreation)
 	server.NewAccountMinAgentAge(backend.Config.NewAccountMinAgentAge)
+	for name, cfg := range backend.Config.OIDC {
+		if err := server.AddOIDCProvider(name, cfg); err != nil {
+			return fmt.Errorf("server error: %s", err)
+		}
+	}
 
 	// Spin off goroutine to watch ctx and close listener if shutdown requested.
 	go func() {
@@ -3,8 +3,10 @@ package cmd
 import (
 	"flag"
 	"fmt"
+	"strings"
 
 	"euphoria.io/heim/heimctl/worker"
+	"euphoria.io/heim/proto/jobs"
 	"euphoria.io/scope"
 )
 
@@ -22,14 +24,20 @@ func (workerCmd) desc() string {
 }
 
 func (workerCmd) usage() string {
-	return "worker [--http=<interface:port>] [--worker=ID] QUEUE"
+	return "worker [--http=<interface:port>] [--worker=ID] QUEUE..."
 }
 
 func (workerCmd) longdesc() string {
-	return `
-	Run a worker for processing job items from QUEUE. The worker will idle
-	until it can claim a job.
-`[1:]
+	return fmt.Sprintf(`
+	Run a worker for processing job items from each QUEUE. The worker will
+	idle until it can claim a job.
+
+	Some queues receive recurring jobs, which the worker also schedules.
+	Any number of workers may schedule the same recurring job; each tick
+	of its schedule is only enqueued once across the cluster. These are:
+
+%s
+`[1:], listRecurringJobs())
 }
 
 func (cmd *workerCmd) flags() *flag.FlagSet {
@@ -70,5 +78,13 @@ func (cmd *workerCmd) run(ctx scope.Context, args []string) error {
 	go worker.Serve(ctx, cmd.addr)
 
 	// Start scanner.
-	return worker.Loop(ctx, heim, cmd.worker, args[0])
+	return worker.Loop(ctx, heim, cmd.worker, args...)
+}
+
+func listRecurringJobs() string {
+	lines := make([]string, len(jobs.RecurringJobs))
+	for i, rj := range jobs.RecurringJobs {
+		lines[i] = fmt.Sprintf("    * %-20s %s", rj.Queue, rj.Schedule)
+	}
+	return strings.Join(lines, "\n")
 }
@@ -0,0 +1,22 @@
+package grants
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	revokedGrants = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:      "revoked",
+		Subsystem: "grants",
+		Help:      "Number of expired grants revoked, labeled by kind of grant.",
+	}, []string{"kind"})
+
+	lastScan = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:      "last_scan",
+		Subsystem: "grants",
+		Help:      "The last Unix time the expired grant scanner loop completed.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(revokedGrants)
+	prometheus.MustRegister(lastScan)
+}
@@ -0,0 +1,65 @@
+package grants
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"euphoria.io/heim/backend/psql"
+	"euphoria.io/heim/cluster"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/scope"
+)
+
+// grantTables maps each kind of grant to the table its expiry is recorded in.
+var grantTables = map[string]string{
+	"access":  "room_capability",
+	"manager": "room_manager_capability",
+}
+
+type expiredGrant struct {
+	Room         string
+	CapabilityID string `db:"capability_id"`
+	AccountID    string `db:"account_id"`
+}
+
+// Scan revokes expired access and manager grants, and disconnects the
+// sessions of accounts that held them so they reauthorize.
+func Scan(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
+	for kind, table := range grantTables {
+		// Deleting the capability cascades to the room's grant.
+		var rows []expiredGrant
+		_, err := pb.DbMap.Select(
+			&rows,
+			fmt.Sprintf(
+				"WITH expired AS (SELECT room, capability_id FROM %s WHERE expires <= NOW())"+
+					" DELETE FROM capability c USING expired e WHERE c.id = e.capability_id"+
+					" RETURNING e.room, e.capability_id, COALESCE(c.account_id, '') AS account_id",
+				table))
+		if err != nil {
+			return fmt.Errorf("%s grants: %s", kind, err)
+		}
+
+		for _, row := range rows {
+			logging.Logger(ctx).Printf(
+				"revoked expired %s grant %s in %s", kind, row.CapabilityID, row.Room)
+			revokedGrants.With(prometheus.Labels{"kind": kind}).Inc()
+
+			// Passcode grants can't be traced back to sessions. Account
+			// sessions are disconnected so they reauthorize without the grant.
+			if row.AccountID == "" {
+				continue
+			}
+			userID := proto.UserID(fmt.Sprintf("account:%s", row.AccountID))
+			event := &proto.DisconnectEvent{Reason: "authentication changed"}
+			if err := pb.NotifyUserInRoom(ctx, row.Room, userID, proto.DisconnectEventType, event); err != nil {
+				return fmt.Errorf("notify %s in %s: %s", userID, row.Room, err)
+			}
+		}
+	}
+
+	lastScan.Set(float64(time.Now().Unix()))
+	return nil
+}
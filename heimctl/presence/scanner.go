@@ -18,6 +18,10 @@ const (
 	chunkSize = 1000
 )
 
+// ScanLoop scans the presence table at every interval until ctx is
+// cancelled. Presence changes by the second, so this runs as a service of
+// its own, the only one to publish these gauges, rather than as a
+// recurring job that any worker could pick up once a minute.
 func ScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval time.Duration) {
 	defer ctx.WaitGroup().Done()
 
@@ -43,6 +47,8 @@ func ScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval t
 	}
 }
 
+// scan collects metrics about live and lurking sessions from the presence
+// table.
 func scan(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
 	type PresenceWithUserAgent struct {
 		psql.Presence
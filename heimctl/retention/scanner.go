@@ -13,10 +13,16 @@ import (
 	"euphoria.io/scope"
 )
 
-const (
-	maxErrors   = 3
-	GracePeriod = time.Hour
-)
+const GracePeriod = time.Hour
+
+// Scan deletes messages that have outlived their room's retention period, and
+// then flags rooms where expired messages remain past the grace period.
+func Scan(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
+	if err := scanToDelete(ctx, c, pb); err != nil {
+		return err
+	}
+	return scanForExpired(ctx, c, pb)
+}
 
 func scanForExpired(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
 	rows, err := pb.DbMap.Select(
@@ -60,31 +66,6 @@ func scanForExpired(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) erro
 	return nil
 }
 
-func ExpiredScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval time.Duration) {
-	defer ctx.WaitGroup().Done()
-
-	errCount := 0
-	for {
-		t := time.After(interval)
-		select {
-		case <-ctx.Done():
-			return
-		case <-t:
-			if err := scanForExpired(ctx, c, pb); err != nil {
-				errCount++
-				fmt.Printf("scan error [%d/%d]: %s", errCount, maxErrors, err)
-				if errCount > maxErrors {
-					fmt.Println("maximum scan errors exceeded, terminating")
-					ctx.Terminate(fmt.Errorf("maximum scan errors exceeded"))
-					return
-				}
-				continue
-			}
-			errCount = 0
-		}
-	}
-}
-
 func scanToDelete(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error {
 	rows, err := pb.DbMap.Select(
 		psql.Room{},
@@ -116,28 +97,3 @@ func scanToDelete(ctx scope.Context, c cluster.Cluster, pb *psql.Backend) error
 	}
 	return nil
 }
-
-func DeleteScanLoop(ctx scope.Context, c cluster.Cluster, pb *psql.Backend, interval time.Duration) {
-	defer ctx.WaitGroup().Done()
-
-	errCount := 0
-	for {
-		t := time.After(interval)
-		select {
-		case <-ctx.Done():
-			return
-		case <-t:
-			if err := scanToDelete(ctx, c, pb); err != nil {
-				errCount++
-				fmt.Printf("delete scan error [%d/%d]: %s", errCount, maxErrors, err)
-				if errCount > maxErrors {
-					fmt.Println("maximum delete scan errors exceeded, terminating")
-					ctx.Terminate(fmt.Errorf("maximum delete scan errors exceeded"))
-					return
-				}
-				continue
-			}
-			errCount = 0
-		}
-	}
-}
@@ -0,0 +1,44 @@
+package stats
+
+import (
+	"time"
+
+	"gopkg.in/gorp.v1"
+
+	"euphoria.io/heim/backend/psql"
+	"euphoria.io/scope"
+)
+
+// CaughtUp is how close to the present analysis gets before there's nothing
+// more to analyze.
+const CaughtUp = time.Hour + time.Minute
+
+// Analyze runs one round of analysis of recent activity, filling in the stats
+// tables. It returns the time analysis has reached, or false if there was
+// nothing to analyze.
+func Analyze(ctx scope.Context, pb *psql.Backend) (time.Time, bool, error) {
+	var row struct {
+		Last gorp.NullTime
+	}
+	if err := pb.DbMap.SelectOne(&row, "SELECT stats_sessions_analyze() AS last"); err != nil {
+		return time.Time{}, false, err
+	}
+	return row.Last.Time, row.Last.Valid, nil
+}
+
+// Backfill runs rounds of analysis until it's caught up to the present.
+func Backfill(ctx scope.Context, pb *psql.Backend, progress func(time.Time)) error {
+	for ctx.Err() == nil {
+		last, ok, err := Analyze(ctx, pb)
+		if err != nil || !ok {
+			return err
+		}
+		if progress != nil {
+			progress(last)
+		}
+		if last.After(time.Now().Add(-CaughtUp)) {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/scope"
+)
+
+type AccountDeletionWorker struct {
+	heim *proto.Heim
+}
+
+func (AccountDeletionWorker) QueueName() string     { return jobs.AccountDeletionQueue }
+func (AccountDeletionWorker) JobType() jobs.JobType { return jobs.AccountDeletionJobType }
+
+func (w *AccountDeletionWorker) Init(heim *proto.Heim) error {
+	w.heim = heim
+	return nil
+}
+
+func (w *AccountDeletionWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	return w.heim.DeleteAccount(ctx, payload.(*jobs.AccountDeletionJob).AccountID)
+}
+
+type AccountDataExportWorker struct {
+	heim *proto.Heim
+}
+
+func (AccountDataExportWorker) QueueName() string     { return jobs.AccountDataExportQueue }
+func (AccountDataExportWorker) JobType() jobs.JobType { return jobs.AccountDataExportJobType }
+
+func (w *AccountDataExportWorker) Init(heim *proto.Heim) error {
+	w.heim = heim
+	return nil
+}
+
+func (w *AccountDataExportWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	return w.heim.ExportAccountData(ctx, payload.(*jobs.AccountDataExportJob).AccountID)
+}
+
+func init() {
+	register(&AccountDeletionWorker{})
+	register(&AccountDataExportWorker{})
+}
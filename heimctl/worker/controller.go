@@ -94,7 +94,7 @@ func (c *Controller) processOne(ctx scope.Context) error {
 		return err
 	}
 
-	if job.Type != jobs.EmailJobType {
+	if job.Type != c.w.JobType() {
 		return jobs.ErrInvalidJobType
 	}
 
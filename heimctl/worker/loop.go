@@ -4,19 +4,54 @@ import (
 	"fmt"
 
 	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/logging"
 	"euphoria.io/scope"
 )
 
-func Loop(ctx scope.Context, heim *proto.Heim, workerName, queueName string) error {
+// Loop processes jobs from each of the given queues, and schedules the
+// recurring jobs bound for them, until ctx is cancelled or processing of any
+// queue fails.
+func Loop(ctx scope.Context, heim *proto.Heim, workerName string, queueNames ...string) error {
 	fmt.Printf("Loop\n")
-	ctrl, err := NewController(ctx, heim, workerName, queueName)
-	if err != nil {
-		fmt.Printf("error: %s\n", err)
-		return err
+	ctrls := make([]*Controller, 0, len(queueNames))
+	for _, queueName := range queueNames {
+		ctrl, err := NewController(ctx, heim, workerName, queueName)
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			return err
+		}
+		ctrls = append(ctrls, ctrl)
 	}
 
-	ctx.WaitGroup().Add(1)
-	go ctrl.background(ctx)
+	// Only schedule jobs that this worker will process, so that queues
+	// without workers don't fill up.
+	recurring := []*jobs.RecurringJob{}
+	for _, rj := range jobs.RecurringJobs {
+		for _, queueName := range queueNames {
+			if rj.Queue == queueName {
+				recurring = append(recurring, rj)
+			}
+		}
+	}
+	if len(recurring) > 0 {
+		ctx.WaitGroup().Add(1)
+		go func() {
+			defer ctx.WaitGroup().Done()
+			if err := jobs.RunScheduler(ctx, heim.Backend.Jobs(), recurring); err != nil {
+				logging.Logger(ctx).Printf("error: scheduler: %s", err)
+				ctx.Terminate(err)
+			}
+		}()
+	}
+
+	for _, ctrl := range ctrls {
+		ctx.WaitGroup().Add(1)
+		go func(ctrl *Controller) {
+			ctrl.background(ctx)
+			ctx.Cancel()
+		}(ctrl)
+	}
 	ctx.WaitGroup().Wait()
 	return ctx.Err()
 }
@@ -0,0 +1,27 @@
+package worker
+
+import (
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/scope"
+)
+
+type NotificationDigestWorker struct {
+	heim *proto.Heim
+}
+
+func (NotificationDigestWorker) QueueName() string     { return jobs.NotificationDigestQueue }
+func (NotificationDigestWorker) JobType() jobs.JobType { return jobs.NotificationDigestJobType }
+
+func (w *NotificationDigestWorker) Init(heim *proto.Heim) error {
+	w.heim = heim
+	return nil
+}
+
+func (w *NotificationDigestWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	return w.heim.SendNotificationDigest(ctx, payload.(*jobs.NotificationDigestJob).AccountID)
+}
+
+func init() {
+	register(&NotificationDigestWorker{})
+}
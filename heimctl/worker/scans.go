@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"fmt"
+
+	"euphoria.io/heim/backend/psql"
+	"euphoria.io/heim/heimctl/grants"
+	"euphoria.io/heim/heimctl/retention"
+	"euphoria.io/heim/heimctl/stats"
+	"euphoria.io/heim/proto"
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/scope"
+)
+
+// psqlWorker is embedded by workers that scan the psql backend directly.
+type psqlWorker struct {
+	heim *proto.Heim
+	pb   *psql.Backend
+}
+
+func (w *psqlWorker) Init(heim *proto.Heim) error {
+	pb, ok := heim.Backend.(*psql.Backend)
+	if !ok {
+		return fmt.Errorf("only psql backend is supported")
+	}
+	w.heim = heim
+	w.pb = pb
+	return nil
+}
+
+type GrantExpiryWorker struct {
+	psqlWorker
+}
+
+func (GrantExpiryWorker) QueueName() string     { return jobs.GrantExpiryQueue }
+func (GrantExpiryWorker) JobType() jobs.JobType { return jobs.GrantExpiryJobType }
+
+func (w *GrantExpiryWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	return grants.Scan(ctx, w.heim.Cluster, w.pb)
+}
+
+type MessageRetentionWorker struct {
+	psqlWorker
+}
+
+func (MessageRetentionWorker) QueueName() string     { return jobs.MessageRetentionQueue }
+func (MessageRetentionWorker) JobType() jobs.JobType { return jobs.MessageRetentionJobType }
+
+func (w *MessageRetentionWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	return retention.Scan(ctx, w.heim.Cluster, w.pb)
+}
+
+type StatsAnalysisWorker struct {
+	psqlWorker
+}
+
+func (StatsAnalysisWorker) QueueName() string     { return jobs.StatsAnalysisQueue }
+func (StatsAnalysisWorker) JobType() jobs.JobType { return jobs.StatsAnalysisJobType }
+
+func (w *StatsAnalysisWorker) Work(ctx scope.Context, job *jobs.Job, payload interface{}) error {
+	return stats.Backfill(ctx, w.pb, nil)
+}
+
+func init() {
+	register(&GrantExpiryWorker{})
+	register(&MessageRetentionWorker{})
+	register(&StatsAnalysisWorker{})
+}
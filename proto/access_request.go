@@ -0,0 +1,45 @@
+package proto
+
+import (
+	"time"
+
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+const MaxAccessRequestNoteLength = 1024
+
+// AccessRequestEmailInterval is how often a room's managers may be emailed
+// about requests from the same account.
+const AccessRequestEmailInterval = 24 * time.Hour
+
+// An AccessRequest is a request from an account, made after bouncing off a
+// private room, to be granted access to the room.
+type AccessRequest struct {
+	ID        snowflake.Snowflake `json:"id"`        // the id of the request
+	Room      string              `json:"room"`      // the name of the room access is requested to
+	Account   AccountView         `json:"account"`   // the account requesting access
+	Note      string              `json:"note"`      // a note from the requester to the room's managers
+	Requested Time                `json:"requested"` // the time the request was made
+}
+
+type AccessRequestTracker interface {
+	// Add records an access request. A request from the same account to the
+	// same room replaces any earlier one.
+	Add(ctx scope.Context, req *AccessRequest) error
+
+	// Get returns the request with the given ID in the given room.
+	Get(ctx scope.Context, room string, id snowflake.Snowflake) (*AccessRequest, error)
+
+	// List returns the pending requests to the given room, oldest first.
+	List(ctx scope.Context, room string) ([]AccessRequest, error)
+
+	// Remove deletes a request once it has been resolved.
+	Remove(ctx scope.Context, room string, id snowflake.Snowflake) error
+
+	// MarkEmailed records that the room's managers are being emailed about a
+	// request from the given account. If they were already emailed about a
+	// request from the account after the given time, nothing is recorded and
+	// false is returned.
+	MarkEmailed(ctx scope.Context, room string, accountID snowflake.Snowflake, since time.Time) (bool, error)
+}
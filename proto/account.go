@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"image"
 	"io"
+	"regexp"
 	"strings"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 
 	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/heim/templates"
 	"euphoria.io/scope"
 )
 
@@ -26,6 +28,9 @@ const (
 	MinPasswordLength            = 6
 	ClientKeyType                = security.AES128
 	PasswordResetRequestLifetime = time.Hour
+	OTPRecoveryCodeCount         = 10
+	OTPRecoveryCodeSize          = 8
+	MaxLocaleLength              = 35
 )
 
 type OTP struct {
@@ -52,6 +57,54 @@ func (o *OTP) Validate(password string) error {
 	return nil
 }
 
+// GenerateOTPRecoveryCodes returns a new set of single-use codes that may be
+// given in place of a one-time password, for when a user loses access to
+// their authentication app.
+func GenerateOTPRecoveryCodes(kms security.KMS) ([]string, error) {
+	codes := make([]string, OTPRecoveryCodeCount)
+	for i := range codes {
+		code, err := kms.GenerateNonce(OTPRecoveryCodeSize)
+		if err != nil {
+			return nil, err
+		}
+		hexCode := hex.EncodeToString(code)
+		parts := make([]string, 0, len(hexCode)/4)
+		for j := 0; j < len(hexCode); j += 4 {
+			parts = append(parts, hexCode[j:j+4])
+		}
+		codes[i] = strings.Join(parts, "-")
+	}
+	return codes, nil
+}
+
+// OTPRecoveryCodeDigest returns the digest under which a recovery code is
+// stored for the given account. Recovery codes themselves are never stored.
+// Dashes, spaces, and case are ignored.
+func OTPRecoveryCodeDigest(accountID snowflake.Snowflake, code string) string {
+	normalized := strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || r == ' ':
+			return -1
+		case r >= 'A' && r <= 'F':
+			return r - 'A' + 'a'
+		default:
+			return r
+		}
+	}, code)
+	digest := sha256.Sum256([]byte(accountID.String() + ":" + normalized))
+	return hex.EncodeToString(digest[:])
+}
+
+// CheckOTP validates a one-time password against the account's enrolled OTP.
+// If that fails, the password is redeemed as a recovery code instead.
+func CheckOTP(ctx scope.Context, am AccountManager, kms security.KMS, accountID snowflake.Snowflake, password string) error {
+	err := am.ValidateOTP(ctx, kms, accountID, password)
+	if err != ErrAccessDenied {
+		return err
+	}
+	return am.RedeemOTPRecoveryCode(ctx, accountID, OTPRecoveryCodeDigest(accountID, password))
+}
+
 type AccountManager interface {
 	// GetAccount returns the account with the given ID.
 	Get(ctx scope.Context, id snowflake.Snowflake) (Account, error)
@@ -64,17 +117,29 @@ type AccountManager interface {
 		Account, *security.ManagedKey, error)
 
 	// ResolveAccount returns any account registered under the given account identity.
+	// Email addresses an account has added, but not yet verified, don't
+	// resolve to it; only the address it registered with does.
 	Resolve(ctx scope.Context, namespace, id string) (Account, error)
 
+	// ResolveUnverified is like Resolve, but also finds accounts by email
+	// addresses they have added but not yet verified. It should only be used
+	// to complete verification.
+	ResolveUnverified(ctx scope.Context, namespace, id string) (Account, error)
+
 	// GrantStaff adds a StaffKMS capability to the identified account.
 	GrantStaff(ctx scope.Context, accountID snowflake.Snowflake, kmsCred security.KMSCredential) error
 
 	// RevokeStaff removes a StaffKMS capability from the identified account.
 	RevokeStaff(ctx scope.Context, accountID snowflake.Snowflake) error
 
-	// VerifyPersonalIdentity marks a personal identity as verified.
+	// VerifyPersonalIdentity marks a personal identity as verified. This
+	// also clears any earlier undeliverable mark.
 	VerifyPersonalIdentity(ctx scope.Context, namespace, id string) error
 
+	// MarkPersonalIdentityUndeliverable records that email to a personal
+	// identity has bounced or been reported as spam.
+	MarkPersonalIdentityUndeliverable(ctx scope.Context, namespace, id string) error
+
 	// ChangeClientKey re-encrypts account keys with a new client key.
 	// The correct former client key must also be given.
 	ChangeClientKey(
@@ -99,9 +164,23 @@ type AccountManager interface {
 	// email will be sent out.
 	ChangeEmail(ctx scope.Context, accountID snowflake.Snowflake, email string) (bool, error)
 
+	// AddPersonalIdentity adds an unverified personal identity to an account.
+	// Unlike ChangeEmail, verifying the identity doesn't make it the account's
+	// primary email, unless the account has none. Until it's verified, the
+	// identity doesn't hold the address, which another account may still
+	// register, add, or change its email to.
+	AddPersonalIdentity(ctx scope.Context, accountID snowflake.Snowflake, namespace, id string) error
+
+	// RemovePersonalIdentity removes a personal identity from an account.
+	RemovePersonalIdentity(ctx scope.Context, accountID snowflake.Snowflake, namespace, id string) error
+
 	// ChangeName changes an account's name.
 	ChangeName(ctx scope.Context, accountID snowflake.Snowflake, name string) error
 
+	// ChangeLocale changes an account's preferred locale. The locale should
+	// already be normalized; see NormalizeLocale.
+	ChangeLocale(ctx scope.Context, accountID snowflake.Snowflake, locale string) error
+
 	// OTP unlocks and returns the user's enrolled OTP, or nil if one has never
 	// been generated.
 	OTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake) (*OTP, error)
@@ -112,23 +191,59 @@ type AccountManager interface {
 
 	// ValidateOTP validates a one-time passcode according to the user's enrolled OTP.
 	ValidateOTP(ctx scope.Context, kms security.KMS, accountID snowflake.Snowflake, passcode string) error
+
+	// DisableOTP removes the user's enrolled OTP, along with any recovery codes.
+	DisableOTP(ctx scope.Context, accountID snowflake.Snowflake) error
+
+	// SetOTPRecoveryCodes replaces the user's OTP recovery codes. Only the
+	// digests of the codes are given; see OTPRecoveryCodeDigest.
+	SetOTPRecoveryCodes(ctx scope.Context, accountID snowflake.Snowflake, digests []string) error
+
+	// RedeemOTPRecoveryCode removes the recovery code with the given digest,
+	// or returns ErrAccessDenied if the user has no such code.
+	RedeemOTPRecoveryCode(ctx scope.Context, accountID snowflake.Snowflake, digest string) error
 }
 
 type PersonalIdentity interface {
 	Namespace() string
 	ID() string
 	Verified() bool
+
+	// Undeliverable returns true if email to the identity has bounced, or its
+	// owner has reported email from us as spam.
+	Undeliverable() bool
 }
 
 func ValidatePersonalIdentity(namespace, id string) (bool, string) {
 	switch namespace {
 	case "email":
 		return true, ""
+	case OIDCNamespace:
+		if _, _, ok := ParseOIDCIdentity(id); !ok {
+			return false, fmt.Sprintf("invalid oidc identity: %s", id)
+		}
+		return true, ""
 	default:
 		return false, fmt.Sprintf("invalid namespace: %s", namespace)
 	}
 }
 
+var localeRegexp = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{1,8})*$`)
+
+// NormalizeLocale checks that a locale is a language tag, such as "de" or
+// "pt-BR", and returns it in the form email templates are named with. An empty
+// locale is left as is.
+func NormalizeLocale(locale string) (string, error) {
+	if locale == "" {
+		return "", nil
+	}
+	locale = templates.NormalizeLocale(locale)
+	if len(locale) > MaxLocaleLength || !localeRegexp.MatchString(locale) {
+		return "", ErrInvalidLocale
+	}
+	return locale, nil
+}
+
 func ValidateAccountPassword(password string) (bool, string) {
 	if len(password) < MinPasswordLength {
 		return false, fmt.Sprintf("password must be at least %d characters long", MinPasswordLength)
@@ -140,6 +255,11 @@ type Account interface {
 	ID() snowflake.Snowflake
 	Name() string
 	Email() (string, bool)
+
+	// Locale returns the account's preferred locale for email, or an empty
+	// string for the default.
+	Locale() string
+
 	KeyFromPassword(password string) *security.ManagedKey
 	KeyPair() security.ManagedKeyPair
 	Unlock(clientKey *security.ManagedKey) (*security.ManagedKeyPair, error)
@@ -160,7 +280,47 @@ type AccountView struct {
 // PersonalAccountView describes an account to its owner.
 type PersonalAccountView struct {
 	AccountView
-	Email string `json:"email"` // the account's email address
+	Email  string `json:"email"`            // the account's email address
+	Locale string `json:"locale,omitempty"` // the account's preferred locale for email, if not the default
+}
+
+// PersonalIdentityView describes one of an account's personal identities to
+// its owner.
+type PersonalIdentityView struct {
+	Namespace     string `json:"namespace"`               // the namespace of the personal identifier
+	ID            string `json:"id"`                      // the personal identifier
+	Verified      bool   `json:"verified"`                // true if the identity has been verified
+	Primary       bool   `json:"primary,omitempty"`       // true if this is the account's primary email
+	Undeliverable bool   `json:"undeliverable,omitempty"` // true if email to the identity has bounced
+}
+
+// HasVerifiedPersonalIdentity returns true if the account has verified that it
+// owns the given personal identity.
+func HasVerifiedPersonalIdentity(account Account, namespace, id string) bool {
+	for _, pid := range account.PersonalIdentities() {
+		if pid.Namespace() == namespace && pid.ID() == id {
+			return pid.Verified()
+		}
+	}
+	return false
+}
+
+// PersonalIdentityViews describes the account's personal identities to its
+// owner.
+func PersonalIdentityViews(account Account) []PersonalIdentityView {
+	primary, _ := account.Email()
+	pids := account.PersonalIdentities()
+	views := make([]PersonalIdentityView, len(pids))
+	for i, pid := range pids {
+		views[i] = PersonalIdentityView{
+			Namespace:     pid.Namespace(),
+			ID:            pid.ID(),
+			Verified:      pid.Verified(),
+			Primary:       pid.Namespace() == "email" && pid.ID() == primary,
+			Undeliverable: pid.Undeliverable(),
+		}
+	}
+	return views
 }
 
 // NewAccountSecurity initializes the nonce and account secrets for a new account
@@ -0,0 +1,302 @@
+package proto
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+const (
+	// AccountDataExportLifetime is how long a personal data export remains
+	// available for download.
+	AccountDataExportLifetime = 7 * 24 * time.Hour
+
+	// DeletedSenderID replaces the sender ID of messages posted by accounts
+	// that have since been deleted.
+	DeletedSenderID = UserID("deleted")
+
+	accountDataPageSize = 1000
+)
+
+// A RoomMessage is a message along with the name of the room it was posted in.
+type RoomMessage struct {
+	Room string `json:"room"`
+	Message
+}
+
+// A RoomGrant describes an access or manager grant held by an account in a room.
+type RoomGrant struct {
+	Room    string    `json:"room"`
+	Manager bool      `json:"manager"`
+	Granted time.Time `json:"granted"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// An AccountDataExport is an archive of the personal data held about an
+// account, ready for its owner to download.
+type AccountDataExport struct {
+	ID        string
+	AccountID snowflake.Snowflake
+	Created   time.Time
+	Expires   time.Time
+	Data      []byte
+}
+
+// An AccountDataTracker finds and removes the data held about an account
+// across rooms, to honor requests for personal data exports and account
+// deletion.
+type AccountDataTracker interface {
+	// Messages returns up to n of the messages posted by the account across
+	// all rooms, newest first, starting before the given message ID.
+	Messages(ctx scope.Context, accountID snowflake.Snowflake, n int, before snowflake.Snowflake) (
+		[]RoomMessage, error)
+
+	// Grants returns the access and manager grants held by the account.
+	Grants(ctx scope.Context, accountID snowflake.Snowflake) ([]RoomGrant, error)
+
+	// RevokeGrants revokes all access and manager grants held by the account.
+	RevokeGrants(ctx scope.Context, accountID snowflake.Snowflake) error
+
+	// AnonymizeMessages replaces the sender of every message posted by the
+	// account, or by any of the given agents (as users or bots), with
+	// DeletedSenderID, and clears the sender's name and address. It also
+	// removes them as the editor of messages, and replaces them in session
+	// statistics with a pseudonym that can't be traced back.
+	AnonymizeMessages(ctx scope.Context, accountID snowflake.Snowflake, agentIDs []string) error
+
+	// Delete removes the account's personal identities, name, and
+	// authentication secrets, and clears the nicks it had in PMs. The account
+	// can never be logged into again.
+	Delete(ctx scope.Context, accountID snowflake.Snowflake) error
+
+	// SaveExport stores a personal data export.
+	SaveExport(ctx scope.Context, export *AccountDataExport) error
+
+	// GetExport returns the unexpired personal data export with the given ID.
+	GetExport(ctx scope.Context, id string) (*AccountDataExport, error)
+}
+
+// QueueAccountDeletion schedules the deletion of an account.
+func QueueAccountDeletion(ctx scope.Context, b Backend, accountID snowflake.Snowflake) error {
+	jq, err := b.Jobs().GetQueue(ctx, jobs.AccountDeletionQueue)
+	if err != nil {
+		return err
+	}
+	payload := &jobs.AccountDeletionJob{AccountID: accountID}
+	_, err = jq.Add(ctx, jobs.AccountDeletionJobType, payload, jobs.AccountDataJobOptions...)
+	return err
+}
+
+// QueueAccountDataExport schedules a personal data export for an account.
+func QueueAccountDataExport(ctx scope.Context, b Backend, accountID snowflake.Snowflake) error {
+	jq, err := b.Jobs().GetQueue(ctx, jobs.AccountDataExportQueue)
+	if err != nil {
+		return err
+	}
+	payload := &jobs.AccountDataExportJob{AccountID: accountID}
+	_, err = jq.Add(ctx, jobs.AccountDataExportJobType, payload, jobs.AccountDataJobOptions...)
+	return err
+}
+
+// DeleteAccount revokes the account's grants, logs out its agents, anonymizes
+// its messages, and finally removes its identities. Each step may be safely
+// repeated, so a failed deletion can be retried from the start.
+func (heim *Heim) DeleteAccount(ctx scope.Context, accountID snowflake.Snowflake) error {
+	b := heim.Backend
+
+	if err := b.AccountData().RevokeGrants(ctx, accountID); err != nil {
+		return fmt.Errorf("revoke grants: %s", err)
+	}
+
+	agents, err := b.AgentTracker().ListForAccount(ctx, accountID)
+	if err != nil {
+		return fmt.Errorf("list agents: %s", err)
+	}
+
+	// Messages the account's agents posted before logging in are anonymized
+	// too. Logging the agents out forgets which account they belonged to, so
+	// anonymize once before that, in case a retry can no longer find them.
+	agentIDs := make([]string, len(agents))
+	for i, agent := range agents {
+		agentIDs[i] = agent.IDString()
+	}
+	if err := b.AccountData().AnonymizeMessages(ctx, accountID, agentIDs); err != nil {
+		return fmt.Errorf("anonymize messages: %s", err)
+	}
+
+	for _, agent := range agents {
+		if err := b.AgentTracker().ClearClientKey(ctx, agent.IDString()); err != nil {
+			return fmt.Errorf("clear agent %s: %s", agent.IDString(), err)
+		}
+	}
+
+	// Kick any live sessions, so they can't go on acting as the account.
+	err = b.NotifyUser(
+		ctx, UserID("account:"+accountID.String()), DisconnectEventType,
+		DisconnectEvent{Reason: "account deleted"})
+	if err != nil {
+		return fmt.Errorf("disconnect sessions: %s", err)
+	}
+
+	// Catch anything posted before the sessions were kicked.
+	if err := b.AccountData().AnonymizeMessages(ctx, accountID, agentIDs); err != nil {
+		return fmt.Errorf("anonymize messages: %s", err)
+	}
+
+	if err := b.AccountData().Delete(ctx, accountID); err != nil {
+		return fmt.Errorf("delete account: %s", err)
+	}
+
+	return nil
+}
+
+// An exportedEmail describes an email sent to an account, in a data export.
+type exportedEmail struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	To        string    `json:"to"`
+	From      string    `json:"from"`
+	Created   time.Time `json:"created"`
+	Delivered time.Time `json:"delivered,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// ExportAccountData collects the account's details, messages, emails, grants,
+// reserved nicks, and blocked users into a zip archive of JSON files, and
+// emails the account a link to download it. Messages in private rooms are
+// exported as stored, encrypted.
+func (heim *Heim) ExportAccountData(ctx scope.Context, accountID snowflake.Snowflake) error {
+	b := heim.Backend
+
+	account, err := b.AccountManager().Get(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	email, _ := account.Email()
+
+	files := map[string]interface{}{
+		"account.json": struct {
+			PersonalAccountView
+			Identities []PersonalIdentityView `json:"identities"`
+		}{
+			PersonalAccountView: PersonalAccountView{
+				AccountView: *account.View(""),
+				Email:       email,
+				Locale:      account.Locale(),
+			},
+			Identities: PersonalIdentityViews(account),
+		},
+	}
+
+	messages := []RoomMessage{}
+	var before snowflake.Snowflake
+	for {
+		page, err := b.AccountData().Messages(ctx, accountID, accountDataPageSize, before)
+		if err != nil {
+			return fmt.Errorf("messages: %s", err)
+		}
+		messages = append(messages, page...)
+		if len(page) < accountDataPageSize {
+			break
+		}
+		before = page[len(page)-1].ID
+	}
+	files["messages.json"] = messages
+
+	sent := []exportedEmail{}
+	var sentBefore time.Time
+	for {
+		page, err := b.EmailTracker().List(ctx, accountID, accountDataPageSize, sentBefore)
+		if err != nil {
+			return fmt.Errorf("emails: %s", err)
+		}
+		for _, ref := range page {
+			sent = append(sent, exportedEmail{
+				ID:        ref.ID,
+				Type:      ref.EmailType,
+				To:        ref.SendTo,
+				From:      ref.SendFrom,
+				Created:   ref.Created,
+				Delivered: ref.Delivered,
+				Message:   string(ref.Message),
+			})
+		}
+		if len(page) < accountDataPageSize {
+			break
+		}
+		sentBefore = page[len(page)-1].Created
+	}
+	files["emails.json"] = sent
+
+	grants, err := b.AccountData().Grants(ctx, accountID)
+	if err != nil {
+		return fmt.Errorf("grants: %s", err)
+	}
+	files["grants.json"] = grants
+
+	nicks, err := b.NickReservations().List(ctx, accountID)
+	if err != nil {
+		return fmt.Errorf("reserved nicks: %s", err)
+	}
+	files["nicks.json"] = nicks
+
+	blocked, err := b.Blocks().List(ctx, accountID)
+	if err != nil {
+		return fmt.Errorf("blocks: %s", err)
+	}
+	files["blocks.json"] = blocked
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{
+		"account.json", "messages.json", "emails.json", "grants.json", "nicks.json", "blocks.json",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files[name]); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	id, err := heim.KMS.GenerateNonce(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	export := &AccountDataExport{
+		ID:        hex.EncodeToString(id),
+		AccountID: accountID,
+		Created:   now,
+		Expires:   now.Add(AccountDataExportLifetime),
+		Data:      buf.Bytes(),
+	}
+	if err := b.AccountData().SaveExport(ctx, export); err != nil {
+		return err
+	}
+
+	params := &AccountDataExportEmailParams{
+		CommonEmailParams: DefaultCommonEmailParams,
+		AccountName:       account.Name(),
+		ExportID:          export.ID,
+		Expires:           export.Expires,
+	}
+	if _, err := heim.SendEmail(ctx, b, account, "", AccountDataExportEmail, params); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -67,6 +67,16 @@ func TestValidatePersonalIdentity(t *testing.T) {
 		So(reason, ShouldEqual, "")
 	})
 
+	Convey("OIDC ids must name an issuer and subject", t, func() {
+		ok, reason := ValidatePersonalIdentity("oidc", OIDCIdentity("https://sso.example.com", "1234"))
+		So(ok, ShouldBeTrue)
+		So(reason, ShouldEqual, "")
+
+		ok, reason = ValidatePersonalIdentity("oidc", "1234")
+		So(ok, ShouldBeFalse)
+		So(reason, ShouldEqual, "invalid oidc identity: 1234")
+	})
+
 	Convey("No other namespace is accepted", t, func() {
 		ok, reason := ValidatePersonalIdentity("notemail", "test")
 		So(ok, ShouldBeFalse)
@@ -91,3 +101,28 @@ func TestValidateAccountPassword(t *testing.T) {
 			fmt.Sprintf("password must be at least %d characters long", MinPasswordLength))
 	})
 }
+
+func TestOTPRecoveryCodes(t *testing.T) {
+	kms := security.LocalKMS()
+	kms.SetMasterKey(make([]byte, security.AES256.KeySize()))
+
+	Convey("Generated codes are distinct and formatted for reading", t, func() {
+		codes, err := GenerateOTPRecoveryCodes(kms)
+		So(err, ShouldBeNil)
+		So(len(codes), ShouldEqual, OTPRecoveryCodeCount)
+		seen := map[string]bool{}
+		for _, code := range codes {
+			So(code, ShouldHaveLength, OTPRecoveryCodeSize*2+OTPRecoveryCodeSize/2-1)
+			So(seen[code], ShouldBeFalse)
+			seen[code] = true
+		}
+	})
+
+	Convey("Digests ignore formatting but not account", t, func() {
+		digest := OTPRecoveryCodeDigest(1, "0123-4567-89ab-cdef")
+		So(OTPRecoveryCodeDigest(1, "0123456789ABCDEF"), ShouldEqual, digest)
+		So(OTPRecoveryCodeDigest(1, "0123 4567 89AB CDEF"), ShouldEqual, digest)
+		So(OTPRecoveryCodeDigest(2, "0123-4567-89ab-cdef"), ShouldNotEqual, digest)
+		So(OTPRecoveryCodeDigest(1, "0123-4567-89ab-cdee"), ShouldNotEqual, digest)
+	})
+}
@@ -34,6 +34,24 @@ type AgentTracker interface {
 
 	// ClearClientKey logs the agent out.
 	ClearClientKey(ctx scope.Context, agentID string) error
+
+	// RecordConnection notes the address and user agent the agent most
+	// recently connected from.
+	RecordConnection(ctx scope.Context, agentID, ip, userAgent string) error
+
+	// ListForAccount returns the agents logged into the given account, most
+	// recently seen first.
+	ListForAccount(ctx scope.Context, accountID snowflake.Snowflake) ([]*Agent, error)
+}
+
+// AgentView describes a browser or device logged into an account.
+type AgentView struct {
+	ID        string `json:"id"`                   // the id of the agent
+	Created   Time   `json:"created"`              // the time the agent was first seen
+	LastSeen  Time   `json:"last_seen"`            // the time the agent last connected while logged in
+	IP        string `json:"ip,omitempty"`         // the address the agent last connected from
+	UserAgent string `json:"user_agent,omitempty"` // the user agent the agent last connected with
+	Current   bool   `json:"current,omitempty"`    // true if this is the agent making the request
 }
 
 func NewAgent(agentID []byte, accessKey *security.ManagedKey) (*Agent, error) {
@@ -78,10 +96,24 @@ type Agent struct {
 	Created            time.Time
 	Blessed            bool
 	Bot                bool
+	LastSeen           time.Time
+	LastIP             string
+	LastUserAgent      string
+	LoggedIn           time.Time
 }
 
 func (a *Agent) IDString() string { return base64.URLEncoding.EncodeToString(a.ID) }
 
+func (a *Agent) View() AgentView {
+	return AgentView{
+		ID:        a.IDString(),
+		Created:   Time(a.Created),
+		LastSeen:  Time(a.LastSeen),
+		IP:        a.LastIP,
+		UserAgent: a.LastUserAgent,
+	}
+}
+
 func (a *Agent) verify(accessKey *security.ManagedKey) bool {
 	var (
 		mac [16]byte
@@ -128,5 +160,6 @@ func (a *Agent) SetClientKey(accessKey, clientKey *security.ManagedKey) error {
 	}
 
 	a.EncryptedClientKey = &encryptedClientKey
+	a.LoggedIn = time.Now()
 	return nil
 }
@@ -6,6 +6,7 @@ type AuthOption string
 
 const (
 	AuthPasscode = AuthOption("passcode")
+	AuthInvite   = AuthOption("invite")
 )
 
 type Authorization struct {
@@ -11,10 +11,18 @@ import (
 
 // A Backend provides Rooms and an implementation version.
 type Backend interface {
+	AccessRequests() AccessRequestTracker
+	AccountData() AccountDataTracker
 	AccountManager() AccountManager
 	AgentTracker() AgentTracker
+	Blocks() BlockTracker
+	EmailPreferences() EmailPreferenceTracker
 	EmailTracker() EmailTracker
 	Jobs() jobs.JobService
+	LoginAttempts() LoginAttemptTracker
+	NickReservations() NickReservationTracker
+	Notifications() NotificationTracker
+	PendingInvites() PendingInviteTracker
 	PMTracker() PMTracker
 
 	// Ban adds an entry to the global ban list. A zero value for until
@@ -24,6 +32,10 @@ type Backend interface {
 	// UnbanAgent removes a global ban.
 	Unban(ctx scope.Context, ban Ban) error
 
+	// IsBanned returns true if the given agent or account is banned from the
+	// room, or globally.
+	IsBanned(ctx scope.Context, room string, id UserID) (bool, error)
+
 	Close()
 
 	// Create creates a new room.
@@ -39,8 +51,16 @@ type Backend interface {
 	// Version returns the implementation version string.
 	Version() string
 
+	// IsUserOnline returns true if the given user has any live sessions.
+	IsUserOnline(ctx scope.Context, userID UserID) (bool, error)
+
 	// NotifyUser broadcasts a packet to all sessions associated with the given userID
 	NotifyUser(ctx scope.Context, userID UserID, packetType PacketType, payload interface{}, excluding ...Session) error
+
+	// NotifyUserInRoom is like NotifyUser, but only reaches the user's
+	// sessions in the given room, including sessions knocking on it.
+	NotifyUserInRoom(
+		ctx scope.Context, room string, userID UserID, packetType PacketType, payload interface{}) error
 }
 
 type BackendFactory func(*Heim) (Backend, error)
@@ -0,0 +1,47 @@
+package proto
+
+import (
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+// A BlockTracker keeps track of the users each account has blocked. Events
+// caused by a blocked user are withheld from the blocker's sessions, and the
+// blocked user may not initiate PMs with the blocker.
+type BlockTracker interface {
+	// Block adds a user to an account's block list. Blocking a user that is
+	// already blocked has no effect.
+	Block(ctx scope.Context, accountID snowflake.Snowflake, userID UserID) error
+
+	// Unblock removes a user from an account's block list. It returns
+	// ErrUserNotBlocked if the user isn't blocked.
+	Unblock(ctx scope.Context, accountID snowflake.Snowflake, userID UserID) error
+
+	// List returns the users blocked by an account, in the order they were
+	// blocked.
+	List(ctx scope.Context, accountID snowflake.Snowflake) ([]UserID, error)
+
+	// IsBlocked reports whether an account has blocked a user.
+	IsBlocked(ctx scope.Context, accountID snowflake.Snowflake, userID UserID) (bool, error)
+}
+
+// ValidateBlockedUserID returns ErrInvalidUserID if the given ID can't name
+// a user that may be blocked.
+func ValidateBlockedUserID(userID UserID) error {
+	kind, id := userID.Parse()
+	if id == "" {
+		return ErrInvalidUserID
+	}
+	switch kind {
+	case "account":
+		var accountID snowflake.Snowflake
+		if err := accountID.FromString(id); err != nil {
+			return ErrInvalidUserID
+		}
+		return nil
+	case "agent", "bot":
+		return nil
+	default:
+		return ErrInvalidUserID
+	}
+}
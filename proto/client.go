@@ -197,6 +197,42 @@ func (c *Client) AuthenticateWithPasscode(ctx scope.Context, room ManagedRoom, p
 	return "", nil
 }
 
+// AuthenticateWithInvite authorizes the client with an invite code. If the
+// client is logged in, its account is granted access for as long as the invite
+// lasts.
+func (c *Client) AuthenticateWithInvite(
+	ctx scope.Context, kms security.KMS, room ManagedRoom, code string) (string, error) {
+
+	mkey, err := room.MessageKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if mkey == nil {
+		return "", nil
+	}
+
+	capability, err := mkey.RedeemInvite(ctx, kms, code, c.Account)
+	if err != nil {
+		switch err {
+		case ErrInviteNotFound, ErrInviteExpired, ErrInviteExhausted:
+			return err.Error(), nil
+		default:
+			return "", err
+		}
+	}
+
+	holderKey := security.KeyFromPasscode([]byte(code), mkey.Nonce(), security.AES128)
+	roomKey, err := decryptRoomKey(holderKey, capability)
+	if err != nil {
+		return "", err
+	}
+
+	c.Authorization.AddMessageKey(mkey.KeyID(), roomKey)
+	c.Authorization.CurrentMessageKeyID = mkey.KeyID()
+	return "", nil
+}
+
 func getIP(r *http.Request) string {
 	addr := r.RemoteAddr
 	if ffs := r.Header["X-Forwarded-For"]; len(ffs) > 0 {
@@ -1,19 +1,30 @@
 package proto
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"html/template"
+	"net/mail"
 	"net/url"
+	"strings"
 	"time"
 
 	"euphoria.io/heim/proto/emails"
 	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/security"
 	"euphoria.io/heim/proto/snowflake"
 	"euphoria.io/heim/templates"
 	"euphoria.io/scope"
 )
 
 const (
+	AccessRequestEmail         = "access-request"
+	AccountDataExportEmail     = "data-export"
+	LoginLockoutEmail          = "login-lockout"
+	NotificationDigestEmail    = "notification-digest"
 	PasswordChangedEmail       = "password-changed"
 	PasswordResetEmail         = "password-reset"
 	RoomInvitationEmail        = "room-invitation"
@@ -24,11 +35,29 @@ const (
 
 type EmailTracker interface {
 	Get(ctx scope.Context, accountID snowflake.Snowflake, id string) (*emails.EmailRef, error)
+
+	// List returns up to n of the emails sent to the account, newest first,
+	// created before the given time. A zero time means now.
 	List(ctx scope.Context, accountID snowflake.Snowflake, n int, before time.Time) ([]*emails.EmailRef, error)
+
 	MarkDelivered(ctx scope.Context, accountID snowflake.Snowflake, id string) error
+
+	// UseReplyAddress records that an email reply address, identified by its
+	// token, has been used. It returns ErrEmailReplyUsed if it already had
+	// been. The record may be forgotten once the address expires.
+	UseReplyAddress(ctx scope.Context, accountID snowflake.Snowflake, token string, expires time.Time) error
+
+	// MarkFailed records that the email with the given Message-ID bounced or
+	// drew a complaint, and returns it.
+	MarkFailed(ctx scope.Context, id string) (*emails.EmailRef, error)
+
+	// Send renders and queues an email to the account, with the given
+	// Message-ID. It returns ErrEmailOptedOut if the email is optional and
+	// the account has opted out of it, or ErrEmailUndeliverable if the
+	// address is known to be bad.
 	Send(
 		ctx scope.Context, js jobs.JobService, templater *templates.Templater, deliverer emails.Deliverer,
-		account Account, to, templateName string, data interface{}) (*emails.EmailRef, error)
+		account Account, msgID, to, templateName string, data interface{}) (*emails.EmailRef, error)
 }
 
 type CommonEmailParams struct {
@@ -39,15 +68,227 @@ type CommonEmailParams struct {
 	SiteURL       string        `yaml:"site_url"`
 	HelpAddress   template.HTML `yaml:"help_address"`
 	SenderAddress template.HTML `yaml:"sender_address"`
+
+	// These are filled in when an optional email is sent, so that the
+	// recipient can manage their preferences or unsubscribe.
+	EmailPreferencesToken string `yaml:"-"`
+	UnsubscribeEmail      string `yaml:"-"`
 }
 
 func (p *CommonEmailParams) SiteURLShort() template.HTML {
 	return template.HTML(p.CommonData.LocalDomain)
 }
 
+// EmailPreferencesURL returns a link to the recipient's email preferences, or
+// an empty string if the email isn't optional.
 func (p *CommonEmailParams) EmailPreferencesURL() template.HTML {
-	// TODO: incorporate token
-	return template.HTML(fmt.Sprintf("%s/prefs/emails", p.SiteURL))
+	if p.EmailPreferencesToken == "" {
+		return ""
+	}
+	return template.HTML(emailPreferencesURL(p.SiteURL, "/prefs/emails", url.Values{
+		"token": []string{p.EmailPreferencesToken},
+	}))
+}
+
+// UnsubscribeURL returns the one-click unsubscribe link for the email, or an
+// empty string if the email isn't optional.
+func (p *CommonEmailParams) UnsubscribeURL() string {
+	if p.EmailPreferencesToken == "" || p.UnsubscribeEmail == "" {
+		return ""
+	}
+	return emailPreferencesURL(p.SiteURL, "/prefs/emails/unsubscribe", url.Values{
+		"token": []string{p.EmailPreferencesToken},
+		"email": []string{p.UnsubscribeEmail},
+	})
+}
+
+func (p *CommonEmailParams) linkEmailPreferences(token, templateName string) {
+	p.EmailPreferencesToken = token
+	p.UnsubscribeEmail = templateName
+}
+
+func emailPreferencesURL(siteURL, path string, v url.Values) string {
+	u := url.URL{
+		Path:     path,
+		RawQuery: v.Encode(),
+	}
+	return siteURL + u.String()
+}
+
+// IsOptionalEmail returns true if accounts may opt out of the email with the
+// given template.
+func IsOptionalEmail(templateName string) bool {
+	var none EmailPreferences
+	return !none.AllowsEmail(templateName)
+}
+
+// CheckEmailPreferences returns ErrEmailOptedOut if the account has opted out
+// of the email with the given template.
+func CheckEmailPreferences(
+	ctx scope.Context, prefs EmailPreferenceTracker, accountID snowflake.Snowflake, templateName string) error {
+
+	if !IsOptionalEmail(templateName) {
+		return nil
+	}
+	p, err := prefs.Get(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if !p.AllowsEmail(templateName) {
+		return ErrEmailOptedOut
+	}
+	return nil
+}
+
+// IsEmailSuppressed returns true if err is why Send declined to send an
+// email the account doesn't need to receive.
+func IsEmailSuppressed(err error) bool {
+	return err == ErrEmailOptedOut || err == ErrEmailUndeliverable
+}
+
+// CheckEmailDeliverable returns ErrEmailUndeliverable if mail to the given
+// address has bounced or drawn a complaint. Emails the account asks for, to
+// verify an address or reset a password, are always let through, so that a
+// fixed mailbox can be verified again.
+func CheckEmailDeliverable(account Account, to, templateName string) error {
+	switch templateName {
+	case PasswordResetEmail, VerificationEmail, WelcomeEmail:
+		return nil
+	}
+	for _, pid := range account.PersonalIdentities() {
+		if pid.Namespace() == "email" && strings.EqualFold(pid.ID(), to) && pid.Undeliverable() {
+			return ErrEmailUndeliverable
+		}
+	}
+	return nil
+}
+
+// EmailMessageID returns a new Message-ID for an email to the account. The
+// ID is signed with the account's system key, so that bounces and complaints
+// about it can't be forged without having seen the email.
+func EmailMessageID(kms security.KMS, account Account, domain string) (string, error) {
+	sf, err := snowflake.New()
+	if err != nil {
+		return "", err
+	}
+
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return "", err
+	}
+
+	mac, err := emailMessageIDMAC(&systemKey, account.ID(), sf)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%s.%s.%s@%s>", sf, account.ID(), hex.EncodeToString(mac), domain), nil
+}
+
+// CheckEmailMessageID verifies the signature on a Message-ID returned by
+// EmailMessageID, and returns the account the email was sent to.
+func CheckEmailMessageID(ctx scope.Context, kms security.KMS, b Backend, msgID string) (Account, error) {
+	local := strings.TrimPrefix(msgID, "<")
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+
+	parts := strings.Split(local, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidEmailMessageID
+	}
+	var sf, accountID snowflake.Snowflake
+	if err := sf.FromString(parts[0]); err != nil {
+		return nil, ErrInvalidEmailMessageID
+	}
+	if err := accountID.FromString(parts[1]); err != nil {
+		return nil, ErrInvalidEmailMessageID
+	}
+	mac, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidEmailMessageID
+	}
+
+	account, err := b.AccountManager().Get(ctx, accountID)
+	if err != nil {
+		if err == ErrAccountNotFound {
+			return nil, ErrInvalidEmailMessageID
+		}
+		return nil, err
+	}
+
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return nil, err
+	}
+	expected, err := emailMessageIDMAC(&systemKey, accountID, sf)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, expected) {
+		return nil, ErrInvalidEmailMessageID
+	}
+	return account, nil
+}
+
+func emailMessageIDMAC(key *security.ManagedKey, accountID, sf snowflake.Snowflake) ([]byte, error) {
+	if key.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+
+	mac := hmac.New(sha256.New, key.Plaintext)
+	mac.Write([]byte(fmt.Sprintf("email-message-id:%s:%s", accountID, sf)))
+	return mac.Sum(nil)[:16], nil
+}
+
+// ProcessEmailFeedback handles a bounce or complaint about an email we sent.
+// Permanent failures mark the email failed, and its recipient undeliverable.
+// Feedback about a Message-ID that doesn't carry a valid signature is ignored.
+func ProcessEmailFeedback(ctx scope.Context, kms security.KMS, b Backend, fb *emails.Feedback) error {
+	if !fb.Permanent {
+		logging.Logger(ctx).Printf("ignoring transient %s for %s: %s", fb.Kind, fb.MessageID, fb.Status)
+		return nil
+	}
+
+	if _, err := CheckEmailMessageID(ctx, kms, b, fb.MessageID); err != nil {
+		if err == ErrInvalidEmailMessageID {
+			logging.Logger(ctx).Printf("ignoring %s for unsigned email %s", fb.Kind, fb.MessageID)
+			return nil
+		}
+		return err
+	}
+
+	ref, err := b.EmailTracker().MarkFailed(ctx, fb.MessageID)
+	if err != nil {
+		if err == ErrEmailNotFound {
+			logging.Logger(ctx).Printf("ignoring %s for unknown email %s", fb.Kind, fb.MessageID)
+			return nil
+		}
+		return err
+	}
+
+	to := ref.SendTo
+	if addr, err := mail.ParseAddress(to); err == nil {
+		to = addr.Address
+	}
+	logging.Logger(ctx).Printf("%s for %s: marking %s undeliverable", fb.Kind, ref.ID, to)
+	err = b.AccountManager().MarkPersonalIdentityUndeliverable(ctx, "email", to)
+	if err != nil && err != ErrPersonalIdentityNotFound {
+		return err
+	}
+	return nil
+}
+
+// EmailFeedbackHandler returns a handler for inbound email that processes
+// bounces and complaints, and drops anything else.
+func EmailFeedbackHandler(kms security.KMS, b Backend) emails.InboundHandler {
+	return func(ctx scope.Context, msg *emails.InboundMessage) error {
+		fb, err := emails.ParseFeedback(msg.Message)
+		if err != nil {
+			logging.Logger(ctx).Printf("dropping inbound email from %s: %s", msg.From, err)
+			return nil
+		}
+		return ProcessEmailFeedback(ctx, kms, b, fb)
+	}
 }
 
 type VerificationEmailParams struct {
@@ -85,6 +326,19 @@ func (p PasswordChangedEmailParams) Subject() template.HTML {
 	return template.HTML(fmt.Sprintf("Your %s account password has been changed", p.SiteName))
 }
 
+type LoginLockoutEmailParams struct {
+	CommonEmailParams
+	AccountName     string
+	ClientAddress   string
+	LockoutDuration time.Duration
+}
+
+func (p LoginLockoutEmailParams) Subject() template.HTML {
+	return template.HTML(fmt.Sprintf("Logins to your %s account have been paused", p.SiteName))
+}
+
+func (p LoginLockoutEmailParams) LockoutMinutes() int { return int(p.LockoutDuration / time.Minute) }
+
 type PasswordResetEmailParams struct {
 	CommonEmailParams
 	AccountName  string
@@ -139,6 +393,89 @@ func (p RoomInvitationWelcomeEmailParams) RoomURL() template.HTML {
 	return template.HTML(fmt.Sprintf("%s/room/%s", p.SiteURL, p.RoomName))
 }
 
+type AccessRequestEmailParams struct {
+	CommonEmailParams
+	AccountName   string
+	RoomName      string
+	RequesterName string
+	RequesterNote string
+}
+
+func (p AccessRequestEmailParams) Subject() template.HTML {
+	return template.HTML(fmt.Sprintf("%s is asking to join &%s", p.RequesterName, p.RoomName))
+}
+
+func (p AccessRequestEmailParams) RoomURL() template.HTML {
+	return template.HTML(fmt.Sprintf("%s/room/%s", p.SiteURL, p.RoomName))
+}
+
+type AccountDataExportEmailParams struct {
+	CommonEmailParams
+	AccountName string
+	ExportID    string
+	Expires     time.Time
+}
+
+func (p AccountDataExportEmailParams) Subject() template.HTML {
+	return template.HTML(fmt.Sprintf("Your %s data export is ready", p.SiteName))
+}
+
+func (p AccountDataExportEmailParams) DownloadURL() template.HTML {
+	return template.HTML(fmt.Sprintf("%s/prefs/data-export/%s", p.SiteURL, p.ExportID))
+}
+
+func (p AccountDataExportEmailParams) ExpiresDate() string {
+	return p.Expires.Format("January 2, 2006")
+}
+
+type NotificationDigestEmailParams struct {
+	CommonEmailParams
+	AccountName   string
+	Notifications []*Notification
+
+	// ReplyAddresses holds the address to reply to each notification at, by
+	// notification ID, when replying by email is enabled.
+	ReplyAddresses map[snowflake.Snowflake]string `yaml:"-"`
+}
+
+func (p NotificationDigestEmailParams) Subject() template.HTML {
+	if len(p.Notifications) == 1 {
+		n := p.Notifications[0]
+		if n.IsPM() {
+			return template.HTML(fmt.Sprintf("%s sent you a private message on %s", n.SenderName, p.SiteName))
+		}
+		return template.HTML(fmt.Sprintf("%s mentioned you in &%s", n.SenderName, n.Room))
+	}
+	return template.HTML(fmt.Sprintf("You have %d unread notifications on %s", len(p.Notifications), p.SiteName))
+}
+
+func (p NotificationDigestEmailParams) RoomURL(room string) template.HTML {
+	return template.HTML(fmt.Sprintf("%s/room/%s/", p.SiteURL, room))
+}
+
+// ReplyAddress returns the address to reply to the notification at by email,
+// or an empty string if replying by email isn't enabled.
+func (p NotificationDigestEmailParams) ReplyAddress(n *Notification) string {
+	return p.ReplyAddresses[n.ID]
+}
+
+// ReplyTo returns the address replies to the email itself should go to. It's
+// the reply address of the latest notification, as long as all notifications
+// are from the same room; otherwise there's no telling where the reply was
+// meant to go, and it's empty.
+func (p NotificationDigestEmailParams) ReplyTo() string {
+	if len(p.Notifications) == 0 {
+		return ""
+	}
+	latest := p.Notifications[len(p.Notifications)-1]
+	for _, n := range p.Notifications {
+		if n.Room != latest.Room {
+			return ""
+		}
+	}
+	return p.ReplyAddress(latest)
+}
+
 var (
 	DefaultCommonEmailParams = CommonEmailParams{
 		CommonData: emails.CommonData{
@@ -169,6 +506,17 @@ var (
 			},
 		},
 
+		LoginLockoutEmail: map[string]templates.TemplateTest{
+			"default": templates.TemplateTest{
+				Data: &LoginLockoutEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+					ClientAddress:     "192.0.2.1",
+					LockoutDuration:   15 * time.Minute,
+				},
+			},
+		},
+
 		PasswordResetEmail: map[string]templates.TemplateTest{
 			"default": templates.TemplateTest{
 				Data: &PasswordResetEmailParams{
@@ -189,6 +537,69 @@ var (
 			},
 		},
 
+		AccessRequestEmail: map[string]templates.TemplateTest{
+			"default": templates.TemplateTest{
+				Data: &AccessRequestEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+					RoomName:          "cabal",
+					RequesterName:     "thatguy",
+					RequesterNote:     "it's me, from the other room",
+				},
+			},
+		},
+
+		AccountDataExportEmail: map[string]templates.TemplateTest{
+			"default": templates.TemplateTest{
+				Data: &AccountDataExportEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+					ExportID:          "0123456789abcdef",
+					Expires:           time.Date(2016, time.January, 8, 0, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+
+		NotificationDigestEmail: map[string]templates.TemplateTest{
+			"default": templates.TemplateTest{
+				Data: &NotificationDigestEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+					Notifications: []*Notification{
+						{
+							Kind:       MentionNotification,
+							Room:       "cabal",
+							SenderName: "thatguy",
+							Excerpt:    "@yourname are you coming tonight?",
+						},
+						{
+							Kind:       PMNotification,
+							Room:       "pm:0123456789abc",
+							SenderName: "thatguy",
+						},
+					},
+				},
+			},
+			"reply": templates.TemplateTest{
+				Data: &NotificationDigestEmailParams{
+					CommonEmailParams: DefaultCommonEmailParams,
+					AccountName:       "yourname",
+					Notifications: []*Notification{
+						{
+							ID:         1,
+							Kind:       MentionNotification,
+							Room:       "cabal",
+							SenderName: "thatguy",
+							Excerpt:    "@yourname are you coming tonight?",
+						},
+					},
+					ReplyAddresses: map[snowflake.Snowflake]string{
+						1: "reply+cabal.0123456789abc.0123456789abd.0123456789abcdef@heim.invalid",
+					},
+				},
+			},
+		},
+
 		RoomInvitationWelcomeEmail: map[string]templates.TemplateTest{
 			"default": templates.TemplateTest{
 				Data: &RoomInvitationWelcomeEmailParams{
@@ -211,6 +622,19 @@ func ValidateEmailTemplates(templater *templates.Templater) []error {
 			testList = append(testList, testCase)
 		}
 		errors = append(errors, templater.Validate(templateName, testList...)...)
+		for _, locale := range templater.Locales() {
+			localized := templater.Localize(templateName, locale)
+			if localized == templateName {
+				continue
+			}
+			// A localization must replace every part of the email.
+			for _, ext := range []string{".hdr", ".txt", ".html"} {
+				if templater.Templates[localized].Lookup(localized+ext) == nil {
+					errors = append(errors, fmt.Errorf("%s%s: %s", localized, ext, templates.ErrTemplateNotFound))
+				}
+			}
+			errors = append(errors, templater.Validate(localized, testList...)...)
+		}
 	}
 	if len(errors) == 0 {
 		return nil
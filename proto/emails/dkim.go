@@ -0,0 +1,198 @@
+package emails
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders are the headers covered by a DKIM signature, when
+// present. RFC 8058 requires the List-Unsubscribe headers to be signed.
+var DefaultDKIMHeaders = []string{
+	"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// A DKIMSigner adds a DKIM-Signature header (RFC 6376) to outgoing messages,
+// using rsa-sha256 with relaxed header and body canonicalization.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      *rsa.PrivateKey
+	Headers  []string
+
+	now func() time.Time
+}
+
+// LoadDKIMSigner reads a PEM-encoded RSA private key (PKCS #1 or PKCS #8)
+// from the given file.
+func LoadDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", keyFile)
+	}
+
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %s", keyFile, err)
+		}
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", keyFile, err)
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("%s: not an RSA key", keyFile)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %q", keyFile, block.Type)
+	}
+
+	return &DKIMSigner{Domain: domain, Selector: selector, Key: key}, nil
+}
+
+// Sign returns the message with a DKIM-Signature header prepended.
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	headers, body := splitMessage(message)
+
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+
+	names := s.Headers
+	if names == nil {
+		names = DefaultDKIMHeaders
+	}
+	signed := []string{}
+	hashed := &bytes.Buffer{}
+	for _, name := range names {
+		// Only the last instance of each header is signed.
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.EqualFold(headerName(headers[i]), name) {
+				signed = append(signed, strings.ToLower(name))
+				hashed.WriteString(dkimRelaxedHeader(headers[i]))
+				hashed.WriteString("\r\n")
+				break
+			}
+		}
+	}
+
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	sig := fmt.Sprintf(
+		"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.Domain, s.Selector, now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	hashed.WriteString(dkimRelaxedHeader(sig))
+
+	digest := sha256.Sum256(hashed.Bytes())
+	b, err := rsa.SignPKCS1v15(rand.Reader, s.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	result := &bytes.Buffer{}
+	result.WriteString(sig)
+	result.WriteString(base64.StdEncoding.EncodeToString(b))
+	result.WriteString("\r\n")
+	result.Write(message)
+	return result.Bytes(), nil
+}
+
+// splitMessage returns a message's header fields, with continuation lines
+// joined to the field they belong to, and its body, with CRLF line endings.
+func splitMessage(message []byte) ([]string, []string) {
+	lines := strings.Split(string(message), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+
+	headers := []string{}
+	for i, line := range lines {
+		switch {
+		case line == "":
+			return headers, lines[i+1:]
+		case (line[0] == ' ' || line[0] == '\t') && len(headers) > 0:
+			headers[len(headers)-1] += "\r\n" + line
+		default:
+			headers = append(headers, line)
+		}
+	}
+	return headers, nil
+}
+
+func headerName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return field
+}
+
+// dkimRelaxedHeader canonicalizes a header field as described in RFC 6376,
+// section 3.4.2.
+func dkimRelaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return strings.ToLower(field)
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.Join(strings.Fields(value), " ")
+	return name + ":" + value
+}
+
+// dkimRelaxedBody canonicalizes a message body as described in RFC 6376,
+// section 3.4.4.
+func dkimRelaxedBody(lines []string) []byte {
+	canonical := make([]string, len(lines))
+	for i, line := range lines {
+		canonical[i] = strings.TrimRight(collapseWhitespace(line), " ")
+	}
+	for len(canonical) > 0 && canonical[len(canonical)-1] == "" {
+		canonical = canonical[:len(canonical)-1]
+	}
+
+	buf := &bytes.Buffer{}
+	for _, line := range canonical {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+func collapseWhitespace(line string) string {
+	buf := &bytes.Buffer{}
+	space := false
+	for _, r := range line {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			buf.WriteByte(' ')
+			space = false
+		}
+		buf.WriteRune(r)
+	}
+	if space {
+		buf.WriteByte(' ')
+	}
+	return buf.String()
+}
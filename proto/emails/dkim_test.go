@@ -0,0 +1,156 @@
+package emails
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var (
+	dkimKeyOnce sync.Once
+	dkimKey     *rsa.PrivateKey
+)
+
+func testDKIMKey() *rsa.PrivateKey {
+	dkimKeyOnce.Do(func() {
+		var err error
+		if dkimKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+			panic(err)
+		}
+	})
+	return dkimKey
+}
+
+// verifyDKIM checks the DKIM-Signature at the top of a message.
+func verifyDKIM(message []byte, pub *rsa.PublicKey) error {
+	headers, body := splitMessage(message)
+	if len(headers) == 0 || headerName(headers[0]) != "DKIM-Signature" {
+		return fmt.Errorf("no DKIM-Signature")
+	}
+	sigHeader, headers := headers[0], headers[1:]
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(sigHeader[len("DKIM-Signature:"):], ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		}
+	}
+
+	bodyHash := sha256.Sum256(dkimRelaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		return fmt.Errorf("body hash mismatch")
+	}
+
+	hashed := ""
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.EqualFold(headerName(headers[i]), name) {
+				hashed += dkimRelaxedHeader(headers[i]) + "\r\n"
+				break
+			}
+		}
+	}
+	hashed += dkimRelaxedHeader(sigHeader[:strings.LastIndex(sigHeader, "b=")+2])
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(hashed))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+}
+
+func TestDKIM(t *testing.T) {
+	Convey("Relaxed canonicalization", t, func() {
+		// Example from RFC 6376, section 3.4.5.
+		headers, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+		So(len(headers), ShouldEqual, 2)
+		So(dkimRelaxedHeader(headers[0]), ShouldEqual, "a:X")
+		So(dkimRelaxedHeader(headers[1]), ShouldEqual, "b:Y Z")
+		So(string(dkimRelaxedBody(body)), ShouldEqual, " C\r\nD E\r\n")
+
+		_, body = splitMessage([]byte("Subject: empty\n\n\n\n"))
+		So(string(dkimRelaxedBody(body)), ShouldEqual, "")
+	})
+
+	Convey("Signing", t, func() {
+		s := &DKIMSigner{
+			Domain:   "heim.invalid",
+			Selector: "test",
+			Key:      testDKIMKey(),
+			now:      func() time.Time { return time.Unix(1500000000, 0) },
+		}
+		message := []byte("From: noreply@heim.invalid\r\nTo: someone@heim.invalid\r\n" +
+			"Subject: hi\r\nX-Unsigned: yes\r\n\r\nhello  there\r\n")
+
+		signed, err := s.Sign(message)
+		So(err, ShouldBeNil)
+		So(strings.HasSuffix(string(signed), string(message)), ShouldBeTrue)
+		So(string(signed), ShouldStartWith,
+			"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=heim.invalid; s=test; t=1500000000; h=from:to:subject; bh=")
+		So(verifyDKIM(signed, &s.Key.PublicKey), ShouldBeNil)
+
+		Convey("Signature survives whitespace changes", func() {
+			mangled := strings.Replace(string(signed), "Subject: hi", "Subject:   hi", 1)
+			mangled = strings.Replace(mangled, "hello  there", "hello there", 1)
+			So(verifyDKIM([]byte(mangled), &s.Key.PublicKey), ShouldBeNil)
+		})
+
+		Convey("Signature breaks when content changes", func() {
+			tampered := strings.Replace(string(signed), "Subject: hi", "Subject: bye", 1)
+			So(verifyDKIM([]byte(tampered), &s.Key.PublicKey), ShouldNotBeNil)
+
+			tampered = strings.Replace(string(signed), "hello", "goodbye", 1)
+			So(verifyDKIM([]byte(tampered), &s.Key.PublicKey), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Loading keys", t, func() {
+		f, err := ioutil.TempFile("", "dkim")
+		So(err, ShouldBeNil)
+		defer os.Remove(f.Name())
+
+		Convey("PKCS #1", func() {
+			So(pem.Encode(f, &pem.Block{
+				Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testDKIMKey())}), ShouldBeNil)
+			f.Close()
+
+			s, err := LoadDKIMSigner("heim.invalid", "test", f.Name())
+			So(err, ShouldBeNil)
+			So(s.Key.N.Cmp(testDKIMKey().N), ShouldEqual, 0)
+		})
+
+		Convey("PKCS #8", func() {
+			der, err := x509.MarshalPKCS8PrivateKey(testDKIMKey())
+			So(err, ShouldBeNil)
+			So(pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}), ShouldBeNil)
+			f.Close()
+
+			s, err := LoadDKIMSigner("heim.invalid", "test", f.Name())
+			So(err, ShouldBeNil)
+			So(s.Key.N.Cmp(testDKIMKey().N), ShouldEqual, 0)
+		})
+
+		Convey("Garbage", func() {
+			f.WriteString("not a key")
+			f.Close()
+
+			_, err := LoadDKIMSigner("heim.invalid", "test", f.Name())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -28,7 +28,11 @@ type Emailer interface {
 	Send(ctx scope.Context, to, templateName string, data interface{}) (*EmailRef, error)
 }
 
-func NewEmail(templater *templates.Templater, msgID, to, templateName string, data interface{}) (*EmailRef, error) {
+// NewEmail renders an email from the named template, localized to the given
+// locale if possible.
+func NewEmail(
+	templater *templates.Templater, msgID, to, templateName, locale string, data interface{}) (*EmailRef, error) {
+
 	now := time.Now()
 	ref := &EmailRef{
 		ID:        msgID,
@@ -45,7 +49,7 @@ func NewEmail(templater *templates.Templater, msgID, to, templateName string, da
 		cd.initCommonData(to)
 	}
 
-	email, err := templates.EvaluateEmail(templater, templateName, data)
+	email, err := templates.EvaluateLocalizedEmail(templater, templateName, locale, data)
 	if err != nil {
 		return nil, err
 	}
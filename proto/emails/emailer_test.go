@@ -89,11 +89,19 @@ func TestTemplateEmailer(t *testing.T) {
 			{{define "test.hdr"}}Subject: test
 From: noreply@heim.invalid{{end}}`)
 		So(err, ShouldBeNil)
+		deTmpl, err := template.New("test.de").Parse(`
+			{{define "test.de.html"}}HTML-Teil{{end}}
+			{{define "test.de.txt"}}Textteil{{end}}
+			{{define "test.de.hdr"}}Subject: Test
+From: noreply@heim.invalid{{end}}`)
+		So(err, ShouldBeNil)
 
-		templater := &templates.Templater{Templates: map[string]*template.Template{"test": tmpl}}
+		templater := &templates.Templater{
+			Templates: map[string]*template.Template{"test": tmpl, "test.de": deTmpl},
+		}
 
 		Convey("Send test email", func() {
-			ref, err := NewEmail(templater, "<msgid@test>", "test@heim.invalid", "test", nil)
+			ref, err := NewEmail(templater, "<msgid@test>", "test@heim.invalid", "test", "", nil)
 			So(err, ShouldBeNil)
 			So(ref.ID, ShouldEqual, "<msgid@test>")
 			So(ref.SendTo, ShouldEqual, "test@heim.invalid")
@@ -105,5 +113,18 @@ From: noreply@heim.invalid{{end}}`)
 			So(string(email.Text), ShouldEqual, "text part")
 			So(string(email.HTML), ShouldEqual, "html part")
 		})
+
+		Convey("Send localized email", func() {
+			ref, err := NewEmail(templater, "<msgid@test>", "test@heim.invalid", "test", "de-AT", nil)
+			So(err, ShouldBeNil)
+			email := parseEmail(ref.Message)
+			So(email.Header.Get("Subject"), ShouldEqual, "Test")
+			So(string(email.Text), ShouldEqual, "Textteil")
+			So(string(email.HTML), ShouldEqual, "HTML-Teil")
+
+			ref, err = NewEmail(templater, "<msgid@test>", "test@heim.invalid", "test", "fr", nil)
+			So(err, ShouldBeNil)
+			So(string(parseEmail(ref.Message).Text), ShouldEqual, "text part")
+		})
 	})
 }
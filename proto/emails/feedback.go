@@ -0,0 +1,142 @@
+package emails
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ErrNotFeedback is returned by ParseFeedback for messages that aren't
+// delivery status notifications or abuse reports.
+var ErrNotFeedback = fmt.Errorf("not a delivery status notification or feedback report")
+
+const (
+	BounceFeedback    = "bounce"
+	ComplaintFeedback = "complaint"
+)
+
+// Feedback is what a remote mail server reported about an email we sent:
+// either a bounce (a delivery status notification, RFC 3464) or a complaint
+// (an abuse report in the Abuse Reporting Format, RFC 5965).
+type Feedback struct {
+	Kind      string
+	MessageID string
+	Recipient string
+	Status    string
+	Permanent bool
+}
+
+// ParseFeedback parses an inbound multipart/report message.
+func ParseFeedback(message []byte) (*Feedback, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return nil, ErrNotFeedback
+	}
+
+	fb := &Feedback{}
+	switch strings.ToLower(params["report-type"]) {
+	case "delivery-status":
+		fb.Kind = BounceFeedback
+	case "feedback-report":
+		fb.Kind = ComplaintFeedback
+		fb.Permanent = true
+	default:
+		return nil, ErrNotFeedback
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status":
+			if err := fb.readDeliveryStatus(part); err != nil {
+				return nil, err
+			}
+		case "message/feedback-report":
+			fields, err := readFieldGroups(part)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) > 0 && fb.Recipient == "" {
+				fb.Recipient = fields[0].Get("Original-Rcpt-To")
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			original, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+			if err != nil && len(original) == 0 {
+				return nil, err
+			}
+			fb.MessageID = strings.TrimSpace(original.Get("Message-ID"))
+			if fb.Recipient == "" {
+				if to, err := mail.ParseAddress(original.Get("To")); err == nil {
+					fb.Recipient = to.Address
+				}
+			}
+		}
+		io.Copy(ioutil.Discard, part)
+	}
+
+	if fb.MessageID == "" {
+		return nil, fmt.Errorf("%s report doesn't include the original Message-ID", fb.Kind)
+	}
+	return fb, nil
+}
+
+// readDeliveryStatus takes the recipient and status from the first
+// per-recipient field group of a message/delivery-status part.
+func (fb *Feedback) readDeliveryStatus(r io.Reader) error {
+	groups, err := readFieldGroups(r)
+	if err != nil {
+		return err
+	}
+	// The first group describes the message; the rest its recipients.
+	if len(groups) < 2 {
+		return fmt.Errorf("delivery status has no recipients")
+	}
+	recipient := groups[1]
+
+	fb.Recipient = recipient.Get("Final-Recipient")
+	if i := strings.IndexByte(fb.Recipient, ';'); i >= 0 {
+		fb.Recipient = strings.TrimSpace(fb.Recipient[i+1:])
+	}
+	fb.Status = recipient.Get("Status")
+	fb.Permanent = strings.EqualFold(recipient.Get("Action"), "failed") && strings.HasPrefix(fb.Status, "5.")
+	return nil
+}
+
+// readFieldGroups reads blank-line separated groups of header fields.
+func readFieldGroups(r io.Reader) ([]textproto.MIMEHeader, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	groups := []textproto.MIMEHeader{}
+	for {
+		group, err := tr.ReadMIMEHeader()
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+		if err == io.EOF {
+			return groups, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package emails
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func crlf(s string) []byte { return []byte(strings.Replace(s, "\n", "\r\n", -1)) }
+
+const testDSN = `From: MAILER-DAEMON@mx.example.com
+To: noreply@heim.invalid
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status;
+	boundary="BOUNDARY"
+
+--BOUNDARY
+Content-Type: text/plain
+
+Your message could not be delivered.
+
+--BOUNDARY
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+Arrival-Date: Mon, 1 Jan 2018 00:00:00 +0000
+
+Final-Recipient: rfc822; gone@example.com
+Original-Recipient: rfc822;gone@example.com
+Action: %s
+Status: %s
+Diagnostic-Code: smtp; 550 5.1.1 user unknown
+
+--BOUNDARY
+Content-Type: text/rfc822-headers
+
+From: heim <noreply@heim.invalid>
+To: gone@example.com
+Subject: Welcome!
+Message-ID: <123@heim.invalid>
+
+--BOUNDARY--
+`
+
+const testARF = `From: abuse@example.com
+To: noreply@heim.invalid
+Subject: FW: Notification digest
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=feedback-report; boundary="BOUNDARY"
+
+--BOUNDARY
+Content-Type: text/plain
+
+This is an email abuse report.
+
+--BOUNDARY
+Content-Type: message/feedback-report
+
+Feedback-Type: abuse
+User-Agent: SomeGenerator/1.0
+Version: 1
+
+--BOUNDARY
+Content-Type: message/rfc822
+Content-Disposition: inline
+
+From: heim <noreply@heim.invalid>
+To: annoyed@example.com
+Subject: Notification digest
+Message-ID: <456@heim.invalid>
+
+You were mentioned.
+
+--BOUNDARY--
+`
+
+func TestParseFeedback(t *testing.T) {
+	Convey("Hard bounces are permanent", t, func() {
+		fb, err := ParseFeedback(crlf(fmt.Sprintf(testDSN, "failed", "5.1.1")))
+		So(err, ShouldBeNil)
+		So(fb, ShouldResemble, &Feedback{
+			Kind:      BounceFeedback,
+			MessageID: "<123@heim.invalid>",
+			Recipient: "gone@example.com",
+			Status:    "5.1.1",
+			Permanent: true,
+		})
+	})
+
+	Convey("Delays are not", t, func() {
+		fb, err := ParseFeedback(crlf(fmt.Sprintf(testDSN, "delayed", "4.4.1")))
+		So(err, ShouldBeNil)
+		So(fb.Kind, ShouldEqual, BounceFeedback)
+		So(fb.MessageID, ShouldEqual, "<123@heim.invalid>")
+		So(fb.Permanent, ShouldBeFalse)
+	})
+
+	Convey("Abuse reports are permanent complaints", t, func() {
+		fb, err := ParseFeedback(crlf(testARF))
+		So(err, ShouldBeNil)
+		So(fb, ShouldResemble, &Feedback{
+			Kind:      ComplaintFeedback,
+			MessageID: "<456@heim.invalid>",
+			Recipient: "annoyed@example.com",
+			Permanent: true,
+		})
+	})
+
+	Convey("Other mail is rejected", t, func() {
+		_, err := ParseFeedback(crlf("From: someone@example.com\nSubject: hi\n\nhello\n"))
+		So(err, ShouldEqual, ErrNotFeedback)
+
+		_, err = ParseFeedback(crlf(strings.Replace(testARF, "feedback-report;", "disposition-notification;", 1)))
+		So(err, ShouldEqual, ErrNotFeedback)
+	})
+
+	Convey("Reports must identify the original message", t, func() {
+		report := strings.Replace(testARF, "Message-ID: <456@heim.invalid>\n", "", 1)
+		_, err := ParseFeedback(crlf(report))
+		So(err, ShouldNotBeNil)
+	})
+}
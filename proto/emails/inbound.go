@@ -0,0 +1,238 @@
+package emails
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/scope"
+)
+
+// MaxInboundMessageSize bounds the size of messages accepted by ServeSMTP.
+const MaxInboundMessageSize = 10 << 20
+
+// An InboundMessage is an email received by ServeSMTP or PollMaildir.
+type InboundMessage struct {
+	From    string
+	To      []string
+	Message []byte
+}
+
+// An InboundHandler processes an inbound email. A RejectedError from the
+// handler is reported back to the sending server as a permanent failure, and
+// any other error as a temporary one.
+type InboundHandler func(ctx scope.Context, msg *InboundMessage) error
+
+// ServeSMTP accepts email over SMTP from l and passes each message to the
+// handler, until the context is cancelled. It's meant to sit behind an MTA
+// that relays just the addresses we're interested in, so it implements no
+// authentication or TLS, and accepts mail to any recipient.
+func ServeSMTP(ctx scope.Context, l net.Listener, localName string, handler InboundHandler) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Alive() {
+				return err
+			}
+			return nil
+		}
+		go serveSMTPConn(ctx, conn, localName, handler)
+	}
+}
+
+func serveSMTPConn(ctx scope.Context, conn net.Conn, localName string, handler InboundHandler) {
+	defer conn.Close()
+
+	tc := textproto.NewConn(conn)
+	reply := func(code int, text string) bool {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		return tc.PrintfLine("%d %s", code, text) == nil
+	}
+
+	if !reply(220, localName+" ESMTP heim") {
+		return
+	}
+
+	msg := &InboundMessage{}
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		ok := true
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			msg = &InboundMessage{}
+			ok = reply(250, localName)
+		case "MAIL":
+			addr, valid := smtpPath(arg, "FROM:")
+			if !valid {
+				ok = reply(501, "syntax error in MAIL command")
+				break
+			}
+			msg = &InboundMessage{From: addr}
+			ok = reply(250, "ok")
+		case "RCPT":
+			addr, valid := smtpPath(arg, "TO:")
+			if !valid || addr == "" {
+				ok = reply(501, "syntax error in RCPT command")
+				break
+			}
+			msg.To = append(msg.To, addr)
+			ok = reply(250, "ok")
+		case "DATA":
+			if len(msg.To) == 0 {
+				ok = reply(503, "need RCPT first")
+				break
+			}
+			if !reply(354, "end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := ioutil.ReadAll(&limitedReader{R: tc.DotReader(), N: MaxInboundMessageSize})
+			if err == errMessageTooLarge {
+				reply(552, "message too large")
+				return
+			}
+			if err != nil {
+				return
+			}
+			msg.Message = data
+			switch err := handler(ctx, msg).(type) {
+			case nil:
+				ok = reply(250, "ok")
+			case *RejectedError:
+				ok = reply(550, err.Reason)
+			default:
+				logging.Logger(ctx).Printf("inbound email from %s: %s", msg.From, err)
+				ok = reply(451, "message could not be processed")
+			}
+			msg = &InboundMessage{}
+		case "RSET":
+			msg = &InboundMessage{}
+			ok = reply(250, "ok")
+		case "NOOP":
+			ok = reply(250, "ok")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			ok = reply(502, "command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// smtpPath parses the address from the argument to MAIL or RCPT, ignoring
+// any parameters that follow it. The null path, <>, yields "".
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+var errMessageTooLarge = fmt.Errorf("message too large")
+
+// limitedReader is like io.LimitedReader, but fails instead of truncating.
+type limitedReader struct {
+	R io.Reader
+	N int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+	if l.N < 0 {
+		return n, errMessageTooLarge
+	}
+	return n, err
+}
+
+// PollMaildir passes each new message in a Maildir to the handler, checking
+// for new messages at the given interval until the context is cancelled.
+// Handled and rejected messages are moved to cur and marked seen. Messages
+// the handler fails on otherwise are left in new, to be retried.
+func PollMaildir(ctx scope.Context, dir string, interval time.Duration, handler InboundHandler) error {
+	for {
+		if err := pollMaildir(ctx, dir, handler); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func pollMaildir(ctx scope.Context, dir string, handler InboundHandler) error {
+	newDir := filepath.Join(dir, "new")
+	files, err := ioutil.ReadDir(newDir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(newDir, fi.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		msg := &InboundMessage{Message: data}
+		if parsed, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+			if from, err := mail.ParseAddress(parsed.Header.Get("Return-Path")); err == nil {
+				msg.From = from.Address
+			}
+			if to, err := mail.ParseAddress(parsed.Header.Get("Delivered-To")); err == nil {
+				msg.To = []string{to.Address}
+			}
+		}
+
+		if err := handler(ctx, msg); err != nil {
+			logging.Logger(ctx).Printf("inbound email %s: %s", path, err)
+			if _, ok := err.(*RejectedError); !ok {
+				continue
+			}
+		}
+
+		if err := os.Rename(path, filepath.Join(dir, "cur", fi.Name()+":2,S")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package emails
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInbound(t *testing.T) {
+	Convey("SMTP", t, func() {
+		ctx := scope.New()
+		defer ctx.Cancel()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		received := make(chan *InboundMessage, 1)
+		go ServeSMTP(ctx, l, "heim.invalid", func(ctx scope.Context, msg *InboundMessage) error {
+			if msg.From == "fail@example.com" {
+				return fmt.Errorf("try again later")
+			}
+			received <- msg
+			return nil
+		})
+
+		message := "Subject: bounce\r\n\r\nhello\r\n.leading dot\r\n"
+		err = smtp.SendMail(l.Addr().String(), nil, "", []string{"bounces@heim.invalid"}, []byte(message))
+		So(err, ShouldBeNil)
+
+		msg := <-received
+		So(msg.From, ShouldEqual, "")
+		So(msg.To, ShouldResemble, []string{"bounces@heim.invalid"})
+		So(string(msg.Message), ShouldEqual, strings.Replace(message, "\r\n", "\n", -1))
+
+		Convey("Handler errors are temporary failures", func() {
+			err := smtp.SendMail(
+				l.Addr().String(), nil, "fail@example.com", []string{"bounces@heim.invalid"}, []byte(message))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "451")
+		})
+	})
+
+	Convey("Maildir", t, func() {
+		dir, err := ioutil.TempDir("", "inbound")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		d, err := NewMaildirDeliverer("heim.invalid", dir)
+		So(err, ShouldBeNil)
+
+		ctx := scope.New()
+		for i := 0; i < 3; i++ {
+			ref := testRef(i)
+			ref.Message = []byte(fmt.Sprintf(
+				"Return-Path: <mailer-daemon@example.com>\nDelivered-To: bounces@heim.invalid\nSubject: %d\n\n", i))
+			So(d.Deliver(ctx, ref), ShouldBeNil)
+		}
+
+		seen := []string{}
+		err = pollMaildir(ctx, dir, func(ctx scope.Context, msg *InboundMessage) error {
+			So(msg.From, ShouldEqual, "mailer-daemon@example.com")
+			So(msg.To, ShouldResemble, []string{"bounces@heim.invalid"})
+			if strings.Contains(string(msg.Message), "Subject: 1\n") {
+				return fmt.Errorf("try again later")
+			}
+			seen = append(seen, string(msg.Message))
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(len(seen), ShouldEqual, 2)
+
+		// Handled messages are moved to cur, and the failure left for later.
+		cur, err := ioutil.ReadDir(filepath.Join(dir, "cur"))
+		So(err, ShouldBeNil)
+		So(len(cur), ShouldEqual, 2)
+		So(cur[0].Name(), ShouldEndWith, ":2,S")
+
+		remaining, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+		So(err, ShouldBeNil)
+		So(len(remaining), ShouldEqual, 1)
+
+		Convey("Polling stops when cancelled", func() {
+			done := make(chan error)
+			go func() {
+				done <- PollMaildir(ctx, dir, time.Millisecond, func(scope.Context, *InboundMessage) error { return nil })
+			}()
+			time.Sleep(10 * time.Millisecond)
+			ctx.Cancel()
+			So(<-done, ShouldBeNil)
+
+			remaining, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+			So(err, ShouldBeNil)
+			So(len(remaining), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,204 @@
+package emails
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"euphoria.io/scope"
+)
+
+const DefaultSendmailPath = "/usr/sbin/sendmail"
+
+// envelopeAddresses returns the bare sender and recipient addresses of an
+// email, defaulting the sender to noreply at the local domain.
+func envelopeAddresses(localName string, ref *EmailRef) (string, string, error) {
+	if ref.SendFrom == "" {
+		ref.SendFrom = "noreply@" + localName
+	}
+	sendFrom, err := mail.ParseAddress(ref.SendFrom)
+	if err != nil {
+		return "", "", fmt.Errorf("from address error: %s", err)
+	}
+	sendTo, err := mail.ParseAddress(ref.SendTo)
+	if err != nil {
+		return "", "", fmt.Errorf("to address error: %s", err)
+	}
+	return sendFrom.Address, sendTo.Address, nil
+}
+
+// unixLineEndings converts CRLF line endings to LF, as local mail stores and
+// sendmail expect.
+func unixLineEndings(message []byte) []byte {
+	return bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1)
+}
+
+// A MaildirDeliverer writes each email as a new message in a Maildir, where
+// it can be inspected with any mail reader.
+type MaildirDeliverer struct {
+	dir       string
+	localName string
+
+	m       sync.Mutex
+	counter int
+}
+
+// NewMaildirDeliverer returns a deliverer into the Maildir at dir, which is
+// created if necessary.
+func NewMaildirDeliverer(localName, dir string) (*MaildirDeliverer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &MaildirDeliverer{dir: dir, localName: localName}, nil
+}
+
+func (d *MaildirDeliverer) String() string    { return fmt.Sprintf("maildir[%s]", d.dir) }
+func (d *MaildirDeliverer) LocalName() string { return d.localName }
+
+func (d *MaildirDeliverer) Deliver(ctx scope.Context, ref *EmailRef) error {
+	if _, _, err := envelopeAddresses(d.localName, ref); err != nil {
+		return fmt.Errorf("%s: %s", d, err)
+	}
+
+	// Write to tmp, then move into new, so readers never see partial messages.
+	name := d.uniqueName()
+	tmpPath := filepath.Join(d.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpPath, unixLineEndings(ref.Message), 0600); err != nil {
+		return fmt.Errorf("%s: write error: %s", d, err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(d.dir, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%s: rename error: %s", d, err)
+	}
+
+	ref.Delivered = time.Now()
+	return nil
+}
+
+func (d *MaildirDeliverer) uniqueName() string {
+	d.m.Lock()
+	d.counter++
+	counter := d.counter
+	d.m.Unlock()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = d.localName
+	}
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), counter, hostname)
+}
+
+// An MboxDeliverer appends each email to a single mbox file, in the mboxrd
+// format. The file shouldn't be written to by anything else.
+type MboxDeliverer struct {
+	path      string
+	localName string
+
+	m sync.Mutex
+}
+
+func NewMboxDeliverer(localName, path string) *MboxDeliverer {
+	return &MboxDeliverer{path: path, localName: localName}
+}
+
+func (d *MboxDeliverer) String() string    { return fmt.Sprintf("mbox[%s]", d.path) }
+func (d *MboxDeliverer) LocalName() string { return d.localName }
+
+func (d *MboxDeliverer) Deliver(ctx scope.Context, ref *EmailRef) error {
+	sendFrom, _, err := envelopeAddresses(d.localName, ref)
+	if err != nil {
+		return fmt.Errorf("%s: %s", d, err)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From %s %s\n", sendFrom, time.Now().UTC().Format(time.ANSIC))
+	lines := strings.Split(strings.TrimSuffix(string(unixLineEndings(ref.Message)), "\n"), "\n")
+	for _, line := range lines {
+		// Quote lines that would otherwise be taken for a message separator.
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteByte('>')
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("%s: open error: %s", d, err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: write error: %s", d, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%s: close error: %s", d, err)
+	}
+
+	ref.Delivered = time.Now()
+	return nil
+}
+
+// A SendmailDeliverer pipes each email to a sendmail-compatible binary, such
+// as the one installed by postfix, exim, or msmtp.
+type SendmailDeliverer struct {
+	path      string
+	localName string
+
+	// DKIM, if set, signs each message before it's sent.
+	DKIM *DKIMSigner
+}
+
+func NewSendmailDeliverer(localName, path string) *SendmailDeliverer {
+	if path == "" {
+		path = DefaultSendmailPath
+	}
+	return &SendmailDeliverer{path: path, localName: localName}
+}
+
+func (d *SendmailDeliverer) String() string    { return fmt.Sprintf("sendmail[%s]", d.path) }
+func (d *SendmailDeliverer) LocalName() string { return d.localName }
+
+func (d *SendmailDeliverer) Deliver(ctx scope.Context, ref *EmailRef) error {
+	sendFrom, sendTo, err := envelopeAddresses(d.localName, ref)
+	if err != nil {
+		return fmt.Errorf("%s: %s", d, err)
+	}
+	if strings.HasPrefix(sendFrom, "-") || strings.HasPrefix(sendTo, "-") {
+		return fmt.Errorf("%s: refusing address that looks like a flag", d)
+	}
+
+	message := ref.Message
+	if d.DKIM != nil {
+		if message, err = d.DKIM.Sign(message); err != nil {
+			return fmt.Errorf("%s: dkim error: %s", d, err)
+		}
+	}
+
+	output := &bytes.Buffer{}
+	cmd := exec.Command(d.path, "-i", "-f", sendFrom, sendTo)
+	cmd.Stdin = bytes.NewReader(unixLineEndings(message))
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s: %s", d, err, strings.TrimSpace(output.String()))
+	}
+
+	ref.Delivered = time.Now()
+	return nil
+}
@@ -0,0 +1,111 @@
+package emails
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocalDeliverers(t *testing.T) {
+	ctx := scope.New()
+
+	Convey("Maildir", t, func() {
+		dir, err := ioutil.TempDir("", "maildir")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		d, err := NewMaildirDeliverer("heim.invalid", filepath.Join(dir, "Maildir"))
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 2; i++ {
+			ref := testRef(i)
+			So(d.Deliver(ctx, ref), ShouldBeNil)
+			So(ref.Delivered.IsZero(), ShouldBeFalse)
+		}
+
+		tmp, err := ioutil.ReadDir(filepath.Join(dir, "Maildir", "tmp"))
+		So(err, ShouldBeNil)
+		So(len(tmp), ShouldEqual, 0)
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, "Maildir", "new"))
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 2)
+
+		contents := []string{}
+		for _, fi := range files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, "Maildir", "new", fi.Name()))
+			So(err, ShouldBeNil)
+			contents = append(contents, string(data))
+		}
+		So(contents, ShouldContain, string(testRef(0).Message))
+		So(contents, ShouldContain, string(testRef(1).Message))
+	})
+
+	Convey("Mbox", t, func() {
+		dir, err := ioutil.TempDir("", "mbox")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "mbox")
+		d := NewMboxDeliverer("heim.invalid", path)
+
+		ref := testRef(0)
+		ref.Message = []byte("Subject: quoting\r\n\r\nFrom here\r\n>From there\r\nnot From\r\n")
+		So(d.Deliver(ctx, ref), ShouldBeNil)
+		So(d.Deliver(ctx, testRef(1)), ShouldBeNil)
+
+		data, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		messages := strings.Split(string(data), "\n\nFrom ")
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0], ShouldStartWith, "From noreply@heim.invalid ")
+		So(messages[0], ShouldEndWith,
+			"\nSubject: quoting\n\n>From here\n>>From there\nnot From")
+		So(messages[1], ShouldStartWith, "noreply@heim.invalid ")
+		So(messages[1], ShouldEndWith, "\nSubject: test 1\n\nhello\n\n")
+	})
+
+	Convey("Sendmail", t, func() {
+		dir, err := ioutil.TempDir("", "sendmail")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		// A stand-in for sendmail that records its arguments and input.
+		script := filepath.Join(dir, "sendmail")
+		So(ioutil.WriteFile(script, []byte(
+			"#!/bin/sh\necho \"$@\" > \"$0.args\"\ncat > \"$0.stdin\"\n"), 0700), ShouldBeNil)
+
+		d := NewSendmailDeliverer("heim.invalid", script)
+		ref := testRef(0)
+		ref.Message = []byte("Subject: hi\r\n\r\nhello\r\n")
+		So(d.Deliver(ctx, ref), ShouldBeNil)
+		So(ref.Delivered.IsZero(), ShouldBeFalse)
+
+		args, err := ioutil.ReadFile(script + ".args")
+		So(err, ShouldBeNil)
+		So(string(args), ShouldEqual, "-i -f noreply@heim.invalid user0@heim.invalid\n")
+
+		stdin, err := ioutil.ReadFile(script + ".stdin")
+		So(err, ShouldBeNil)
+		So(string(stdin), ShouldEqual, "Subject: hi\n\nhello\n")
+
+		Convey("Failures are reported with output", func() {
+			So(ioutil.WriteFile(script, []byte("#!/bin/sh\necho no relay >&2\nexit 75\n"), 0700), ShouldBeNil)
+			err := d.Deliver(ctx, testRef(1))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "no relay")
+		})
+
+		Convey("Flag-like addresses are refused", func() {
+			ref := testRef(1)
+			ref.SendTo = "-oQ/tmp/x@heim.invalid"
+			So(d.Deliver(ctx, ref), ShouldNotBeNil)
+		})
+	})
+}
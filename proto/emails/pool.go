@@ -0,0 +1,125 @@
+package emails
+
+import (
+	"fmt"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"euphoria.io/scope"
+)
+
+const (
+	DefaultSMTPPoolSize    = 4
+	DefaultSMTPPoolMaxIdle = time.Minute
+)
+
+// A PooledSMTPDeliverer delivers email over a bounded pool of authenticated
+// connections to an SMTP server, reusing them from one message to the next.
+// Idle connections are checked with a NOOP before reuse, and dropped once
+// they've been idle longer than maxIdle.
+type PooledSMTPDeliverer struct {
+	*SMTPDeliverer
+
+	maxIdle time.Duration
+	slots   chan struct{}
+
+	m    sync.Mutex
+	idle []*pooledSMTPConn
+}
+
+type pooledSMTPConn struct {
+	*smtp.Client
+	lastUsed time.Time
+}
+
+// NewPooledSMTPDeliverer wraps d so that at most size deliveries run at
+// once, each on a reused connection where possible.
+func NewPooledSMTPDeliverer(d *SMTPDeliverer, size int, maxIdle time.Duration) *PooledSMTPDeliverer {
+	if size < 1 {
+		size = DefaultSMTPPoolSize
+	}
+	if maxIdle <= 0 {
+		maxIdle = DefaultSMTPPoolMaxIdle
+	}
+	return &PooledSMTPDeliverer{
+		SMTPDeliverer: d,
+		maxIdle:       maxIdle,
+		slots:         make(chan struct{}, size),
+	}
+}
+
+func (p *PooledSMTPDeliverer) String() string { return fmt.Sprintf("smtp-pool[%s]", p.addr) }
+
+func (p *PooledSMTPDeliverer) Deliver(ctx scope.Context, ref *EmailRef) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	if err := p.send(c.Client, ref); err != nil {
+		// The connection may be in any state, so don't reuse it.
+		c.Close()
+		return err
+	}
+
+	p.put(c)
+	return nil
+}
+
+// Close quits all idle connections.
+func (p *PooledSMTPDeliverer) Close() {
+	p.m.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.m.Unlock()
+
+	for _, c := range idle {
+		c.Quit()
+	}
+}
+
+// get returns a healthy idle connection, or dials a new one.
+func (p *PooledSMTPDeliverer) get() (*pooledSMTPConn, error) {
+	for {
+		p.m.Lock()
+		if len(p.idle) == 0 {
+			p.m.Unlock()
+			break
+		}
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.m.Unlock()
+
+		if time.Now().Sub(c.lastUsed) > p.maxIdle {
+			c.Quit()
+			continue
+		}
+		if err := c.Noop(); err != nil {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+
+	c, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	return &pooledSMTPConn{Client: c}, nil
+}
+
+func (p *PooledSMTPDeliverer) put(c *pooledSMTPConn) {
+	c.lastUsed = time.Now()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.idle = append(p.idle, c)
+}
@@ -0,0 +1,243 @@
+package emails
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// ErrNoReplyText is returned by ParseReply for messages without a plain text
+// part.
+var ErrNoReplyText = fmt.Errorf("no plain text found in reply")
+
+// A Reply is the new content of an inbound reply to one of our emails.
+type Reply struct {
+	From string
+	Text string
+
+	// AuthenticationResults holds the Authentication-Results headers added
+	// by the MTAs the reply passed through.
+	AuthenticationResults []string
+}
+
+// ParseReply extracts the sender and the text of a reply, with quoted text
+// and signatures removed.
+func ParseReply(message []byte) (*Reply, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("from address error: %s", err)
+	}
+
+	text, err := plainText(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &Reply{
+		From:                  from.Address,
+		Text:                  StripQuotedReply(text),
+		AuthenticationResults: msg.Header["Authentication-Results"],
+	}
+	return reply, nil
+}
+
+// Authenticated returns true if the MTA identified by authServID vouched for
+// the reply's From address, with a DKIM signature, SPF check, or DMARC
+// evaluation that passed for the From address's domain. Results from any
+// other authserv-id could have been written by the sender, so they're
+// ignored.
+func (r *Reply) Authenticated(authServID string) bool {
+	domain := r.From[strings.LastIndex(r.From, "@")+1:]
+	for _, value := range r.AuthenticationResults {
+		results := strings.Split(stripComments(value), ";")
+		if fields := strings.Fields(results[0]); len(fields) == 0 || !strings.EqualFold(fields[0], authServID) {
+			continue
+		}
+		for _, result := range results[1:] {
+			fields := strings.Fields(result)
+			if len(fields) == 0 {
+				continue
+			}
+			var ptype string
+			switch strings.ToLower(fields[0]) {
+			case "dkim=pass":
+				ptype = "header.d"
+			case "spf=pass":
+				ptype = "smtp.mailfrom"
+			case "dmarc=pass":
+				ptype = "header.from"
+			default:
+				continue
+			}
+			for _, prop := range fields[1:] {
+				kv := strings.SplitN(prop, "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], ptype) && alignedDomain(domain, kv[1]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// stripComments removes parenthesized comments from a header value.
+func stripComments(value string) string {
+	var b bytes.Buffer
+	depth := 0
+	for _, c := range value {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// alignedDomain returns true if the authenticated identifier, a domain or an
+// address, belongs to the given domain or one of its parents.
+func alignedDomain(domain, identifier string) bool {
+	identifier = strings.ToLower(strings.Trim(identifier, `"`))
+	identifier = identifier[strings.LastIndex(identifier, "@")+1:]
+	domain = strings.ToLower(domain)
+	if identifier == "" {
+		return false
+	}
+	return domain == identifier || strings.HasSuffix(domain, "."+identifier)
+}
+
+// plainText returns the first text/plain part of a message body, decoded.
+func plainText(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 says to assume plain text.
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return "", ErrNoReplyText
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := plainText(part.Header, part)
+			if err != ErrNoReplyText {
+				return text, err
+			}
+		}
+	}
+
+	if mediaType != "text/plain" {
+		return "", ErrNoReplyText
+	}
+	if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" && charset != "us-ascii" {
+		return "", fmt.Errorf("unsupported charset: %s", charset)
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{body})
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// newlineStripper drops line breaks, which the base64 decoder can't handle.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (ns *newlineStripper) Read(p []byte) (int, error) {
+	n, err := ns.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+var (
+	// Lines that introduce quoted text, or a signature. Everything from the
+	// first of these on is dropped.
+	replyCutoffs = []*regexp.Regexp{
+		regexp.MustCompile(`^On .*wrote:$`),
+		regexp.MustCompile(`^-+ ?Original Message ?-+$`),
+		regexp.MustCompile(`^_{10,}$`),
+		regexp.MustCompile(`^From: `),
+		regexp.MustCompile(`^--$`),
+		regexp.MustCompile(`^Sent from my `),
+	}
+
+	// An attribution line that has been wrapped onto two lines.
+	wrappedAttribution = regexp.MustCompile(`^On .*\S.*$`)
+	wrappedWrote       = regexp.MustCompile(`^.*wrote:$`)
+)
+
+// StripQuotedReply returns the text of an email reply, without the quoted
+// message it replies to, or the sender's signature.
+func StripQuotedReply(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+
+	kept := []string{}
+scan:
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, " \t")
+		for _, cutoff := range replyCutoffs {
+			if cutoff.MatchString(trimmed) {
+				break scan
+			}
+		}
+		if wrappedAttribution.MatchString(trimmed) && i+1 < len(lines) &&
+			wrappedWrote.MatchString(strings.TrimRight(lines[i+1], " \t")) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		kept = append(kept, trimmed)
+	}
+
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// A RejectedError is returned by an InboundHandler to refuse a message for
+// good, rather than have it retried.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string { return e.Reason }
+
+// Reject returns a RejectedError.
+func Reject(format string, args ...interface{}) error {
+	return &RejectedError{Reason: fmt.Sprintf(format, args...)}
+}
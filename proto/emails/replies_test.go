@@ -0,0 +1,139 @@
+package emails
+
+import (
+	"net"
+	"net/smtp"
+	"testing"
+
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStripQuotedReply(t *testing.T) {
+	Convey("Quoted text is dropped", t, func() {
+		text := "Sounds good.\n\n> @yourname are you coming tonight?\n> \n"
+		So(StripQuotedReply(text), ShouldEqual, "Sounds good.")
+	})
+
+	Convey("Everything after an attribution is dropped", t, func() {
+		text := "Yes!\r\nSee you there.\r\n\r\nOn Mon, Jan 1, 2018 at 12:00 AM, heim <reply+cabal@heim.invalid> wrote:\r\n" +
+			"> thatguy mentioned you in &cabal\r\n"
+		So(StripQuotedReply(text), ShouldEqual, "Yes!\nSee you there.")
+
+		text = "Yes!\n\nOn Mon, Jan 1, 2018 at 12:00 AM, heim\n<reply+cabal@heim.invalid> wrote:\n> hi\n"
+		So(StripQuotedReply(text), ShouldEqual, "Yes!")
+
+		text = "Yes!\n\n-----Original Message-----\nFrom: heim\n"
+		So(StripQuotedReply(text), ShouldEqual, "Yes!")
+	})
+
+	Convey("Signatures are dropped", t, func() {
+		So(StripQuotedReply("Yes!\n-- \nYour Name\n"), ShouldEqual, "Yes!")
+		So(StripQuotedReply("Yes!\n\nSent from my phone\n"), ShouldEqual, "Yes!")
+	})
+}
+
+func TestParseReply(t *testing.T) {
+	Convey("Plain text", t, func() {
+		reply, err := ParseReply(crlf("From: Your Name <you@example.com>\nSubject: Re: hi\n\nSure.\n\n> hi\n"))
+		So(err, ShouldBeNil)
+		So(reply, ShouldResemble, &Reply{From: "you@example.com", Text: "Sure."})
+	})
+
+	Convey("The plain text part of a multipart message is decoded", t, func() {
+		message := `From: you@example.com
+Subject: Re: hi
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="OUTER"
+
+--OUTER
+Content-Type: multipart/related; boundary="INNER"
+
+--INNER
+Content-Type: text/plain; charset="UTF-8"
+Content-Transfer-Encoding: quoted-printable
+
+Caf=C3=A9 at 8? This line is long enough that it has to be wrapped with a so=
+ft line break.
+
+> hi
+--INNER--
+
+--OUTER
+Content-Type: text/html; charset="UTF-8"
+
+<p>Café at 8?</p>
+--OUTER--
+`
+		reply, err := ParseReply(crlf(message))
+		So(err, ShouldBeNil)
+		So(reply.Text, ShouldEqual,
+			"Café at 8? This line is long enough that it has to be wrapped with a soft line break.")
+
+		message = "From: you@example.com\nContent-Type: text/plain\nContent-Transfer-Encoding: base64\n\n" +
+			"U3VyZS4KCj4g\naGkK\n"
+		reply, err = ParseReply(crlf(message))
+		So(err, ShouldBeNil)
+		So(reply.Text, ShouldEqual, "Sure.")
+	})
+
+	Convey("Messages without plain text are refused", t, func() {
+		_, err := ParseReply(crlf("From: you@example.com\nContent-Type: text/html\n\n<p>hi</p>\n"))
+		So(err, ShouldEqual, ErrNoReplyText)
+	})
+}
+
+func TestReplyAuthenticated(t *testing.T) {
+	parse := func(headers string) *Reply {
+		reply, err := ParseReply(crlf(headers + "From: you@mail.example.com\n\nSure.\n"))
+		So(err, ShouldBeNil)
+		return reply
+	}
+
+	Convey("A passing result from our MTA for the From domain authenticates", t, func() {
+		reply := parse("Authentication-Results: mx.heim.invalid;\n" +
+			" dkim=pass (2048-bit key) header.d=example.com header.s=s1;\n spf=fail smtp.mailfrom=evil.invalid\n")
+		So(reply.Authenticated("mx.heim.invalid"), ShouldBeTrue)
+		So(reply.Authenticated("MX.HEIM.INVALID"), ShouldBeTrue)
+
+		reply = parse("Authentication-Results: mx.heim.invalid 1; spf=pass smtp.mailfrom=you@mail.example.com\n")
+		So(reply.Authenticated("mx.heim.invalid"), ShouldBeTrue)
+
+		reply = parse("Authentication-Results: mx.heim.invalid; dmarc=pass header.from=mail.example.com\n")
+		So(reply.Authenticated("mx.heim.invalid"), ShouldBeTrue)
+	})
+
+	Convey("Failing, unaligned, or foreign results don't", t, func() {
+		So(parse("").Authenticated("mx.heim.invalid"), ShouldBeFalse)
+		So(parse("Authentication-Results: mx.heim.invalid; dkim=fail header.d=example.com\n").
+			Authenticated("mx.heim.invalid"), ShouldBeFalse)
+		So(parse("Authentication-Results: mx.heim.invalid; dkim=pass header.d=evil.invalid\n").
+			Authenticated("mx.heim.invalid"), ShouldBeFalse)
+		So(parse("Authentication-Results: mx.heim.invalid; dkim=pass header.d=ample.com\n").
+			Authenticated("mx.heim.invalid"), ShouldBeFalse)
+		So(parse("Authentication-Results: mx.evil.invalid; dkim=pass header.d=example.com\n").
+			Authenticated("mx.heim.invalid"), ShouldBeFalse)
+		So(parse("Authentication-Results: mx.heim.invalid; dkim=pass (header.d=example.com)\n").
+			Authenticated("mx.heim.invalid"), ShouldBeFalse)
+	})
+}
+
+func TestRejectedReplies(t *testing.T) {
+	Convey("Rejections are permanent failures", t, func() {
+		ctx := scope.New()
+		defer ctx.Cancel()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		go ServeSMTP(ctx, l, "heim.invalid", func(ctx scope.Context, msg *InboundMessage) error {
+			return Reject("no such mailbox")
+		})
+
+		err = smtp.SendMail(
+			l.Addr().String(), nil, "you@example.com", []string{"reply+x@heim.invalid"}, crlf("Subject: hi\n\nhi\n"))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "550")
+	})
+}
@@ -3,7 +3,6 @@ package emails
 import (
 	"crypto/tls"
 	"fmt"
-	"net/mail"
 	"net/smtp"
 	"time"
 
@@ -27,52 +26,71 @@ type SMTPDeliverer struct {
 	localName string
 	auth      smtp.Auth
 	tlsConfig *tls.Config
+
+	// DKIM, if set, signs each message before it's sent.
+	DKIM *DKIMSigner
 }
 
 func (s *SMTPDeliverer) String() string    { return fmt.Sprintf("smtp[%s]", s.addr) }
 func (s *SMTPDeliverer) LocalName() string { return s.localName }
 
 func (s *SMTPDeliverer) Deliver(ctx scope.Context, ref *EmailRef) error {
-	// Connect and authenticate to SMTP server.
-	c, err := smtp.Dial(s.addr)
+	c, err := s.dial()
 	if err != nil {
-		return fmt.Errorf("%s: dial error: %s", s, err)
+		return err
 	}
 	defer c.Quit()
 
+	return s.send(c, ref)
+}
+
+// dial connects and authenticates to the SMTP server.
+func (s *SMTPDeliverer) dial() (*smtp.Client, error) {
+	c, err := smtp.Dial(s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: dial error: %s", s, err)
+	}
+
 	if err := c.Hello(s.localName); err != nil {
-		return fmt.Errorf("%s: ehlo error: %s", s, err)
+		c.Close()
+		return nil, fmt.Errorf("%s: ehlo error: %s", s, err)
 	}
 
 	if s.tlsConfig != nil {
 		if err := c.StartTLS(s.tlsConfig); err != nil {
-			return fmt.Errorf("%s: starttls error: %s", s, err)
+			c.Close()
+			return nil, fmt.Errorf("%s: starttls error: %s", s, err)
 		}
 	}
 
 	if s.auth != nil {
 		if err := c.Auth(s.auth); err != nil {
-			return fmt.Errorf("%s: auth error: %s", s, err)
+			c.Close()
+			return nil, fmt.Errorf("%s: auth error: %s", s, err)
 		}
 	}
 
-	// Send email.
-	if ref.SendFrom == "" {
-		ref.SendFrom = "noreply@" + s.localName
-	}
-	sendFrom, err := mail.ParseAddress(ref.SendFrom)
+	return c, nil
+}
+
+// send delivers one email over an established connection.
+func (s *SMTPDeliverer) send(c *smtp.Client, ref *EmailRef) error {
+	sendFrom, sendTo, err := envelopeAddresses(s.localName, ref)
 	if err != nil {
-		return fmt.Errorf("%s: from address error: %s", s, err)
+		return fmt.Errorf("%s: %s", s, err)
 	}
-	if err := c.Mail(sendFrom.Address); err != nil {
-		return fmt.Errorf("%s: mail error: %s", s, err)
+
+	message := ref.Message
+	if s.DKIM != nil {
+		if message, err = s.DKIM.Sign(message); err != nil {
+			return fmt.Errorf("%s: dkim error: %s", s, err)
+		}
 	}
 
-	sendTo, err := mail.ParseAddress(ref.SendTo)
-	if err != nil {
-		return fmt.Errorf("%s: to address error: %s", s, err)
+	if err := c.Mail(sendFrom); err != nil {
+		return fmt.Errorf("%s: mail error: %s", s, err)
 	}
-	if err := c.Rcpt(sendTo.Address); err != nil {
+	if err := c.Rcpt(sendTo); err != nil {
 		return fmt.Errorf("%s: rcpt error: %s", s, err)
 	}
 
@@ -81,7 +99,7 @@ func (s *SMTPDeliverer) Deliver(ctx scope.Context, ref *EmailRef) error {
 		return fmt.Errorf("%s: data error: %s", s, err)
 	}
 
-	if _, err := wc.Write(ref.Message); err != nil {
+	if _, err := wc.Write(message); err != nil {
 		return fmt.Errorf("%s: write error: %s", s, err)
 	}
 	if err := wc.Close(); err != nil {
@@ -0,0 +1,216 @@
+package emails
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"euphoria.io/scope"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testSMTPServer is a minimal local stand-in for an SMTP relay. It accepts
+// every message, and keeps count of connections.
+type testSMTPServer struct {
+	net.Listener
+
+	m        sync.Mutex
+	conns    map[net.Conn]bool
+	dialed   int
+	active   int
+	peak     int
+	messages []string
+}
+
+func newTestSMTPServer() *testSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+
+	s := &testSMTPServer{Listener: l, conns: map[net.Conn]bool{}}
+	go s.serve()
+	return s
+}
+
+func (s *testSMTPServer) serve() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		s.m.Lock()
+		s.conns[conn] = true
+		s.dialed++
+		s.m.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *testSMTPServer) handle(conn net.Conn) {
+	defer func() {
+		s.m.Lock()
+		delete(s.conns, conn)
+		s.m.Unlock()
+		conn.Close()
+	}()
+
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost ESMTP test")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tc.PrintfLine("250 localhost")
+		case "MAIL":
+			s.m.Lock()
+			s.active++
+			if s.active > s.peak {
+				s.peak = s.active
+			}
+			s.m.Unlock()
+			tc.PrintfLine("250 ok")
+		case "RCPT", "NOOP", "RSET":
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			data, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			// Linger a little, so that concurrent deliveries overlap.
+			time.Sleep(5 * time.Millisecond)
+			s.m.Lock()
+			s.active--
+			s.messages = append(s.messages, string(data))
+			s.m.Unlock()
+			tc.PrintfLine("250 ok")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 unrecognized command")
+		}
+	}
+}
+
+// dropConnections hangs up on every connected client.
+func (s *testSMTPServer) dropConnections() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testSMTPServer) stats() (dialed, peak, messages int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.dialed, s.peak, len(s.messages)
+}
+
+func testRef(n int) *EmailRef {
+	return &EmailRef{
+		SendFrom: "heim <noreply@heim.invalid>",
+		SendTo:   fmt.Sprintf("user%d@heim.invalid", n),
+		Message:  []byte(fmt.Sprintf("From: noreply@heim.invalid\nSubject: test %d\n\nhello\n", n)),
+	}
+}
+
+func TestSMTPDeliverer(t *testing.T) {
+	ctx := scope.New()
+
+	Convey("Unpooled delivery connects for every email", t, func() {
+		server := newTestSMTPServer()
+		defer server.Close()
+
+		d := NewSMTPDeliverer("heim.invalid", server.Addr().String(), "", nil)
+		for i := 0; i < 3; i++ {
+			ref := testRef(i)
+			So(d.Deliver(ctx, ref), ShouldBeNil)
+			So(ref.Delivered.IsZero(), ShouldBeFalse)
+		}
+		dialed, _, messages := server.stats()
+		So(dialed, ShouldEqual, 3)
+		So(messages, ShouldEqual, 3)
+	})
+
+	Convey("Pooled delivery reuses connections", t, func() {
+		server := newTestSMTPServer()
+		defer server.Close()
+
+		d := NewPooledSMTPDeliverer(
+			NewSMTPDeliverer("heim.invalid", server.Addr().String(), "", nil), 2, time.Minute)
+		defer d.Close()
+		for i := 0; i < 5; i++ {
+			So(d.Deliver(ctx, testRef(i)), ShouldBeNil)
+		}
+		dialed, _, messages := server.stats()
+		So(dialed, ShouldEqual, 1)
+		So(messages, ShouldEqual, 5)
+
+		Convey("Dead connections are replaced", func() {
+			server.dropConnections()
+			So(d.Deliver(ctx, testRef(5)), ShouldBeNil)
+			dialed, _, messages := server.stats()
+			So(dialed, ShouldEqual, 2)
+			So(messages, ShouldEqual, 6)
+		})
+
+		Convey("Stale connections are replaced", func() {
+			d.maxIdle = time.Nanosecond
+			time.Sleep(time.Millisecond)
+			So(d.Deliver(ctx, testRef(5)), ShouldBeNil)
+			dialed, _, _ := server.stats()
+			So(dialed, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Pooled delivery bounds concurrency", t, func() {
+		server := newTestSMTPServer()
+		defer server.Close()
+
+		d := NewPooledSMTPDeliverer(
+			NewSMTPDeliverer("heim.invalid", server.Addr().String(), "", nil), 3, time.Minute)
+		defer d.Close()
+
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			go func(i int) { errs <- d.Deliver(ctx, testRef(i)) }(i)
+		}
+		for i := 0; i < 20; i++ {
+			So(<-errs, ShouldBeNil)
+		}
+
+		dialed, peak, messages := server.stats()
+		So(dialed, ShouldBeLessThanOrEqualTo, 3)
+		So(peak, ShouldBeLessThanOrEqualTo, 3)
+		So(messages, ShouldEqual, 20)
+	})
+
+	Convey("Delivered mail is DKIM-signed when configured", t, func() {
+		server := newTestSMTPServer()
+		defer server.Close()
+
+		d := NewSMTPDeliverer("heim.invalid", server.Addr().String(), "", nil)
+		d.DKIM = &DKIMSigner{Domain: "heim.invalid", Selector: "test", Key: testDKIMKey()}
+		So(d.Deliver(ctx, testRef(0)), ShouldBeNil)
+
+		server.m.Lock()
+		message := server.messages[0]
+		server.m.Unlock()
+		r := textproto.NewReader(bufio.NewReader(strings.NewReader(message)))
+		header, err := r.ReadMIMEHeader()
+		So(err, ShouldBeNil)
+		So(header.Get("DKIM-Signature"), ShouldContainSubstring, "d=heim.invalid; s=test;")
+		So(verifyDKIM([]byte(message), &d.DKIM.Key.PublicKey), ShouldBeNil)
+	})
+}
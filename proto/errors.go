@@ -4,6 +4,8 @@ import "fmt"
 
 var (
 	ErrAccessDenied                    = fmt.Errorf("access denied")
+	ErrAccessRequestNotFound           = fmt.Errorf("access request not found")
+	ErrAccountDataExportNotFound       = fmt.Errorf("data export not found")
 	ErrAccountIdentityInUse            = fmt.Errorf("account identity already in use")
 	ErrAccountNotFound                 = fmt.Errorf("account not found")
 	ErrAgentAlreadyExists              = fmt.Errorf("agent already exists")
@@ -13,20 +15,41 @@ var (
 	ErrEditInconsistent                = fmt.Errorf("edit inconsistent")
 	ErrEmailNotFound                   = fmt.Errorf("email not found")
 	ErrEmailAlreadyDelivered           = fmt.Errorf("email already delivered")
+	ErrEmailReplyExpired               = fmt.Errorf("email reply address has expired")
+	ErrEmailReplyUnauthenticated       = fmt.Errorf("email reply sender could not be authenticated")
+	ErrEmailReplyUsed                  = fmt.Errorf("email reply address has already been used")
+	ErrEmailOptedOut                   = fmt.Errorf("recipient has opted out of this email")
+	ErrEmailUndeliverable              = fmt.Errorf("recipient's email address is undeliverable")
 	ErrInvalidConfirmationCode         = fmt.Errorf("invalid confirmation code")
+	ErrInvalidEmailMessageID           = fmt.Errorf("invalid email message ID")
+	ErrInvalidEmailPreferencesToken    = fmt.Errorf("invalid email preferences token")
+	ErrInvalidEmailReplyAddress        = fmt.Errorf("invalid email reply address")
+	ErrInvalidLocale                   = fmt.Errorf("invalid locale")
 	ErrInvalidNick                     = fmt.Errorf("invalid nick")
 	ErrInvalidParent                   = fmt.Errorf("invalid parent ID")
 	ErrInvalidUserID                   = fmt.Errorf("invalid user ID")
 	ErrInvalidVerificationToken        = fmt.Errorf("invalid verification token")
+	ErrInviteExhausted                 = fmt.Errorf("invite has been used up")
+	ErrInviteExpired                   = fmt.Errorf("invite expired")
+	ErrInviteNotFound                  = fmt.Errorf("invite not found")
 	ErrLoggedIn                        = fmt.Errorf("logged in")
 	ErrOTPAlreadyEnrolled              = fmt.Errorf("otp already enrolled")
 	ErrOTPNotEnrolled                  = fmt.Errorf("otp not enrolled")
 	ErrManagerNotFound                 = fmt.Errorf("manager not found")
 	ErrMessageNotFound                 = fmt.Errorf("message not found")
 	ErrMessageTooLong                  = fmt.Errorf("message too long")
+	ErrNickNotReserved                 = fmt.Errorf("nick not reserved")
+	ErrNickReserved                    = fmt.Errorf("nick reserved by another account")
 	ErrNotLoggedIn                     = fmt.Errorf("not logged in")
+	ErrOIDCAccount                     = fmt.Errorf("account logs in through an identity provider")
+	ErrOIDCLoginRequired               = fmt.Errorf("log in through the identity provider again to continue")
 	ErrPMNotFound                      = fmt.Errorf("pm not found")
 	ErrPersonalIdentityAlreadyVerified = fmt.Errorf("personal identity already verified")
 	ErrPersonalIdentityInUse           = fmt.Errorf("personal identity already in use")
+	ErrPersonalIdentityIsPrimary       = fmt.Errorf("personal identity is primary")
+	ErrPersonalIdentityNotFound        = fmt.Errorf("personal identity not found")
+	ErrPersonalIdentityNotVerified     = fmt.Errorf("personal identity not verified")
 	ErrRoomNotFound                    = fmt.Errorf("room not found")
+	ErrTooManyReservedNicks            = fmt.Errorf("too many reserved nicks")
+	ErrUserNotBlocked                  = fmt.Errorf("user not blocked")
 )
@@ -3,32 +3,71 @@ package proto
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
 	"euphoria.io/scope"
 )
 
 type CapabilityTable interface {
+	// Get returns the capability with the given ID. Expired capabilities are
+	// not returned.
 	Get(ctx scope.Context, capabilityID string) (security.Capability, error)
-	Save(ctx scope.Context, account Account, c security.Capability) error
+
+	// Save stores a capability. A zero value for expires indicates the
+	// capability never expires.
+	Save(ctx scope.Context, account Account, c security.Capability, expires time.Time) error
+
 	Remove(ctx scope.Context, capabilityID string) error
+
+	// List returns all unexpired capabilities in the table, in the order
+	// they were granted.
+	List(ctx scope.Context) ([]CapabilityGrant, error)
+}
+
+// AccountGrant describes a grant of access to an account.
+type AccountGrant struct {
+	AccountView
+	Granted Time `json:"granted"` // the time the grant was made
+	Expires Time `json:"expires"` // the time the grant expires, or null if it never expires
+}
+
+// PasscodeGrant describes a grant of access to a passcode.
+type PasscodeGrant struct {
+	CapabilityID string `json:"capability_id"` // the id of the capability the passcode unlocks
+	Granted      Time   `json:"granted"`       // the time the grant was made
+	Expires      Time   `json:"expires"`       // the time the grant expires, or null if it never expires
 }
 
+// A CapabilityGrant describes a capability stored in a CapabilityTable.
+type CapabilityGrant struct {
+	CapabilityID string
+	AccountID    snowflake.Snowflake // zero if the capability wasn't granted to an account
+	Granted      time.Time
+	Expires      time.Time
+}
+
+// An AccountGrantable issues grants to accounts. A zero value for expires
+// indicates the grant never expires.
 type AccountGrantable interface {
 	GrantToAccount(
 		ctx scope.Context, kms security.KMS, manager Account, managerClientKey *security.ManagedKey,
-		target Account) error
+		target Account, expires time.Time) error
 
-	StaffGrantToAccount(ctx scope.Context, kms security.KMS, target Account) error
+	StaffGrantToAccount(ctx scope.Context, kms security.KMS, target Account, expires time.Time) error
 
 	RevokeFromAccount(ctx scope.Context, account Account) error
 
 	AccountCapability(ctx scope.Context, account Account) (*security.PublicKeyCapability, error)
 }
 
+// A PasscodeGrantable issues grants to passcodes. A zero value for expires
+// indicates the grant never expires.
 type PasscodeGrantable interface {
 	GrantToPasscode(
-		ctx scope.Context, manager Account, managerClientKey *security.ManagedKey, passcode string) error
+		ctx scope.Context, manager Account, managerClientKey *security.ManagedKey, passcode string,
+		expires time.Time) error
 
 	RevokeFromPasscode(ctx scope.Context, passcode string) error
 
@@ -38,6 +77,7 @@ type PasscodeGrantable interface {
 type GrantManager struct {
 	Capabilities     CapabilityTable
 	Managers         AccountGrantable
+	Invites          InviteTable
 	KeyEncryptingKey *security.ManagedKey
 	SubjectKeyPair   *security.ManagedKeyPair
 	SubjectNonce     []byte
@@ -115,7 +155,7 @@ func (gs *GrantManager) Authority(
 
 func (gs *GrantManager) GrantToAccount(
 	ctx scope.Context, kms security.KMS, manager Account, managerKey *security.ManagedKey,
-	target Account) error {
+	target Account, expires time.Time) error {
 
 	subjectKeyPair, public, private, err := gs.Authority(ctx, manager, managerKey)
 	if err != nil {
@@ -129,10 +169,12 @@ func (gs *GrantManager) GrantToAccount(
 		return err
 	}
 
-	return gs.Capabilities.Save(ctx, target, c)
+	return gs.Capabilities.Save(ctx, target, c, expires)
 }
 
-func (gs *GrantManager) StaffGrantToAccount(ctx scope.Context, kms security.KMS, target Account) error {
+func (gs *GrantManager) StaffGrantToAccount(
+	ctx scope.Context, kms security.KMS, target Account, expires time.Time) error {
+
 	keyEncryptingKey := gs.KeyEncryptingKey.Clone()
 	if err := kms.DecryptKey(&keyEncryptingKey); err != nil {
 		return fmt.Errorf("key-encrypting-key decrypt error: %s", err)
@@ -160,7 +202,7 @@ func (gs *GrantManager) StaffGrantToAccount(ctx scope.Context, kms security.KMS,
 		return err
 	}
 
-	return gs.Capabilities.Save(ctx, target, c)
+	return gs.Capabilities.Save(ctx, target, c, expires)
 }
 
 func (gs *GrantManager) RevokeFromAccount(ctx scope.Context, account Account) error {
@@ -185,7 +227,8 @@ func (gs *GrantManager) AccountCapability(
 }
 
 func (gs *GrantManager) GrantToPasscode(
-	ctx scope.Context, manager Account, managerKey *security.ManagedKey, passcode string) error {
+	ctx scope.Context, manager Account, managerKey *security.ManagedKey, passcode string,
+	expires time.Time) error {
 
 	_, public, private, err := gs.Authority(ctx, manager, managerKey)
 	if err != nil {
@@ -199,7 +242,7 @@ func (gs *GrantManager) GrantToPasscode(
 		return err
 	}
 
-	return gs.Capabilities.Save(ctx, nil, c)
+	return gs.Capabilities.Save(ctx, nil, c, expires)
 }
 
 func (gs *GrantManager) RevokeFromPasscode(ctx scope.Context, passcode string) error {
@@ -222,6 +265,17 @@ func (gs *GrantManager) PasscodeCapability(
 		return nil, err
 	}
 
+	// Invite codes can only be used through RedeemInvite.
+	if gs.Invites != nil {
+		invite, err := gs.Invites.Get(ctx, cid)
+		if err != nil && err != ErrInviteNotFound {
+			return nil, err
+		}
+		if invite != nil {
+			return nil, nil
+		}
+	}
+
 	c, err := gs.Capabilities.Get(ctx, cid)
 	if err != nil {
 		if err == ErrCapabilityNotFound {
@@ -231,3 +285,205 @@ func (gs *GrantManager) PasscodeCapability(
 	}
 	return &security.SharedSecretCapability{Capability: c}, nil
 }
+
+func (gs *GrantManager) inviteID(code string) (string, error) {
+	return security.SharedSecretCapabilityID(
+		security.KeyFromPasscode([]byte(code), gs.SubjectNonce, security.AES128),
+		gs.SubjectNonce)
+}
+
+func (gs *GrantManager) GrantToInvite(
+	ctx scope.Context, manager Account, managerKey *security.ManagedKey, code string,
+	expires time.Time, maxUses int) (*Invite, error) {
+
+	if gs.Invites == nil {
+		return nil, ErrAccessDenied
+	}
+
+	if err := gs.GrantToPasscode(ctx, manager, managerKey, code, expires); err != nil {
+		return nil, err
+	}
+
+	cid, err := gs.inviteID(code)
+	if err != nil {
+		return nil, err
+	}
+
+	invite := &Invite{
+		ID:        cid,
+		CreatorID: manager.ID(),
+		Created:   Now(),
+		Expires:   Time(expires),
+		MaxUses:   maxUses,
+	}
+	if err := gs.Invites.Save(ctx, invite); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+func (gs *GrantManager) RevokeInvite(ctx scope.Context, inviteID string) error {
+	if gs.Invites == nil {
+		return ErrInviteNotFound
+	}
+	if err := gs.Invites.Remove(ctx, inviteID); err != nil {
+		return err
+	}
+	if err := gs.Capabilities.Remove(ctx, inviteID); err != nil && err != ErrCapabilityNotFound {
+		return err
+	}
+	return nil
+}
+
+func (gs *GrantManager) ListInvites(ctx scope.Context) ([]Invite, error) {
+	if gs.Invites == nil {
+		return nil, nil
+	}
+	return gs.Invites.List(ctx)
+}
+
+func (gs *GrantManager) LookupInvite(ctx scope.Context, code string) (*Invite, error) {
+	if gs.Invites == nil {
+		return nil, nil
+	}
+
+	cid, err := gs.inviteID(code)
+	if err != nil {
+		return nil, err
+	}
+
+	invite, err := gs.Invites.Get(ctx, cid)
+	if err != nil {
+		if err == ErrInviteNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return invite, nil
+}
+
+func (gs *GrantManager) RedeemInvite(
+	ctx scope.Context, kms security.KMS, code string, account Account) (
+	*security.SharedSecretCapability, error) {
+
+	if gs.Invites == nil {
+		return nil, ErrInviteNotFound
+	}
+
+	cid, err := gs.inviteID(code)
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up the capability first, so that a failed redemption doesn't
+	// count as a use.
+	c, err := gs.Capabilities.Get(ctx, cid)
+	if err != nil {
+		if err == ErrCapabilityNotFound {
+			return nil, ErrInviteNotFound
+		}
+		return nil, err
+	}
+	capability := &security.SharedSecretCapability{Capability: c}
+
+	if account == nil {
+		if _, err := gs.Invites.Redeem(ctx, cid); err != nil {
+			return nil, err
+		}
+		return capability, nil
+	}
+
+	// An account only uses up the invite the first time it redeems it.
+	existing, err := gs.AccountCapability(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return capability, nil
+	}
+
+	invite, err := gs.Invites.Redeem(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if err := gs.StaffGrantToAccount(ctx, kms, account, time.Time(invite.Expires)); err != nil {
+		return nil, err
+	}
+	return capability, nil
+}
+
+// ListGrants returns the unexpired grants issued with the key. Grants backing
+// invites are left out, since they're listed with ListInvites.
+func (gs *GrantManager) ListGrants(ctx scope.Context) ([]CapabilityGrant, error) {
+	grants, err := gs.Capabilities.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if gs.Invites == nil {
+		return grants, nil
+	}
+
+	invites, err := gs.Invites.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inviteIDs := make(map[string]struct{}, len(invites))
+	for _, invite := range invites {
+		inviteIDs[invite.ID] = struct{}{}
+	}
+
+	result := make([]CapabilityGrant, 0, len(grants))
+	for _, grant := range grants {
+		if _, ok := inviteIDs[grant.CapabilityID]; !ok {
+			result = append(result, grant)
+		}
+	}
+	return result, nil
+}
+
+// ListRoomAccess describes the accounts and passcodes that have been granted
+// access to a private room.
+func ListRoomAccess(ctx scope.Context, b Backend, room ManagedRoom) (*ListAccessReply, error) {
+	mkey, err := room.MessageKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mkey == nil {
+		return nil, fmt.Errorf("room is public")
+	}
+
+	grants, err := mkey.ListGrants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &ListAccessReply{
+		AccountGrants:  []AccountGrant{},
+		PasscodeGrants: []PasscodeGrant{},
+	}
+	for _, grant := range grants {
+		if grant.AccountID == 0 {
+			reply.PasscodeGrants = append(reply.PasscodeGrants, PasscodeGrant{
+				CapabilityID: grant.CapabilityID,
+				Granted:      Time(grant.Granted),
+				Expires:      Time(grant.Expires),
+			})
+			continue
+		}
+
+		account, err := b.AccountManager().Get(ctx, grant.AccountID)
+		if err != nil {
+			if err == ErrAccountNotFound {
+				continue
+			}
+			return nil, err
+		}
+		reply.AccountGrants = append(reply.AccountGrants, AccountGrant{
+			AccountView: *account.View(room.ID()),
+			Granted:     Time(grant.Granted),
+			Expires:     Time(grant.Expires),
+		})
+	}
+	return reply, nil
+}
@@ -3,7 +3,10 @@ package proto
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/pquerna/otp/totp"
 	"github.com/savaki/geoip2"
@@ -13,6 +16,7 @@ import (
 	"euphoria.io/heim/cluster"
 	"euphoria.io/heim/proto/emails"
 	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
 	"euphoria.io/heim/templates"
 	"euphoria.io/scope"
 )
@@ -30,6 +34,18 @@ type Heim struct {
 	EmailTemplater *templates.Templater
 	GeoIP          *geoip2.Api
 	PageTemplater  *templates.Templater
+
+	// NotificationDigestWindow is how long notifications are collected
+	// before they're emailed. Zero means DefaultNotificationDigestWindow.
+	NotificationDigestWindow time.Duration
+
+	// EmailReplyDomain is the domain of the addresses notification emails
+	// can be replied to at. If empty, replying by email is disabled.
+	EmailReplyDomain string
+
+	// EmailReplyAuthServID is the authserv-id of the Authentication-Results
+	// headers that the MTA receiving email replies adds to them.
+	EmailReplyAuthServID string
 }
 
 func (heim *Heim) MockDeliverer() emails.MockDeliverer {
@@ -39,6 +55,10 @@ func (heim *Heim) MockDeliverer() emails.MockDeliverer {
 func (heim *Heim) SendEmail(
 	ctx scope.Context, b Backend, account Account, to, templateName string, data interface{}) (*emails.EmailRef, error) {
 
+	// Prefer the account's primary email, once verified.
+	if primary, verified := account.Email(); to == "" && verified {
+		to = primary
+	}
 	if to == "" {
 		for _, pid := range account.PersonalIdentities() {
 			if pid.Namespace() == "email" {
@@ -52,7 +72,29 @@ func (heim *Heim) SendEmail(
 			}
 		}
 	}
-	return b.EmailTracker().Send(ctx, b.Jobs(), heim.EmailTemplater, heim.EmailDeliverer, account, to, templateName, data)
+
+	// Optional emails link to the account's preferences.
+	if p, ok := data.(interface {
+		linkEmailPreferences(token, templateName string)
+	}); ok && IsOptionalEmail(templateName) {
+		token, err := EmailPreferencesToken(heim.KMS, account)
+		if err != nil {
+			return nil, fmt.Errorf("email preferences token: %s", err)
+		}
+		p.linkEmailPreferences(token, templateName)
+	}
+
+	domain := "heim"
+	if heim.EmailDeliverer != nil {
+		domain = heim.EmailDeliverer.LocalName()
+	}
+	msgID, err := EmailMessageID(heim.KMS, account, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.EmailTracker().Send(
+		ctx, b.Jobs(), heim.EmailTemplater, heim.EmailDeliverer, account, msgID, to, templateName, data)
 }
 
 func (heim *Heim) OnAccountEmailChanged(
@@ -98,8 +140,26 @@ func (heim *Heim) OnAccountPasswordChanged(ctx scope.Context, b Backend, account
 	return nil
 }
 
+func (heim *Heim) OnAccountLockout(
+	ctx scope.Context, b Backend, account Account, clientAddress string, duration time.Duration) error {
+
+	params := &LoginLockoutEmailParams{
+		CommonEmailParams: DefaultCommonEmailParams,
+		AccountName:       account.Name(),
+		ClientAddress:     clientAddress,
+		LockoutDuration:   duration,
+	}
+	if _, err := heim.SendEmail(ctx, b, account, "", LoginLockoutEmail, params); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// OnAccountPasswordResetRequest sends the confirmation of a password reset
+// request to the given address, or to the account's usual address if empty.
 func (heim *Heim) OnAccountPasswordResetRequest(
-	ctx scope.Context, b Backend, account Account, req *PasswordResetRequest) error {
+	ctx scope.Context, b Backend, account Account, to string, req *PasswordResetRequest) error {
 
 	// TODO: account names
 	params := &PasswordResetEmailParams{
@@ -107,7 +167,7 @@ func (heim *Heim) OnAccountPasswordResetRequest(
 		AccountName:       account.Name(),
 		Confirmation:      req.String(),
 	}
-	if _, err := heim.SendEmail(ctx, b, account, "", PasswordResetEmail, params); err != nil {
+	if _, err := heim.SendEmail(ctx, b, account, to, PasswordResetEmail, params); err != nil {
 		return err
 	}
 
@@ -155,6 +215,53 @@ func (heim *Heim) OnAccountRegistration(
 	return nil
 }
 
+// VerifyEmail records that the account has verified it owns the email address,
+// and claims any invites sent to the address.
+func (heim *Heim) VerifyEmail(ctx scope.Context, b Backend, account Account, email string) error {
+	if err := b.AccountManager().VerifyPersonalIdentity(ctx, "email", email); err != nil {
+		return err
+	}
+	return heim.OnEmailVerified(ctx, b, account, email)
+}
+
+// OnEmailVerified should be called after an account verifies that it owns an
+// email address. It grants the account access to any rooms the address was
+// invited to. Invites are only claimed once the address is verified, since
+// anyone can register an account with any address.
+func (heim *Heim) OnEmailVerified(ctx scope.Context, b Backend, account Account, email string) error {
+	invites, err := b.PendingInvites().Claim(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	for _, invite := range invites {
+		room, err := b.GetRoom(ctx, invite.Room)
+		if err != nil {
+			if err == ErrRoomNotFound {
+				continue
+			}
+			return err
+		}
+
+		mkey, err := room.MessageKey(ctx)
+		if err != nil {
+			return err
+		}
+		if mkey == nil {
+			// The room is no longer private, so there's nothing to grant.
+			continue
+		}
+
+		// The manager who sent the invite isn't around to unlock the grant, so
+		// it has to be issued with the server's authority.
+		if err := mkey.StaffGrantToAccount(ctx, heim.KMS, account, time.Time{}); err != nil {
+			return fmt.Errorf("pending invite grant error: %s", err)
+		}
+	}
+
+	return nil
+}
+
 func (heim *Heim) NewOTP(account Account) (*OTP, error) {
 	name := ""
 	for _, ident := range account.PersonalIdentities() {
@@ -199,3 +306,66 @@ func CheckEmailVerificationToken(kms security.KMS, account Account, email string
 
 	return nil
 }
+
+// EmailPreferencesToken returns a token granting access to an account's email
+// preferences, for use in links from emails.
+func EmailPreferencesToken(kms security.KMS, account Account) (string, error) {
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return "", err
+	}
+
+	mac, err := emailPreferencesMAC(&systemKey, account.ID())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", account.ID(), hex.EncodeToString(mac)), nil
+}
+
+// ResolveEmailPreferencesToken returns the account an email preferences token
+// was issued for.
+func ResolveEmailPreferencesToken(ctx scope.Context, kms security.KMS, b Backend, token string) (Account, error) {
+	parts := strings.SplitN(token, "-", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidEmailPreferencesToken
+	}
+	var accountID snowflake.Snowflake
+	if err := accountID.FromString(parts[0]); err != nil {
+		return nil, ErrInvalidEmailPreferencesToken
+	}
+	mac, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidEmailPreferencesToken
+	}
+
+	account, err := b.AccountManager().Get(ctx, accountID)
+	if err != nil {
+		if err == ErrAccountNotFound {
+			return nil, ErrInvalidEmailPreferencesToken
+		}
+		return nil, err
+	}
+
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return nil, err
+	}
+	expected, err := emailPreferencesMAC(&systemKey, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, expected) {
+		return nil, ErrInvalidEmailPreferencesToken
+	}
+	return account, nil
+}
+
+func emailPreferencesMAC(key *security.ManagedKey, accountID snowflake.Snowflake) ([]byte, error) {
+	if key.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+
+	mac := hmac.New(sha256.New, key.Plaintext)
+	mac.Write([]byte("email-preferences:" + accountID.String()))
+	return mac.Sum(nil), nil
+}
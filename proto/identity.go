@@ -49,10 +49,11 @@ type Identity interface {
 }
 
 type IdentityView struct {
-	ID        UserID `json:"id"`         // the id of an agent or account
-	Name      string `json:"name"`       // the name-in-use at the time this view was captured
-	ServerID  string `json:"server_id"`  // the id of the server that captured this view
-	ServerEra string `json:"server_era"` // the era of the server that captured this view
+	ID        UserID `json:"id"`                 // the id of an agent or account
+	Name      string `json:"name"`               // the name-in-use at the time this view was captured
+	ServerID  string `json:"server_id"`          // the id of the server that captured this view
+	ServerEra string `json:"server_era"`         // the era of the server that captured this view
+	Verified  bool   `json:"verified,omitempty"` // if true, the name in use is reserved by this identity's account
 }
 
 // LoadEmoji takes a json key-value object stored in the file at path and
@@ -0,0 +1,120 @@
+package proto
+
+import (
+	"encoding/hex"
+	"time"
+
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+const InviteCodeSize = 16
+
+// An Invite is a usage-limited, optionally expiring grant of access to a
+// private room. Each invite is backed by a passcode capability on the room's
+// current message key. The code handed out to users is the passcode, and is
+// never stored; the invite's ID is the ID of the capability.
+type Invite struct {
+	ID        string              `json:"id"`         // the id of the invite
+	CreatorID snowflake.Snowflake `json:"creator_id"` // the id of the account that created the invite
+	Created   Time                `json:"created"`    // the time the invite was created
+	Expires   Time                `json:"expires"`    // the time the invite expires, or null if it never expires
+	MaxUses   int                 `json:"max_uses"`   // the number of times the invite may be redeemed, or 0 if unlimited
+	Uses      int                 `json:"uses"`       // the number of times the invite has been redeemed
+}
+
+// Check returns an error if the invite can no longer be redeemed.
+func (i *Invite) Check(now time.Time) error {
+	if expires := time.Time(i.Expires); !expires.IsZero() && !now.Before(expires) {
+		return ErrInviteExpired
+	}
+	if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+		return ErrInviteExhausted
+	}
+	return nil
+}
+
+// GenerateInviteCode returns a new random invite code.
+func GenerateInviteCode(kms security.KMS) (string, error) {
+	code, err := kms.GenerateNonce(InviteCodeSize)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(code), nil
+}
+
+type InviteTable interface {
+	Get(ctx scope.Context, inviteID string) (*Invite, error)
+	List(ctx scope.Context) ([]Invite, error)
+	Save(ctx scope.Context, invite *Invite) error
+	Remove(ctx scope.Context, inviteID string) error
+
+	// Redeem verifies that the invite may still be used and atomically
+	// counts one use against it.
+	Redeem(ctx scope.Context, inviteID string) (*Invite, error)
+}
+
+type InviteGrantable interface {
+	// GrantToInvite creates a capability for the given invite code. A zero
+	// value for expires indicates the invite never expires, and a zero value
+	// for maxUses indicates it may be redeemed any number of times.
+	GrantToInvite(
+		ctx scope.Context, manager Account, managerClientKey *security.ManagedKey, code string,
+		expires time.Time, maxUses int) (*Invite, error)
+
+	// RevokeInvite removes an invite and its capability.
+	RevokeInvite(ctx scope.Context, inviteID string) error
+
+	// ListInvites returns all invites that have been issued against the key.
+	ListInvites(ctx scope.Context) ([]Invite, error)
+
+	// LookupInvite returns the invite for the given code, or nil if there is
+	// none. It does not count as a use of the invite.
+	LookupInvite(ctx scope.Context, code string) (*Invite, error)
+
+	// RedeemInvite counts one use against the invite for the given code and
+	// returns its capability. If an account is given, it's also granted
+	// access until the invite expires, and redeeming the invite again once
+	// it has access doesn't count as another use.
+	RedeemInvite(
+		ctx scope.Context, kms security.KMS, code string, account Account) (
+		*security.SharedSecretCapability, error)
+}
+
+// DefaultPendingInviteLifetime is how long an email invitation to an
+// unregistered address lasts, unless the sender chooses otherwise.
+const DefaultPendingInviteLifetime = 30 * 24 * time.Hour
+
+// A PendingInvite is an invitation to a private room that was sent to an
+// email address with no account registered to it. Access to the room is
+// granted once an account has verified ownership of the address, unless the
+// invite has expired by then.
+type PendingInvite struct {
+	Room      string              `json:"room"`       // the room the address was invited to
+	Email     string              `json:"email"`      // the address that was invited
+	CreatorID snowflake.Snowflake `json:"creator_id"` // the id of the account that sent the invite
+	Created   Time                `json:"created"`    // the time the invite was sent
+	Expires   Time                `json:"expires"`    // the time the invite expires
+}
+
+// Expired returns true if the invite can no longer be claimed.
+func (pi *PendingInvite) Expired(now time.Time) bool { return !now.Before(time.Time(pi.Expires)) }
+
+type PendingInviteTracker interface {
+	// Add records a pending invite. Inviting the same address to the same
+	// room again replaces the earlier invite.
+	Add(ctx scope.Context, invite *PendingInvite) error
+
+	// List returns the unexpired pending invites to the given room, oldest
+	// first.
+	List(ctx scope.Context, room string) ([]*PendingInvite, error)
+
+	// Remove revokes the pending invite of the given address to the given
+	// room. If there's no such invite, returns ErrInviteNotFound.
+	Remove(ctx scope.Context, room, email string) error
+
+	// Claim removes all pending invites sent to the given address, and
+	// returns those that haven't expired.
+	Claim(ctx scope.Context, email string) ([]*PendingInvite, error)
+}
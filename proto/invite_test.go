@@ -0,0 +1,30 @@
+package proto
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInviteCheck(t *testing.T) {
+	now := time.Now()
+
+	Convey("Unlimited invites never lapse", t, func() {
+		invite := &Invite{Uses: 1000}
+		So(invite.Check(now), ShouldBeNil)
+	})
+
+	Convey("Invites expire", t, func() {
+		invite := &Invite{Expires: Time(now.Add(time.Minute))}
+		So(invite.Check(now), ShouldBeNil)
+		So(invite.Check(now.Add(time.Minute)), ShouldEqual, ErrInviteExpired)
+	})
+
+	Convey("Invites are used up", t, func() {
+		invite := &Invite{MaxUses: 2, Uses: 1}
+		So(invite.Check(now), ShouldBeNil)
+		invite.Uses++
+		So(invite.Check(now), ShouldEqual, ErrInviteExhausted)
+	})
+}
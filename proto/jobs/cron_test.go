@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		So(err, ShouldBeNil)
+		return t
+	}
+
+	next := func(expr, from string) string {
+		schedule, err := ParseSchedule(expr)
+		So(err, ShouldBeNil)
+		t := schedule.Next(at(from))
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04")
+	}
+
+	Convey("Every minute", t, func() {
+		So(next("* * * * *", "2018-01-01 00:00"), ShouldEqual, "2018-01-01 00:01")
+		So(next("* * * * *", "2018-12-31 23:59"), ShouldEqual, "2019-01-01 00:00")
+	})
+
+	Convey("Ticks are strictly after the given time", t, func() {
+		So(next("30 * * * *", "2018-01-01 00:30"), ShouldEqual, "2018-01-01 01:30")
+		schedule, err := ParseSchedule("* * * * *")
+		So(err, ShouldBeNil)
+		So(schedule.Next(at("2018-01-01 00:00").Add(30*time.Second)), ShouldResemble, at("2018-01-01 00:01"))
+	})
+
+	Convey("Lists, ranges, and steps", t, func() {
+		So(next("*/15 * * * *", "2018-01-01 00:16"), ShouldEqual, "2018-01-01 00:30")
+		So(next("5,10 * * * *", "2018-01-01 00:06"), ShouldEqual, "2018-01-01 00:10")
+		So(next("0 9-17/4 * * *", "2018-01-01 13:00"), ShouldEqual, "2018-01-01 17:00")
+		So(next("50/5 * * * *", "2018-01-01 00:56"), ShouldEqual, "2018-01-01 01:50")
+	})
+
+	Convey("Days of the month and week", t, func() {
+		// 2018-01-01 was a Monday.
+		So(next("0 0 * * 0", "2018-01-01 00:00"), ShouldEqual, "2018-01-07 00:00")
+		So(next("0 0 * * 7", "2018-01-01 00:00"), ShouldEqual, "2018-01-07 00:00")
+		So(next("0 0 31 * *", "2018-02-01 00:00"), ShouldEqual, "2018-03-31 00:00")
+		So(next("0 0 29 2 *", "2018-01-01 00:00"), ShouldEqual, "2020-02-29 00:00")
+
+		// Either restriction matches when both are given.
+		So(next("0 0 15 * 3", "2018-01-01 00:00"), ShouldEqual, "2018-01-03 00:00")
+		So(next("0 0 2 * 3", "2018-01-01 00:00"), ShouldEqual, "2018-01-02 00:00")
+	})
+
+	Convey("Macros", t, func() {
+		So(next("@hourly", "2018-01-01 00:01"), ShouldEqual, "2018-01-01 01:00")
+		So(next("@daily", "2018-01-01 00:01"), ShouldEqual, "2018-01-02 00:00")
+		So(next("@monthly", "2018-01-01 00:01"), ShouldEqual, "2018-02-01 00:00")
+		So(next("@yearly", "2018-01-01 00:01"), ShouldEqual, "2019-01-01 00:00")
+	})
+
+	Convey("Impossible schedules never tick", t, func() {
+		So(next("0 0 30 2 *", "2018-01-01 00:00"), ShouldEqual, "")
+	})
+
+	Convey("Invalid expressions", t, func() {
+		for _, expr := range []string{
+			"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+			"* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@weekdays",
+		} {
+			_, err := ParseSchedule(expr)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
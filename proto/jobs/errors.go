@@ -4,6 +4,7 @@ import "fmt"
 
 var (
 	ErrInvalidJobType        = fmt.Errorf("invalid job type")
+	ErrJobAlreadyScheduled   = fmt.Errorf("job already scheduled")
 	ErrJobCancelled          = fmt.Errorf("job cancelled")
 	ErrJobCanceled           = ErrJobCancelled
 	ErrJobNotFound           = fmt.Errorf("job not found")
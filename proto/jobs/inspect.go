@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"fmt"
+	"io"
+
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+// Inspect writes a description of a job, followed by the log of each of its
+// attempts, to w.
+func Inspect(ctx scope.Context, jq JobQueue, jobID snowflake.Snowflake, w io.Writer) error {
+	job, err := jq.Get(ctx, jobID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Job %s (%s) in %s:\n", job.ID, job.Type, jq.Name())
+	fmt.Fprintf(w, "  created %s, due %s\n", job.Created, job.Due)
+	fmt.Fprintf(w, "  priority %d, %d attempts made, %d remaining\n",
+		job.Priority, job.AttemptsMade, job.AttemptsRemaining)
+	if !job.DeadLettered.IsZero() {
+		fmt.Fprintf(w, "  dead since %s: %s\n", job.DeadLettered, job.FailureReason)
+	}
+	fmt.Fprintf(w, "  payload: %s\n", job.Data)
+
+	for attempt := int32(0); attempt <= job.AttemptsMade; attempt++ {
+		jl, err := jq.Log(ctx, job.ID, attempt)
+		if err != nil {
+			if err == ErrJobNotFound {
+				continue
+			}
+			return err
+		}
+		outcome := "succeeded"
+		if !jl.Success {
+			outcome = "failed: " + jl.FailureReason
+		}
+		fmt.Fprintf(w, "Attempt %d by %s %s\n", jl.AttemptNumber, jl.HandlerID, outcome)
+		if len(jl.Log) > 0 {
+			w.Write(jl.Log)
+			if jl.Log[len(jl.Log)-1] != '\n' {
+				fmt.Fprintln(w)
+			}
+		}
+	}
+	return nil
+}
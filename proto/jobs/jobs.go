@@ -16,13 +16,24 @@ import (
 const (
 	DefaultMaxWorkDuration = time.Minute
 
-	EmailQueue = "emails"
+	AccountDeletionQueue    = "account-deletions"
+	AccountDataExportQueue  = "account-data-exports"
+	EmailQueue              = "emails"
+	NotificationDigestQueue = "notification-digests"
+
+	GrantExpiryQueue      = "grant-expiry"
+	MessageRetentionQueue = "message-retention"
+	StatsAnalysisQueue    = "stats-analysis"
 )
 
 type JobType string
 
 var (
-	BackoffDuration = 5 * time.Second
+	// BackoffDuration is how long a failed job waits before it can be
+	// claimed again, unless it was added with its own JobOptions.Backoff.
+	// The wait doubles with each failed attempt, up to MaxBackoffDuration.
+	BackoffDuration    = 5 * time.Second
+	MaxBackoffDuration = time.Hour
 
 	EmailJobType    = JobType("email")
 	EmailJobOptions = []JobOption{
@@ -30,18 +41,109 @@ var (
 		JobOptions.MaxWorkDuration(30 * time.Second),
 	}
 
+	AccountDeletionJobType   = JobType("account-deletion")
+	AccountDataExportJobType = JobType("account-data-export")
+	AccountDataJobOptions    = []JobOption{
+		JobOptions.MaxAttempts(5),
+		JobOptions.MaxWorkDuration(5 * time.Minute),
+	}
+
+	NotificationDigestJobType    = JobType("notification-digest")
+	NotificationDigestJobOptions = []JobOption{
+		JobOptions.MaxAttempts(3),
+		JobOptions.MaxWorkDuration(time.Minute),
+	}
+
+	GrantExpiryJobType      = JobType("grant-expiry")
+	MessageRetentionJobType = JobType("message-retention")
+	StatsAnalysisJobType    = JobType("stats-analysis")
+
+	// Scans are retried at the next tick of their schedule instead.
+	ScanJobOptions = []JobOption{
+		JobOptions.MaxAttempts(1),
+		JobOptions.MaxWorkDuration(5 * time.Minute),
+	}
+
+	// RecurringJobs are enqueued by the scheduler of each worker that
+	// processes their queue.
+	RecurringJobs = []*RecurringJob{
+		{
+			Name:     "grant-expiry",
+			Schedule: "* * * * *",
+			Queue:    GrantExpiryQueue,
+			Type:     GrantExpiryJobType,
+			Payload:  &GrantExpiryJob{},
+			Options:  ScanJobOptions,
+		},
+		{
+			Name:     "message-retention",
+			Schedule: "* * * * *",
+			Queue:    MessageRetentionQueue,
+			Type:     MessageRetentionJobType,
+			Payload:  &MessageRetentionJob{},
+			Options:  ScanJobOptions,
+		},
+		{
+			Name:     "stats-analysis",
+			Schedule: "*/10 * * * *",
+			Queue:    StatsAnalysisQueue,
+			Type:     StatsAnalysisJobType,
+			Payload:  &StatsAnalysisJob{},
+			Options:  ScanJobOptions,
+		},
+	}
+
 	jobPayloadMap = map[JobType]reflect.Type{
-		EmailJobType: reflect.TypeOf(EmailJob{}),
+		AccountDeletionJobType:    reflect.TypeOf(AccountDeletionJob{}),
+		AccountDataExportJobType:  reflect.TypeOf(AccountDataExportJob{}),
+		EmailJobType:              reflect.TypeOf(EmailJob{}),
+		GrantExpiryJobType:        reflect.TypeOf(GrantExpiryJob{}),
+		MessageRetentionJobType:   reflect.TypeOf(MessageRetentionJob{}),
+		NotificationDigestJobType: reflect.TypeOf(NotificationDigestJob{}),
+		StatsAnalysisJobType:      reflect.TypeOf(StatsAnalysisJob{}),
 	}
 )
 
+// An AccountDeletionJob removes an account and anonymizes its messages.
+type AccountDeletionJob struct {
+	AccountID snowflake.Snowflake
+}
+
+// An AccountDataExportJob collects the personal data held about an account
+// into an archive, and emails its owner a link to download it.
+type AccountDataExportJob struct {
+	AccountID snowflake.Snowflake
+}
+
+// A NotificationDigestJob emails an account the notifications collected for
+// it while it was offline.
+type NotificationDigestJob struct {
+	AccountID snowflake.Snowflake
+}
+
 type EmailJob struct {
 	AccountID snowflake.Snowflake
 	EmailID   string
 }
 
+// A GrantExpiryJob revokes access and manager grants that have expired.
+type GrantExpiryJob struct{}
+
+// A MessageRetentionJob deletes messages older than their room's retention
+// period allows.
+type MessageRetentionJob struct{}
+
+// A StatsAnalysisJob analyzes recent activity to fill in the stats tables.
+type StatsAnalysisJob struct{}
+
 type JobService interface {
 	GetQueue(ctx scope.Context, name string) (JobQueue, error)
+
+	// AddRecurring enqueues the job defined by a recurring job for the given
+	// tick of its schedule, due at that tick. If the recurring job has
+	// already been enqueued for this tick or a later one, by any process in
+	// the cluster, returns ErrJobAlreadyScheduled.
+	AddRecurring(ctx scope.Context, rj *RecurringJob, tick time.Time) (snowflake.Snowflake, error)
 }
 
 type JobQueue interface {
@@ -50,7 +152,8 @@ type JobQueue interface {
 
 	// Add enqueues a new job, as defined by the given type/payload.
 	// If any callers waiting in WaitForJob (not just in the local
-	// process), at least one should be woken.
+	// process), at least one should be woken. A job added with the
+	// RunAt or Delay option can't be claimed until that time.
 	Add(ctx scope.Context, jobType JobType, payload interface{}, options ...JobOption) (
 		snowflake.Snowflake, error)
 
@@ -60,12 +163,14 @@ type JobQueue interface {
 		ctx scope.Context, jobType JobType, payload interface{}, handlerID string, options ...JobOption) (*Job, error)
 
 	// WaitForJob blocks until notification of a new claimable job
-	// in the queue. This does not guarantee that a job will be
+	// in the queue, or until the next delayed job in the queue
+	// becomes claimable. This does not guarantee that a job will be
 	// immediately claimable.
 	WaitForJob(ctx scope.Context) error
 
-	// TryClaim tries to acquire a currently unclaimed job. If none is
-	// available, returns ErrJobNotFound.
+	// TryClaim tries to acquire a currently unclaimed job whose RunAt
+	// time has passed, preferring jobs of higher Priority, then those
+	// due soonest. If none is available, returns ErrJobNotFound.
 	TryClaim(ctx scope.Context, handlerID string) (*Job, error)
 
 	// TrySteal attempts to preempt another handler's claim. Only jobs
@@ -93,8 +198,9 @@ type JobQueue interface {
 
 	// Fail marks a job as failed and releases the claim on it.
 	// If the job has not been stolen and still has attempts
-	// remaining, it will return to the queue and be immediately
-	// up for claim again.
+	// remaining, it will return to the queue and be up for claim
+	// again once its retry backoff has passed. If this was its final
+	// attempt, the job becomes dead, keeping the reason it failed.
 	Fail(ctx scope.Context, jobID snowflake.Snowflake, handlerID string, attemptNumber int32, reason string, log []byte) error
 
 	// Stats returns information about the number of jobs in the queue.
@@ -102,6 +208,25 @@ type JobQueue interface {
 
 	// Log returns the output of a given job attempt.
 	Log(ctx scope.Context, jobID snowflake.Snowflake, attemptNumber int32) (*JobLog, error)
+
+	// Get returns a job that hasn't been completed or cancelled, whether
+	// it's waiting, claimed, or dead. If there's no such job in the queue,
+	// returns ErrJobNotFound.
+	Get(ctx scope.Context, jobID snowflake.Snowflake) (*Job, error)
+
+	// DeadLetters returns up to n jobs that failed their final attempt,
+	// most recently failed first. Dead jobs stay in the queue, unclaimable,
+	// until they're requeued or purged.
+	DeadLetters(ctx scope.Context, n int) ([]*Job, error)
+
+	// Requeue returns a dead job to the queue with the given number of
+	// attempts, claimable immediately. Its attempt count and logs are reset.
+	// If the job isn't dead, returns ErrJobNotFound.
+	Requeue(ctx scope.Context, jobID snowflake.Snowflake, attempts int32) error
+
+	// Purge removes a dead job from the queue for good. Its logs are kept.
+	// If the job isn't dead, returns ErrJobNotFound.
+	Purge(ctx scope.Context, jobID snowflake.Snowflake) error
 }
 
 type JobOption interface {
@@ -139,12 +264,59 @@ func (JobOptionConstructor) MaxWorkDuration(d time.Duration) JobMaxWorkDuration
 
 func (JobOptionConstructor) Due(t time.Time) JobDue { return JobDue(t) }
 
+// JobRunAt keeps a job from being claimed before the given time. A job
+// that would otherwise be due sooner becomes due then instead.
+type JobRunAt time.Time
+
+func (t JobRunAt) Apply(job *Job) error {
+	job.RunAt = time.Time(t)
+	if job.Due.Before(job.RunAt) {
+		job.Due = job.RunAt
+	}
+	return nil
+}
+
+// JobDelay keeps a job from being claimed until the given duration after
+// it's added.
+type JobDelay time.Duration
+
+func (d JobDelay) Apply(job *Job) error {
+	return JobRunAt(job.Created.Add(time.Duration(d))).Apply(job)
+}
+
+// JobBackoff sets how long a job waits to be retried after its first failed
+// attempt. The wait doubles with each further failure.
+type JobBackoff time.Duration
+
+func (d JobBackoff) Apply(job *Job) error {
+	job.Backoff = time.Duration(d)
+	return nil
+}
+
+// JobPriority sets a job's priority. Jobs of higher priority are claimed
+// before any job of lower priority, regardless of when they're due.
+type JobPriority int32
+
+func (p JobPriority) Apply(job *Job) error {
+	job.Priority = int32(p)
+	return nil
+}
+
+func (JobOptionConstructor) RunAt(t time.Time) JobRunAt { return JobRunAt(t) }
+
+func (JobOptionConstructor) Delay(d time.Duration) JobDelay { return JobDelay(d) }
+
+func (JobOptionConstructor) Backoff(d time.Duration) JobBackoff { return JobBackoff(d) }
+
+func (JobOptionConstructor) Priority(p int32) JobPriority { return JobPriority(p) }
+
 var JobOptions JobOptionConstructor
 
 type JobQueueStats struct {
 	Waiting int64 // number of jobs waiting to be claimed
 	Due     int64 // number of jobs that are due (whether claimed or waiting)
 	Claimed int64 // number of jobs currently claimed
+	Dead    int64 // number of jobs that failed their final attempt
 }
 
 type Job struct {
@@ -153,10 +325,18 @@ type Job struct {
 	Data              json.RawMessage
 	Created           time.Time
 	Due               time.Time
+	RunAt             time.Time
 	MaxWorkDuration   time.Duration
+	Backoff           time.Duration
+	Priority          int32
 	AttemptsMade      int32
 	AttemptsRemaining int32
 
+	// DeadLettered is when the job failed its final attempt, and
+	// FailureReason why. DeadLettered is zero unless the job is dead.
+	DeadLettered  time.Time
+	FailureReason string
+
 	*JobClaim
 }
 
@@ -176,6 +356,20 @@ func (j *Job) Payload() (interface{}, error) {
 
 func (j *Job) Encode() ([]byte, error) { return json.Marshal(j) }
 
+// RetryBackoff returns how long a job that failed the given attempt (counting
+// from zero) should wait before it's retried, starting from the given backoff
+// and doubling with each attempt, up to MaxBackoffDuration.
+func RetryBackoff(backoff time.Duration, attempt int32) time.Duration {
+	delay := backoff
+	for i := int32(0); i < attempt && delay < MaxBackoffDuration; i++ {
+		delay *= 2
+	}
+	if delay > MaxBackoffDuration {
+		delay = MaxBackoffDuration
+	}
+	return delay
+}
+
 func (j *Job) Exec(ctx scope.Context, f func(scope.Context) error) error {
 	if j.JobClaim == nil {
 		return ErrJobNotClaimed
@@ -183,17 +377,9 @@ func (j *Job) Exec(ctx scope.Context, f func(scope.Context) error) error {
 
 	w := io.MultiWriter(os.Stdout, j)
 	prefix := fmt.Sprintf("[%s-%s] ", j.Queue.Name(), j.HandlerID)
-	deadline := time.Now().Add(j.MaxWorkDuration)
 	child := logging.LoggingContext(ctx.ForkWithTimeout(j.MaxWorkDuration), w, prefix)
 	if err := f(child); err != nil {
 		logging.Logger(child).Printf("error: %s", err)
-		if err != scope.TimedOut {
-			delay := time.Duration(j.AttemptsMade+1) * BackoffDuration
-			if time.Now().Add(delay).After(deadline) {
-				delay = deadline.Sub(time.Now())
-			}
-			time.Sleep(delay)
-		}
 		return j.Fail(ctx, err.Error())
 	}
 	return j.Complete(ctx)
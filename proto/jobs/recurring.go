@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/scope"
+)
+
+// A RecurringJob is a job that's enqueued at every tick of a cron schedule.
+type RecurringJob struct {
+	// Name identifies the recurring job across the cluster, so that each
+	// tick is only enqueued once.
+	Name string
+
+	// Schedule is a cron expression, as accepted by ParseSchedule. Ticks
+	// are computed in UTC.
+	Schedule string
+
+	Queue   string
+	Type    JobType
+	Payload interface{}
+	Options []JobOption
+}
+
+// RunScheduler enqueues each of the given recurring jobs at every tick of its
+// schedule, until ctx is cancelled. Any number of schedulers may run across
+// the cluster; each tick is enqueued by only one of them. Ticks missed while
+// no scheduler is running are skipped.
+func RunScheduler(ctx scope.Context, js JobService, recurring []*RecurringJob) error {
+	schedules := make([]*Schedule, len(recurring))
+	next := make([]time.Time, len(recurring))
+	now := time.Now().UTC()
+	for i, rj := range recurring {
+		schedule, err := ParseSchedule(rj.Schedule)
+		if err != nil {
+			return fmt.Errorf("%s: %s", rj.Name, err)
+		}
+		schedules[i] = schedule
+		next[i] = schedule.Next(now)
+	}
+
+	logger := logging.Logger(ctx)
+	for {
+		var tick time.Time
+		for _, t := range next {
+			if !t.IsZero() && (tick.IsZero() || t.Before(tick)) {
+				tick = t
+			}
+		}
+		if tick.IsZero() {
+			<-ctx.Done()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tick.Sub(time.Now())):
+		}
+
+		for i, rj := range recurring {
+			if !next[i].Equal(tick) {
+				continue
+			}
+			next[i] = schedules[i].Next(tick)
+			jobID, err := js.AddRecurring(ctx, rj, tick)
+			switch err {
+			case nil:
+				logger.Printf("scheduled %s for %s: job %s", rj.Name, tick, jobID)
+			case ErrJobAlreadyScheduled:
+			default:
+				logger.Printf("error: scheduling %s for %s: %s", rj.Name, tick, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package proto
+
+import (
+	"time"
+
+	"euphoria.io/scope"
+)
+
+// LoginFailures counts the recent failed login attempts against a key, which
+// names either an account or a client address.
+type LoginFailures struct {
+	Key         string
+	Count       int
+	LastFailure time.Time
+}
+
+type LoginAttemptTracker interface {
+	// Attempt counts an attempt against the given key as a failure, before
+	// its outcome is known, and returns the failures recorded before it. The
+	// attempt is counted and the record read atomically, so that concurrent
+	// attempts can't all be judged against the same record. If the last
+	// failure is older than window, the count starts over.
+	Attempt(ctx scope.Context, key string, window time.Duration) (*LoginFailures, error)
+
+	// Forgive takes back one attempt counted against the given key, after it
+	// turned out not to be a failure.
+	Forgive(ctx scope.Context, key string) error
+
+	// Reset forgets the failures recorded against the given key.
+	Reset(ctx scope.Context, key string) error
+}
+
+// A LoginThrottle is a policy for slowing down repeated failed attempts to
+// log in or register. After a few free failures, each further failure doubles
+// the wait before the next attempt is accepted, until enough failures add up
+// to a lockout. The wait is capped below the window, so that failures keep
+// adding up instead of being forgotten before a lockout is reached.
+type LoginThrottle struct {
+	FreeFailures    int           // failures allowed before backing off
+	LockoutFailures int           // failures that trigger a lockout
+	LockoutDuration time.Duration // how long a lockout lasts
+	MaxBackoff      time.Duration // the longest wait before a lockout; if zero or not shorter than Window, half of Window
+	Window          time.Duration // failures older than this are forgotten
+}
+
+var (
+	// AccountLoginThrottle applies to failed logins to a single account.
+	AccountLoginThrottle = LoginThrottle{
+		FreeFailures:    3,
+		LockoutFailures: 10,
+		LockoutDuration: 15 * time.Minute,
+		MaxBackoff:      5 * time.Minute,
+		Window:          time.Hour,
+	}
+
+	// ClientLoginThrottle applies to failed logins and registrations from a
+	// single client address, across accounts. It's more forgiving, because
+	// many users may share an address.
+	ClientLoginThrottle = LoginThrottle{
+		FreeFailures:    10,
+		LockoutFailures: 50,
+		LockoutDuration: time.Hour,
+		MaxBackoff:      5 * time.Minute,
+		Window:          time.Hour,
+	}
+)
+
+// RetryAfter returns the time before which another attempt should be refused,
+// given the recorded failures. A zero time means an attempt may be made now.
+func (t LoginThrottle) RetryAfter(f *LoginFailures) time.Time {
+	switch {
+	case f.Count == 0 || time.Now().Sub(f.LastFailure) > t.Window:
+		return time.Time{}
+	case f.Count >= t.LockoutFailures:
+		return f.LastFailure.Add(t.LockoutDuration)
+	case f.Count > t.FreeFailures:
+		return f.LastFailure.Add(t.backoff(f.Count - t.FreeFailures))
+	default:
+		return time.Time{}
+	}
+}
+
+func (t LoginThrottle) backoff(n int) time.Duration {
+	max := t.MaxBackoff
+	if max <= 0 || max >= t.Window {
+		max = t.Window / 2
+	}
+	// Stop doubling well before the shift could overflow.
+	if n > 30 {
+		return max
+	}
+	if d := time.Second << uint(n); d < max {
+		return d
+	}
+	return max
+}
+
+// LockedOut returns true if the given failure record has just reached a
+// lockout, so that the owner can be notified once.
+func (t LoginThrottle) LockedOut(f *LoginFailures) bool { return f.Count == t.LockoutFailures }
+
+// AccountLoginKey returns the key under which failed logins to the given
+// account are counted.
+func AccountLoginKey(account Account) string { return "account:" + account.ID().String() }
+
+// ClientLoginKey returns the key under which failed attempts from the given
+// client address are counted.
+func ClientLoginKey(ip string) string { return "ip:" + ip }
@@ -0,0 +1,65 @@
+package proto
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	throttle := LoginThrottle{
+		FreeFailures:    2,
+		LockoutFailures: 5,
+		LockoutDuration: time.Hour,
+		MaxBackoff:      3 * time.Second,
+		Window:          time.Hour,
+	}
+	now := time.Now()
+	retryAfter := func(count int, lastFailure time.Time) time.Duration {
+		t := throttle.RetryAfter(&LoginFailures{Count: count, LastFailure: lastFailure})
+		if t.IsZero() {
+			return 0
+		}
+		return t.Sub(lastFailure)
+	}
+
+	Convey("Free failures don't delay the next attempt", t, func() {
+		So(retryAfter(0, time.Time{}), ShouldEqual, 0)
+		So(retryAfter(1, now), ShouldEqual, 0)
+		So(retryAfter(2, now), ShouldEqual, 0)
+	})
+
+	Convey("Further failures back off exponentially", t, func() {
+		So(retryAfter(3, now), ShouldEqual, 2*time.Second)
+		So(retryAfter(4, now), ShouldEqual, 3*time.Second)
+	})
+
+	Convey("Backoff stays within the window", t, func() {
+		uncapped := LoginThrottle{FreeFailures: 1, LockoutFailures: 1000, Window: time.Hour}
+		for count := 2; count < 1000; count++ {
+			wait := uncapped.RetryAfter(&LoginFailures{Count: count, LastFailure: now}).Sub(now)
+			So(wait, ShouldBeGreaterThan, 0)
+			So(wait, ShouldBeLessThanOrEqualTo, 30*time.Minute)
+		}
+
+		// The default client throttle must be able to reach its lockout.
+		ct := ClientLoginThrottle
+		for count := ct.FreeFailures + 1; count < ct.LockoutFailures; count++ {
+			wait := ct.RetryAfter(&LoginFailures{Count: count, LastFailure: now}).Sub(now)
+			So(wait, ShouldBeLessThan, ct.Window)
+		}
+	})
+
+	Convey("Enough failures lock out", t, func() {
+		So(retryAfter(5, now), ShouldEqual, time.Hour)
+		So(retryAfter(6, now), ShouldEqual, time.Hour)
+		So(throttle.LockedOut(&LoginFailures{Count: 4}), ShouldBeFalse)
+		So(throttle.LockedOut(&LoginFailures{Count: 5}), ShouldBeTrue)
+		So(throttle.LockedOut(&LoginFailures{Count: 6}), ShouldBeFalse)
+	})
+
+	Convey("Failures outside the window are forgotten", t, func() {
+		So(retryAfter(5, now.Add(-2*time.Hour)), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"strings"
+	"unicode"
+
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxReservedNicks is the number of nicks a single account may reserve.
+const MaxReservedNicks = 3
+
+// ReservedNickKey returns the key under which a nick, as normalized by
+// NormalizeNick, is reserved. Nicks that look alike mention the same user, so
+// they share a reservation. The key folds away differences in case,
+// whitespace, punctuation, accents, and compatibility forms (NFKC), and maps
+// Greek and Cyrillic letters to the Latin letters they resemble.
+func ReservedNickKey(nick string) string {
+	folded := strings.ToLower(norm.NFKC.String(nick))
+	key := make([]rune, 0, len(folded))
+	for _, r := range norm.NFD.String(folded) {
+		if c, ok := nickConfusables[r]; ok {
+			r = c
+		}
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			key = append(key, r)
+		}
+	}
+	if len(key) == 0 {
+		// Nicks made only of symbols are compared as they are.
+		return strings.Join(strings.Fields(folded), "")
+	}
+	return string(key)
+}
+
+// nickConfusables maps lowercase letters to the Latin letters they are
+// easily mistaken for.
+var nickConfusables = map[rune]rune{
+	// Greek
+	'α': 'a', 'β': 'b', 'γ': 'y', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k',
+	'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ϲ': 'c',
+	'ϳ': 'j',
+
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'н': 'h', 'і': 'i',
+	'ј': 'j', 'к': 'k', 'ӏ': 'l', 'м': 'm', 'о': 'o', 'р': 'p', 'ԛ': 'q',
+	'ѕ': 's', 'т': 't', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'с': 'c',
+
+	// Latin
+	'ı': 'i', 'ɡ': 'g',
+}
+
+// A NickReservationTracker keeps track of the nicks reserved by accounts.
+// A reserved nick may only be used by sessions logged into the account that
+// holds it.
+type NickReservationTracker interface {
+	// Reserve reserves a normalized nick for an account. It returns
+	// ErrNickReserved if another account holds the nick, or
+	// ErrTooManyReservedNicks if the account already holds MaxReservedNicks
+	// other nicks.
+	Reserve(ctx scope.Context, accountID snowflake.Snowflake, nick string) error
+
+	// Release gives up an account's reservation of a nick. It returns
+	// ErrNickNotReserved if the account doesn't hold the nick.
+	Release(ctx scope.Context, accountID snowflake.Snowflake, nick string) error
+
+	// List returns the nicks reserved by an account, in the order they were
+	// reserved.
+	List(ctx scope.Context, accountID snowflake.Snowflake) ([]string, error)
+
+	// Owner returns the ID of the account holding a nick, if any.
+	Owner(ctx scope.Context, nick string) (snowflake.Snowflake, bool, error)
+}
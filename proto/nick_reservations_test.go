@@ -0,0 +1,36 @@
+package proto
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReservedNickKey(t *testing.T) {
+	Convey("Nicks differing in case or spacing share a key", t, func() {
+		So(ReservedNickKey("Logan"), ShouldEqual, "logan")
+		So(ReservedNickKey("logan"), ShouldEqual, ReservedNickKey("LOGAN"))
+		So(ReservedNickKey("Room Host"), ShouldEqual, ReservedNickKey("roomhost"))
+		So(ReservedNickKey("Room Host"), ShouldEqual, ReservedNickKey("room  host"))
+	})
+
+	Convey("Look-alike nicks share a key", t, func() {
+		So(ReservedNickKey("ad.min"), ShouldEqual, "admin")
+		So(ReservedNickKey("admin!"), ShouldEqual, "admin")
+		So(ReservedNickKey("\u0391dmin"), ShouldEqual, "admin")
+		So(ReservedNickKey("\u0430dmin"), ShouldEqual, "admin")
+		So(ReservedNickKey("ａｄｍｉｎ"), ShouldEqual, "admin")
+		So(ReservedNickKey("admi\u200bn"), ShouldEqual, "admin")
+		So(ReservedNickKey("admín"), ShouldEqual, "admin")
+	})
+
+	Convey("Nicks of only symbols keep their symbols", t, func() {
+		So(ReservedNickKey("☃"), ShouldEqual, "☃")
+		So(ReservedNickKey("☃"), ShouldNotEqual, ReservedNickKey("☄"))
+	})
+
+	Convey("Distinct nicks have distinct keys", t, func() {
+		So(ReservedNickKey("logan"), ShouldNotEqual, ReservedNickKey("logan2"))
+		So(ReservedNickKey("logan"), ShouldNotEqual, ReservedNickKey("l0gan"))
+	})
+}
@@ -0,0 +1,386 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"euphoria.io/heim/proto/jobs"
+	"euphoria.io/heim/proto/logging"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+const (
+	// MentionNotification is the kind of notification recorded when an
+	// account is mentioned by one of its reserved nicks.
+	MentionNotification = "mention"
+
+	// PMNotification is the kind of notification recorded when an account
+	// receives a message in a private chat.
+	PMNotification = "pm"
+
+	// DefaultNotificationDigestWindow is how long notifications are collected
+	// before they're emailed, unless configured otherwise.
+	DefaultNotificationDigestWindow = 15 * time.Minute
+
+	// MaxNotificationExcerptLength is the number of characters of a message
+	// quoted in a notification email.
+	MaxNotificationExcerptLength = 200
+)
+
+// A Notification records a mention or private message that reached an
+// account while it had no live sessions.
+type Notification struct {
+	ID         snowflake.Snowflake
+	AccountID  snowflake.Snowflake
+	Kind       string
+	Room       string
+	MessageID  snowflake.Snowflake
+	SenderName string
+	Excerpt    string
+	Created    time.Time
+}
+
+// IsPM returns true if the notification is for a private message.
+func (n *Notification) IsPM() bool { return n.Kind == PMNotification }
+
+// A NotificationTracker holds the notifications waiting to be emailed to
+// each account.
+type NotificationTracker interface {
+	// Add records a pending notification. It returns true if no digest was
+	// scheduled for the account, in which case it is marked as scheduled and
+	// the caller should schedule one.
+	Add(ctx scope.Context, n *Notification) (bool, error)
+
+	// ReleaseDigest records that no digest is scheduled for the account any
+	// more, because it's being sent or couldn't be scheduled. The next
+	// notification added schedules another.
+	ReleaseDigest(ctx scope.Context, accountID snowflake.Snowflake) error
+
+	// Pending returns an account's pending notifications, oldest first.
+	Pending(ctx scope.Context, accountID snowflake.Snowflake) ([]*Notification, error)
+
+	// Clear removes an account's pending notifications, up to and including
+	// the one with the given ID.
+	Clear(ctx scope.Context, accountID, through snowflake.Snowflake) error
+}
+
+// EmailPreferences are an account's choices of which optional emails to
+// receive.
+type EmailPreferences struct {
+	AccessRequests bool `json:"access_requests"` // email about requests for access to rooms the account manages
+	Invitations    bool `json:"invitations"`     // email about invitations to private rooms
+	Mentions       bool `json:"mentions"`        // email about mentions of reserved nicks while offline
+	PMs            bool `json:"pms"`             // email about private messages received while offline
+}
+
+// DefaultEmailPreferences apply to accounts that haven't chosen otherwise.
+var DefaultEmailPreferences = EmailPreferences{
+	AccessRequests: true,
+	Invitations:    true,
+	Mentions:       true,
+	PMs:            true,
+}
+
+// Allows returns true if the preferences allow emailing about the given kind
+// of notification.
+func (p *EmailPreferences) Allows(kind string) bool {
+	switch kind {
+	case MentionNotification:
+		return p.Mentions
+	case PMNotification:
+		return p.PMs
+	default:
+		return false
+	}
+}
+
+// AllowsEmail returns true if the preferences allow sending the email with
+// the given template. Emails that aren't optional are always allowed.
+func (p *EmailPreferences) AllowsEmail(templateName string) bool {
+	switch templateName {
+	case AccessRequestEmail:
+		return p.AccessRequests
+	case NotificationDigestEmail:
+		return p.Mentions || p.PMs
+	case RoomInvitationEmail:
+		return p.Invitations
+	default:
+		return true
+	}
+}
+
+// Unsubscribe opts out of the email with the given template. It returns false
+// if the email isn't optional.
+func (p *EmailPreferences) Unsubscribe(templateName string) bool {
+	switch templateName {
+	case AccessRequestEmail:
+		p.AccessRequests = false
+	case NotificationDigestEmail:
+		p.Mentions = false
+		p.PMs = false
+	case RoomInvitationEmail:
+		p.Invitations = false
+	default:
+		return false
+	}
+	return true
+}
+
+// An EmailPreferenceTracker stores each account's email preferences.
+type EmailPreferenceTracker interface {
+	// Get returns the account's preferences, or DefaultEmailPreferences if
+	// it has none.
+	Get(ctx scope.Context, accountID snowflake.Snowflake) (*EmailPreferences, error)
+
+	// Set replaces the account's preferences.
+	Set(ctx scope.Context, accountID snowflake.Snowflake, prefs *EmailPreferences) error
+}
+
+// Mentions returns the nicks mentioned in a message, as @nick. Trailing
+// punctuation isn't considered part of the nick.
+func Mentions(content string) []string {
+	nicks := []string{}
+	for _, word := range strings.Fields(content) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		nick := strings.TrimRightFunc(word[1:], func(r rune) bool {
+			return unicode.IsPunct(r) && r != '_' && r != '-'
+		})
+		if nick != "" {
+			nicks = append(nicks, nick)
+		}
+	}
+	return nicks
+}
+
+// Excerpt shortens message content for quoting in a notification.
+func Excerpt(content string) string {
+	runes := []rune(strings.TrimSpace(content))
+	if len(runes) <= MaxNotificationExcerptLength {
+		return string(runes)
+	}
+	return string(runes[:MaxNotificationExcerptLength-1]) + "…"
+}
+
+// Notify records a notification for an account that has no live sessions,
+// unless its preferences rule it out. If no digest email is scheduled for the
+// account, one is scheduled, due once the digest window has passed.
+func (heim *Heim) Notify(ctx scope.Context, n *Notification) error {
+	b := heim.Backend
+
+	prefs, err := b.EmailPreferences().Get(ctx, n.AccountID)
+	if err != nil {
+		return err
+	}
+	if !prefs.Allows(n.Kind) {
+		return nil
+	}
+
+	online, err := b.IsUserOnline(ctx, UserID(fmt.Sprintf("account:%s", n.AccountID)))
+	if err != nil || online {
+		return err
+	}
+
+	if n.ID == 0 {
+		if n.ID, err = snowflake.New(); err != nil {
+			return err
+		}
+	}
+	if n.Created.IsZero() {
+		n.Created = time.Now()
+	}
+	schedule, err := b.Notifications().Add(ctx, n)
+	if err != nil || !schedule {
+		return err
+	}
+	if err := heim.scheduleNotificationDigest(ctx, n.AccountID); err != nil {
+		if err := b.Notifications().ReleaseDigest(ctx, n.AccountID); err != nil {
+			logging.Logger(ctx).Printf("release notification digest: %s", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// NotifyOffline records notifications for the other participant of a private
+// chat, and for the owners of reserved nicks mentioned in a message, so they
+// can be emailed if they're offline. Only messages in public rooms are
+// quoted. Failures are logged rather than returned, so they don't fail the
+// send.
+func (heim *Heim) NotifyOffline(
+	ctx scope.Context, room Room, roomName string, sender IdentityView, msgID snowflake.Snowflake,
+	content string, quote bool) {
+
+	b := heim.Backend
+	logger := logging.Logger(ctx)
+	recipients := map[snowflake.Snowflake]string{}
+
+	if pmRoom, ok := room.(PMRoom); ok {
+		pm := pmRoom.PM()
+		roomName = fmt.Sprintf("pm:%s", pm.ID)
+		other := pm.Receiver
+		if sender.ID != UserID(fmt.Sprintf("account:%s", pm.Initiator)) {
+			other = UserID(fmt.Sprintf("account:%s", pm.Initiator))
+		}
+		if kind, id := other.Parse(); kind == "account" {
+			var accountID snowflake.Snowflake
+			if err := accountID.FromString(id); err == nil {
+				recipients[accountID] = PMNotification
+			}
+		}
+	}
+
+	for _, nick := range Mentions(content) {
+		owner, ok, err := b.NickReservations().Owner(ctx, nick)
+		if err != nil {
+			logger.Printf("mention lookup failed: %s", err)
+			continue
+		}
+		if _, notified := recipients[owner]; !ok || notified {
+			continue
+		}
+		readable, err := heim.canReadRoom(ctx, room, owner)
+		if err != nil {
+			logger.Printf("mention access check failed: %s", err)
+			continue
+		}
+		if readable {
+			recipients[owner] = MentionNotification
+		}
+	}
+
+	if kind, id := sender.ID.Parse(); kind == "account" {
+		var accountID snowflake.Snowflake
+		if err := accountID.FromString(id); err == nil {
+			delete(recipients, accountID)
+		}
+	}
+
+	excerpt := ""
+	if quote {
+		excerpt = Excerpt(content)
+	}
+	for accountID, kind := range recipients {
+		blocked, err := b.Blocks().IsBlocked(ctx, accountID, sender.ID)
+		if err != nil {
+			logger.Printf("block lookup failed: %s", err)
+			continue
+		}
+		if blocked {
+			continue
+		}
+		n := &Notification{
+			AccountID:  accountID,
+			Kind:       kind,
+			Room:       roomName,
+			MessageID:  msgID,
+			SenderName: sender.Name,
+			Excerpt:    excerpt,
+		}
+		if err := heim.Notify(ctx, n); err != nil {
+			logger.Printf("notify %s failed: %s", accountID, err)
+		}
+	}
+}
+
+// canReadRoom returns true if the given account may read the room, so that
+// mentions in private rooms and private chats don't leak to outsiders.
+func (heim *Heim) canReadRoom(ctx scope.Context, room Room, accountID snowflake.Snowflake) (bool, error) {
+	switch r := room.(type) {
+	case PMRoom:
+		pm := r.PM()
+		return accountID == pm.Initiator || pm.Receiver == UserID(fmt.Sprintf("account:%s", accountID)), nil
+	case ManagedRoom:
+		mkey, err := r.MessageKey(ctx)
+		if err != nil {
+			return false, err
+		}
+		if mkey == nil {
+			return true, nil
+		}
+		account, err := heim.Backend.AccountManager().Get(ctx, accountID)
+		if err != nil {
+			return false, err
+		}
+		capability, err := mkey.AccountCapability(ctx, account)
+		if err != nil {
+			return false, err
+		}
+		if capability != nil {
+			return true, nil
+		}
+		if _, err := r.ManagerCapability(ctx, account); err != nil {
+			if err == ErrManagerNotFound {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	default:
+		return true, nil
+	}
+}
+
+func (heim *Heim) scheduleNotificationDigest(ctx scope.Context, accountID snowflake.Snowflake) error {
+	window := heim.NotificationDigestWindow
+	if window == 0 {
+		window = DefaultNotificationDigestWindow
+	}
+	jq, err := heim.Backend.Jobs().GetQueue(ctx, jobs.NotificationDigestQueue)
+	if err != nil {
+		return err
+	}
+	options := append(
+		[]jobs.JobOption{jobs.JobOptions.Delay(window)}, jobs.NotificationDigestJobOptions...)
+	payload := &jobs.NotificationDigestJob{AccountID: accountID}
+	_, err = jq.Add(ctx, jobs.NotificationDigestJobType, payload, options...)
+	return err
+}
+
+// SendNotificationDigest emails an account its pending notifications, if it
+// has any, and then clears them.
+func (heim *Heim) SendNotificationDigest(ctx scope.Context, accountID snowflake.Snowflake) error {
+	b := heim.Backend
+
+	// Release the digest before collecting notifications, so any that arrive
+	// from here on schedule another.
+	if err := b.Notifications().ReleaseDigest(ctx, accountID); err != nil {
+		return err
+	}
+
+	notifications, err := b.Notifications().Pending(ctx, accountID)
+	if err != nil || len(notifications) == 0 {
+		return err
+	}
+
+	account, err := b.AccountManager().Get(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	params := &NotificationDigestEmailParams{
+		CommonEmailParams: DefaultCommonEmailParams,
+		AccountName:       account.Name(),
+		Notifications:     notifications,
+	}
+	if heim.EmailReplyDomain != "" {
+		params.ReplyAddresses = make(map[snowflake.Snowflake]string, len(notifications))
+		for _, n := range notifications {
+			addr, err := EmailReplyAddress(heim.KMS, account, heim.EmailReplyDomain, n.Room, n.MessageID)
+			if err != nil {
+				return fmt.Errorf("email reply address: %s", err)
+			}
+			params.ReplyAddresses[n.ID] = addr
+		}
+	}
+	_, err = heim.SendEmail(ctx, b, account, "", NotificationDigestEmail, params)
+	if err != nil && !IsEmailSuppressed(err) {
+		return err
+	}
+
+	return b.Notifications().Clear(ctx, accountID, notifications[len(notifications)-1].ID)
+}
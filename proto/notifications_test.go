@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMentions(t *testing.T) {
+	Convey("Words starting with @ are mentions", t, func() {
+		So(Mentions("hi @logan, and @max_power!"), ShouldResemble, []string{"logan", "max_power"})
+		So(Mentions("@room-host: ping"), ShouldResemble, []string{"room-host"})
+	})
+
+	Convey("Bare and embedded @ signs aren't mentions", t, func() {
+		So(Mentions("meet @ noon, mail me@example.com"), ShouldBeEmpty)
+		So(Mentions("@!"), ShouldBeEmpty)
+	})
+}
+
+func TestExcerpt(t *testing.T) {
+	Convey("Short messages are quoted in full", t, func() {
+		So(Excerpt("  hello there \n"), ShouldEqual, "hello there")
+	})
+
+	Convey("Long messages are truncated", t, func() {
+		excerpt := Excerpt(strings.Repeat("ü", 500))
+		So(utf8.RuneCountInString(excerpt), ShouldEqual, MaxNotificationExcerptLength)
+		So(strings.HasSuffix(excerpt, "…"), ShouldBeTrue)
+	})
+}
+
+func TestEmailPreferences(t *testing.T) {
+	Convey("Only optional emails can be opted out of", t, func() {
+		So(IsOptionalEmail(AccessRequestEmail), ShouldBeTrue)
+		So(IsOptionalEmail(NotificationDigestEmail), ShouldBeTrue)
+		So(IsOptionalEmail(RoomInvitationEmail), ShouldBeTrue)
+		So(IsOptionalEmail(PasswordResetEmail), ShouldBeFalse)
+		So(IsOptionalEmail(RoomInvitationWelcomeEmail), ShouldBeFalse)
+
+		prefs := DefaultEmailPreferences
+		So(prefs.Unsubscribe(VerificationEmail), ShouldBeFalse)
+		So(prefs, ShouldResemble, DefaultEmailPreferences)
+	})
+
+	Convey("Unsubscribing from digests opts out of mentions and PMs", t, func() {
+		prefs := DefaultEmailPreferences
+		So(prefs.Unsubscribe(NotificationDigestEmail), ShouldBeTrue)
+		So(prefs.AllowsEmail(NotificationDigestEmail), ShouldBeFalse)
+		So(prefs.Allows(MentionNotification), ShouldBeFalse)
+		So(prefs.Allows(PMNotification), ShouldBeFalse)
+		So(prefs.AllowsEmail(AccessRequestEmail), ShouldBeTrue)
+
+		prefs.PMs = true
+		So(prefs.AllowsEmail(NotificationDigestEmail), ShouldBeTrue)
+	})
+}
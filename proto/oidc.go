@@ -0,0 +1,65 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto/security"
+)
+
+const (
+	// OIDCNamespace is the personal identity namespace of accounts registered
+	// through an OpenID Connect provider.
+	OIDCNamespace = "oidc"
+
+	// OIDCRecentLogin is how recently an account registered through an OIDC
+	// provider must have logged in through it before commands that would
+	// otherwise ask for a password are accepted.
+	OIDCRecentLogin = 5 * time.Minute
+)
+
+// OIDCIdentity returns the personal identity ID of the user known to the
+// given OIDC issuer by the given subject. Subjects are only unique within
+// an issuer, so both are included.
+func OIDCIdentity(issuer, subject string) string { return issuer + "|" + subject }
+
+// ParseOIDCIdentity splits an OIDC personal identity ID into its issuer and
+// subject.
+func ParseOIDCIdentity(id string) (issuer, subject string, ok bool) {
+	idx := strings.LastIndex(id, "|")
+	if idx <= 0 || idx == len(id)-1 {
+		return "", "", false
+	}
+	return id[:idx], id[idx+1:], true
+}
+
+// OIDCAccountClientKey returns the client key of an account registered
+// through an OIDC provider. Such accounts have no password of their own;
+// instead one is derived from the account's system key, which is wrapped by
+// the KMS, and its identity. The account's keys can therefore only be
+// unlocked by a server that has both verified an ID token for the identity
+// and asked the KMS to unwrap that account's key material.
+func OIDCAccountClientKey(kms security.KMS, account Account, identity string) (*security.ManagedKey, error) {
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, systemKey.Plaintext)
+	mac.Write([]byte(OIDCNamespace + ":" + identity))
+	return account.KeyFromPassword(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// IsOIDCAccount returns true if the account was registered through an OIDC
+// provider, and so has no password of its own.
+func IsOIDCAccount(account Account) bool {
+	for _, pid := range account.PersonalIdentities() {
+		if pid.Namespace() == OIDCNamespace {
+			return true
+		}
+	}
+	return false
+}
@@ -14,6 +14,9 @@ func (c PacketType) Event() PacketType { return c + "-event" }
 func (c PacketType) Reply() PacketType { return c + "-reply" }
 
 var (
+	AddIdentityType      = PacketType("add-identity")
+	AddIdentityReplyType = AddIdentityType.Reply()
+
 	AuthType      = PacketType("auth")
 	AuthReplyType = AuthType.Reply()
 
@@ -22,6 +25,13 @@ var (
 	UnbanType      = PacketType("unban")
 	UnbanReplyType = UnbanType.Reply()
 
+	BlockUserType        = PacketType("block-user")
+	BlockUserEventType   = BlockUserType.Event()
+	BlockUserReplyType   = BlockUserType.Reply()
+	UnblockUserType      = PacketType("unblock-user")
+	UnblockUserEventType = UnblockUserType.Event()
+	UnblockUserReplyType = UnblockUserType.Reply()
+
 	SendType      = PacketType("send")
 	SendEventType = SendType.Event()
 	SendReplyType = SendType.Reply()
@@ -29,16 +39,36 @@ var (
 	ChangeEmailType      = PacketType("change-email")
 	ChangeEmailReplyType = ChangeEmailType.Reply()
 
+	ChangeLocaleType      = PacketType("change-locale")
+	ChangeLocaleReplyType = ChangeLocaleType.Reply()
+
 	ChangeNameType      = PacketType("change-name")
 	ChangeNameReplyType = ChangeNameType.Reply()
 
 	ChangePasswordType      = PacketType("change-password")
 	ChangePasswordReplyType = ChangePasswordType.Reply()
 
+	CreateInviteType      = PacketType("create-invite")
+	CreateInviteReplyType = CreateInviteType.Reply()
+
+	DeleteAccountType      = PacketType("delete-account")
+	DeleteAccountReplyType = DeleteAccountType.Reply()
+
+	DisableOTPType      = PacketType("disable-otp")
+	DisableOTPReplyType = DisableOTPType.Reply()
+
 	EditMessageType      = PacketType("edit-message")
 	EditMessageEventType = EditMessageType.Event()
 	EditMessageReplyType = EditMessageType.Reply()
 
+	EnrollOTPType      = PacketType("enroll-otp")
+	EnrollOTPReplyType = EnrollOTPType.Reply()
+
+	GetEmailPreferencesType      = PacketType("get-email-preferences")
+	GetEmailPreferencesReplyType = GetEmailPreferencesType.Reply()
+	SetEmailPreferencesType      = PacketType("set-email-preferences")
+	SetEmailPreferencesReplyType = SetEmailPreferencesType.Reply()
+
 	GetMessageType      = PacketType("get-message")
 	GetMessageReplyType = GetMessageType.Reply()
 
@@ -48,11 +78,44 @@ var (
 	GrantManagerType      = PacketType("grant-manager")
 	GrantManagerReplyType = GrantManagerType.Reply()
 
+	InviteByEmailType      = PacketType("invite-by-email")
+	InviteByEmailReplyType = InviteByEmailType.Reply()
+
 	JoinType      = PacketType("join")
 	JoinEventType = JoinType.Event()
 	PartType      = PacketType("part")
 	PartEventType = PartType.Event()
 
+	ListAccessType      = PacketType("list-access")
+	ListAccessReplyType = ListAccessType.Reply()
+
+	ListAccessRequestsType      = PacketType("list-access-requests")
+	ListAccessRequestsReplyType = ListAccessRequestsType.Reply()
+
+	ListBlockedUsersType      = PacketType("list-blocked-users")
+	ListBlockedUsersReplyType = ListBlockedUsersType.Reply()
+
+	ListEmailInvitesType      = PacketType("list-email-invites")
+	ListEmailInvitesReplyType = ListEmailInvitesType.Reply()
+
+	ListIdentitiesType      = PacketType("list-identities")
+	ListIdentitiesReplyType = ListIdentitiesType.Reply()
+
+	ListInvitesType      = PacketType("list-invites")
+	ListInvitesReplyType = ListInvitesType.Reply()
+
+	ListLoginsType      = PacketType("list-logins")
+	ListLoginsReplyType = ListLoginsType.Reply()
+
+	ListManagersType      = PacketType("list-managers")
+	ListManagersReplyType = ListManagersType.Reply()
+
+	ListPMsType      = PacketType("list-pms")
+	ListPMsReplyType = ListPMsType.Reply()
+
+	ListReservedNicksType      = PacketType("list-reserved-nicks")
+	ListReservedNicksReplyType = ListReservedNicksType.Reply()
+
 	LogType      = PacketType("log")
 	LogReplyType = LogType.Reply()
 
@@ -79,18 +142,48 @@ var (
 	RegisterAccountType      = PacketType("register-account")
 	RegisterAccountReplyType = RegisterAccountType.Reply()
 
+	ReleaseNickType      = PacketType("release-nick")
+	ReleaseNickReplyType = ReleaseNickType.Reply()
+
+	RemoveIdentityType      = PacketType("remove-identity")
+	RemoveIdentityReplyType = RemoveIdentityType.Reply()
+
+	RequestAccessType      = PacketType("request-access")
+	RequestAccessReplyType = RequestAccessType.Reply()
+
+	RequestDataExportType      = PacketType("request-data-export")
+	RequestDataExportReplyType = RequestDataExportType.Reply()
+
 	ResendVerificationEmailType      = PacketType("resend-verification-email")
 	ResendVerificationEmailReplyType = ResendVerificationEmailType.Reply()
 
+	ReserveNickType      = PacketType("reserve-nick")
+	ReserveNickReplyType = ReserveNickType.Reply()
+
 	ResetPasswordType      = PacketType("reset-password")
 	ResetPasswordReplyType = ResetPasswordType.Reply()
 
+	ResolveAccessRequestType      = PacketType("resolve-access-request")
+	ResolveAccessRequestReplyType = ResolveAccessRequestType.Reply()
+
 	RevokeAccessType      = PacketType("revoke-access")
 	RevokeAccessReplyType = RevokeAccessType.Reply()
 
+	RevokeEmailInviteType      = PacketType("revoke-email-invite")
+	RevokeEmailInviteReplyType = RevokeEmailInviteType.Reply()
+
+	RevokeInviteType      = PacketType("revoke-invite")
+	RevokeInviteReplyType = RevokeInviteType.Reply()
+
+	RevokeLoginType      = PacketType("revoke-login")
+	RevokeLoginReplyType = RevokeLoginType.Reply()
+
 	RevokeManagerType      = PacketType("revoke-manager")
 	RevokeManagerReplyType = RevokeManagerType.Reply()
 
+	SetPrimaryIdentityType      = PacketType("set-primary-identity")
+	SetPrimaryIdentityReplyType = SetPrimaryIdentityType.Reply()
+
 	StaffCreateRoomType      = PacketType("staff-create-room")
 	StaffCreateRoomReplyType = StaffCreateRoomType.Reply()
 
@@ -121,14 +214,19 @@ var (
 	UnlockStaffCapabilityType      = PacketType("unlock-staff-capability")
 	UnlockStaffCapabilityReplyType = UnlockStaffCapabilityType.Reply()
 
+	ValidateOTPType      = PacketType("validate-otp")
+	ValidateOTPReplyType = ValidateOTPType.Reply()
+
 	WhoType      = PacketType("who")
 	WhoReplyType = WhoType.Reply()
 
-	BounceEventType     = PacketType("bounce").Event()
-	DisconnectEventType = PacketType("disconnect").Event()
-	HelloEventType      = PacketType("hello").Event()
-	NetworkEventType    = PacketType("network").Event()
-	SnapshotEventType   = PacketType("snapshot").Event()
+	AccessRequestEventType         = PacketType("access-request").Event()
+	AccessRequestResolvedEventType = PacketType("access-request-resolved").Event()
+	BounceEventType                = PacketType("bounce").Event()
+	DisconnectEventType            = PacketType("disconnect").Event()
+	HelloEventType                 = PacketType("hello").Event()
+	NetworkEventType               = PacketType("network").Event()
+	SnapshotEventType              = PacketType("snapshot").Event()
 
 	ErrorReplyType = PacketType("error").Reply()
 
@@ -140,16 +238,31 @@ var (
 		ChangeEmailType:      reflect.TypeOf(ChangeEmailCommand{}),
 		ChangeEmailReplyType: reflect.TypeOf(ChangeEmailReply{}),
 
+		ChangeLocaleType:      reflect.TypeOf(ChangeLocaleCommand{}),
+		ChangeLocaleReplyType: reflect.TypeOf(ChangeLocaleReply{}),
+
 		ChangeNameType:      reflect.TypeOf(ChangeNameCommand{}),
 		ChangeNameReplyType: reflect.TypeOf(ChangeNameReply{}),
 
 		ChangePasswordType:      reflect.TypeOf(ChangePasswordCommand{}),
 		ChangePasswordReplyType: reflect.TypeOf(ChangePasswordReply{}),
 
+		CreateInviteType:      reflect.TypeOf(CreateInviteCommand{}),
+		CreateInviteReplyType: reflect.TypeOf(CreateInviteReply{}),
+
+		DeleteAccountType:      reflect.TypeOf(DeleteAccountCommand{}),
+		DeleteAccountReplyType: reflect.TypeOf(DeleteAccountReply{}),
+
+		DisableOTPType:      reflect.TypeOf(DisableOTPCommand{}),
+		DisableOTPReplyType: reflect.TypeOf(DisableOTPReply{}),
+
 		EditMessageType:      reflect.TypeOf(EditMessageCommand{}),
 		EditMessageEventType: reflect.TypeOf(EditMessageEvent{}),
 		EditMessageReplyType: reflect.TypeOf(EditMessageReply{}),
 
+		EnrollOTPType:      reflect.TypeOf(EnrollOTPCommand{}),
+		EnrollOTPReplyType: reflect.TypeOf(EnrollOTPReply{}),
+
 		GetMessageType:      reflect.TypeOf(GetMessageCommand{}),
 		GetMessageReplyType: reflect.TypeOf(GetMessageReply{}),
 
@@ -159,6 +272,44 @@ var (
 		GrantManagerType:      reflect.TypeOf(GrantManagerCommand{}),
 		GrantManagerReplyType: reflect.TypeOf(GrantManagerReply{}),
 
+		GetEmailPreferencesType:      reflect.TypeOf(GetEmailPreferencesCommand{}),
+		GetEmailPreferencesReplyType: reflect.TypeOf(GetEmailPreferencesReply{}),
+		SetEmailPreferencesType:      reflect.TypeOf(SetEmailPreferencesCommand{}),
+		SetEmailPreferencesReplyType: reflect.TypeOf(SetEmailPreferencesReply{}),
+
+		InviteByEmailType:      reflect.TypeOf(InviteByEmailCommand{}),
+		InviteByEmailReplyType: reflect.TypeOf(InviteByEmailReply{}),
+
+		ListAccessType:      reflect.TypeOf(ListAccessCommand{}),
+		ListAccessReplyType: reflect.TypeOf(ListAccessReply{}),
+
+		ListAccessRequestsType:      reflect.TypeOf(ListAccessRequestsCommand{}),
+		ListAccessRequestsReplyType: reflect.TypeOf(ListAccessRequestsReply{}),
+
+		ListBlockedUsersType:      reflect.TypeOf(ListBlockedUsersCommand{}),
+		ListBlockedUsersReplyType: reflect.TypeOf(ListBlockedUsersReply{}),
+
+		ListEmailInvitesType:      reflect.TypeOf(ListEmailInvitesCommand{}),
+		ListEmailInvitesReplyType: reflect.TypeOf(ListEmailInvitesReply{}),
+
+		ListIdentitiesType:      reflect.TypeOf(ListIdentitiesCommand{}),
+		ListIdentitiesReplyType: reflect.TypeOf(ListIdentitiesReply{}),
+
+		ListInvitesType:      reflect.TypeOf(ListInvitesCommand{}),
+		ListInvitesReplyType: reflect.TypeOf(ListInvitesReply{}),
+
+		ListLoginsType:      reflect.TypeOf(ListLoginsCommand{}),
+		ListLoginsReplyType: reflect.TypeOf(ListLoginsReply{}),
+
+		ListManagersType:      reflect.TypeOf(ListManagersCommand{}),
+		ListManagersReplyType: reflect.TypeOf(ListManagersReply{}),
+
+		ListPMsType:      reflect.TypeOf(ListPMsCommand{}),
+		ListPMsReplyType: reflect.TypeOf(ListPMsReply{}),
+
+		ListReservedNicksType:      reflect.TypeOf(ListReservedNicksCommand{}),
+		ListReservedNicksReplyType: reflect.TypeOf(ListReservedNicksReply{}),
+
 		LogType:      reflect.TypeOf(LogCommand{}),
 		LogReplyType: reflect.TypeOf(LogReply{}),
 
@@ -173,6 +324,9 @@ var (
 		PingEventType: reflect.TypeOf(PingEvent{}),
 		PingReplyType: reflect.TypeOf(PingReply{}),
 
+		SetPrimaryIdentityType:      reflect.TypeOf(SetPrimaryIdentityCommand{}),
+		SetPrimaryIdentityReplyType: reflect.TypeOf(SetPrimaryIdentityReply{}),
+
 		StaffCreateRoomType:      reflect.TypeOf(StaffCreateRoomCommand{}),
 		StaffCreateRoomReplyType: reflect.TypeOf(StaffCreateRoomReply{}),
 
@@ -200,6 +354,9 @@ var (
 		StaffRevokeManagerType:      reflect.TypeOf(StaffRevokeManagerCommand{}),
 		StaffRevokeManagerReplyType: reflect.TypeOf(StaffRevokeManagerReply{}),
 
+		AddIdentityType:      reflect.TypeOf(AddIdentityCommand{}),
+		AddIdentityReplyType: reflect.TypeOf(AddIdentityReply{}),
+
 		AuthType:      reflect.TypeOf(AuthCommand{}),
 		AuthReplyType: reflect.TypeOf(AuthReply{}),
 
@@ -208,11 +365,20 @@ var (
 		UnbanType:      reflect.TypeOf(UnbanCommand{}),
 		UnbanReplyType: reflect.TypeOf(UnbanReply{}),
 
-		BounceEventType:     reflect.TypeOf(BounceEvent{}),
-		DisconnectEventType: reflect.TypeOf(DisconnectEvent{}),
-		HelloEventType:      reflect.TypeOf(HelloEvent{}),
-		NetworkEventType:    reflect.TypeOf(NetworkEvent{}),
-		SnapshotEventType:   reflect.TypeOf(SnapshotEvent{}),
+		BlockUserType:        reflect.TypeOf(BlockUserCommand{}),
+		BlockUserEventType:   reflect.TypeOf(BlockUserEvent{}),
+		BlockUserReplyType:   reflect.TypeOf(BlockUserReply{}),
+		UnblockUserType:      reflect.TypeOf(UnblockUserCommand{}),
+		UnblockUserEventType: reflect.TypeOf(UnblockUserEvent{}),
+		UnblockUserReplyType: reflect.TypeOf(UnblockUserReply{}),
+
+		AccessRequestEventType:         reflect.TypeOf(AccessRequestEvent{}),
+		AccessRequestResolvedEventType: reflect.TypeOf(AccessRequestResolvedEvent{}),
+		BounceEventType:                reflect.TypeOf(BounceEvent{}),
+		DisconnectEventType:            reflect.TypeOf(DisconnectEvent{}),
+		HelloEventType:                 reflect.TypeOf(HelloEvent{}),
+		NetworkEventType:               reflect.TypeOf(NetworkEvent{}),
+		SnapshotEventType:              reflect.TypeOf(SnapshotEvent{}),
 
 		LoginType:      reflect.TypeOf(LoginCommand{}),
 		LoginEventType: reflect.TypeOf(LoginEvent{}),
@@ -229,12 +395,39 @@ var (
 		RegisterAccountType:      reflect.TypeOf(RegisterAccountCommand{}),
 		RegisterAccountReplyType: reflect.TypeOf(RegisterAccountReply{}),
 
+		ReleaseNickType:      reflect.TypeOf(ReleaseNickCommand{}),
+		ReleaseNickReplyType: reflect.TypeOf(ReleaseNickReply{}),
+
+		RemoveIdentityType:      reflect.TypeOf(RemoveIdentityCommand{}),
+		RemoveIdentityReplyType: reflect.TypeOf(RemoveIdentityReply{}),
+
+		RequestAccessType:      reflect.TypeOf(RequestAccessCommand{}),
+		RequestAccessReplyType: reflect.TypeOf(RequestAccessReply{}),
+
+		RequestDataExportType:      reflect.TypeOf(RequestDataExportCommand{}),
+		RequestDataExportReplyType: reflect.TypeOf(RequestDataExportReply{}),
+
 		ResendVerificationEmailType:      reflect.TypeOf(ResendVerificationEmailCommand{}),
 		ResendVerificationEmailReplyType: reflect.TypeOf(ResendVerificationEmailReply{}),
 
+		ReserveNickType:      reflect.TypeOf(ReserveNickCommand{}),
+		ReserveNickReplyType: reflect.TypeOf(ReserveNickReply{}),
+
 		ResetPasswordType:      reflect.TypeOf(ResetPasswordCommand{}),
 		ResetPasswordReplyType: reflect.TypeOf(ResetPasswordReply{}),
 
+		ResolveAccessRequestType:      reflect.TypeOf(ResolveAccessRequestCommand{}),
+		ResolveAccessRequestReplyType: reflect.TypeOf(ResolveAccessRequestReply{}),
+
+		RevokeEmailInviteType:      reflect.TypeOf(RevokeEmailInviteCommand{}),
+		RevokeEmailInviteReplyType: reflect.TypeOf(RevokeEmailInviteReply{}),
+
+		RevokeInviteType:      reflect.TypeOf(RevokeInviteCommand{}),
+		RevokeInviteReplyType: reflect.TypeOf(RevokeInviteReply{}),
+
+		RevokeLoginType:      reflect.TypeOf(RevokeLoginCommand{}),
+		RevokeLoginReplyType: reflect.TypeOf(RevokeLoginReply{}),
+
 		RevokeManagerType:      reflect.TypeOf(RevokeManagerCommand{}),
 		RevokeManagerReplyType: reflect.TypeOf(RevokeManagerReply{}),
 
@@ -244,6 +437,9 @@ var (
 		UnlockStaffCapabilityType:      reflect.TypeOf(UnlockStaffCapabilityCommand{}),
 		UnlockStaffCapabilityReplyType: reflect.TypeOf(UnlockStaffCapabilityReply{}),
 
+		ValidateOTPType:      reflect.TypeOf(ValidateOTPCommand{}),
+		ValidateOTPReplyType: reflect.TypeOf(ValidateOTPReply{}),
+
 		WhoType:      reflect.TypeOf(WhoCommand{}),
 		WhoReplyType: reflect.TypeOf(WhoReply{}),
 	}
@@ -320,6 +516,182 @@ type ChangeEmailReply struct {
 	VerificationNeeded bool   `json:"verification_needed"` // if true, a verification email will be sent out, and the user must verify the address before it becomes their primary address
 }
 
+// The `add-identity` command adds a personal identity, such as a backup email
+// address, to the signed in account. The account's password must be given.
+//
+// A verification email is sent to the new address. Once verified, the address
+// may be used to log in or to reset the account's password, and may be made
+// the account's primary email with [set-primary-identity](#set-primary-identity).
+// Only the `email` namespace may be added this way.
+type AddIdentityCommand struct {
+	Namespace string `json:"namespace"` // the namespace of the personal identifier
+	ID        string `json:"id"`        // the personal identifier
+	Password  string `json:"password"`  // the account's password
+}
+
+// `add-identity-reply` returns the account's personal identities, including
+// the new one.
+type AddIdentityReply struct {
+	Identities []PersonalIdentityView `json:"identities"` // the account's personal identities
+}
+
+// The `list-identities` command lists the personal identities of the signed
+// in account.
+type ListIdentitiesCommand struct{}
+
+// `list-identities-reply` returns the account's personal identities.
+type ListIdentitiesReply struct {
+	Identities []PersonalIdentityView `json:"identities"` // the account's personal identities
+}
+
+// The `remove-identity` command removes a personal identity from the signed in
+// account. The account's password must be given. The primary email can't be
+// removed; make another address primary first.
+type RemoveIdentityCommand struct {
+	Namespace string `json:"namespace"` // the namespace of the personal identifier
+	ID        string `json:"id"`        // the personal identifier
+	Password  string `json:"password"`  // the account's password
+}
+
+// `remove-identity-reply` returns the account's remaining personal identities.
+type RemoveIdentityReply struct {
+	Identities []PersonalIdentityView `json:"identities"` // the account's personal identities
+}
+
+// The `set-primary-identity` command makes one of the signed in account's
+// verified email addresses its primary email, where notifications are sent.
+// The account's password must be given.
+type SetPrimaryIdentityCommand struct {
+	Namespace string `json:"namespace"` // the namespace of the personal identifier
+	ID        string `json:"id"`        // the personal identifier
+	Password  string `json:"password"`  // the account's password
+}
+
+// `set-primary-identity-reply` returns the account's personal identities.
+type SetPrimaryIdentityReply struct {
+	Identities []PersonalIdentityView `json:"identities"` // the account's personal identities
+}
+
+// The `reserve-nick` command reserves a nick for the signed in account, so that
+// no one else may use it. Nicks that look alike, differing only in case,
+// whitespace, punctuation, accents, or look-alike letters from other scripts,
+// are reserved together. The account must have a verified personal identity.
+type ReserveNickCommand struct {
+	Name string `json:"name"` // the nick to reserve
+}
+
+// `reserve-nick-reply` returns the nicks reserved by the account, including
+// the new one.
+type ReserveNickReply struct {
+	Nicks []string `json:"nicks"` // the nicks reserved by the account
+}
+
+// The `release-nick` command gives up one of the signed in account's reserved
+// nicks.
+type ReleaseNickCommand struct {
+	Name string `json:"name"` // the reserved nick to give up
+}
+
+// `release-nick-reply` returns the nicks still reserved by the account.
+type ReleaseNickReply struct {
+	Nicks []string `json:"nicks"` // the nicks reserved by the account
+}
+
+// The `list-reserved-nicks` command lists the nicks reserved by the signed in
+// account.
+type ListReservedNicksCommand struct{}
+
+// `list-reserved-nicks-reply` returns the nicks reserved by the account.
+type ListReservedNicksReply struct {
+	Nicks []string `json:"nicks"` // the nicks reserved by the account
+}
+
+// The `block-user` command adds a user to the signed in account's block list.
+// Messages, edits, and nick changes by the blocked user are no longer sent to
+// the account's sessions in any room, including in snapshots and logs, and the
+// blocked user can't initiate a PM with the account. The account's other
+// sessions are sent a [block-user-event](#block-user-event).
+type BlockUserCommand struct {
+	UserID UserID `json:"user_id"` // the id of the user to block
+}
+
+// `block-user-reply` confirms that the user was blocked.
+type BlockUserReply struct{}
+
+// A `block-user-event` informs the sessions of a signed in account that the
+// account blocked a user from another session.
+type BlockUserEvent struct {
+	UserID UserID `json:"user_id"` // the id of the user that was blocked
+}
+
+// The `unblock-user` command removes a user from the signed in account's
+// block list. The account's other sessions are sent an
+// [unblock-user-event](#unblock-user-event).
+type UnblockUserCommand struct {
+	UserID UserID `json:"user_id"` // the id of the user to unblock
+}
+
+// `unblock-user-reply` confirms that the user was unblocked.
+type UnblockUserReply struct{}
+
+// An `unblock-user-event` informs the sessions of a signed in account that the
+// account unblocked a user from another session.
+type UnblockUserEvent struct {
+	UserID UserID `json:"user_id"` // the id of the user that was unblocked
+}
+
+// The `list-blocked-users` command lists the users blocked by the signed in
+// account.
+type ListBlockedUsersCommand struct{}
+
+// `list-blocked-users-reply` returns the users blocked by the account.
+type ListBlockedUsersReply struct {
+	UserIDs []UserID `json:"user_ids"` // the ids of the blocked users
+}
+
+// The `list-pms` command lists the private chats the signed in account takes
+// part in, most recently active first. A private chat's unread count covers
+// messages from the other participant posted since the account last left it.
+type ListPMsCommand struct{}
+
+// `list-pms-reply` returns the account's private chats.
+type ListPMsReply struct {
+	PMs []PMSummary `json:"pms"` // the account's private chats
+}
+
+// The `get-email-preferences` command returns the signed in account's choices
+// of which notification emails to receive.
+type GetEmailPreferencesCommand struct{}
+
+// `get-email-preferences-reply` returns the account's email preferences.
+type GetEmailPreferencesReply struct {
+	Preferences EmailPreferences `json:"preferences"` // the account's email preferences
+}
+
+// The `set-email-preferences` command replaces the signed in account's choices
+// of which notification emails to receive. While an account has no live
+// sessions, mentions of its reserved nicks and private messages sent to it
+// are collected and emailed as a digest.
+type SetEmailPreferencesCommand struct {
+	Preferences EmailPreferences `json:"preferences"` // the new email preferences
+}
+
+// `set-email-preferences-reply` confirms that the preferences were saved.
+type SetEmailPreferencesReply struct{}
+
+// The `change-locale` command sets the language the signed in account prefers
+// to receive email in, as a language tag such as `de` or `pt-BR`. An empty
+// locale restores the default. Email isn't translated into every language;
+// the closest translation available is used, falling back to English.
+type ChangeLocaleCommand struct {
+	Locale string `json:"locale"` // the locale to associate with the account
+}
+
+// The `change-locale-reply` packet indicates a successful locale change.
+type ChangeLocaleReply struct {
+	Locale string `json:"locale"` // the new locale associated with the account
+}
+
 // The `change-name` command changes the name associated with the signed in account.
 type ChangeNameCommand struct {
 	Name string `json:"name"` // the name to associate with the account
@@ -339,6 +711,63 @@ type ChangePasswordCommand struct {
 // The `change-password-reply` packet returns the outcome of changing the password.
 type ChangePasswordReply struct{}
 
+// The `enroll-otp` command generates a new OTP key for the signed in account,
+// as the first step of enabling two-factor authentication. The key must then
+// be confirmed with a successful [validate-otp](#validate-otp) command before
+// it's required at login. An error will be returned if the account already
+// has a validated OTP key.
+type EnrollOTPCommand struct{}
+
+// `enroll-otp-reply` returns the OTP key in several forms that a user can
+// use to import into their personal authentication app.
+type EnrollOTPReply struct {
+	URI     string `json:"uri"`    // the otpauth URI for the generated key (https://github.com/google/google-authenticator/wiki/Key-Uri-Format)
+	QRImage string `json:"qr_uri"` // the data URI for a QR image encoding the otpauth URI
+}
+
+// The `validate-otp` command validates a one-time password against the
+// latest OTP key generated for the account by the `enroll-otp` command. Once
+// validated, a one-time password is required to [login](#login) to the account.
+type ValidateOTPCommand struct {
+	Password string `json:"password"` // a one-time password from the authentication app
+}
+
+// `validate-otp-reply` confirms that two-factor authentication is enabled for
+// the account. It returns a set of single-use recovery codes, any of which may
+// be given in place of a one-time password. They can't be recovered later, so
+// the client should ask the user to record them right away.
+type ValidateOTPReply struct {
+	RecoveryCodes []string `json:"recovery_codes"` // single-use codes for logging in without the authentication app
+}
+
+// The `delete-account` command permanently deletes the signed in account. The
+// account's password must be given, as well as a one-time password (or
+// recovery code) if the account is enrolled in two-factor authentication.
+//
+// Deletion happens in the background. The account's grants are revoked, all
+// of its logins are ended, the messages it posted are anonymized, and its
+// personal identities are removed. The account can't be recovered afterward.
+type DeleteAccountCommand struct {
+	Password string `json:"password"`      // the account's password
+	OTP      string `json:"otp,omitempty"` // a one-time password or recovery code, if enrolled
+}
+
+// `delete-account-reply` confirms that the account has been scheduled for
+// deletion.
+type DeleteAccountReply struct{}
+
+// The `disable-otp` command turns off two-factor authentication for the
+// signed in account. Both the account's password and a current one-time
+// password (or recovery code) must be given. Any unused recovery codes are
+// discarded.
+type DisableOTPCommand struct {
+	Password string `json:"password"` // the account's password
+	OTP      string `json:"otp"`      // a one-time password or recovery code
+}
+
+// `disable-otp-reply` confirms that two-factor authentication was disabled.
+type DisableOTPReply struct{}
+
 // `edit-message-reply` returns the id of a successful edit.
 type EditMessageReply struct {
 	EditID snowflake.Snowflake `json:"edit_id"` // the unique id of the edit that was applied
@@ -358,29 +787,154 @@ type EditMessageEvent struct {
 
 // The `grant-access` command may be used by an active manager in a private room
 // to create a new capability for access. Access may be granted to either a
-// passcode or an account.
+// passcode or an account. The grant may be given a limited duration, after
+// which it's revoked automatically.
 //
 // If the room is not private, or if the requested access grant already exists,
 // an error will be returned.
 type GrantAccessCommand struct {
 	AccountID snowflake.Snowflake `json:"account_id,omitempty"` // the id of an account to grant access to
 	Passcode  string              `json:"passcode,omitempty"`   // a passcode to grant access to; anyone presenting the same passcode can access the room
+	Seconds   int                 `json:"seconds,omitempty"`    // the duration of the grant; if not given, the grant never expires
 }
 
 // `grant-access-reply` confirms that access was granted.
 type GrantAccessReply struct{}
 
 // The `grant-manager` command may be used by an active room manager to make
-// another account a manager in the same room.
+// another account a manager in the same room. The grant may be given a
+// limited duration, after which it's revoked automatically.
 //
 // An error is returned if the account can't be found.
 type GrantManagerCommand struct {
-	AccountID snowflake.Snowflake `json:"account_id"` // the id of an account to grant manager status to
+	AccountID snowflake.Snowflake `json:"account_id"`        // the id of an account to grant manager status to
+	Seconds   int                 `json:"seconds,omitempty"` // the duration of the grant; if not given, the grant never expires
 }
 
 // `grant-manager-reply` confirms that manager status was granted.
 type GrantManagerReply struct{}
 
+// The `create-invite` command may be used by an active manager in a private
+// room to create an invite. An invite is a randomly generated passcode that
+// may expire, and may be limited to a number of uses. Invites are redeemed
+// with the [auth](#auth) command, or by visiting /room/*room*/invite/*code*.
+//
+// If the room is not private, an error will be returned.
+type CreateInviteCommand struct {
+	Seconds int `json:"seconds,omitempty"`  // the number of seconds until the invite expires; if not given, the invite never expires
+	MaxUses int `json:"max_uses,omitempty"` // the number of times the invite may be redeemed; if not given, there is no limit
+}
+
+// `create-invite-reply` returns the newly created invite, along with its code.
+// The code can't be recovered later, so it should be passed along right away.
+type CreateInviteReply struct {
+	Invite
+	Code string `json:"code"` // the code to present when redeeming the invite
+}
+
+// The `invite-by-email` command may be used by an active manager in a private
+// room to invite someone to the room by email. If an account has verified that
+// it owns the given address, it's granted access to the room and sent an
+// invitation. Otherwise the address is sent an invitation to sign up, and
+// access is granted once an account has verified that it owns the address. Until then, the
+// invitation is listed by [list-email-invites](#list-email-invites), and may
+// be revoked with [revoke-email-invite](#revoke-email-invite).
+type InviteByEmailCommand struct {
+	Email   string `json:"email"`             // the address to send the invitation to
+	Message string `json:"message,omitempty"` // an optional note to include in the invitation
+	Seconds int    `json:"seconds,omitempty"` // the number of seconds until an invitation to sign up expires; if not given, it expires after 30 days
+}
+
+// `invite-by-email-reply` indicates that the invitation was sent.
+type InviteByEmailReply struct{}
+
+// The `list-email-invites` command may be used by an active manager in a
+// private room to list the invitations sent by [invite-by-email](#invite-by-email)
+// that haven't been claimed yet.
+type ListEmailInvitesCommand struct{}
+
+// `list-email-invites-reply` returns the room's unclaimed, unexpired email
+// invitations, oldest first.
+type ListEmailInvitesReply struct {
+	Invites []PendingInvite `json:"invites"` // the pending email invitations
+}
+
+// The `revoke-email-invite` command may be used by an active manager in a
+// private room to revoke an unclaimed invitation sent by
+// [invite-by-email](#invite-by-email).
+type RevokeEmailInviteCommand struct {
+	Email string `json:"email"` // the address whose invitation should be revoked
+}
+
+// `revoke-email-invite-reply` confirms that the invitation was revoked.
+type RevokeEmailInviteReply struct{}
+
+// The `list-access` command may be used by an active manager in a private room
+// to list the accounts and passcodes that have been granted access to the room.
+// Passcodes aren't stored, so passcode grants are identified only by the id of
+// their capability.
+type ListAccessCommand struct{}
+
+// `list-access-reply` returns the room's access grants, in the order they
+// were granted.
+type ListAccessReply struct {
+	AccountGrants  []AccountGrant  `json:"account_grants"`  // the grants of access to accounts
+	PasscodeGrants []PasscodeGrant `json:"passcode_grants"` // the grants of access to passcodes
+}
+
+// The `list-managers` command may be used by an active manager to list the
+// accounts that manage the room.
+type ListManagersCommand struct{}
+
+// `list-managers-reply` returns the room's managers.
+type ListManagersReply struct {
+	Managers []AccountView `json:"managers"` // the accounts that manage the room
+}
+
+// The `list-access-requests` command may be used by an active manager in a
+// private room to list the pending [access requests](#request-access) to the
+// room.
+type ListAccessRequestsCommand struct{}
+
+// `list-access-requests-reply` returns the room's pending access requests,
+// oldest first.
+type ListAccessRequestsReply struct {
+	Requests []AccessRequest `json:"requests"` // the pending access requests
+}
+
+// The `resolve-access-request` command may be used by an active manager in a
+// private room to approve or deny an [access request](#request-access).
+// Approving a request grants access to the requesting account, just as
+// [grant-access](#grant-access) would. Either way, the request is removed and
+// the requester is sent an [access-request-resolved-event](#access-request-resolved-event).
+type ResolveAccessRequestCommand struct {
+	ID      snowflake.Snowflake `json:"id"`                // the id of the request to resolve
+	Approve bool                `json:"approve"`           // whether to grant access to the requester
+	Seconds int                 `json:"seconds,omitempty"` // the duration of the grant, if approved; if not given, the grant never expires
+}
+
+// `resolve-access-request-reply` confirms that the request was resolved.
+type ResolveAccessRequestReply struct{}
+
+// The `list-invites` command may be used by an active manager in a private
+// room to list the invites that have been created for the room's current
+// message key.
+type ListInvitesCommand struct{}
+
+// `list-invites-reply` returns the room's invites.
+type ListInvitesReply struct {
+	Invites []Invite `json:"invites"` // a list of invites
+}
+
+// The `revoke-invite` command may be used by an active manager in a private
+// room to revoke an invite, regardless of who created it.
+type RevokeInviteCommand struct {
+	ID string `json:"id"` // the id of the invite to revoke
+}
+
+// `revoke-invite-reply` confirms that the invite was revoked.
+type RevokeInviteReply struct{}
+
 // The `staff-grant-manager` command is a version of the [grant-manager](#grant-manager)
 // command that is available to staff. The staff account does not need to be a manager
 // of the room to use this command.
@@ -431,6 +985,9 @@ type LogReply struct {
 // The `nick` command sets the name you present to the room. This name applies
 // to all messages sent during this session, until the `nick` command is called
 // again.
+//
+// A nick reserved by an account (see `reserve-nick`) may only be taken by
+// sessions signed into that account. Their identity is marked as verified.
 type NickCommand struct {
 	Name string `json:"name"` // the requested name (maximum length 36 bytes)
 }
@@ -471,6 +1028,7 @@ type PingReply struct {
 type AuthCommand struct {
 	Type     AuthOption `json:"type"`               // the method of authentication
 	Passcode string     `json:"passcode,omitempty"` // use this field for `passcode` authentication
+	Invite   string     `json:"invite,omitempty"`   // use this field for `invite` authentication
 }
 
 // The `auth-reply` packet reports whether the `auth` command succeeded.
@@ -479,6 +1037,25 @@ type AuthReply struct {
 	Reason  string `json:"reason,omitempty"` // if `success` was false, the reason for failure
 }
 
+// The `request-access` command asks the managers of a private room to grant
+// access to the client's account. It may be sent in response to a `bounce-event`,
+// and requires the client to be logged in. Managers present in the room are
+// sent an [access-request-event](#access-request-event), and the others are
+// notified by email.
+//
+// The session stays connected while the request is pending, and receives an
+// [access-request-resolved-event](#access-request-resolved-event) once a
+// manager acts on it. Sending another request replaces the earlier one.
+type RequestAccessCommand struct {
+	Note string `json:"note,omitempty"` // a note to the managers explaining the request
+}
+
+// `request-access-reply` confirms that the request was sent to the room's
+// managers.
+type RequestAccessReply struct {
+	ID snowflake.Snowflake `json:"id"` // the id of the request
+}
+
 // `Ban` describes an entry in a ban list. When incoming sessions match one of
 // these entries, they are rejected.
 type Ban struct {
@@ -508,6 +1085,19 @@ type UnbanCommand struct {
 // The `unban-reply` packet indicates that the `unban` command succeeded.
 type UnbanReply UnbanCommand
 
+// An `access-request-event` is sent to managers of a private room who are
+// present in the room when someone [requests access](#request-access) to it.
+type AccessRequestEvent AccessRequest
+
+// An `access-request-resolved-event` informs a session that [requested access](#request-access)
+// to a room whether the request was approved. If it was, the client may
+// reconnect to join the room.
+type AccessRequestResolvedEvent struct {
+	ID       snowflake.Snowflake `json:"id"`       // the id of the request
+	Room     string              `json:"room"`     // the name of the room access was requested to
+	Approved bool                `json:"approved"` // whether access was granted
+}
+
 // A `bounce-event` indicates that access to a room is denied.
 type BounceEvent struct {
 	Reason      string       `json:"reason,omitempty"`       // the reason why access was denied
@@ -574,25 +1164,47 @@ type NetworkEvent struct {
 // The `login` command attempts to log an anonymous session into an account.
 // It will return an error if the session is already logged in.
 //
+// Any of the account's verified personal identities may be given (see
+// [add-identity](#add-identity)), as well as its primary email.
+//
+// If the account is enrolled in two-factor authentication (see [enroll-otp](#enroll-otp)),
+// a one-time password from the user's authentication app, or one of their
+// recovery codes, must be given as well. If it's missing, the login fails
+// with `otp_required` set in the reply, and the client should prompt for it
+// and send the command again.
+//
+// Accounts in the `oidc` namespace log in through an external identity
+// provider instead, by visiting `/login/oidc/{provider}?return={path}` in the
+// browser. An account is registered on the first such login. Sessions of the
+// same browser receive a `login-event` when it succeeds.
+//
 // If the login succeeds, the client should expect to receive a
 // `disconnect-event` shortly after. The next connection the client makes
 // will be a logged in session.
 type LoginCommand struct {
-	Namespace string `json:"namespace"` // the namespace of a personal identifier
-	ID        string `json:"id"`        // the id of a personal identifier
-	Password  string `json:"password"`  // the password for unlocking the account
+	Namespace string `json:"namespace"`     // the namespace of a personal identifier
+	ID        string `json:"id"`            // the id of a personal identifier
+	Password  string `json:"password"`      // the password for unlocking the account
+	OTP       string `json:"otp,omitempty"` // a one-time password or recovery code, if the account is enrolled in two-factor authentication
 }
 
 // The `login-reply` packet returns whether the session successfully logged
 // into an account.
 //
+// Repeated failures to log into an account, or from the same address, are
+// slowed down. Once a few attempts have failed, each further failure doubles
+// the time before another attempt is accepted, and enough failures lock the
+// account out for a while. Refused attempts fail with `retry_after` set.
+//
 // If this reply returns success, the client should expect to receive a
 // `disconnect-event` shortly after. The next connection the client makes
 // will be a logged in session.
 type LoginReply struct {
-	Success   bool                `json:"success"`              // true if the session is now logged in
-	Reason    string              `json:"reason,omitempty"`     // if `success` was false, the reason why
-	AccountID snowflake.Snowflake `json:"account_id,omitempty"` // if `success` was true, the id of the account the session logged into.
+	Success     bool                `json:"success"`                // true if the session is now logged in
+	Reason      string              `json:"reason,omitempty"`       // if `success` was false, the reason why
+	OTPRequired bool                `json:"otp_required,omitempty"` // if true, the login must be retried with a one-time password
+	RetryAfter  int                 `json:"retry_after,omitempty"`  // if too many attempts have failed, the number of seconds to wait before trying again
+	AccountID   snowflake.Snowflake `json:"account_id,omitempty"`   // if `success` was true, the id of the account the session logged into.
 }
 
 // The `login-event` packet is sent to all sessions of an agent when that
@@ -613,6 +1225,26 @@ type LogoutCommand struct{}
 // agent is logged out (except for the session that issued the logout command).
 type LogoutEvent struct{}
 
+// The `list-logins` command lists the browsers and devices (agents) that are
+// logged into the signed in account.
+type ListLoginsCommand struct{}
+
+// `list-logins-reply` returns the account's logins, most recently seen first.
+type ListLoginsReply struct {
+	Logins []AgentView `json:"logins"` // the agents logged into the account
+}
+
+// The `revoke-login` command logs an agent out of the signed in account. Any
+// of the agent's sessions that are connected are disconnected. The agent
+// must be one returned by [list-logins](#list-logins), other than the one
+// making the request; use [logout](#logout) for that.
+type RevokeLoginCommand struct {
+	AgentID string `json:"agent_id"` // the id of the agent to log out
+}
+
+// `revoke-login-reply` confirms that the agent was logged out.
+type RevokeLoginReply struct{}
+
 // The `logout-reply` packet confirms a logout.
 type LogoutReply struct{}
 
@@ -630,11 +1262,13 @@ type PMInitiateReply struct {
 }
 
 // The `pm-initiate-event` informs the client that another user wants to chat
-// with them privately.
+// with them privately. Sessions of a signed in account also receive one on
+// joining a room for each of the account's other private chats with unread
+// messages.
 type PMInitiateEvent struct {
 	From     UserID              `json:"from"`      // the id of the user inviting the client to chat privately
 	FromNick string              `json:"from_nick"` // the nick of the inviting user
-	FromRoom string              `json:"from_room"` // the room where the invitation was sent from
+	FromRoom string              `json:"from_room"` // the room where the invitation was sent from, or empty if it's a reminder of unread messages
 	PMID     snowflake.Snowflake `json:"pm_id"`     // the private chat can be accessed at /room/pm:*PMID*
 }
 
@@ -644,7 +1278,14 @@ type PMInitiateEvent struct {
 // If the account registration succeeds, the client should expect to receive a
 // `disconnect-event` shortly after. The next connection the client makes will be
 // a logged in session using the new account.
-type RegisterAccountCommand LoginCommand
+//
+// Only the `email` namespace may be registered this way; see [login](#login)
+// for the `oidc` namespace.
+type RegisterAccountCommand struct {
+	Namespace string `json:"namespace"` // the namespace of a personal identifier
+	ID        string `json:"id"`        // the id of a personal identifier
+	Password  string `json:"password"`  // the password for unlocking the account
+}
 
 // The `register-account-reply` packet returns whether the new account was
 // registered.
@@ -665,7 +1306,9 @@ type ResendVerificationEmailReply struct{}
 
 // The `reset-password` command generates a password reset request. An email
 // will be sent to the owner of the given personal identifier, with
-// instructions and a confirmation code for resetting the password.
+// instructions and a confirmation code for resetting the password. If the
+// identifier is one of the account's verified email addresses, the email is
+// sent there; otherwise it goes to the account's primary email.
 type ResetPasswordCommand struct {
 	Namespace string `json:"namespace"`
 	ID        string `json:"id"`
@@ -674,6 +1317,15 @@ type ResetPasswordCommand struct {
 // `reset-password-reply` confirms that the password reset is in progress.
 type ResetPasswordReply struct{}
 
+// The `request-data-export` command asks for a copy of the personal data held
+// about the signed in account: its details, the messages it posted, the emails
+// sent to it, and its room grants. The archive is prepared in the background,
+// and a link to download it is emailed to the account.
+type RequestDataExportCommand struct{}
+
+// `request-data-export-reply` confirms that the export is being prepared.
+type RequestDataExportReply struct{}
+
 // The `revoke-access` command disables an access grant to a private room.
 // The grant may be to an account or to a passcode.
 //
@@ -850,6 +1502,8 @@ func MakeEvent(payload interface{}) (*Packet, error) {
 		packet.Type = SnapshotEventType
 	case *HelloEvent:
 		packet.Type = HelloEventType
+	case *PMInitiateEvent:
+		packet.Type = PMInitiateEventType
 	default:
 		return nil, fmt.Errorf("don't know how to make event from %T", payload)
 	}
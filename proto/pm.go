@@ -12,6 +12,50 @@ import (
 type PMTracker interface {
 	Initiate(ctx scope.Context, kms security.KMS, room Room, client *Client, receiver UserID) (snowflake.Snowflake, error)
 	Room(ctx scope.Context, kms security.KMS, pmID snowflake.Snowflake, client *Client) (Room, *security.ManagedKey, error)
+
+	// AccountRoom is like Room, but unlocks the private chat for one of its
+	// participating accounts with the KMS, rather than a client key. It's for
+	// acting on behalf of an account that isn't connected.
+	AccountRoom(ctx scope.Context, kms security.KMS, pmID snowflake.Snowflake, account Account) (
+		Room, *security.ManagedKey, error)
+
+	// List returns the private chats the account takes part in, most recently
+	// active first.
+	List(ctx scope.Context, accountID snowflake.Snowflake) ([]PMSummary, error)
+
+	// MarkRead records that the account has read the private chat up to and
+	// including the given message. It never moves the account's read position
+	// backwards.
+	MarkRead(ctx scope.Context, pmID, accountID, messageID snowflake.Snowflake) error
+}
+
+// A PMRoom is the Room of a private chat.
+type PMRoom interface {
+	Room
+	PM() *PM
+}
+
+// A PMSummary describes a private chat from the point of view of one of its
+// participants.
+type PMSummary struct {
+	PMID            snowflake.Snowflake `json:"pm_id"`             // the private chat can be accessed at /room/pm:*PMID*
+	With            UserID              `json:"with"`              // the id of the other participant
+	WithNick        string              `json:"with_nick"`         // the nick of the other participant
+	LastMessageTime Time                `json:"last_message_time"` // the time of the latest message, or null if there are none
+	Unread          int                 `json:"unread"`            // the number of messages from the other participant not yet read
+}
+
+// Summarize returns a summary of the PM from the point of view of the given
+// account, without any message details.
+func (pm *PM) Summarize(accountID snowflake.Snowflake) PMSummary {
+	if pm.Initiator == accountID {
+		return PMSummary{PMID: pm.ID, With: pm.Receiver, WithNick: pm.ReceiverNick}
+	}
+	return PMSummary{
+		PMID:     pm.ID,
+		With:     UserID(fmt.Sprintf("account:%s", pm.Initiator)),
+		WithNick: pm.InitiatorNick,
+	}
 }
 
 func NewPM(kms security.KMS, client *Client, initiatorNick string, receiver UserID, receiverNick string) (
@@ -167,6 +211,27 @@ func (pm *PM) Access(ctx scope.Context, b Backend, kms security.KMS, client *Cli
 	}
 }
 
+// SystemAccess unlocks the PM key with the KMS, on behalf of a participating
+// account. It returns the key and the other participant's name.
+func (pm *PM) SystemAccess(kms security.KMS, account Account) (*security.ManagedKey, string, error) {
+	otherName := pm.ReceiverNick
+	if account.ID() != pm.Initiator {
+		if pm.Receiver != UserID(fmt.Sprintf("account:%s", account.ID())) {
+			return nil, "", ErrAccessDenied
+		}
+		otherName = pm.InitiatorNick
+	}
+
+	pmKey := pm.EncryptedSystemKey.Clone()
+	if err := kms.DecryptKey(&pmKey); err != nil {
+		return nil, "", err
+	}
+	if err := pm.verifyKey(&pmKey); err != nil {
+		return nil, "", err
+	}
+	return &pmKey, otherName, nil
+}
+
 func (pm *PM) verifyKey(pmKey *security.ManagedKey) error {
 	var (
 		mac [16]byte
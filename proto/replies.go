@@ -0,0 +1,343 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"euphoria.io/heim/proto/emails"
+	"euphoria.io/heim/proto/security"
+	"euphoria.io/heim/proto/snowflake"
+	"euphoria.io/scope"
+)
+
+// EmailReplyPrefix starts the local part of every email reply address.
+const EmailReplyPrefix = "reply+"
+
+// EmailReplyLifetime is how long an email reply address remains valid after
+// it's issued.
+var EmailReplyLifetime = 30 * 24 * time.Hour
+
+// EmailReplyAddress returns the address an account can reply to by email to
+// post a reply to a message. The address is signed with the account's system
+// key, so it can't be forged or reused for another account, room, or message,
+// and expires after EmailReplyLifetime.
+func EmailReplyAddress(
+	kms security.KMS, account Account, domain, room string, msgID snowflake.Snowflake) (string, error) {
+
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(EmailReplyLifetime).Unix()
+	mac, err := emailReplyMAC(&systemKey, account.ID(), room, msgID, expires)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"%s%s.%s.%s.%s.%s@%s", EmailReplyPrefix, strings.Replace(room, ":", "-", 1), msgID, account.ID(),
+		strconv.FormatInt(expires, 36), hex.EncodeToString(mac), domain), nil
+}
+
+// ResolveEmailReplyAddress returns the account, room, and message an email
+// reply address was issued for. It returns ErrEmailReplyExpired if the address
+// is authentic but has expired.
+func ResolveEmailReplyAddress(ctx scope.Context, kms security.KMS, b Backend, addr string) (
+	Account, string, snowflake.Snowflake, error) {
+
+	target, err := resolveEmailReplyAddress(ctx, kms, b, addr)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return target.account, target.room, target.parent, nil
+}
+
+// An emailReplyTarget is what an email reply address was issued for.
+type emailReplyTarget struct {
+	account Account
+	room    string
+	parent  snowflake.Snowflake
+
+	// token identifies the address, for recording its use.
+	token   string
+	expires time.Time
+}
+
+func resolveEmailReplyAddress(ctx scope.Context, kms security.KMS, b Backend, addr string) (
+	*emailReplyTarget, error) {
+
+	local := addr
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		local = addr[:i]
+	}
+	if !strings.HasPrefix(strings.ToLower(local), EmailReplyPrefix) {
+		return nil, ErrInvalidEmailReplyAddress
+	}
+
+	parts := strings.Split(local[len(EmailReplyPrefix):], ".")
+	if len(parts) != 5 {
+		return nil, ErrInvalidEmailReplyAddress
+	}
+	room := strings.Replace(strings.ToLower(parts[0]), "-", ":", 1)
+	var msgID, accountID snowflake.Snowflake
+	if err := msgID.FromString(parts[1]); err != nil {
+		return nil, ErrInvalidEmailReplyAddress
+	}
+	if err := accountID.FromString(parts[2]); err != nil {
+		return nil, ErrInvalidEmailReplyAddress
+	}
+	expires, err := strconv.ParseInt(parts[3], 36, 64)
+	if err != nil {
+		return nil, ErrInvalidEmailReplyAddress
+	}
+	mac, err := hex.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrInvalidEmailReplyAddress
+	}
+
+	account, err := b.AccountManager().Get(ctx, accountID)
+	if err != nil {
+		if err == ErrAccountNotFound {
+			return nil, ErrInvalidEmailReplyAddress
+		}
+		return nil, err
+	}
+
+	systemKey := account.SystemKey()
+	if err := kms.DecryptKey(&systemKey); err != nil {
+		return nil, err
+	}
+	expected, err := emailReplyMAC(&systemKey, accountID, room, msgID, expires)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, expected) {
+		return nil, ErrInvalidEmailReplyAddress
+	}
+	if time.Now().Unix() > expires {
+		return nil, ErrEmailReplyExpired
+	}
+	target := &emailReplyTarget{
+		account: account,
+		room:    room,
+		parent:  msgID,
+		token:   hex.EncodeToString(mac),
+		expires: time.Unix(expires, 0),
+	}
+	return target, nil
+}
+
+func emailReplyMAC(
+	key *security.ManagedKey, accountID snowflake.Snowflake, room string, msgID snowflake.Snowflake,
+	expires int64) ([]byte, error) {
+
+	if key.Encrypted() {
+		return nil, security.ErrKeyMustBeDecrypted
+	}
+
+	mac := hmac.New(sha256.New, key.Plaintext)
+	mac.Write([]byte(fmt.Sprintf("email-reply:%s:%s:%s:%d", accountID, room, msgID, expires)))
+	// Half the MAC is plenty, and keeps the address a reasonable length.
+	return mac.Sum(nil)[:16], nil
+}
+
+// PostEmailReply posts the text of an email reply into the room it was sent
+// to the reply address of, as a reply to the message the address was issued
+// for. The reply must come from one of the account's verified email addresses,
+// as vouched for by the MTA that received it, and the account must still have
+// access to the room and not be banned from it. Each reply address can be
+// used only once. Replies in private rooms are encrypted with the room's
+// current message key.
+func (heim *Heim) PostEmailReply(ctx scope.Context, to string, reply *emails.Reply) (*Message, error) {
+	b := heim.Backend
+
+	target, err := resolveEmailReplyAddress(ctx, heim.KMS, b, to)
+	if err != nil {
+		return nil, err
+	}
+	account, roomName, parent := target.account, target.room, target.parent
+
+	fromAccount := false
+	for _, pid := range account.PersonalIdentities() {
+		if pid.Namespace() == "email" && pid.Verified() && strings.EqualFold(pid.ID(), reply.From) {
+			fromAccount = true
+			break
+		}
+	}
+	if !fromAccount {
+		return nil, ErrAccessDenied
+	}
+	if heim.EmailReplyAuthServID == "" || !reply.Authenticated(heim.EmailReplyAuthServID) {
+		return nil, ErrEmailReplyUnauthenticated
+	}
+
+	if reply.Text == "" {
+		return nil, emails.ErrNoReplyText
+	}
+	if len(reply.Text) > MaxMessageLength {
+		return nil, ErrMessageTooLong
+	}
+
+	sender := IdentityView{
+		ID:   UserID(fmt.Sprintf("account:%s", account.ID())),
+		Name: account.Name(),
+	}
+	banned, err := b.IsBanned(ctx, roomName, sender.ID)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		return nil, ErrAccessDenied
+	}
+
+	room, key, err := heim.emailReplyRoom(ctx, account, roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	isValidParent, err := room.IsValidParent(parent)
+	if err != nil {
+		return nil, err
+	}
+	if !isValidParent {
+		return nil, ErrInvalidParent
+	}
+
+	owner, reserved, err := b.NickReservations().Owner(ctx, account.Name())
+	if err != nil {
+		return nil, err
+	}
+	if reserved && owner != account.ID() {
+		return nil, ErrNickReserved
+	}
+
+	// Claim the address last, so that a reply that's refused doesn't use it
+	// up.
+	if err := b.EmailTracker().UseReplyAddress(ctx, account.ID(), target.token, target.expires); err != nil {
+		return nil, err
+	}
+
+	msgID, err := snowflake.New()
+	if err != nil {
+		return nil, err
+	}
+
+	sender.Verified = reserved
+	if heim.PeerDesc != nil {
+		sender.ServerID = heim.PeerDesc.ID
+		sender.ServerEra = heim.PeerDesc.Era
+	}
+	msg := Message{
+		ID:      msgID,
+		Content: reply.Text,
+		Parent:  parent,
+		Sender: SessionView{
+			IdentityView: sender,
+			SessionID:    fmt.Sprintf("email:%s", msgID),
+		},
+	}
+
+	if key != nil {
+		keyID, _, err := room.MessageKeyID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := EncryptMessage(&msg, keyID, key); err != nil {
+			return nil, err
+		}
+	}
+
+	sent, err := room.Send(ctx, nil, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	heim.NotifyOffline(ctx, room, roomName, sender, sent.ID, reply.Text, key == nil)
+	return &sent, nil
+}
+
+// emailReplyRoom returns the room an email reply is to be posted in, and the
+// key to encrypt it with if the room is private.
+func (heim *Heim) emailReplyRoom(ctx scope.Context, account Account, roomName string) (
+	Room, *security.ManagedKey, error) {
+
+	if strings.HasPrefix(roomName, "pm:") {
+		var pmID snowflake.Snowflake
+		if err := pmID.FromString(roomName[len("pm:"):]); err != nil {
+			return nil, nil, ErrInvalidEmailReplyAddress
+		}
+		return heim.Backend.PMTracker().AccountRoom(ctx, heim.KMS, pmID, account)
+	}
+
+	room, err := heim.Backend.GetRoom(ctx, roomName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mkey, err := room.MessageKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mkey == nil {
+		return room, nil, nil
+	}
+
+	// Only accounts that could unlock the room themselves may post to it.
+	capability, err := mkey.AccountCapability(ctx, account)
+	if err != nil {
+		return nil, nil, err
+	}
+	if capability == nil {
+		if _, err := room.ManagerCapability(ctx, account); err != nil {
+			if err == ErrManagerNotFound {
+				return nil, nil, ErrAccessDenied
+			}
+			return nil, nil, err
+		}
+	}
+
+	key := mkey.ManagedKey()
+	if err := heim.KMS.DecryptKey(&key); err != nil {
+		return nil, nil, err
+	}
+	return room, &key, nil
+}
+
+// EmailReplyHandler returns an InboundHandler that posts replies to
+// notification emails. Replies that can never be posted are rejected.
+func EmailReplyHandler(heim *Heim) emails.InboundHandler {
+	return func(ctx scope.Context, msg *emails.InboundMessage) error {
+		var to string
+		for _, addr := range msg.To {
+			if strings.HasPrefix(strings.ToLower(addr), EmailReplyPrefix) {
+				to = addr
+				break
+			}
+		}
+		if to == "" {
+			return emails.Reject("no such mailbox")
+		}
+
+		reply, err := emails.ParseReply(msg.Message)
+		if err != nil {
+			return emails.Reject("unreadable reply: %s", err)
+		}
+
+		_, err = heim.PostEmailReply(ctx, to, reply)
+		switch err {
+		case nil:
+			return nil
+		case ErrInvalidEmailReplyAddress, ErrEmailReplyExpired, ErrEmailReplyUnauthenticated, ErrEmailReplyUsed,
+			ErrAccessDenied, ErrAccountNotFound, ErrRoomNotFound, ErrPMNotFound, ErrInvalidParent, ErrMessageTooLong,
+			ErrNickReserved, emails.ErrNoReplyText:
+			return emails.Reject("reply not posted: %s", err)
+		default:
+			return err
+		}
+	}
+}
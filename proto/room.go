@@ -114,11 +114,11 @@ type ManagedRoom interface {
 
 	// AddManager adds an account as a manager of the room. An unencrypted
 	// client key and corresponding account are needed from the user taking
-	// this action.
+	// this action. A zero value for expires indicates the grant never expires.
 	AddManager(
 		ctx scope.Context, kms security.KMS,
 		actor Account, actorKey *security.ManagedKey,
-		newManager Account) error
+		newManager Account, expires time.Time) error
 
 	// RemoveManager removes an account as manager. An unencrypted client key
 	// and corresponding account are needed from the user taking this action.
@@ -129,11 +129,21 @@ type ManagedRoom interface {
 	ManagerCapability(ctx scope.Context, manager Account) (security.Capability, error)
 
 	MinAgentAge() time.Duration
+
+	// Knock registers a session that has been bounced from the room and is
+	// waiting on an access request, so that it receives notifications
+	// addressed to its user in the room. Joining the room replaces the
+	// registration.
+	Knock(ctx scope.Context, session Session) error
+
+	// CancelKnock removes a registration made with Knock.
+	CancelKnock(ctx scope.Context, session Session) error
 }
 
 type RoomMessageKey interface {
 	AccountGrantable
 	PasscodeGrantable
+	InviteGrantable
 
 	// ID returns a unique identifier for the key.
 	KeyID() string
@@ -146,6 +156,10 @@ type RoomMessageKey interface {
 
 	// ManagedKey returns the current encrypted ManagedKey for the room.
 	ManagedKey() security.ManagedKey
+
+	// ListGrants returns the unexpired access grants issued with the key,
+	// other than those backing invites.
+	ListGrants(ctx scope.Context) ([]CapabilityGrant, error)
 }
 
 type RoomManagerKey interface {
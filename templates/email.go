@@ -140,7 +140,22 @@ func (e *Email) WriteTo(w io.Writer) (int64, error) {
 	return wc.n, nil
 }
 
+// An Unsubscriber is an email context that offers one-click unsubscription.
+type Unsubscriber interface {
+	// UnsubscribeURL returns the https URL to POST to in order to
+	// unsubscribe, or an empty string if the email can't be unsubscribed
+	// from.
+	UnsubscribeURL() string
+}
+
 func EvaluateEmail(t *Templater, baseName string, context interface{}) (*Email, error) {
+	return EvaluateLocalizedEmail(t, baseName, "", context)
+}
+
+// EvaluateLocalizedEmail is like EvaluateEmail, but uses the template's
+// localization for the given locale, if there is one.
+func EvaluateLocalizedEmail(t *Templater, baseName, locale string, context interface{}) (*Email, error) {
+	baseName = t.Localize(baseName, locale)
 	email := &Email{}
 
 	headerBytes, err := t.Evaluate(baseName+".hdr", context)
@@ -154,6 +169,14 @@ func EvaluateEmail(t *Templater, baseName string, context interface{}) (*Email,
 		return nil, fmt.Errorf("%s.hdr: %s", baseName, err)
 	}
 
+	// Advertise one-click unsubscription as described in RFC 8058.
+	if u, ok := context.(Unsubscriber); ok {
+		if url := u.UnsubscribeURL(); url != "" {
+			email.Header.Set("List-Unsubscribe", fmt.Sprintf("<%s>", url))
+			email.Header.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		}
+	}
+
 	if email.Text, err = t.Evaluate(baseName+".txt", context); err != nil {
 		return nil, fmt.Errorf("%s.txt: %s", baseName, err)
 	}
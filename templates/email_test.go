@@ -166,5 +166,24 @@ func TestEmail(t *testing.T) {
 				},
 			},
 		})
+
+		e, err = EvaluateEmail(templater, "test", &unsubscribable{url: "https://heim.invalid/unsubscribe?t=1"})
+		So(err, ShouldBeNil)
+		So(e.Header, ShouldResemble, textproto.MIMEHeader{
+			"Subject":               []string{"test"},
+			"List-Unsubscribe":      []string{"<https://heim.invalid/unsubscribe?t=1>"},
+			"List-Unsubscribe-Post": []string{"List-Unsubscribe=One-Click"},
+		})
+
+		e, err = EvaluateEmail(templater, "test", &unsubscribable{})
+		So(err, ShouldBeNil)
+		So(e.Header, ShouldResemble, textproto.MIMEHeader{"Subject": []string{"test"}})
 	})
 }
+
+type unsubscribable struct {
+	StaticFiles
+	url string
+}
+
+func (u *unsubscribable) UnsubscribeURL() string { return u.url }
@@ -0,0 +1,263 @@
+package templates
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Previewer serves a browsable preview of the email templates under Path,
+// rendered with sample data, for use while editing them. Templates are
+// reloaded whenever a file under Path changes.
+type Previewer struct {
+	Path string
+
+	// Scenarios holds the sample data to render each template with, by
+	// template name and scenario name.
+	Scenarios map[string]map[string]TemplateTest
+
+	// Validate, if given, checks freshly loaded templates. Its errors are
+	// reported alongside the previews.
+	Validate func(*Templater) []error
+
+	m         sync.Mutex
+	templater *Templater
+	errors    []error
+	version   string
+}
+
+// Templater returns the current templates, reloading them first if they've
+// changed on disk, along with any errors loading or validating them.
+func (p *Previewer) Templater() (*Templater, []error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.reload()
+}
+
+func (p *Previewer) reload() (*Templater, []error) {
+	version, err := p.scan()
+	if err != nil {
+		return &Templater{}, []error{err}
+	}
+	if p.templater != nil && version == p.version {
+		return p.templater, p.errors
+	}
+
+	templater := &Templater{}
+	errors := templater.Load(p.Path)
+	if p.Validate != nil {
+		errors = append(errors, p.Validate(templater)...)
+	}
+	p.templater, p.errors, p.version = templater, errors, version
+	return templater, errors
+}
+
+// scan summarizes the number, sizes, and modification times of the files
+// under Path, so that any change can be noticed.
+func (p *Previewer) scan() (string, error) {
+	var (
+		count  int
+		size   int64
+		latest time.Time
+	)
+	err := filepath.Walk(p.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		count++
+		size += info.Size()
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d@%d", count, size, latest.UnixNano()), nil
+}
+
+func (p *Previewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Sample data is shared between requests, so render one at a time.
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	templater, errors := p.reload()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		p.serveIndex(w, templater, errors)
+		return
+	}
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	testCase, ok := p.Scenarios[parts[0]][parts[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if sf, ok := testCase.Data.(interface {
+		ResetAttachments()
+	}); ok {
+		sf.ResetAttachments()
+	}
+	name := templater.Localize(parts[0], r.URL.Query().Get("locale"))
+	email, err := EvaluateLocalizedEmail(templater, parts[0], r.URL.Query().Get("locale"), testCase.Data)
+
+	switch {
+	case len(parts) == 2:
+		p.servePreview(w, name, parts[1], r.URL.RawQuery, email, err, errors)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case len(parts) == 3 && parts[2] == "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(linkAttachments(email))
+	case len(parts) == 4 && parts[2] == "attachments":
+		for _, att := range email.Attachments {
+			if att.Name == parts[3] {
+				w.Write(att.Content)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// linkAttachments replaces references to inline attachments in an email's
+// HTML with links the preview serves them at.
+func linkAttachments(email *Email) []byte {
+	html := string(email.HTML)
+	for _, att := range email.Attachments {
+		html = strings.Replace(html, "cid:"+att.ContentID, "attachments/"+att.Name, -1)
+	}
+	return []byte(html)
+}
+
+type previewLink struct {
+	Scenario string
+	Locale   string
+}
+
+func (p *Previewer) serveIndex(w http.ResponseWriter, templater *Templater, errors []error) {
+	names := make([]string, 0, len(p.Scenarios))
+	for name := range p.Scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type entry struct {
+		Name  string
+		Links []previewLink
+	}
+	entries := make([]entry, 0, len(names))
+	for _, name := range names {
+		scenarios := make([]string, 0, len(p.Scenarios[name]))
+		for scenario := range p.Scenarios[name] {
+			scenarios = append(scenarios, scenario)
+		}
+		sort.Strings(scenarios)
+
+		e := entry{Name: name}
+		for _, scenario := range scenarios {
+			e.Links = append(e.Links, previewLink{Scenario: scenario})
+			for _, locale := range templater.Locales() {
+				if templater.Localize(name, locale) != name {
+					e.Links = append(e.Links, previewLink{Scenario: scenario, Locale: locale})
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := previewIndexTemplate.Execute(w, map[string]interface{}{
+		"Path":    p.Path,
+		"Errors":  errors,
+		"Entries": entries,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (p *Previewer) servePreview(
+	w http.ResponseWriter, name, scenario, query string, email *Email, err error, errors []error) {
+
+	// Only report the errors that concern this template.
+	relevant := []error{}
+	if err != nil {
+		relevant = append(relevant, err)
+	}
+	for _, e := range errors {
+		if strings.HasPrefix(e.Error(), name+".") || strings.HasPrefix(e.Error(), name+":") {
+			relevant = append(relevant, e)
+		}
+	}
+
+	suffix := ""
+	if query != "" {
+		suffix = "?" + query
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = previewTemplate.Execute(w, map[string]interface{}{
+		"Name":     name,
+		"Scenario": scenario,
+		"Suffix":   template.URL(suffix),
+		"Errors":   relevant,
+		"Email":    email,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const previewStyle = `<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+.errors { color: #b00; }
+.parts { display: flex; }
+.parts > div { flex: 1; margin-right: 1em; }
+pre { white-space: pre-wrap; background: #f4f4f4; padding: 1em; }
+iframe { width: 100%; height: 80vh; border: 1px solid #ccc; }
+th { text-align: left; padding-right: 1em; }
+</style>`
+
+var previewIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>email templates</title>` + previewStyle + `</head><body>
+<h1>email templates in {{.Path}}</h1>
+{{if .Errors}}<ul class="errors">{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<ul>
+{{range .Entries}}{{$name := .Name}}<li>{{.Name}}:
+{{range .Links}} <a href="{{$name}}/{{.Scenario}}/{{if .Locale}}?locale={{.Locale}}{{end}}">{{.Scenario}}{{if .Locale}} ({{.Locale}}){{end}}</a>{{end}}
+</li>
+{{end}}</ul>
+</body></html>
+`))
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Name}} ({{.Scenario}})</title>` + previewStyle + `</head><body>
+<p><a href="../../">all templates</a></p>
+<h1>{{.Name}} ({{.Scenario}})</h1>
+{{if .Errors}}<ul class="errors">{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{with .Email}}
+<table>{{range $k, $vv := .Header}}{{range $vv}}<tr><th>{{$k}}</th><td>{{.}}</td></tr>{{end}}{{end}}</table>
+<div class="parts">
+<div><h2>text</h2><pre>{{printf "%s" .Text}}</pre></div>
+<div><h2>html</h2><iframe src="html{{$.Suffix}}"></iframe></div>
+</div>
+{{if .Attachments}}<h2>attachments</h2>
+<ul>{{range .Attachments}}<li><a href="attachments/{{.Name}}{{$.Suffix}}">{{.Name}}</a> ({{len .Content}} bytes)</li>{{end}}</ul>{{end}}
+{{end}}
+</body></html>
+`))
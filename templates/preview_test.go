@@ -0,0 +1,138 @@
+package templates
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPreviewer(t *testing.T) {
+	Convey("Previewer", t, func() {
+		td, err := ioutil.TempDir("", "")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(td)
+		So(os.Mkdir(filepath.Join(td, "static"), 0755), ShouldBeNil)
+
+		write := func(name, content string) {
+			path := filepath.Join(td, name)
+			So(ioutil.WriteFile(path, []byte(content), 0644), ShouldBeNil)
+			// Make sure the change is noticed even with coarse timestamps.
+			later := time.Now().Add(time.Duration(len(content)) * time.Second)
+			So(os.Chtimes(path, later, later), ShouldBeNil)
+		}
+
+		type params struct {
+			StaticFiles
+			Name string
+		}
+
+		write("welcome.hdr", "Subject: welcome")
+		write("welcome.txt", "welcome, {{.Name}}")
+		write("welcome.html", `<img src="{{.File "logo.png"}}"><p>welcome, {{.Name}}</p>`)
+		write("welcome.de.hdr", "Subject: willkommen")
+		write("welcome.de.txt", "willkommen, {{.Name}}")
+		write("welcome.de.html", "<p>willkommen, {{.Name}}</p>")
+		write(filepath.Join("static", "logo.png"), "logo")
+
+		validations := 0
+		p := &Previewer{
+			Path: td,
+			Scenarios: map[string]map[string]TemplateTest{
+				"welcome": {
+					"default": {Data: &params{Name: "max"}},
+				},
+			},
+			Validate: func(t *Templater) []error {
+				validations++
+				if _, ok := t.Templates["welcome"]; !ok {
+					return []error{errors.New("welcome: template not found")}
+				}
+				return nil
+			},
+		}
+		server := httptest.NewServer(p)
+		defer server.Close()
+
+		get := func(path string) (int, string) {
+			resp, err := http.Get(server.URL + path)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			content, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			return resp.StatusCode, string(content)
+		}
+
+		Convey("Index lists every scenario and localization", func() {
+			status, content := get("/")
+			So(status, ShouldEqual, http.StatusOK)
+			So(content, ShouldContainSubstring, `href="welcome/default/"`)
+			So(content, ShouldContainSubstring, `href="welcome/default/?locale=de"`)
+			So(content, ShouldNotContainSubstring, `class="errors"`)
+		})
+
+		Convey("Preview shows headers, text, and attachments", func() {
+			status, content := get("/welcome/default/")
+			So(status, ShouldEqual, http.StatusOK)
+			So(content, ShouldContainSubstring, "<td>welcome</td>")
+			So(content, ShouldContainSubstring, "<pre>welcome, max</pre>")
+			So(content, ShouldContainSubstring, `<iframe src="html">`)
+			So(content, ShouldContainSubstring, `href="attachments/logo.png"`)
+
+			status, content = get("/welcome/default/html")
+			So(status, ShouldEqual, http.StatusOK)
+			So(content, ShouldEqual, `<img src="attachments/logo.png"><p>welcome, max</p>`)
+
+			status, content = get("/welcome/default/attachments/logo.png")
+			So(status, ShouldEqual, http.StatusOK)
+			So(content, ShouldEqual, "logo")
+
+			status, _ = get("/welcome/default/attachments/missing.png")
+			So(status, ShouldEqual, http.StatusNotFound)
+			status, _ = get("/welcome/missing/")
+			So(status, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Localizations are previewed by locale", func() {
+			_, content := get("/welcome/default/?locale=de")
+			So(content, ShouldContainSubstring, "<pre>willkommen, max</pre>")
+			So(content, ShouldContainSubstring, `<iframe src="html?locale=de">`)
+
+			_, content = get("/welcome/default/html?locale=de")
+			So(content, ShouldEqual, "<p>willkommen, max</p>")
+		})
+
+		Convey("Templates are reloaded when changed", func() {
+			_, content := get("/welcome/default/")
+			So(content, ShouldContainSubstring, "<pre>welcome, max</pre>")
+			So(validations, ShouldEqual, 1)
+
+			get("/")
+			So(validations, ShouldEqual, 1)
+
+			write("welcome.txt", "hello again, {{.Name}}")
+			_, content = get("/welcome/default/")
+			So(content, ShouldContainSubstring, "<pre>hello again, max</pre>")
+			So(validations, ShouldEqual, 2)
+		})
+
+		Convey("Errors are reported inline", func() {
+			write("welcome.txt", "welcome, {{.Nickname}}")
+			_, content := get("/welcome/default/")
+			So(content, ShouldContainSubstring, `class="errors"`)
+			So(content, ShouldContainSubstring, "Nickname")
+
+			So(os.Remove(filepath.Join(td, "welcome.hdr")), ShouldBeNil)
+			So(os.Remove(filepath.Join(td, "welcome.txt")), ShouldBeNil)
+			So(os.Remove(filepath.Join(td, "welcome.html")), ShouldBeNil)
+			_, content = get("/")
+			So(content, ShouldContainSubstring, "welcome: template not found")
+		})
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -43,7 +44,7 @@ func (t *Templater) findAndParse(prefix, path string) []error {
 				errors = append(errors, err)
 				continue
 			}
-			tmpl, errs := t.parseGlob(prefix, path, filepath.Base(tmplName)+".*")
+			tmpl, errs := t.parseGlob(prefix, path, filepath.Base(tmplName))
 			if len(errs) > 0 {
 				errors = append(errors, errs...)
 				continue
@@ -57,11 +58,21 @@ func (t *Templater) findAndParse(prefix, path string) []error {
 	return nil
 }
 
-func (t *Templater) parseGlob(prefix, path, pattern string) (*template.Template, []error) {
-	matches, err := filepath.Glob(filepath.Join(path, pattern))
+func (t *Templater) parseGlob(prefix, path, base string) (*template.Template, []error) {
+	pattern := base + ".*"
+	globbed, err := filepath.Glob(filepath.Join(path, pattern))
 	if err != nil {
 		return nil, []error{err}
 	}
+
+	// Localized variants, such as base.de.txt, belong to a template of their
+	// own.
+	matches := make([]string, 0, len(globbed))
+	for _, match := range globbed {
+		if !strings.Contains(strings.TrimPrefix(filepath.Base(match), base+"."), ".") {
+			matches = append(matches, match)
+		}
+	}
 	if len(matches) == 0 {
 		return nil, []error{fmt.Errorf("not found: %s", pattern)}
 	}
@@ -152,10 +163,72 @@ func (t *Templater) Evaluate(name string, context interface{}) ([]byte, error) {
 	return w.Bytes(), nil
 }
 
+// Validate executes every part of the named template with each test case,
+// and returns any errors.
 func (t *Templater) Validate(name string, testCase ...TemplateTest) []error {
+	tmpl, ok := t.Templates[name]
+	if !ok {
+		return []error{fmt.Errorf("%s: %s", name, ErrTemplateNotFound)}
+	}
+
+	errors := []error{}
+	for _, part := range tmpl.Templates() {
+		if part.Tree == nil {
+			continue
+		}
+		for _, tc := range testCase {
+			if _, err := t.Evaluate(part.Name(), tc.Data); err != nil {
+				errors = append(errors, fmt.Errorf("%s: %s", part.Name(), err))
+			}
+		}
+	}
+	if len(errors) > 0 {
+		return errors
+	}
 	return nil
 }
 
+// NormalizeLocale returns a locale in the form template names use, such as
+// "pt-br" for "pt_BR".
+func NormalizeLocale(locale string) string {
+	return strings.Replace(strings.ToLower(locale), "_", "-", -1)
+}
+
+// Localize returns the name of the template to use for the given locale. A
+// template is localized by giving its files the locale as a second
+// extension, such as welcome.de.txt for welcome.txt. If there's no
+// localization for the locale, the one for its base language is used, and
+// failing that, the default.
+func (t *Templater) Localize(name, locale string) string {
+	locale = NormalizeLocale(locale)
+	for locale != "" {
+		if _, ok := t.Templates[name+"."+locale]; ok {
+			return name + "." + locale
+		}
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return name
+}
+
+// Locales returns the locales any template is localized to, in order.
+func (t *Templater) Locales() []string {
+	seen := map[string]bool{}
+	locales := []string{}
+	for name := range t.Templates {
+		base := filepath.Base(name)
+		if i := strings.Index(base, "."); i >= 0 && !seen[base[i+1:]] {
+			seen[base[i+1:]] = true
+			locales = append(locales, base[i+1:])
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
 type Attachment struct {
 	Name      string
 	ContentID string
@@ -190,4 +190,64 @@ func TestTemplater(t *testing.T) {
 		So(err, ShouldNotBeNil)
 		So(err.Error(), ShouldEndWith, "error calling Error: test")
 	})
+
+	Convey("Localized templates", t, func() {
+		td := tempdir()
+		defer os.RemoveAll(td)
+
+		write(td, "welcome.hdr", "Subject: welcome")
+		write(td, "welcome.txt", "welcome")
+		write(td, "welcome.html", "<p>welcome</p>")
+		write(td, "welcome.de.hdr", "Subject: willkommen")
+		write(td, "welcome.de.txt", "willkommen")
+		write(td, "welcome.de.html", "<p>willkommen</p>")
+		write(td, "welcome.pt-br.html", "<p>bem-vindo</p>")
+
+		templater := &Templater{}
+		So(templater.Load(td), ShouldBeNil)
+		So(templater.Locales(), ShouldResemble, []string{"de", "pt-br"})
+
+		// Localizations aren't parts of the default template.
+		So(templater.Templates["welcome"].Lookup("welcome.de.txt"), ShouldBeNil)
+
+		So(templater.Localize("welcome", ""), ShouldEqual, "welcome")
+		So(templater.Localize("welcome", "de"), ShouldEqual, "welcome.de")
+		So(templater.Localize("welcome", "de_AT"), ShouldEqual, "welcome.de")
+		So(templater.Localize("welcome", "pt-BR"), ShouldEqual, "welcome.pt-br")
+		So(templater.Localize("welcome", "fr"), ShouldEqual, "welcome")
+		So(templater.Localize("alert", "de"), ShouldEqual, "alert")
+
+		content, err := templater.Evaluate("welcome.de.txt", nil)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "willkommen")
+
+		e, err := EvaluateLocalizedEmail(templater, "welcome", "de-CH", &StaticFiles{})
+		So(err, ShouldBeNil)
+		So(e.Header.Get("Subject"), ShouldEqual, "willkommen")
+		So(string(e.Text), ShouldEqual, "willkommen")
+		So(string(e.HTML), ShouldEqual, "<p>willkommen</p>")
+	})
+
+	Convey("Validate", t, func() {
+		td := tempdir()
+		defer os.RemoveAll(td)
+
+		write(td, "test.hdr", "Subject: {{.Subject}}")
+		write(td, "test.html", "<p>{{.Body}}</p>")
+
+		templater := &Templater{}
+		So(templater.Load(td), ShouldBeNil)
+
+		type good struct{ Subject, Body string }
+		type bad struct{ Subject string }
+		So(templater.Validate("test", TemplateTest{Data: good{}}), ShouldBeNil)
+
+		errs := templater.Validate("test", TemplateTest{Data: good{}}, TemplateTest{Data: bad{}})
+		So(len(errs), ShouldEqual, 1)
+		So(errs[0].Error(), ShouldStartWith, "test.html: ")
+
+		errs = templater.Validate("missing", TemplateTest{Data: good{}})
+		So(len(errs), ShouldEqual, 1)
+		So(errs[0].Error(), ShouldEqual, "missing: template not found")
+	})
 }